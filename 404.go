@@ -27,6 +27,12 @@ func (w *fourOhFourConsumerWriter) Write(p []byte) (int, error) {
 	return w.ResponseWriter.Write(p)
 }
 
+func (w *fourOhFourConsumerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 type fourOhFourConsumerHandler struct {
 	http.Handler
 }
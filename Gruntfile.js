@@ -92,6 +92,8 @@ module.exports = function(grunt) {
 						'**/*.ico',
 						'**/*.html',
 						'**/*.txt',
+						'sw.js',
+						'css/high-contrast.css',
 						'fonts/**',
 					],
 					dest: '<%= paths.out.assets %>/',
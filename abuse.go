@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Writes are watched for two kinds of abuse: bursts of near-identical
+// pastes from one source (an IP address, or an account), and dumps of
+// payment card numbers. Either, or an address with a poor reputation (see
+// reputation.go), earns the source a temporary block on
+// creating and editing pastes; blocks are listed for moderators on the
+// admin page and lapse on their own through the expirator.
+
+type AbuseBlock struct {
+	Source  string
+	Reason  string
+	Created time.Time
+	Expires time.Time
+}
+
+func (b *AbuseBlock) ExpirationID() gotimeout.ExpirableID {
+	return gotimeout.ExpirableID(b.Source)
+}
+
+type AbuseBlockedError struct {
+	Block *AbuseBlock
+}
+
+func (e AbuseBlockedError) Error() string {
+	return fmt.Sprintf("You have been temporarily blocked from creating or editing pastes (%s). The block lifts at %s.", e.Block.Reason, e.Block.Expires.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+func (e AbuseBlockedError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+func (e AbuseBlockedError) APIErrorCode() string {
+	return APIErrorBlocked
+}
+
+func (e AbuseBlockedError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{
+		"until":       e.Block.Expires.UTC(),
+		"retry_after": int(time.Until(e.Block.Expires).Seconds()) + 1,
+	}
+}
+
+type AbuseBlockStore struct {
+	Blocks     map[string]*AbuseBlock
+	ExpiryJunk *gotimeout.HandleMap
+
+	filename  string
+	expirator *gotimeout.Expirator
+	mu        sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *AbuseBlockStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save abuse blocks: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+func (s *AbuseBlockStore) Block(source, reason string, duration time.Duration) *AbuseBlock {
+	now := time.Now()
+	block := &AbuseBlock{Source: source, Reason: reason, Created: now, Expires: now.Add(duration)}
+
+	s.mu.Lock()
+	s.Blocks[source] = block
+	s.save()
+	s.mu.Unlock()
+
+	s.expirator.ExpireObject(block, duration)
+	glog.Warningf("Blocked %s from writing until %v: %s", source, block.Expires, reason)
+	healthServer.IncrementMetric("abuse.blocked")
+	return block
+}
+
+func (s *AbuseBlockStore) Get(source string) (*AbuseBlock, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	block, ok := s.Blocks[source]
+	return block, ok
+}
+
+func (s *AbuseBlockStore) Unblock(source string) {
+	if block, ok := s.Get(source); ok {
+		s.expirator.CancelObjectExpiration(block)
+	}
+	s.mu.Lock()
+	delete(s.Blocks, source)
+	s.save()
+	s.mu.Unlock()
+}
+
+// PruneBefore lifts every block imposed before cutoff, returning how many
+// it lifted.
+func (s *AbuseBlockStore) PruneBefore(cutoff time.Time) int {
+	var pruned []*AbuseBlock
+	s.mu.Lock()
+	for source, block := range s.Blocks {
+		if block.Created.Before(cutoff) {
+			pruned = append(pruned, block)
+			delete(s.Blocks, source)
+		}
+	}
+	if len(pruned) > 0 {
+		s.save()
+	}
+	s.mu.Unlock()
+
+	for _, block := range pruned {
+		s.expirator.CancelObjectExpiration(block)
+	}
+	return len(pruned)
+}
+
+// List returns every block, newest first.
+func (s *AbuseBlockStore) List() []*AbuseBlock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blocks := make([]*AbuseBlock, 0, len(s.Blocks))
+	for _, block := range s.Blocks {
+		blocks = append(blocks, block)
+	}
+	sort.Sort(abuseBlocksByCreation(blocks))
+	return blocks
+}
+
+type abuseBlocksByCreation []*AbuseBlock
+
+func (l abuseBlocksByCreation) Len() int           { return len(l) }
+func (l abuseBlocksByCreation) Less(i, j int) bool { return l[i].Created.After(l[j].Created) }
+func (l abuseBlocksByCreation) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func LoadAbuseBlockStore(filename string) *AbuseBlockStore {
+	var s *AbuseBlockStore
+	blockFile, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(blockFile)
+		err := dec.Decode(&s)
+		blockFile.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode abuse blocks: ", err)
+		}
+	}
+	if s == nil {
+		s = &AbuseBlockStore{}
+	}
+	if s.Blocks == nil {
+		s.Blocks = make(map[string]*AbuseBlock)
+	}
+	s.filename = filename
+	s.expirator = gotimeout.NewExpiratorWithStorage(s, s)
+	return s
+}
+
+func (s *AbuseBlockStore) GetExpirable(id gotimeout.ExpirableID) gotimeout.Expirable {
+	block, ok := s.Get(string(id))
+	if !ok {
+		return nil
+	}
+	return block
+}
+
+func (s *AbuseBlockStore) DestroyExpirable(ex gotimeout.Expirable) {
+	if block, ok := ex.(*AbuseBlock); ok {
+		s.mu.Lock()
+		delete(s.Blocks, block.Source)
+		s.save()
+		s.mu.Unlock()
+	}
+}
+
+func (s *AbuseBlockStore) RequiresFlush() bool {
+	return true
+}
+
+func (s *AbuseBlockStore) SaveExpirationHandles(hm *gotimeout.HandleMap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ExpiryJunk = hm
+	return s.save()
+}
+
+func (s *AbuseBlockStore) LoadExpirationHandles() (*gotimeout.HandleMap, error) {
+	return s.ExpiryJunk, nil
+}
+
+// abuseSources returns the sources a request is accountable as: its IP
+// address and, if logged in, its account.
+func abuseSources(r *http.Request) []string {
+	sources := []string{"ip:" + StoredIPForRequest(r)}
+	if user := GetUser(r); user != nil {
+		sources = append(sources, "account:"+user.Name)
+	}
+	return sources
+}
+
+// pasteShape reduces a body to what near-identical pastes share: its
+// letters and punctuation, without the numbers and whitespace that bots
+// vary between copies.
+func pasteShape(body string) string {
+	stripped := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, body)
+	sum := md5.Sum([]byte(stripped))
+	return base32Encoder.EncodeToString(sum[:])
+}
+
+func luhnValid(digits []byte) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// countCardNumbers counts the runs of 13 to 19 digits (optionally split by
+// single spaces or dashes) in body that pass the Luhn check.
+func countCardNumbers(body string) int {
+	count := 0
+	var digits []byte
+	flush := func() {
+		if len(digits) >= 13 && len(digits) <= 19 && luhnValid(digits) {
+			count++
+		}
+		digits = digits[:0]
+	}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case (c == ' ' || c == '-') && len(digits) > 0 && i+1 < len(body) && body[i+1] >= '0' && body[i+1] <= '9':
+		default:
+			flush()
+		}
+	}
+	flush()
+	return count
+}
+
+// abuseBlocked returns an AbuseBlockedError if the request's source is
+// blocked from writing.
+func abuseBlocked(r *http.Request) error {
+	if !instanceConfig.Abuse.Enabled {
+		return nil
+	}
+	for _, source := range abuseSources(r) {
+		if block, ok := abuseBlockStore.Get(source); ok {
+			healthServer.IncrementMetric("abuse.refused")
+			return AbuseBlockedError{block}
+		}
+	}
+	return nil
+}
+
+// checkAbuse is called before body is written to a paste. It returns an
+// error if the request's source is blocked, or has just earned itself a
+// block. Only new pastes count towards bursts.
+func checkAbuse(r *http.Request, body string, newPaste bool) error {
+	if err := abuseBlocked(r); err != nil || !instanceConfig.Abuse.Enabled {
+		return err
+	}
+
+	sources := abuseSources(r)
+	score := ipReputation(r)
+	burstCount := instanceConfig.Abuse.BurstCount
+	if score > 0 && score >= instanceConfig.Reputation.SuspectScore && burstCount > 1 {
+		burstCount /= 2
+	}
+	var reason string
+	if honeypotFilled(r) {
+		reason = "filled in the honeypot field"
+	} else if score > 0 && score >= instanceConfig.Reputation.BlockScore {
+		reason = fmt.Sprintf("your address has a poor reputation (%.2f)", score)
+		// The address is to blame, not the account using it.
+		sources = sources[:1]
+	} else if n := countCardNumbers(body); instanceConfig.Abuse.CardNumbers > 0 && n >= instanceConfig.Abuse.CardNumbers {
+		reason = fmt.Sprintf("paste contains %d payment card numbers", n)
+	} else if newPaste && burstCount > 0 {
+		shape := pasteShape(body)
+		for _, source := range sources {
+			key := "AB|" + source + "|" + shape
+			v, _ := ephStore.Get(key)
+			n, _ := v.(int)
+			n++
+			ephStore.Put(key, n, privacyRetention(instanceConfig.Abuse.BurstWindow.Duration()))
+			if n >= burstCount {
+				reason = fmt.Sprintf("%d near-identical pastes within %v", n, privacyRetention(instanceConfig.Abuse.BurstWindow.Duration()))
+			}
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+
+	var block *AbuseBlock
+	for _, source := range sources {
+		block = abuseBlockStore.Block(source, reason, privacyRetention(instanceConfig.Abuse.BlockDuration.Duration()))
+	}
+	return AbuseBlockedError{block}
+}
+
+func adminUnblockHandler(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
+	abuseBlockStore.Unblock(source)
+	SetFlash(w, "success", fmt.Sprintf("Unblocked %s.", source))
+	w.Header().Set("Location", "/admin/blocks")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var abuseBlockStore *AbuseBlockStore
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	abuseBlockStore = LoadAbuseBlockStore(filepath.Join(arguments.root, "blocks.gob"))
+
+	RegisterTemplateFunction("abuseBlockCount", func() int {
+		abuseBlockStore.mu.Lock()
+		defer abuseBlockStore.mu.Unlock()
+		return len(abuseBlockStore.Blocks)
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// Pastes are shown as <pre><code> regions named for the paste, so that a
+// screen reader can find its way to (and past) the code, and announce the
+// line a visitor highlights. The high-contrast theme (css/high-contrast.css)
+// applies whenever the browser asks for more contrast, or always with
+// accessibility.high_contrast. accessibility.audit makes every page outline
+// and log the controls and images that lack an accessible name; it is meant
+// for checking changes to the templates, not for production.
+
+// pasteContentsLabel names a paste's contents for assistive technology.
+func pasteContentsLabel(p *Paste) string {
+	name := p.Title
+	if name == "" {
+		name = fmt.Sprintf("Paste %s", p.ID)
+	}
+	if p.Language != nil && p.Language != unknownLanguage {
+		return fmt.Sprintf("%s, %s", name, p.Language.Name)
+	}
+	return name
+}
+
+func init() {
+	RegisterTemplateFunction("pasteContentsLabel", pasteContentsLabel)
+	RegisterTemplateFunction("highContrast", func() bool { return instanceConfig.Accessibility.HighContrast })
+	RegisterTemplateFunction("accessibilityAudit", func() bool { return instanceConfig.Accessibility.Audit })
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/gob"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
+)
+
+// Owners can turn on an access log for a paste, which records when it was
+// viewed, from which country (as reported by Cloudflare) and from what kind
+// of referrer; nothing that identifies the viewer is kept. Views by the
+// paste's editors aren't logged. Each log is pruned of events older than
+// access_log.retention by the expirator, which is scheduled for the
+// moment its oldest event is due to go. Access logs are unavailable while
+// privacy.analytics is off.
+
+type AccessEvent struct {
+	Time     time.Time
+	Country  string
+	Referrer string
+}
+
+type accessLogID PasteID
+
+func (id accessLogID) ExpirationID() gotimeout.ExpirableID {
+	return gotimeout.ExpirableID(id)
+}
+
+// accessLogRetention is how long logged events are kept: access_log.retention,
+// or privacy.retention if that is shorter.
+func accessLogRetention() time.Duration {
+	return privacyRetention(instanceConfig.AccessLog.Retention.Duration())
+}
+
+// accessLogsAvailable reports whether owners may keep access logs.
+func accessLogsAvailable() bool {
+	return instanceConfig.AccessLog.Enabled && instanceConfig.Privacy.Analytics
+}
+
+type AccessLogStore struct {
+	Enabled    map[PasteID]bool
+	Logs       map[PasteID][]AccessEvent
+	ExpiryJunk *gotimeout.HandleMap
+
+	filename  string
+	expirator *gotimeout.Expirator
+	dirty     bool
+	mu        sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *AccessLogStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save access logs: ", err)
+		return err
+	}
+
+	s.dirty = false
+	return os.Rename(asideFilename, s.filename)
+}
+
+// run saves recorded events every so often; they arrive too quickly to
+// save each one.
+func (s *AccessLogStore) run() {
+	for _ = range time.Tick(30 * time.Second) {
+		s.mu.Lock()
+		if s.dirty {
+			s.save()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Flush saves any events recorded since the last save.
+func (s *AccessLogStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *AccessLogStore) IsEnabled(id PasteID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Enabled[id]
+}
+
+// SetEnabled turns the log for id on or off; turning it off discards it.
+func (s *AccessLogStore) SetEnabled(id PasteID, enabled bool) {
+	s.mu.Lock()
+	if enabled {
+		s.Enabled[id] = true
+	} else {
+		delete(s.Enabled, id)
+		delete(s.Logs, id)
+	}
+	s.save()
+	s.mu.Unlock()
+
+	if !enabled {
+		s.expirator.CancelObjectExpiration(accessLogID(id))
+	}
+}
+
+func (s *AccessLogStore) Record(id PasteID, event AccessEvent) {
+	s.mu.Lock()
+	if !s.Enabled[id] {
+		s.mu.Unlock()
+		return
+	}
+	events := append(s.Logs[id], event)
+	if max := instanceConfig.AccessLog.MaxEvents; max > 0 && len(events) > max {
+		events = events[len(events)-max:]
+	}
+	s.Logs[id] = events
+	s.dirty = true
+	first := len(events) == 1
+	s.mu.Unlock()
+
+	if first {
+		s.expirator.ExpireObject(accessLogID(id), accessLogRetention())
+	}
+}
+
+// PruneBefore discards every event logged before cutoff, returning how
+// many it discarded.
+func (s *AccessLogStore) PruneBefore(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	for id, events := range s.Logs {
+		n := sort.Search(len(events), func(i int) bool { return events[i].Time.After(cutoff) })
+		if n == 0 {
+			continue
+		}
+		pruned += n
+		if n == len(events) {
+			delete(s.Logs, id)
+		} else {
+			s.Logs[id] = events[n:]
+		}
+	}
+	if pruned > 0 {
+		s.save()
+	}
+	return pruned
+}
+
+// Clear turns every log off and discards it, returning how many events
+// were discarded.
+func (s *AccessLogStore) Clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Enabled) == 0 && len(s.Logs) == 0 {
+		return 0
+	}
+	cleared := 0
+	for _, events := range s.Logs {
+		cleared += len(events)
+	}
+	s.Enabled = make(map[PasteID]bool)
+	s.Logs = make(map[PasteID][]AccessEvent)
+	s.save()
+	return cleared
+}
+
+// Events returns the events logged for id, newest first.
+func (s *AccessLogStore) Events(id PasteID) []AccessEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]AccessEvent, len(s.Logs[id]))
+	for i, event := range s.Logs[id] {
+		events[len(events)-1-i] = event
+	}
+	return events
+}
+
+// Forget discards everything about id.
+func (s *AccessLogStore) Forget(id PasteID) {
+	s.mu.Lock()
+	_, ok := s.Enabled[id]
+	delete(s.Enabled, id)
+	delete(s.Logs, id)
+	if ok {
+		s.save()
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.expirator.CancelObjectExpiration(accessLogID(id))
+	}
+}
+
+func LoadAccessLogStore(filename string) *AccessLogStore {
+	var s *AccessLogStore
+	logFile, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(logFile)
+		err := dec.Decode(&s)
+		logFile.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode access logs: ", err)
+		}
+	}
+	if s == nil {
+		s = &AccessLogStore{}
+	}
+	if s.Enabled == nil {
+		s.Enabled = make(map[PasteID]bool)
+	}
+	if s.Logs == nil {
+		s.Logs = make(map[PasteID][]AccessEvent)
+	}
+	s.filename = filename
+	s.expirator = gotimeout.NewExpiratorWithStorage(s, s)
+	go s.run()
+	return s
+}
+
+func (s *AccessLogStore) GetExpirable(id gotimeout.ExpirableID) gotimeout.Expirable {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Logs[PasteID(id)]) == 0 {
+		return nil
+	}
+	return accessLogID(id)
+}
+
+// DestroyExpirable prunes a log of its expired events, and schedules the
+// next pruning for when the oldest remaining event expires.
+func (s *AccessLogStore) DestroyExpirable(ex gotimeout.Expirable) {
+	id, ok := ex.(accessLogID)
+	if !ok {
+		return
+	}
+
+	retention := accessLogRetention()
+	cutoff := time.Now().Add(-retention)
+	s.mu.Lock()
+	events := s.Logs[PasteID(id)]
+	n := sort.Search(len(events), func(i int) bool { return events[i].Time.After(cutoff) })
+	events = events[n:]
+	if len(events) == 0 {
+		delete(s.Logs, PasteID(id))
+	} else {
+		s.Logs[PasteID(id)] = events
+	}
+	s.save()
+	s.mu.Unlock()
+
+	if len(events) > 0 {
+		s.expirator.ExpireObject(id, events[0].Time.Add(retention).Sub(time.Now()))
+	}
+}
+
+func (s *AccessLogStore) RequiresFlush() bool {
+	return true
+}
+
+func (s *AccessLogStore) SaveExpirationHandles(hm *gotimeout.HandleMap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ExpiryJunk = hm
+	return s.save()
+}
+
+func (s *AccessLogStore) LoadExpirationHandles() (*gotimeout.HandleMap, error) {
+	return s.ExpiryJunk, nil
+}
+
+// referrerCategories sorts referring sites into kinds. A domain ending in
+// a dot matches under any top-level domain.
+var referrerCategories = []struct {
+	category string
+	domains  []string
+}{
+	{"search", []string{"google.", "bing.com", "duckduckgo.com", "yahoo.", "yandex.", "baidu.com", "ecosia.org"}},
+	{"social", []string{"twitter.com", "t.co", "x.com", "facebook.com", "reddit.com", "linkedin.com", "news.ycombinator.com", "mastodon.social"}},
+	{"chat", []string{"discord.com", "discordapp.com", "slack.com", "t.me", "web.telegram.org", "matrix.to"}},
+	{"code", []string{"github.com", "gitlab.com", "bitbucket.org", "stackoverflow.com", "stackexchange.com"}},
+}
+
+func domainMatches(host, domain string) bool {
+	if strings.HasSuffix(domain, ".") {
+		return strings.HasPrefix(host, domain) || strings.Contains(host, "."+domain)
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// referrerCategory classifies where a request came from: "direct",
+// "internal" (this site), one of referrerCategories, or "other".
+func referrerCategory(r *http.Request) string {
+	referer := r.Referer()
+	if referer == "" {
+		return "direct"
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return "other"
+	}
+	host := strings.ToLower(u.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return "internal"
+	}
+	for _, c := range referrerCategories {
+		for _, domain := range c.domains {
+			if domainMatches(host, domain) {
+				return c.category
+			}
+		}
+	}
+	return "other"
+}
+
+// logsAccess records views of a paste in its access log.
+func logsAccess(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		p := o.(*Paste)
+		if accessLogsAvailable() && !isEditAllowed(p, r) {
+			country := r.Header.Get("CF-IPCountry")
+			if country == "XX" {
+				country = ""
+			}
+			accessLogStore.Record(p.ID, AccessEvent{
+				Time:     time.Now(),
+				Country:  country,
+				Referrer: referrerCategory(r),
+			})
+		}
+		fn(o, w, r)
+	}
+}
+
+type accessSummaryEntry struct {
+	Name  string
+	Count int
+}
+
+func summarizeAccess(events []AccessEvent, key func(AccessEvent) string) []accessSummaryEntry {
+	counts := make(map[string]int)
+	for _, event := range events {
+		counts[key(event)]++
+	}
+	summary := make([]accessSummaryEntry, 0, len(counts))
+	for name, count := range counts {
+		if name == "" {
+			name = "unknown"
+		}
+		summary = append(summary, accessSummaryEntry{name, count})
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Count != summary[j].Count {
+			return summary[i].Count > summary[j].Count
+		}
+		return summary[i].Name < summary[j].Name
+	})
+	return summary
+}
+
+func pasteAccessLogHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	var events []AccessEvent
+	if accessLogsAvailable() {
+		events = accessLogStore.Events(p.ID)
+	}
+	RenderPage(w, r, "paste_access", &struct {
+		Paste     *Paste
+		Enabled   bool
+		Retention time.Duration
+		Events    []AccessEvent
+		Countries []accessSummaryEntry
+		Referrers []accessSummaryEntry
+	}{
+		Paste:     p,
+		Enabled:   accessLogsAvailable() && accessLogStore.IsEnabled(p.ID),
+		Retention: accessLogRetention(),
+		Events:    events,
+		Countries: summarizeAccess(events, func(e AccessEvent) string { return e.Country }),
+		Referrers: summarizeAccess(events, func(e AccessEvent) string { return e.Referrer }),
+	})
+}
+
+func pasteAccessLogToggleHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	enabled := r.FormValue("enabled") == "true"
+	if enabled && !accessLogsAvailable() {
+		SetFlash(w, "error", "Access logs aren't available on this instance.")
+		w.Header().Set("Location", pasteURL("access", p))
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	accessLogStore.SetEnabled(p.ID, enabled)
+	if enabled {
+		SetFlash(w, "success", "Views of this paste will be logged.")
+	} else {
+		SetFlash(w, "success", "Access log turned off and cleared.")
+	}
+	w.Header().Set("Location", pasteURL("access", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var accessLogStore *AccessLogStore
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 type User struct {
@@ -15,7 +16,8 @@ type User struct {
 	challengeProvider ChallengeProvider
 }
 
-func (u *User) UpdateChallenge(password string) {
+// UpdateChallenge sets the user's password, and saves the user.
+func (u *User) UpdateChallenge(password string) error {
 	s, ok := u.Values["_salt"]
 	var salt []byte
 	if !ok {
@@ -27,7 +29,7 @@ func (u *User) UpdateChallenge(password string) {
 	key := u.challengeProvider.DeriveKey(password, salt)
 	challengeMessage := append(salt, []byte(u.Name)...)
 	u.Values["_challenge"] = u.challengeProvider.Challenge(challengeMessage, key)
-	u.Save()
+	return u.Save()
 }
 
 func (u *User) Check(password string) bool {
@@ -130,3 +132,65 @@ func (f *FilesystemStore) Save(user *User) error {
 func NewFilesystemStore(path string, challengeProvider ChallengeProvider) *FilesystemStore {
 	return &FilesystemStore{path, challengeProvider}
 }
+
+// MemoryStore keeps accounts in memory, for tests and for instances that
+// needn't remember anyone. Accounts are kept gob-encoded, as FilesystemStore
+// keeps them on disk, so that what can't be saved there can't be saved
+// here either, and each Get returns a User of its own.
+type MemoryStore struct {
+	challengeProvider ChallengeProvider
+
+	mu       sync.Mutex
+	accounts map[string][]byte
+}
+
+func (m *MemoryStore) Get(name string) *User {
+	m.mu.Lock()
+	data := m.accounts[name]
+	m.mu.Unlock()
+	if data == nil {
+		// Not there, or created but not yet saved.
+		return nil
+	}
+
+	var user User
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&user); err != nil {
+		return nil
+	}
+	user.store = m
+	user.challengeProvider = m.challengeProvider
+	return &user
+}
+
+// Create reserves name, so that no other Create can have it, and returns a
+// User to be saved under it.
+func (m *MemoryStore) Create(name string) *User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.accounts[name]; ok {
+		return nil
+	}
+	m.accounts[name] = nil
+
+	return &User{
+		Name:              name,
+		Values:            make(map[string]interface{}),
+		store:             m,
+		challengeProvider: m.challengeProvider,
+	}
+}
+
+func (m *MemoryStore) Save(user *User) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(user); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.accounts[user.Name] = buf.Bytes()
+	m.mu.Unlock()
+	return nil
+}
+
+func NewMemoryStore(challengeProvider ChallengeProvider) *MemoryStore {
+	return &MemoryStore{challengeProvider: challengeProvider, accounts: make(map[string][]byte)}
+}
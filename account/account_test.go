@@ -0,0 +1,52 @@
+package account
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMemoryStoreCreateIsExclusive(t *testing.T) {
+	m := NewMemoryStore(nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m.Create("alice") != nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("created alice %d times, want once", created)
+	}
+
+	if m.Get("alice") != nil {
+		t.Errorf("got alice before she was saved")
+	}
+}
+
+func TestMemoryStoreGet(t *testing.T) {
+	m := NewMemoryStore(nil)
+	user := m.Create("bob")
+	user.Values["greeting"] = "hello"
+	if err := user.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.Get("bob")
+	if got == nil || got.Values["greeting"] != "hello" {
+		t.Fatalf("got %+v, want bob as saved", got)
+	}
+
+	m.accounts["carol"] = []byte("not gob")
+	if m.Get("carol") != nil {
+		t.Errorf("got an account that couldn't be decoded")
+	}
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DHowett/ghostbin/account"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Users may opt into publishing their unencrypted pastes as ActivityPub
+// notes under a handle of their choosing, so that Fediverse accounts can
+// follow them. Each published paste is announced to followers when it is
+// created, and retracted when it is deleted or expires.
+
+const (
+	ACTIVITYPUB_CONTENT_TYPE     = "application/activity+json"
+	ACTIVITYPUB_PREVIEW_LINES    = 20
+	ACTIVITYPUB_MAX_INBOX_LENGTH = 256 * 1024
+	ACTIVITYPUB_SIGNATURE_SKEW   = 12 * time.Hour
+)
+
+var activityPubContext = []string{
+	"https://www.w3.org/ns/activitystreams",
+	"https://w3id.org/security/v1",
+}
+
+var activityPubHandlePattern = regexp.MustCompile(`^[a-z0-9_]{1,30}$`)
+
+type ActivityPubActor struct {
+	// Account is the (mangled) name of the user who owns this actor.
+	Account string
+	// PrivateKey signs deliveries; PKCS#1 DER.
+	PrivateKey []byte
+	// Followers maps each follower's actor IRI to the inbox to deliver to.
+	Followers map[string]string
+}
+
+func (a *ActivityPubActor) privateKey() (*rsa.PrivateKey, error) {
+	return x509.ParsePKCS1PrivateKey(a.PrivateKey)
+}
+
+type ActivityPubStore struct {
+	Actors map[string]*ActivityPubActor
+	// Published records the handle under which each paste was published.
+	Published map[PasteID]string
+
+	filename string
+	mu       sync.Mutex
+}
+
+func LoadActivityPubStore(filename string) *ActivityPubStore {
+	file, err := os.Open(filename)
+	if err == nil {
+		defer file.Close()
+		var store *ActivityPubStore
+		if err := gob.NewDecoder(file).Decode(&store); err == nil {
+			store.filename = filename
+			return store
+		} else {
+			glog.Error("Failed to decode ActivityPub actors: ", err)
+		}
+	}
+	return &ActivityPubStore{
+		Actors:    map[string]*ActivityPubActor{},
+		Published: map[PasteID]string{},
+		filename:  filename,
+	}
+}
+
+// save must be called with s.mu held.
+func (s *ActivityPubStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := gob.NewEncoder(file).Encode(s); err != nil {
+		glog.Error("Failed to save ActivityPub actors: ", err)
+		return err
+	}
+	return os.Rename(asideFilename, s.filename)
+}
+
+type activityPubDelivery struct {
+	handle string
+	inbox  string
+	body   []byte
+}
+
+type ActivityPub struct {
+	// BaseURL is the instance's public URL; actor and object IRIs hang off it.
+	BaseURL string
+	Store   *ActivityPubStore
+
+	deliveries chan activityPubDelivery
+	client     *http.Client
+}
+
+func NewActivityPub(baseURL string, store *ActivityPubStore) *ActivityPub {
+	return &ActivityPub{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Store:      store,
+		deliveries: make(chan activityPubDelivery, 1024),
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (ap *ActivityPub) domain() string {
+	u, err := url.Parse(ap.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (ap *ActivityPub) actorIRI(handle string) string {
+	return ap.BaseURL + "/ap/users/" + handle
+}
+
+func (ap *ActivityPub) noteIRI(id PasteID) string {
+	return ap.BaseURL + "/ap/pastes/" + id.String()
+}
+
+// HandleForUser returns the handle under which a user publishes, if any.
+func (ap *ActivityPub) HandleForUser(user *account.User) string {
+	if user == nil {
+		return ""
+	}
+	handle, _ := user.Values["activitypub.handle"].(string)
+	return handle
+}
+
+func (ap *ActivityPub) Enable(user *account.User, handle string) error {
+	if !activityPubHandlePattern.MatchString(handle) {
+		return fmt.Errorf("Handles may contain only lowercase letters, digits and underscores.")
+	}
+	if ap.HandleForUser(user) != "" {
+		return fmt.Errorf("You are already publishing.")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	ap.Store.mu.Lock()
+	if existing, taken := ap.Store.Actors[handle]; taken {
+		// A user coming back to their old handle keeps its key.
+		if existing.Account != user.Name {
+			ap.Store.mu.Unlock()
+			return fmt.Errorf("The handle %s is taken.", handle)
+		}
+	} else {
+		ap.Store.Actors[handle] = &ActivityPubActor{
+			Account:    user.Name,
+			PrivateKey: x509.MarshalPKCS1PrivateKey(key),
+			Followers:  map[string]string{},
+		}
+	}
+	err = ap.Store.save()
+	ap.Store.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	user.Values["activitypub.handle"] = handle
+	return user.Save()
+}
+
+// Disable stops a user publishing. Their followers are forgotten, and
+// pastes already published stay published until they are deleted. The
+// handle remains reserved for them.
+func (ap *ActivityPub) Disable(user *account.User) error {
+	handle := ap.HandleForUser(user)
+	if handle == "" {
+		return nil
+	}
+
+	ap.Store.mu.Lock()
+	if actor, ok := ap.Store.Actors[handle]; ok {
+		actor.Followers = map[string]string{}
+	}
+	err := ap.Store.save()
+	ap.Store.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	delete(user.Values, "activitypub.handle")
+	return user.Save()
+}
+
+func (ap *ActivityPub) note(p *Paste, handle string) map[string]interface{} {
+	preview := ""
+	if reader, err := p.Reader(); err == nil {
+		body, _ := ioutil.ReadAll(io.LimitReader(reader, 16*1024))
+		reader.Close()
+		lines := strings.SplitN(string(body), "\n", ACTIVITYPUB_PREVIEW_LINES+1)
+		if len(lines) > ACTIVITYPUB_PREVIEW_LINES {
+			lines[ACTIVITYPUB_PREVIEW_LINES] = "..."
+		}
+		preview = strings.Join(lines, "\n")
+	}
+
+	link := ap.BaseURL + pasteURL("show", p)
+	content := ""
+	if p.Title != "" {
+		content = "<p><strong>" + html.EscapeString(p.Title) + "</strong></p>"
+	}
+	content += "<pre><code>" + html.EscapeString(preview) + "</code></pre>"
+	content += `<p><a href="` + html.EscapeString(link) + `">` + html.EscapeString(link) + "</a></p>"
+
+	return map[string]interface{}{
+		"id":           ap.noteIRI(p.ID),
+		"type":         "Note",
+		"attributedTo": ap.actorIRI(handle),
+		"to":           []string{"https://www.w3.org/ns/activitystreams#Public"},
+		"cc":           []string{ap.actorIRI(handle) + "/followers"},
+		"published":    p.LastModified().UTC().Format(time.RFC3339),
+		"url":          link,
+		"name":         p.Title,
+		"content":      content,
+	}
+}
+
+// Publish announces a newly created paste to the followers of the user who
+// created it, if they have opted in. Encrypted pastes are never published.
+func (ap *ActivityPub) Publish(user *account.User, p *Paste) {
+	handle := ap.HandleForUser(user)
+	if handle == "" || p.Encrypted || len(p.Networks) > 0 || p.viewLimited || p.pending {
+		return
+	}
+
+	ap.Store.mu.Lock()
+	ap.Store.Published[p.ID] = handle
+	ap.Store.save()
+	ap.Store.mu.Unlock()
+
+	note := ap.note(p, handle)
+	ap.deliver(handle, map[string]interface{}{
+		"@context":  activityPubContext,
+		"id":        ap.noteIRI(p.ID) + "#create",
+		"type":      "Create",
+		"actor":     ap.actorIRI(handle),
+		"to":        note["to"],
+		"cc":        note["cc"],
+		"published": note["published"],
+		"object":    note,
+	})
+	healthServer.IncrementMetric("activitypub.published")
+}
+
+// Published reports whether the paste has been published to followers.
+func (ap *ActivityPub) Published(id PasteID) bool {
+	ap.Store.mu.Lock()
+	defer ap.Store.mu.Unlock()
+	_, ok := ap.Store.Published[id]
+	return ok
+}
+
+// Retract tells followers that a published paste is gone.
+func (ap *ActivityPub) Retract(id PasteID) {
+	ap.Store.mu.Lock()
+	handle, ok := ap.Store.Published[id]
+	if ok {
+		delete(ap.Store.Published, id)
+		ap.Store.save()
+	}
+	ap.Store.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ap.deliver(handle, map[string]interface{}{
+		"@context": activityPubContext,
+		"id":       ap.noteIRI(id) + "#delete",
+		"type":     "Delete",
+		"actor":    ap.actorIRI(handle),
+		"to":       []string{"https://www.w3.org/ns/activitystreams#Public"},
+		"object": map[string]interface{}{
+			"id":         ap.noteIRI(id),
+			"type":       "Tombstone",
+			"formerType": "Note",
+		},
+	})
+	healthServer.IncrementMetric("activitypub.retracted")
+}
+
+// deliver queues an activity for every follower of handle, once per inbox.
+func (ap *ActivityPub) deliver(handle string, activity interface{}) {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		glog.Error("ACTIVITYPUB: Failed to encode activity: ", err)
+		return
+	}
+
+	ap.Store.mu.Lock()
+	inboxes := map[string]bool{}
+	if actor, ok := ap.Store.Actors[handle]; ok {
+		for _, inbox := range actor.Followers {
+			inboxes[inbox] = true
+		}
+	}
+	ap.Store.mu.Unlock()
+
+	for inbox := range inboxes {
+		ap.queue(activityPubDelivery{handle, inbox, body})
+	}
+}
+
+func (ap *ActivityPub) queue(d activityPubDelivery) {
+	select {
+	case ap.deliveries <- d:
+	default:
+		healthServer.IncrementMetric("activitypub.deliveries.dropped")
+	}
+}
+
+func (ap *ActivityPub) Run() {
+	for d := range ap.deliveries {
+		if err := ap.post(d.handle, d.inbox, d.body); err != nil {
+			glog.Error("ACTIVITYPUB: Delivery to ", d.inbox, " failed: ", err)
+			healthServer.IncrementMetric("activitypub.deliveries.failed")
+		} else {
+			healthServer.IncrementMetric("activitypub.deliveries")
+		}
+	}
+}
+
+func (ap *ActivityPub) post(handle, inbox string, body []byte) error {
+	ap.Store.mu.Lock()
+	actor, ok := ap.Store.Actors[handle]
+	ap.Store.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no actor %s", handle)
+	}
+	key, err := actor.privateKey()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ACTIVITYPUB_CONTENT_TYPE)
+	if err := signActivityPubRequest(req, body, ap.actorIRI(handle)+"#main-key", key); err != nil {
+		return err
+	}
+
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("inbox returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func activityPubDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func activityPubSigningString(req *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = h + ": " + strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			lines[i] = h + ": " + req.Host
+		default:
+			lines[i] = h + ": " + req.Header.Get(h)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signActivityPubRequest adds an HTTP Signature (draft-cavage-http-signatures)
+// covering the request line, host, date and body digest.
+func signActivityPubRequest(req *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	req.Host = req.URL.Host
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", activityPubDigest(body))
+
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	hashed := sha256.Sum256([]byte(activityPubSigningString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+type activityPubRemoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+func (ap *ActivityPub) fetchActor(iri string) (*activityPubRemoteActor, error) {
+	req, err := http.NewRequest("GET", iri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", ACTIVITYPUB_CONTENT_TYPE)
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", iri, resp.StatusCode)
+	}
+
+	var actor activityPubRemoteActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, ACTIVITYPUB_MAX_INBOX_LENGTH)).Decode(&actor); err != nil {
+		return nil, err
+	}
+	return &actor, nil
+}
+
+// verify checks an incoming request's HTTP Signature, returning the actor
+// that signed it.
+func (ap *ActivityPub) verify(r *http.Request, body []byte) (*activityPubRemoteActor, error) {
+	params := map[string]string{}
+	for _, part := range strings.Split(r.Header.Get("Signature"), ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			params[strings.TrimSpace(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, fmt.Errorf("request is not signed")
+	}
+
+	headers := strings.Fields(params["headers"])
+	covered := map[string]bool{}
+	for _, h := range headers {
+		covered[h] = true
+	}
+	if !covered["(request-target)"] || !covered["date"] || !covered["digest"] {
+		return nil, fmt.Errorf("signature does not cover the request")
+	}
+	if r.Header.Get("Digest") != activityPubDigest(body) {
+		return nil, fmt.Errorf("digest mismatch")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date) > ACTIVITYPUB_SIGNATURE_SKEW || time.Until(date) > ACTIVITYPUB_SIGNATURE_SKEW {
+		return nil, fmt.Errorf("signature date out of range")
+	}
+
+	actor, err := ap.fetchActor(params["keyId"])
+	if err != nil {
+		return nil, err
+	}
+	if actor.PublicKey.ID != params["keyId"] {
+		return nil, fmt.Errorf("key %s not found", params["keyId"])
+	}
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("malformed public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(activityPubSigningString(r, headers)))
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
+
+func writeActivityPubJSON(w http.ResponseWriter, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ap *ActivityPub) lookupActor(w http.ResponseWriter, r *http.Request) (string, *ActivityPubActor) {
+	handle := mux.Vars(r)["handle"]
+	ap.Store.mu.Lock()
+	actor, ok := ap.Store.Actors[handle]
+	ap.Store.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return "", nil
+	}
+	return handle, actor
+}
+
+func (ap *ActivityPub) webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := strings.TrimPrefix(r.FormValue("resource"), "acct:")
+	handle := strings.TrimSuffix(resource, "@"+ap.domain())
+	ap.Store.mu.Lock()
+	_, ok := ap.Store.Actors[handle]
+	ap.Store.mu.Unlock()
+	if !ok || handle == resource {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeActivityPubJSON(w, "application/jrd+json", map[string]interface{}{
+		"subject": "acct:" + handle + "@" + ap.domain(),
+		"links": []map[string]string{{
+			"rel":  "self",
+			"type": ACTIVITYPUB_CONTENT_TYPE,
+			"href": ap.actorIRI(handle),
+		}},
+	})
+}
+
+func (ap *ActivityPub) actorHandler(w http.ResponseWriter, r *http.Request) {
+	handle, actor := ap.lookupActor(w, r)
+	if actor == nil {
+		return
+	}
+	key, err := actor.privateKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	iri := ap.actorIRI(handle)
+
+	writeActivityPubJSON(w, ACTIVITYPUB_CONTENT_TYPE, map[string]interface{}{
+		"@context":          activityPubContext,
+		"id":                iri,
+		"type":              "Person",
+		"preferredUsername": handle,
+		"name":              handle + " (" + ap.domain() + " pastes)",
+		"inbox":             iri + "/inbox",
+		"outbox":            iri + "/outbox",
+		"followers":         iri + "/followers",
+		"publicKey": map[string]string{
+			"id":           iri + "#main-key",
+			"owner":        iri,
+			"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})),
+		},
+	})
+}
+
+func (ap *ActivityPub) collectionHandler(w http.ResponseWriter, r *http.Request) {
+	handle, actor := ap.lookupActor(w, r)
+	if actor == nil {
+		return
+	}
+
+	total := 0
+	ap.Store.mu.Lock()
+	if strings.HasSuffix(r.URL.Path, "/followers") {
+		total = len(actor.Followers)
+	} else {
+		for _, h := range ap.Store.Published {
+			if h == handle {
+				total++
+			}
+		}
+	}
+	ap.Store.mu.Unlock()
+
+	writeActivityPubJSON(w, ACTIVITYPUB_CONTENT_TYPE, map[string]interface{}{
+		"@context":   activityPubContext,
+		"id":         ap.BaseURL + r.URL.Path,
+		"type":       "OrderedCollection",
+		"totalItems": total,
+	})
+}
+
+func (ap *ActivityPub) noteHandler(w http.ResponseWriter, r *http.Request) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	ap.Store.mu.Lock()
+	handle, ok := ap.Store.Published[id]
+	ap.Store.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	p, err := pasteStore.Get(id, nil)
+	if err != nil || p.trashed != "" {
+		http.Error(w, "Gone", http.StatusGone)
+		return
+	}
+	if len(p.Networks) > 0 || p.viewLimited || p.pending {
+		// Restricted, or held for approval, since it was published.
+		http.NotFound(w, r)
+		return
+	}
+	note := ap.note(p, handle)
+	note["@context"] = activityPubContext
+	writeActivityPubJSON(w, ACTIVITYPUB_CONTENT_TYPE, note)
+}
+
+type activityPubIncoming struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (ap *ActivityPub) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	handle, actor := ap.lookupActor(w, r)
+	if actor == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, ACTIVITYPUB_MAX_INBOX_LENGTH))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var activity activityPubIncoming
+	if err := json.Unmarshal(body, &activity); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	remote, err := ap.verify(r, body)
+	if err != nil {
+		healthServer.IncrementMetric("activitypub.inbox.rejected")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if remote.PublicKey.Owner != activity.Actor {
+		http.Error(w, "Signer is not the actor", http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		follower, err := ap.fetchActor(activity.Actor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		inbox := follower.Inbox
+		if follower.Endpoints.SharedInbox != "" {
+			inbox = follower.Endpoints.SharedInbox
+		}
+
+		ap.Store.mu.Lock()
+		actor.Followers[activity.Actor] = inbox
+		ap.Store.save()
+		ap.Store.mu.Unlock()
+
+		accept, _ := json.Marshal(map[string]interface{}{
+			"@context": activityPubContext,
+			"id":       ap.actorIRI(handle) + "#accept-" + base64.RawURLEncoding.EncodeToString([]byte(activity.ID)),
+			"type":     "Accept",
+			"actor":    ap.actorIRI(handle),
+			"object":   json.RawMessage(body),
+		})
+		ap.queue(activityPubDelivery{handle, follower.Inbox, accept})
+		healthServer.IncrementMetric("activitypub.follows")
+
+	case "Undo":
+		var undone activityPubIncoming
+		if json.Unmarshal(activity.Object, &undone) == nil && undone.Type == "Follow" {
+			ap.Store.mu.Lock()
+			delete(actor.Followers, activity.Actor)
+			ap.Store.save()
+			ap.Store.mu.Unlock()
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (ap *ActivityPub) RegisterRoutes(router *mux.Router) {
+	router.Methods("GET").Path("/.well-known/webfinger").Handler(http.HandlerFunc(ap.webfingerHandler))
+	router.Methods("GET").Path("/ap/users/{handle}").Handler(http.HandlerFunc(ap.actorHandler))
+	router.Methods("GET").Path("/ap/users/{handle}/outbox").Handler(http.HandlerFunc(ap.collectionHandler))
+	router.Methods("GET").Path("/ap/users/{handle}/followers").Handler(http.HandlerFunc(ap.collectionHandler))
+	router.Methods("POST").Path("/ap/users/{handle}/inbox").Handler(http.HandlerFunc(ap.inboxHandler))
+	router.Methods("GET").Path("/ap/pastes/{id}").Handler(http.HandlerFunc(ap.noteHandler))
+	router.Methods("POST").Path("/session/activitypub").Handler(http.HandlerFunc(ap.settingsHandler))
+}
+
+func (ap *ActivityPub) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUser(r)
+	if user == nil {
+		RenderError(fmt.Errorf("You need to log in to publish your pastes."), http.StatusForbidden, w)
+		return
+	}
+
+	var err error
+	if r.FormValue("publish") == "true" {
+		if !featureEnabled(r, activityPubFeature.Name) {
+			RenderError(fmt.Errorf("Publishing isn't available to your account yet."), http.StatusForbidden, w)
+			return
+		}
+		handle := strings.ToLower(strings.TrimSpace(r.FormValue("handle")))
+		if err = ap.Enable(user, handle); err == nil {
+			SetFlash(w, "success", fmt.Sprintf("Your public pastes are now published as @%s@%s.", handle, ap.domain()))
+		}
+	} else {
+		if err = ap.Disable(user); err == nil {
+			SetFlash(w, "success", "Your pastes are no longer published.")
+		}
+	}
+	if err != nil {
+		SetFlash(w, "error", err.Error())
+	}
+
+	w.Header().Set("Location", "/session")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var activityPub *ActivityPub
+
+var activityPubFeature = RegisterFeature("activitypub", "Accounts can publish their pastes over ActivityPub.", RolloutOn)
+
+func init() {
+	SubscribeEvent(func(ev *Event) {
+		if activityPub != nil {
+			activityPub.Retract(ev.PasteID)
+		}
+	}, EventPasteExpired, EventPasteDestroyed)
+
+	RegisterTemplateFunction("activityPubEnabled", func() bool { return activityPub != nil })
+	RegisterTemplateFunction("activityPubAddress", func(user *account.User) string {
+		if activityPub == nil {
+			return ""
+		}
+		if handle := activityPub.HandleForUser(user); handle != "" {
+			return "@" + handle + "@" + activityPub.domain()
+		}
+		return ""
+	})
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// The JSON API lives under /api/v1. Successful responses are JSON objects;
+// failures are {"error": "<message>", "code": "<code>"} with the status
+// code belonging to the code, and a "details" object where one of them has
+// more to say (a validation error's field, a rate limit's retry_after).
+
+var apiRouter *mux.Router
+
+const (
+	APIErrorValidation         = "validation"
+	APIErrorUnauthorized       = "unauthorized"
+	APIErrorForbidden          = "forbidden"
+	APIErrorBlocked            = "blocked"
+	APIErrorNotFound           = "not_found"
+	APIErrorConflict           = "conflict"
+	APIErrorPreconditionFailed = "precondition_failed"
+	APIErrorExpired            = "expired"
+	APIErrorTooLarge           = "too_large"
+	APIErrorRateLimited        = "rate_limited"
+	APIErrorQuotaExceeded      = "quota_exceeded"
+	APIErrorInternal           = "internal"
+	APIErrorNotImplemented     = "not_implemented"
+	APIErrorTimeout            = "timeout"
+	APIErrorUpstream           = "upstream"
+)
+
+var apiErrorStatuses = map[string]int{
+	APIErrorValidation:         http.StatusBadRequest,
+	APIErrorUnauthorized:       http.StatusUnauthorized,
+	APIErrorForbidden:          http.StatusForbidden,
+	APIErrorBlocked:            http.StatusForbidden,
+	APIErrorNotFound:           http.StatusNotFound,
+	APIErrorConflict:           http.StatusConflict,
+	APIErrorPreconditionFailed: http.StatusPreconditionFailed,
+	APIErrorExpired:            http.StatusGone,
+	APIErrorTooLarge:           http.StatusRequestEntityTooLarge,
+	APIErrorRateLimited:        http.StatusTooManyRequests,
+	APIErrorQuotaExceeded:      http.StatusTooManyRequests,
+	APIErrorInternal:           http.StatusInternalServerError,
+	APIErrorNotImplemented:     http.StatusNotImplemented,
+	APIErrorTimeout:            http.StatusGatewayTimeout,
+	APIErrorUpstream:           http.StatusBadGateway,
+}
+
+// APIErrorCoder is implemented by errors that know their API error code.
+// Errors that don't are given the code for their status.
+type APIErrorCoder interface {
+	APIErrorCode() string
+}
+
+// APIErrorDetailer is implemented by errors with details for API clients.
+type APIErrorDetailer interface {
+	APIErrorDetails() map[string]interface{}
+}
+
+// APIError is an error with an API error code, for failures that don't
+// have a type of their own.
+type APIError struct {
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func apiError(code string, format string, args ...interface{}) *APIError {
+	return &APIError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// With adds a detail to e.
+func (e *APIError) With(key string, value interface{}) *APIError {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func (e *APIError) StatusCode() int {
+	return apiErrorStatuses[e.Code]
+}
+
+func (e *APIError) APIErrorCode() string {
+	return e.Code
+}
+
+func (e *APIError) APIErrorDetails() map[string]interface{} {
+	return e.Details
+}
+
+func apiErrorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return APIErrorValidation
+	case http.StatusForbidden:
+		return APIErrorForbidden
+	case http.StatusTooManyRequests:
+		return APIErrorRateLimited
+	}
+	for code, s := range apiErrorStatuses {
+		if s == status && code != APIErrorBlocked && code != APIErrorQuotaExceeded {
+			return code
+		}
+	}
+	return APIErrorInternal
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Error("Failed to encode API response: ", err)
+	}
+}
+
+// writeAPIError answers with err, which is a 500 unless it is an HTTPError.
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if weberr, ok := err.(HTTPError); ok {
+		status = weberr.StatusCode()
+	}
+	code := apiErrorCodeForStatus(status)
+	if coder, ok := err.(APIErrorCoder); ok {
+		code = coder.APIErrorCode()
+	}
+
+	body := map[string]interface{}{"error": err.Error(), "code": code}
+	if id := responseRequestID(w); id != "" {
+		body["request_id"] = id
+	}
+	if detailer, ok := err.(APIErrorDetailer); ok {
+		if details := detailer.APIErrorDetails(); len(details) > 0 {
+			body["details"] = details
+			if retry, ok := details["retry_after"].(int); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+			}
+		}
+	}
+	writeAPIResponse(w, status, body)
+}
+
+// apiRequiresUserPermission is requiresUserPermission for API endpoints.
+func apiRequiresUserPermission(permission string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userHasPermission(r, permission) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		healthServer.IncrementMetric("permission." + permission + ".failed")
+		writeAPIError(w, apiError(APIErrorForbidden, "you are not allowed to do that"))
+	})
+}
+
+// apiPasteCreateHandler creates a paste. Form values: text (required),
+// lang, title, expire, retention, immutable. Encrypted pastes can only be created with the web
+// form.
+//
+// With PUT, which must carry an Idempotency-Key, the request body is the
+// text (unless it is a form) and the other values go in the query, so that
+// e.g. `curl -T file -H "Idempotency-Key: $id" .../pastes?lang=go` works.
+func apiPasteCreateHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := idempotencyKeyForRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	value := r.FormValue
+	if r.Method == "PUT" {
+		if key == "" {
+			writeAPIError(w, apiError(APIErrorValidation, "PUT requires an Idempotency-Key"))
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/x-www-form-urlencoded") && !strings.HasPrefix(ct, "multipart/form-data") {
+			text, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(PASTE_MAXIMUM_LENGTH)+1))
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			value = func(name string) string {
+				if name == "text" {
+					return string(text)
+				}
+				return r.FormValue(name)
+			}
+		}
+	}
+
+	in, err := parsePasteInput(value)
+	if err == nil {
+		err = checkRetentionClass(r, in)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	body := in.Body
+	if len(strings.TrimSpace(body)) == 0 {
+		writeAPIError(w, apiError(APIErrorValidation, "text must not be empty").With("field", "text"))
+		return
+	}
+
+	var fingerprint string
+	if key != "" {
+		fingerprint = in.fingerprint()
+		p, err := claimIdempotencyKey(key, fingerprint)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if p != nil {
+			// The client that sent the key first is this one, retrying.
+			perms := GetPastePermissions(r)
+			perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
+			perms.Save(w, r)
+			sessions.Save(r, w)
+
+			healthServer.IncrementMetric("paste.created.replayed")
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeAPIResponse(w, http.StatusCreated, map[string]interface{}{
+				"id":     p.ID,
+				"url":    pasteURL("show", p),
+				"status": pasteStatus(p),
+			})
+			return
+		}
+		defer releaseIdempotencyKey(key)
+	}
+
+	p, err := createAPIPaste(r, in)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if key != "" {
+		rememberIdempotencyKey(key, fingerprint, p)
+	}
+
+	perms := GetPastePermissions(r)
+	perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
+	perms.Save(w, r)
+	sessions.Save(r, w)
+
+	publishPaste(r, p)
+
+	healthServer.IncrementMetric("paste.created")
+	healthServer.IncrementMetric("paste.created.api")
+	resp := map[string]interface{}{
+		"id":     p.ID,
+		"url":    pasteURL("show", p),
+		"status": pasteStatus(p),
+	}
+	if p.immutable {
+		resp["immutable"] = true
+	}
+	if p.diagnostics != nil {
+		resp["diagnostics"] = p.diagnostics
+	}
+	writeAPIResponse(w, http.StatusCreated, resp)
+}
+
+// createAPIPaste checks and stores a new unencrypted paste. Granting the
+// caller permissions on it, and publishing it, are left to the caller.
+func createAPIPaste(r *http.Request, in *PasteInput) (*Paste, error) {
+	if err := checkAbuse(r, in.Body, true); err != nil {
+		return nil, err
+	}
+
+	p, err := newPaste(r.Context(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = storeStage.Do(r.Context(), func(context.Context) error {
+		pw, err := p.Writer()
+		if err != nil {
+			return err
+		}
+		pw.Write([]byte(in.Body))
+		p.Language = LanguageNamed(in.Language)
+		if p.Language == nil {
+			p.Language = unknownLanguage
+		}
+		validatePasteBody(p, []byte(in.Body))
+		sealPaste(p, in)
+		limitPasteViews(p, in)
+		p.Title = pasteTitle(p, in)
+		p.License = in.License
+		p.Networks = in.Networks
+		p.Source = in.Source
+		p.immutable = in.Immutable
+		p.Retention = defaultRetention(in.Retention)
+		setPasteExpiration(p, defaultExpiration(in.Expiration))
+		attributeChange(r, p)
+		holdForApproval(r, p)
+		return pw.Close() // Saves p
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// apiPasteUpdateHandler updates a paste the caller may edit. Form values
+// are those of apiPasteCreateHandler, and any left out keep the paste's.
+// With If-Match (or the form value revision), the update is refused with
+// 412 unless the paste is still at that revision. The response, like the
+// paste's JSON, carries the new revision as its ETag.
+func apiPasteUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, err := getPaste(r.Context(), id, nil)
+	if _, ok := err.(DeadlineExceededError); ok {
+		writeAPIError(w, err)
+		return
+	}
+	if p == nil || p.trashed != "" {
+		writeAPIError(w, PasteNotFoundError{ID: id})
+		return
+	}
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"edit", id})
+		return
+	}
+	if p.Encrypted {
+		writeAPIError(w, apiError(APIErrorValidation, "encrypted pastes can only be edited with the web form"))
+		return
+	}
+	if err := checkPasteMutable(p); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	defer lockPasteUpdates(p.ID)()
+	if err := checkPastePrecondition(r, p); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	r.ParseForm()
+	current := map[string]string{"title": p.Title, "license": p.License, "networks": pasteNetworksValue(p)}
+	in, err := parsePasteInput(func(name string) string {
+		if _, ok := r.Form[name]; ok {
+			if (name == "expire" && r.FormValue(name) == p.Expiration) || (name == "sealed_until" && r.FormValue(name) == pasteSealValue(p)) || (name == "views" && r.FormValue(name) == pasteViewsValue(p)) || (name == "retention" && r.FormValue(name) == p.Retention) {
+				return ""
+			}
+			return r.FormValue(name)
+		}
+		if name == "text" {
+			reader, err := p.Reader()
+			if err != nil {
+				return ""
+			}
+			defer reader.Close()
+			body, _ := ioutil.ReadAll(reader)
+			return string(body)
+		}
+		return current[name]
+	})
+	if err == nil {
+		err = checkRetentionClass(r, in)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(strings.TrimSpace(in.Body)) == 0 {
+		writeAPIError(w, apiError(APIErrorValidation, "text must not be empty").With("field", "text"))
+		return
+	}
+	if err := checkAbuse(r, in.Body, false); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	attributeChange(r, p)
+	holdForApproval(r, p)
+	if err := savePasteInputContext(r.Context(), p, in, false); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	healthServer.IncrementMetric("paste.updated")
+	healthServer.IncrementMetric("paste.updated.api")
+	revision := pasteRevision(p)
+	w.Header().Set("ETag", pasteETag(revision))
+	resp := map[string]interface{}{
+		"id":       p.ID,
+		"url":      pasteURL("show", p),
+		"revision": revision,
+		"status":   pasteStatus(p),
+	}
+	if p.diagnostics != nil {
+		resp["diagnostics"] = p.diagnostics
+	}
+	writeAPIResponse(w, http.StatusOK, resp)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Reads refresh a paste's last-access time at most this often, to spare
+// the metadata a write on every view.
+const ACCESS_TIME_RESOLUTION time.Duration = 1 * time.Hour
+
+// ColdStore holds the bodies of pastes that have been archived out of the
+// filesystem store. objectstore.Client satisfies it.
+type ColdStore interface {
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// DirectoryColdStore keeps archived bodies in a directory, which is
+// expected to live on cheaper (slower) storage than the paste store.
+type DirectoryColdStore struct {
+	Path string
+}
+
+func (d *DirectoryColdStore) filename(key string) string {
+	return filepath.Join(d.Path, filepath.FromSlash(key))
+}
+
+func (d *DirectoryColdStore) Put(key string, r io.Reader, size int64) error {
+	filename := d.filename(key)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	asideFilename := filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	return os.Rename(asideFilename, filename)
+}
+
+func (d *DirectoryColdStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(d.filename(key))
+}
+
+func (d *DirectoryColdStore) Delete(key string) error {
+	err := os.Remove(d.filename(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (store *FilesystemPasteStore) archivedKey(filename string) string {
+	return getMetadata(filename, "archived", "")
+}
+
+// lastAccessed is the later of a paste's modification and last read.
+func (store *FilesystemPasteStore) lastAccessed(filename string, fi os.FileInfo) time.Time {
+	t := fi.ModTime()
+	if secs, err := strconv.ParseInt(getMetadata(filename, "accessed", ""), 10, 64); err == nil {
+		if accessed := time.Unix(secs, 0); accessed.After(t) {
+			t = accessed
+		}
+	}
+	return t
+}
+
+func (store *FilesystemPasteStore) touch(filename string) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+	if time.Since(store.lastAccessed(filename, fi)) > ACCESS_TIME_RESOLUTION {
+		putMetadata(filename, "accessed", strconv.FormatInt(time.Now().Unix(), 10))
+	}
+}
+
+// replaceBody atomically swaps the body of the paste at filename for the
+// contents of r, carrying its metadata and modification time across, and
+// setting the metadata in marks (archived, say, or packed). Readers holding
+// the old body open are unaffected.
+func (store *FilesystemPasteStore) replaceBody(filename string, r io.Reader, marks map[string]string) error {
+	if err := store.fault("write", filename); err != nil {
+		return err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	asideFilename := filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	file.Close()
+	if err != nil {
+		os.Remove(asideFilename)
+		return err
+	}
+
+	for _, name := range pasteMetadataNames {
+		if hasMetadata(filename, name) {
+			putMetadata(asideFilename, name, getMetadata(filename, name, ""))
+		}
+	}
+	for name, value := range marks {
+		putMetadata(asideFilename, name, value)
+	}
+	os.Chtimes(asideFilename, fi.ModTime(), fi.ModTime())
+
+	return os.Rename(asideFilename, filename)
+}
+
+// Archive moves a paste's body to the cold store, leaving its metadata
+// behind. The body is brought back the next time the paste is read.
+func (store *FilesystemPasteStore) Archive(id PasteID) error {
+	if store.ColdStore == nil {
+		return fmt.Errorf("no cold store is configured")
+	}
+
+	store.archiveMu.Lock()
+	defer store.archiveMu.Unlock()
+
+	filename := store.filenameForID(id)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if store.archivedKey(filename) != "" || store.packedPointer(filename) != "" {
+		return nil
+	}
+
+	key := instanceConfig.Archive.Prefix + id.String()
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	err = store.ColdStore.Put(key, file, fi.Size())
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return store.replaceBody(filename, strings.NewReader(""), map[string]string{"archived": key})
+}
+
+func (store *FilesystemPasteStore) rehydrate(filename string) error {
+	store.archiveMu.Lock()
+	defer store.archiveMu.Unlock()
+
+	key := store.archivedKey(filename)
+	if key == "" {
+		// Someone beat us to it.
+		return nil
+	}
+
+	cold, err := store.ColdStore.Get(key)
+	if err != nil {
+		return err
+	}
+	defer cold.Close()
+
+	if err := store.replaceBody(filename, cold, map[string]string{"archived": ""}); err != nil {
+		return err
+	}
+
+	if err := store.ColdStore.Delete(key); err != nil {
+		glog.Error("Failed to remove rehydrated body ", key, " from cold storage: ", err)
+	}
+	healthServer.IncrementMetric("paste.rehydrated")
+	return nil
+}
+
+// forgetArchivedBody drops the cold copy of a paste that is being rewritten
+// or destroyed.
+func (store *FilesystemPasteStore) forgetArchivedBody(filename string) {
+	key := store.archivedKey(filename)
+	if key == "" {
+		return
+	}
+
+	putMetadata(filename, "archived", "")
+	if store.isDirect(filename) {
+		putMetadata(filename, "direct", "")
+	}
+	if store.ColdStore != nil {
+		if err := store.ColdStore.Delete(key); err != nil {
+			glog.Error("Failed to remove ", key, " from cold storage: ", err)
+		}
+	}
+}
+
+// Archiver moves the bodies of pastes nobody has touched in a while from
+// the filesystem store to its cold store.
+type Archiver struct {
+	Store *FilesystemPasteStore
+	After time.Duration
+}
+
+func (a *Archiver) Sweep() (int, error) {
+	n := 0
+	err := a.Store.Walk(func(id PasteID) error {
+		filename := a.Store.filenameForID(id)
+		fi, err := os.Stat(filename)
+		if err != nil || fi.Size() == 0 || a.Store.archivedKey(filename) != "" || pinnedByFilename(filename) {
+			return nil
+		}
+		if time.Since(a.Store.lastAccessed(filename, fi)) < a.After {
+			return nil
+		}
+
+		if err := a.Store.Archive(id); err != nil {
+			glog.Error("Failed to archive ", id, ": ", err)
+			return nil
+		}
+		n++
+		return nil
+	})
+
+	healthServer.IncrementMetric("archive.runs")
+	if n > 0 {
+		glog.Infof("ARCHIVE: Moved %d pastes to cold storage.", n)
+	}
+	return n, err
+}
+
+var pasteArchiver *Archiver
+
+func init() {
+	RegisterJob("archive", "Move pastes untouched for archive.after into cold storage.", func(run *JobRun) error {
+		if pasteArchiver == nil {
+			return fmt.Errorf("archival is not configured")
+		}
+		n, err := pasteArchiver.Sweep()
+		run.SetResult("archived %d pastes", n)
+		return err
+	})
+
+	RegisterCommand("archive", "move pastes untouched for archive.after into cold storage now", func(args []string) error {
+		if pasteArchiver == nil {
+			return fmt.Errorf("archival is not configured")
+		}
+		n, err := pasteArchiver.Sweep()
+		fmt.Printf("Archived %d pastes.\n", n)
+		return err
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -96,9 +97,26 @@ func authLoginPostHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			reply.Reason = "account creation has been disabled"
-			reply.InvalidFields = []string{"username", "password", "confirm_password"}
-			return
+			invite := InviteCode(strings.TrimSpace(r.FormValue("invite")))
+			switch instanceConfig.Registration.Mode {
+			case RegistrationOpen:
+			case RegistrationInvite:
+				if invite == "" {
+					reply.Status = "moreinfo"
+					reply.Reason = "new accounts need an invite code"
+					reply.InvalidFields = []string{"invite", "confirm_password"}
+					return
+				}
+				if !inviteStore.Valid(invite) {
+					reply.Reason = "that invite code is invalid or has expired"
+					reply.InvalidFields = []string{"invite"}
+					return
+				}
+			default:
+				reply.Reason = "account creation has been disabled"
+				reply.InvalidFields = []string{"username", "password", "confirm_password"}
+				return
+			}
 
 			if confirm == "" {
 				reply.Status = "moreinfo"
@@ -110,8 +128,26 @@ func authLoginPostHandler(w http.ResponseWriter, r *http.Request) {
 				reply.InvalidFields = []string{"password", "confirm_password"}
 				return
 			}
+			// Redeem the invite before the account exists, so that two
+			// registrations racing for one invite can't both get an account.
+			if instanceConfig.Registration.Mode == RegistrationInvite && !inviteStore.Redeem(invite, username) {
+				reply.Reason = "that invite code is invalid or has expired"
+				reply.InvalidFields = []string{"invite"}
+				return
+			}
 			newuser = userStore.Create(username)
+			if newuser == nil {
+				// Someone else registered the name since we looked.
+				if instanceConfig.Registration.Mode == RegistrationInvite {
+					inviteStore.Release(invite, username)
+				}
+				reply.Reason = "that username is taken"
+				reply.InvalidFields = []string{"username"}
+				return
+			}
 			newuser.UpdateChallenge(password)
+			healthServer.IncrementMetric("user.created")
+			PublishEvent(&Event{Kind: EventAccountCreated, Account: newuser.Name})
 			user = newuser
 		} else {
 			if promotion {
@@ -234,6 +270,13 @@ func authLoginPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user != nil && accountDisabled(user) {
+		healthServer.IncrementMetric("user.login.disabled")
+		reply.Status = "invalid"
+		reply.Reason = "this account has been deactivated"
+		return
+	}
+
 	if user != nil {
 		healthServer.IncrementMetric("user.login")
 
@@ -348,8 +391,11 @@ func (u userLookupWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ses, _ := clientLongtermSessionStore.Get(r, "authentication")
 	account, ok := ses.Values["account2"].(string)
 	if ok {
-		user := userStore.Get(account)
-		r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		// Deactivated accounts are logged out wherever they were
+		// logged in.
+		if user := userStore.Get(account); user != nil && !accountDisabled(user) {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		}
 	}
 	u.Handler.ServeHTTP(w, r)
 }
@@ -380,26 +426,45 @@ type CachingUserStore struct {
 	cache *lru.Cache
 }
 
+type cachedUser struct {
+	user   *account.User
+	loaded time.Time
+}
+
 func (c *CachingUserStore) fromCache(name string) *account.User {
 	c.mu.RLock()
 	var user *account.User
 	if c.cache != nil {
-		if u, ok := c.cache.Get(name); ok {
-			user = u.(*account.User)
+		if u, ok := c.cache.Get(name); ok && time.Since(u.(*cachedUser).loaded) < instanceConfig.LookupCache.Accounts.Duration() {
+			user = u.(*cachedUser).user
 		}
 	}
 	c.mu.RUnlock()
+	countLookup("account", user != nil)
 	return user
 }
 
 func (c *CachingUserStore) putCache(name string, user *account.User) {
+	if instanceConfig.LookupCache.Accounts <= 0 {
+		return
+	}
 	c.mu.Lock()
 	if c.cache == nil {
 		c.cache = &lru.Cache{
 			MaxEntries: USER_CACHE_MAX_ENTRIES,
 		}
 	}
-	c.cache.Add(name, user)
+	c.cache.Add(name, &cachedUser{user: user, loaded: time.Now()})
+	c.mu.Unlock()
+}
+
+// Forget drops the named account from the cache, so that it is read again
+// the next time it is asked for.
+func (c *CachingUserStore) Forget(name string) {
+	c.mu.Lock()
+	if c.cache != nil {
+		c.cache.Remove(name)
+	}
 	c.mu.Unlock()
 }
 
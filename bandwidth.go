@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Raw bodies and downloads are counted against soft bandwidth quotas, so
+// that a paste hot-linked as a CDN (or a client pulling everything) can't
+// run up the operator's bill. Bytes served are counted per paste and per
+// source address over bandwidth.window; past a quota, further downloads
+// are either throttled to bandwidth.throttle_rate or refused with 429
+// until the window is over. A paste's editors see a notice on its page
+// while it is over its quota. Bodies served straight from the cold store,
+// and those of pastes exempt from retention (see exemption.go), aren't
+// counted.
+
+const (
+	BandwidthActionThrottle = "throttle"
+	BandwidthActionBlock    = "block"
+)
+
+type bandwidthCounter struct {
+	mu    sync.Mutex
+	bytes int64
+	start time.Time
+}
+
+// BandwidthNotice tells a paste's editors that it went over its quota.
+type BandwidthNotice struct {
+	Bytes  ByteSize
+	Action string
+	Until  time.Time
+}
+
+type BandwidthQuotaError struct {
+	Subject string
+	Until   time.Time
+}
+
+func (e BandwidthQuotaError) Error() string {
+	return fmt.Sprintf("This %s has used up its download allowance for now. Try again after %s.", e.Subject, e.Until.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+func (e BandwidthQuotaError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (e BandwidthQuotaError) APIErrorCode() string {
+	return APIErrorQuotaExceeded
+}
+
+func (e BandwidthQuotaError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{
+		"until":       e.Until.UTC(),
+		"retry_after": int(time.Until(e.Until).Seconds()) + 1,
+	}
+}
+
+// bandwidthCounterFor returns the counter for key, starting a new one if
+// its window is over.
+func bandwidthCounterFor(key string) *bandwidthCounter {
+	bandwidthCounters.Lock()
+	defer bandwidthCounters.Unlock()
+	if v, ok := ephStore.Get(key); ok {
+		return v.(*bandwidthCounter)
+	}
+	c := &bandwidthCounter{start: time.Now()}
+	ephStore.Put(key, c, privacyRetention(instanceConfig.Bandwidth.Window.Duration()))
+	return c
+}
+
+// bandwidthCounters serializes the creation of counters.
+var bandwidthCounters sync.Mutex
+
+// over reports whether c has served more than quota, and when its window
+// ends.
+func (c *bandwidthCounter) over(quota int64) (bool, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return quota > 0 && c.bytes >= quota, c.start.Add(instanceConfig.Bandwidth.Window.Duration())
+}
+
+func (c *bandwidthCounter) add(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytes += n
+	return c.bytes
+}
+
+// pasteBandwidthNotice returns the notice for p, or nil if it is within its
+// quota.
+func pasteBandwidthNotice(p *Paste) *BandwidthNotice {
+	if v, ok := ephStore.Get("BW|N|" + p.ID.String()); ok {
+		return v.(*BandwidthNotice)
+	}
+	return nil
+}
+
+// throttledWriter writes no faster than rate bytes a second.
+type throttledWriter struct {
+	w    io.Writer
+	rate int64
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if int64(len(chunk)) > t.rate {
+			chunk = chunk[:t.rate]
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if f, ok := t.w.(http.Flusher); ok {
+			f.Flush()
+		}
+		time.Sleep(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	}
+	return written, nil
+}
+
+// meterRawBody returns the writer through which to send p's body to r,
+// which counts what is written, and a function to call when done. It
+// returns an error if a quota is used up and bandwidth.action is "block".
+func meterRawBody(w http.ResponseWriter, r *http.Request, p *Paste) (io.Writer, func(), error) {
+	cfg := &instanceConfig.Bandwidth
+	if (cfg.Paste <= 0 && cfg.IP <= 0) || retentionExempt(p) {
+		return w, func() {}, nil
+	}
+
+	pasteCounter := bandwidthCounterFor("BW|P|" + p.ID.String())
+	ipCounter := bandwidthCounterFor("BW|I|" + StoredIPForRequest(r))
+	pasteOver, pasteUntil := pasteCounter.over(cfg.Paste)
+	ipOver, ipUntil := ipCounter.over(cfg.IP)
+
+	var out io.Writer = w
+	if pasteOver || ipOver {
+		healthServer.IncrementMetric("bandwidth.over_quota")
+		if cfg.Action == BandwidthActionBlock {
+			err := BandwidthQuotaError{"paste", pasteUntil}
+			if !pasteOver {
+				err = BandwidthQuotaError{"address", ipUntil}
+			}
+			// The refusal mustn't outlive the quota in caches.
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Del("Surrogate-Control")
+			w.Header().Set("Retry-After", fmt.Sprint(int(time.Until(err.Until).Seconds())+1))
+			return nil, nil, err
+		}
+		out = &throttledWriter{w: w, rate: cfg.ThrottleRate}
+	}
+
+	counting := &countingWriter{w: out}
+	return counting, func() {
+		pasteBytes := pasteCounter.add(counting.n)
+		ipCounter.add(counting.n)
+		healthServer.AddMetric("bandwidth.served", int(counting.n))
+		if cfg.Paste > 0 && pasteBytes >= cfg.Paste && pasteBytes-counting.n < cfg.Paste {
+			glog.Warningf("Paste %v went over its bandwidth quota (%d bytes since %v); downloads will %s until %v", p.ID, pasteBytes, pasteCounter.start, cfg.Action, pasteUntil)
+			ephStore.Put("BW|N|"+p.ID.String(), &BandwidthNotice{ByteSize(pasteBytes), cfg.Action, pasteUntil}, time.Until(pasteUntil))
+		}
+	}, nil
+}
+
+// addressBandwidthUsed returns how many bytes r's address has been sent in
+// its current window, and when the window ends (zero if it has none).
+func addressBandwidthUsed(r *http.Request) (int64, time.Time) {
+	v, ok := ephStore.Get("BW|I|" + StoredIPForRequest(r))
+	if !ok {
+		return 0, time.Time{}
+	}
+	c := v.(*bandwidthCounter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes, c.start.Add(instanceConfig.Bandwidth.Window.Duration())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func validateBandwidthConfig(c *_Configuration) error {
+	switch c.Bandwidth.Action {
+	case BandwidthActionThrottle:
+		if (c.Bandwidth.Paste > 0 || c.Bandwidth.IP > 0) && c.Bandwidth.ThrottleRate <= 0 {
+			return fmt.Errorf("bandwidth.throttle_rate must be positive")
+		}
+	case BandwidthActionBlock:
+	default:
+		return fmt.Errorf("bandwidth.action must be %q or %q, not %q", BandwidthActionThrottle, BandwidthActionBlock, c.Bandwidth.Action)
+	}
+	if (c.Bandwidth.Paste > 0 || c.Bandwidth.IP > 0) && c.Bandwidth.Window.Duration() <= 0 {
+		return fmt.Errorf("bandwidth.window must be positive")
+	}
+	return nil
+}
+
+func init() {
+	RegisterTemplateFunction("pasteBandwidthNotice", pasteBandwidthNotice)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// An instance's branding is its name, logo, colors, footer and contact,
+// shown on every page and in the web manifest and the directory
+// announcement. A hosting provider can white-label the instance per
+// tenant: each host it is reached by can have a branding of its own, which
+// differs from the default only in what it sets.
+//
+// Brandings come from config.yml (branding), over which admins can set
+// their own through the API; for a request, the effective branding is
+// built up from the default in config.yml, the admins' default, the host's
+// in config.yml and the admins' for the host, each field from the last
+// that sets it.
+
+const defaultBrandingColor = "#2a2a2a"
+
+// brandingDefaultHost names the default branding in the API.
+const brandingDefaultHost = "default"
+
+type Branding struct {
+	Name            string `yaml:"name" json:"name,omitempty"`
+	LogoURL         string `yaml:"logo_url" json:"logo_url,omitempty"`
+	PrimaryColor    string `yaml:"primary_color" json:"primary_color,omitempty"`
+	BackgroundColor string `yaml:"background_color" json:"background_color,omitempty"`
+	Footer          string `yaml:"footer" json:"footer,omitempty"`
+	Contact         string `yaml:"contact" json:"contact,omitempty"`
+}
+
+var brandingColorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}){1,2}$`)
+
+// overlay sets the fields of b that o sets.
+func (b *Branding) overlay(o *Branding) {
+	if o == nil {
+		return
+	}
+	for _, f := range []struct{ to, from *string }{
+		{&b.Name, &o.Name},
+		{&b.LogoURL, &o.LogoURL},
+		{&b.PrimaryColor, &o.PrimaryColor},
+		{&b.BackgroundColor, &o.BackgroundColor},
+		{&b.Footer, &o.Footer},
+		{&b.Contact, &o.Contact},
+	} {
+		if *f.from != "" {
+			*f.to = *f.from
+		}
+	}
+}
+
+// CustomColors reports whether b's colors differ from the stylesheet's.
+func (b *Branding) CustomColors() bool {
+	return !strings.EqualFold(b.PrimaryColor, defaultBrandingColor) || !strings.EqualFold(b.BackgroundColor, defaultBrandingColor)
+}
+
+// ContactURL returns a link to the contact.
+func (b *Branding) ContactURL() string {
+	if strings.Contains(b.Contact, "@") && !strings.Contains(b.Contact, "/") {
+		return "mailto:" + b.Contact
+	}
+	return b.Contact
+}
+
+func (b *Branding) validate() error {
+	if len(b.Name) > 64 {
+		return fmt.Errorf("name may be at most 64 characters")
+	}
+	if len(b.Footer) > 1024 {
+		return fmt.Errorf("footer may be at most 1024 characters")
+	}
+	for name, color := range map[string]string{"primary_color": b.PrimaryColor, "background_color": b.BackgroundColor} {
+		if color != "" && !brandingColorPattern.MatchString(color) {
+			return fmt.Errorf("%s must be a color like #2a2a2a, not %q", name, color)
+		}
+	}
+	if b.LogoURL != "" && !strings.HasPrefix(b.LogoURL, "/") {
+		if u, err := url.Parse(b.LogoURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("logo_url must be a URL or a path, not %q", b.LogoURL)
+		}
+	}
+	if b.Contact != "" && !strings.Contains(b.Contact, "@") {
+		if u, err := url.Parse(b.Contact); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("contact must be an email address or a URL, not %q", b.Contact)
+		}
+	}
+	return nil
+}
+
+// brandingHost normalizes a host as brandings are kept by it.
+func brandingHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+type BrandingStore struct {
+	// Hosts maps hosts to the brandings admins set for them; "" is the
+	// default.
+	Hosts map[string]*Branding
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *BrandingStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save branding: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+func (s *BrandingStore) Get(host string) *Branding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.Hosts[host]; ok {
+		c := *b
+		return &c
+	}
+	return nil
+}
+
+func (s *BrandingStore) Put(host string, b *Branding) error {
+	if err := b.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Hosts[host] = b
+	return s.save()
+}
+
+func (s *BrandingStore) Delete(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Hosts[host]; !ok {
+		return false
+	}
+	delete(s.Hosts, host)
+	s.save()
+	return true
+}
+
+func LoadBrandingStore(filename string) *BrandingStore {
+	var s *BrandingStore
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode branding: ", err)
+		}
+	}
+	if s == nil {
+		s = &BrandingStore{}
+	}
+	if s.Hosts == nil {
+		s.Hosts = make(map[string]*Branding)
+	}
+	s.filename = filename
+	return s
+}
+
+var brandingStore *BrandingStore
+
+// brandingForHost returns the effective branding for host; the default's,
+// for "".
+func brandingForHost(host string) *Branding {
+	b := &Branding{Name: brand, PrimaryColor: defaultBrandingColor, BackgroundColor: defaultBrandingColor}
+	b.overlay(&instanceConfig.Branding.Default)
+	b.overlay(brandingStore.Get(""))
+	if host != "" {
+		if hb, ok := instanceConfig.Branding.Hosts[host]; ok {
+			b.overlay(&hb)
+		}
+		b.overlay(brandingStore.Get(host))
+	}
+	return b
+}
+
+// brandingFor returns the effective branding for r, which may be nil.
+func brandingFor(r *http.Request) *Branding {
+	if r == nil {
+		return brandingForHost("")
+	}
+	return brandingForHost(brandingHost(r.Host))
+}
+
+// brandingHosts returns every host with a branding of its own.
+func brandingHosts() []string {
+	seen := make(map[string]bool)
+	for host := range instanceConfig.Branding.Hosts {
+		seen[brandingHost(host)] = true
+	}
+	brandingStore.mu.Lock()
+	for host := range brandingStore.Hosts {
+		if host != "" {
+			seen[host] = true
+		}
+	}
+	brandingStore.mu.Unlock()
+	hosts := make([]string, 0, len(seen))
+	for host := range seen {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// apiBrandingHandler returns the branding for the host the request was
+// made to.
+func apiBrandingHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIResponse(w, http.StatusOK, brandingFor(r))
+}
+
+type brandingDescription struct {
+	Host string `json:"host"`
+	// Branding is in effect; Override is what admins set, if anything.
+	Branding *Branding `json:"branding"`
+	Override *Branding `json:"override,omitempty"`
+}
+
+func describeBranding(host string) brandingDescription {
+	d := brandingDescription{Host: host, Branding: brandingForHost(host), Override: brandingStore.Get(host)}
+	if host == "" {
+		d.Host = brandingDefaultHost
+	}
+	return d
+}
+
+// apiAdminBrandingsHandler lists the default branding, and every host's.
+func apiAdminBrandingsHandler(w http.ResponseWriter, r *http.Request) {
+	brandings := []brandingDescription{describeBranding("")}
+	for _, host := range brandingHosts() {
+		brandings = append(brandings, describeBranding(host))
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"brandings": brandings,
+	})
+}
+
+// apiAdminBrandingHandler returns (GET), sets (PUT) or drops (DELETE) the
+// admins' branding for a host, or for "default". PUT takes the form
+// values name, logo_url, primary_color, background_color, footer and
+// contact; those left out are kept as they were, and empty ones are
+// cleared.
+func apiAdminBrandingHandler(w http.ResponseWriter, r *http.Request) {
+	host := brandingHost(mux.Vars(r)["host"])
+	if host == brandingDefaultHost {
+		host = ""
+	}
+
+	switch r.Method {
+	case "DELETE":
+		if !brandingStore.Delete(host) {
+			writeAPIError(w, apiError(APIErrorNotFound, "no branding has been set for %s", describeBranding(host).Host))
+			return
+		}
+		healthServer.IncrementMetric("branding.changed")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "PUT":
+		r.ParseForm()
+		b := brandingStore.Get(host)
+		if b == nil {
+			b = &Branding{}
+		}
+		for name, field := range map[string]*string{
+			"name":             &b.Name,
+			"logo_url":         &b.LogoURL,
+			"primary_color":    &b.PrimaryColor,
+			"background_color": &b.BackgroundColor,
+			"footer":           &b.Footer,
+			"contact":          &b.Contact,
+		} {
+			if v, ok := r.Form[name]; ok {
+				*field = strings.TrimSpace(v[0])
+			}
+		}
+		if err := brandingStore.Put(host, b); err != nil {
+			writeAPIError(w, apiError(APIErrorValidation, "%v", err))
+			return
+		}
+		healthServer.IncrementMetric("branding.changed")
+	}
+	writeAPIResponse(w, http.StatusOK, describeBranding(host))
+}
+
+func validateBrandingConfig(c *_Configuration) error {
+	if err := c.Branding.Default.validate(); err != nil {
+		return fmt.Errorf("branding.default: %v", err)
+	}
+	for host, b := range c.Branding.Hosts {
+		if err := b.validate(); err != nil {
+			return fmt.Errorf("branding.hosts.%s: %v", host, err)
+		}
+	}
+	normalized := make(map[string]Branding, len(c.Branding.Hosts))
+	for host, b := range c.Branding.Hosts {
+		normalized[brandingHost(host)] = b
+	}
+	c.Branding.Hosts = normalized
+	return nil
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	brandingStore = LoadBrandingStore(filepath.Join(arguments.root, "branding.gob"))
+
+	RegisterTemplateFunction("branding", func(ri *RenderContext) *Branding { return brandingFor(ri.Request) })
+	RegisterTemplateFunction("brand", func(ri *RenderContext) string { return brandingFor(ri.Request).Name })
+}
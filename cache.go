@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses for pastes tell caches how long they may be kept according to
+// the paste's visibility:
+//
+//   - public pastes have been published (over ActivityPub);
+//   - private pastes are encrypted, sealed, on a private instance, or have
+//     an access log (which cached views would go around);
+//   - every other paste is unlisted: anyone can see it, but only with its
+//     link.
+//
+// Each visibility has its own Cache-Control for the HTML view and for raw
+// bodies, and a Surrogate-Control for CDNs. HTML shown to someone logged in
+// or able to edit the paste carries their controls, and is always private;
+// all other HTML varies by Cookie, so that shared caches only answer
+// cookieless requests with it. A paste that will expire is never cached
+// past its expiration.
+
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+type CachePolicy struct {
+	HTML      string `yaml:"html"`
+	Raw       string `yaml:"raw"`
+	Surrogate string `yaml:"surrogate"`
+}
+
+func pasteVisibility(p *Paste) string {
+	if p.Encrypted || p.Sealed() || len(p.Networks) > 0 || p.viewLimited || p.pending || instanceConfig.Instance.Private || (accessLogsAvailable() && accessLogStore.IsEnabled(p.ID)) {
+		return VisibilityPrivate
+	}
+	if activityPub != nil && activityPub.Published(p.ID) {
+		return VisibilityPublic
+	}
+	return VisibilityUnlisted
+}
+
+func cachePolicy(visibility string) *CachePolicy {
+	switch visibility {
+	case VisibilityPublic:
+		return &instanceConfig.Cache.Public
+	case VisibilityUnlisted:
+		return &instanceConfig.Cache.Unlisted
+	}
+	return &instanceConfig.Cache.Private
+}
+
+func setPasteCacheHeaders(w http.ResponseWriter, r *http.Request, p *Paste, raw bool) {
+	visibility := pasteVisibility(p)
+	// Direct bodies are served by way of short-lived signed URLs.
+	if (raw && p.direct) || (!raw && (GetUser(r) != nil || isEditAllowed(p, r))) {
+		visibility = VisibilityPrivate
+	}
+
+	policy := cachePolicy(visibility)
+	value, surrogate := policy.HTML, policy.Surrogate
+	if raw {
+		value = policy.Raw
+	}
+	if exptime := p.ExpirationTime(); !exptime.IsZero() {
+		left := secondsUntil(exptime)
+		value, surrogate = capCacheLifetime(value, left), capCacheLifetime(surrogate, left)
+	}
+	if value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+	if surrogate != "" {
+		w.Header().Set("Surrogate-Control", surrogate)
+	}
+	if !raw && visibility != VisibilityPrivate {
+		w.Header().Add("Vary", "Cookie")
+	}
+}
+
+// capCacheLifetime lowers the lifetimes in a Cache-Control (or
+// Surrogate-Control) value to at most seconds.
+func capCacheLifetime(value string, seconds int) string {
+	if value == "" {
+		return ""
+	}
+	directives := strings.Split(value, ",")
+	for i, directive := range directives {
+		directive = strings.TrimSpace(directive)
+		directives[i] = directive
+		eq := strings.IndexByte(directive, '=')
+		if eq < 0 {
+			continue
+		}
+		switch strings.ToLower(directive[:eq]) {
+		case "max-age", "s-maxage", "stale-while-revalidate", "stale-if-error":
+			if n, err := strconv.Atoi(directive[eq+1:]); err == nil && n > seconds {
+				directives[i] = directive[:eq+1] + strconv.Itoa(seconds)
+			}
+		}
+	}
+	return strings.Join(directives, ", ")
+}
+
+// cachesPaste sets a paste response's caching headers; raw is set for
+// responses carrying the paste's body alone.
+func cachesPaste(raw bool, fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		setPasteCacheHeaders(w, r, o.(*Paste), raw)
+		fn(o, w, r)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Mirrors, search appliances and backup agents keep up with the instance
+// through its change feed, rather than by polling every paste. Every paste
+// creation, update, deletion and expiration is journalled (in a journal
+// like replication's, but kept whether or not the instance replicates),
+// and can be read from a cursor onwards:
+//
+//	GET /api/v1/changes?since=<cursor>[&limit=n]
+//
+// answers with the changes after the cursor, oldest first, the cursor to
+// ask from next, and whether there are more to fetch at once. With no
+// cursor, the feed starts at the oldest change it still has. Sent Accept:
+// text/event-stream, the same changes are streamed as server-sent events
+// (each event's ID is its cursor, so that a reconnecting client resumes
+// with Last-Event-ID), followed by each new change as it happens.
+//
+// A client whose cursor has fallen out of the journal is told so (410), and
+// must resynchronize by other means before starting afresh. The feed is
+// open to admins and to the bearers of changes.tokens.
+
+const (
+	CHANGES_PAGE_SIZE     int = 500
+	CHANGES_MAX_PAGE_SIZE int = 5000
+)
+
+var changeJournal *ReplicationJournal
+
+// Change is a paste change as the feed describes it.
+type Change struct {
+	Cursor string               `json:"cursor"`
+	Type   ReplicationEventType `json:"type"`
+	ID     PasteID              `json:"id"`
+	Time   time.Time            `json:"time"`
+}
+
+func changeForEvent(ev ReplicationEvent) Change {
+	return Change{
+		Cursor: strconv.FormatUint(ev.Seq, 10),
+		Type:   ev.Type,
+		ID:     ev.ID,
+		Time:   ev.Time.UTC(),
+	}
+}
+
+func parseChangeCursor(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, apiError(APIErrorValidation, "since is not a cursor from this feed").With("field", "since")
+	}
+	return seq, nil
+}
+
+func changesAuthorized(r *http.Request) bool {
+	if userHasPermission(r, "admin") {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, t := range instanceConfig.Changes.Tokens {
+		if t != "" && hmac.Equal([]byte(token), []byte(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+func apiChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if changeJournal == nil {
+		writeAPIError(w, apiError(APIErrorNotImplemented, "this instance keeps no change feed"))
+		return
+	}
+	if !changesAuthorized(r) {
+		healthServer.IncrementMetric("changes.refused")
+		writeAPIError(w, apiError(APIErrorUnauthorized, "the change feed needs a token"))
+		return
+	}
+
+	since := r.FormValue("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	seq, err := parseChangeCursor(since)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if since == "" {
+		if oldest, _ := changeJournal.Since(0, 1); len(oldest) > 0 {
+			seq = oldest[0].Seq - 1
+		}
+	}
+	limit := CHANGES_PAGE_SIZE
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n > 0 {
+		limit = n
+		if limit > CHANGES_MAX_PAGE_SIZE {
+			limit = CHANGES_MAX_PAGE_SIZE
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamChanges(w, r, seq)
+		return
+	}
+
+	events, complete := changeJournal.Since(seq, limit)
+	if !complete {
+		writeAPIError(w, changesGoneError(seq))
+		return
+	}
+	changes := make([]Change, 0, len(events))
+	for _, ev := range events {
+		changes = append(changes, changeForEvent(ev))
+	}
+	cursor := strconv.FormatUint(seq, 10)
+	if len(events) > 0 {
+		cursor = changes[len(changes)-1].Cursor
+	}
+	head := changeJournal.Head()
+	healthServer.IncrementMetric("changes.fetched")
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"changes": changes,
+		"cursor":  cursor,
+		"more":    len(events) > 0 && events[len(events)-1].Seq < head,
+	})
+}
+
+func changesGoneError(seq uint64) error {
+	return apiError(APIErrorExpired, "the change feed no longer reaches back to cursor %d; resynchronize and start again", seq)
+}
+
+// streamChanges sends the changes after seq, and then each new one, as
+// server-sent events until the client goes away.
+func streamChanges(w http.ResponseWriter, r *http.Request, seq uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, apiError(APIErrorNotImplemented, "streaming isn't available here"))
+		return
+	}
+
+	// New events only wake the stream; what is sent is always read from
+	// the journal, so that none are missed if the channel overflows.
+	c := changeJournal.Subscribe()
+	defer changeJournal.Unsubscribe(c)
+
+	if _, complete := changeJournal.Since(seq, 1); !complete {
+		writeAPIError(w, changesGoneError(seq))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	healthServer.IncrementMetric("changes.streamed")
+
+	catchUp := func() error {
+		for {
+			events, complete := changeJournal.Since(seq, CHANGES_MAX_PAGE_SIZE)
+			if !complete {
+				fmt.Fprintf(w, "event: gone\ndata: %q\n\n", changesGoneError(seq).Error())
+				return changesGoneError(seq)
+			}
+			for _, ev := range events {
+				body, _ := json.Marshal(changeForEvent(ev))
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, body); err != nil {
+					return err
+				}
+				seq = ev.Seq
+			}
+			flusher.Flush()
+			if len(events) < CHANGES_MAX_PAGE_SIZE {
+				return nil
+			}
+		}
+	}
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		if catchUp() != nil {
+			return
+		}
+		select {
+		case <-c:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// startChangeJournal begins journalling paste changes for the feed.
+func startChangeJournal(filename string, size int) {
+	changeJournal = LoadReplicationJournal(filename, size)
+	changeJournal.metrics = "changes"
+	changeJournal.watch()
+	glog.Info("Journalling changes for /api/v1/changes; head is ", changeJournal.Head())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// A Command is a maintenance task run in place of the server, as
+// `spectre [flags] <command> [arguments]`. Commands run after every store
+// has been opened and the configuration loaded.
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(args []string) error
+}
+
+var commands = map[string]*Command{}
+
+func RegisterCommand(name, usage string, run func(args []string) error) {
+	commands[name] = &Command{Name: name, Usage: usage, Run: run}
+}
+
+func printCommandUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command [arguments]]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].Usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(os.Stderr)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// RunCommand runs the command named by args[0] and returns the process exit
+// status.
+func RunCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n", args[0])
+		printCommandUsage()
+		return 2
+	}
+
+	if err := cmd.Run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.Name, err)
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	RegisterCommand("help", "list the available commands", func(args []string) error {
+		printCommandUsage()
+		return nil
+	})
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ConfigDuration is a time.Duration that unmarshals from the same duration
+// syntax accepted for paste expirations ("30m", "1d", "2w").
+type ConfigDuration time.Duration
+
+func (d *ConfigDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	dur, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(dur)
+	return nil
+}
+
+func (d ConfigDuration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+type _Configuration struct {
+	Instance struct {
+		// Private requires visitors to log in before they can see or
+		// create anything.
+		Private bool `yaml:"private"`
+	} `yaml:"instance"`
+
+	Registration struct {
+		// Mode is "open", "invite" or "closed"; see RegistrationOpen.
+		Mode string `yaml:"mode"`
+		// InviteLifetime is how long an invite code stays valid.
+		InviteLifetime ConfigDuration `yaml:"invite_lifetime"`
+	} `yaml:"registration"`
+
+	ProofOfWork struct {
+		// Enabled makes anonymous API clients solve a proof-of-work
+		// challenge before creating a paste or upload.
+		Enabled bool `yaml:"enabled"`
+		// Difficulty is the number of leading zero bits required.
+		Difficulty int            `yaml:"difficulty"`
+		Lifetime   ConfigDuration `yaml:"lifetime"`
+	} `yaml:"proof_of_work"`
+
+	Abuse struct {
+		Enabled bool `yaml:"enabled"`
+		// BurstCount near-identical pastes from one source within
+		// BurstWindow earn it a block.
+		BurstCount  int            `yaml:"burst_count"`
+		BurstWindow ConfigDuration `yaml:"burst_window"`
+		// As does a paste containing CardNumbers payment card numbers.
+		CardNumbers   int            `yaml:"card_numbers"`
+		BlockDuration ConfigDuration `yaml:"block_duration"`
+		// Traps; see honeypot.go.
+		HoneypotField string   `yaml:"honeypot_field"`
+		TrapPaths     []string `yaml:"trap_paths"`
+		CrawlerTrap   string   `yaml:"crawler_trap"`
+	} `yaml:"abuse"`
+
+	Reputation struct {
+		// DNSBL lists DNS blocklist zones to look writers' addresses up
+		// in; HTTP is a reputation service's URL, with {ip} in it.
+		DNSBL   []string       `yaml:"dnsbl"`
+		HTTP    string         `yaml:"http"`
+		Timeout ConfigDuration `yaml:"timeout"`
+		Cache   ConfigDuration `yaml:"cache"`
+		// Addresses scoring SuspectScore or more are treated with
+		// suspicion; those scoring BlockScore or more are blocked.
+		SuspectScore float64 `yaml:"suspect_score"`
+		BlockScore   float64 `yaml:"block_score"`
+		// PowPenalty is added to the proof-of-work difficulty for
+		// suspect addresses.
+		PowPenalty int `yaml:"pow_penalty"`
+	} `yaml:"reputation"`
+
+	Tombstones struct {
+		// Retention is how long a destroyed paste's tombstone is kept;
+		// 0 keeps none.
+		Retention ConfigDuration `yaml:"retention"`
+		// Expired is how long, at least, an expired paste's tombstone is
+		// kept.
+		Expired ConfigDuration `yaml:"expired"`
+	} `yaml:"tombstones"`
+
+	Expiration struct {
+		// Presets are the expirations pastes may be given, in the order
+		// the paste form offers them.
+		Presets []ExpirationPreset `yaml:"presets"`
+		// Never allows pastes that never expire.
+		Never bool `yaml:"never"`
+		// Default is the expiration of pastes created without one: a
+		// preset's value, or "-1" for never.
+		Default string `yaml:"default"`
+	} `yaml:"expiration"`
+
+	// Defaults are what the paste form starts out with; see defaults.go.
+	Defaults struct {
+		Language  string             `yaml:"language"`
+		Referrers []ReferrerDefaults `yaml:"referrers"`
+	} `yaml:"defaults"`
+
+	Retention struct {
+		// Classes are the retention classes pastes may be put in; see
+		// retention.go.
+		Classes []RetentionClass `yaml:"classes"`
+		// Default is the class of pastes created without one; "" for
+		// none.
+		Default string `yaml:"default"`
+	} `yaml:"retention"`
+
+	// LanguageSettings tunes how pastes are shown, by language ID;
+	// "default" covers languages not named. Admins can override them at
+	// /admin/languages.
+	LanguageSettings map[string]LanguageSettings `yaml:"language_settings"`
+
+	Trash struct {
+		// Expired is how long an expired paste stays in the trash,
+		// restorable, before it is destroyed; 0 destroys it at once.
+		Expired ConfigDuration `yaml:"expired"`
+		// Deleted is how long a paste its owner deleted stays in the
+		// trash, during which the deletion can be undone.
+		Deleted ConfigDuration `yaml:"deleted"`
+	} `yaml:"trash"`
+
+	AccessLog struct {
+		// Enabled lets owners turn on access logs for their pastes.
+		Enabled   bool           `yaml:"enabled"`
+		Retention ConfigDuration `yaml:"retention"`
+		MaxEvents int            `yaml:"max_events"`
+	} `yaml:"access_log"`
+
+	Directory struct {
+		// Announce publishes the instance's announcement at
+		// /.well-known/spectre.
+		Announce    bool     `yaml:"announce"`
+		Description string   `yaml:"description"`
+		Peers       []string `yaml:"peers"`
+	} `yaml:"directory"`
+
+	// Stats publishes coarse stats at /api/v1/stats; see stats.go.
+	Stats struct {
+		Enabled bool `yaml:"enabled"`
+		// Interval is how often the pastes are counted again; MaxAge, how
+		// long responses may be cached.
+		Interval ConfigDuration `yaml:"interval"`
+		MaxAge   ConfigDuration `yaml:"max_age"`
+	} `yaml:"stats"`
+
+	// Branding is how the instance presents itself (Default), and how
+	// it does when reached by each of Hosts; see branding.go.
+	Branding struct {
+		Default Branding            `yaml:"default"`
+		Hosts   map[string]Branding `yaml:"hosts"`
+	} `yaml:"branding"`
+
+	RawHost struct {
+		// URL is the base URL of the host serving raw bodies, if any.
+		URL    string         `yaml:"url"`
+		Expiry ConfigDuration `yaml:"expiry"`
+		// MaxSignedExpiry caps the expiry of signed URLs minted through
+		// the API.
+		MaxSignedExpiry ConfigDuration `yaml:"max_signed_expiry"`
+	} `yaml:"raw_host"`
+
+	// Shortener configures short links to pastes; see shorten.go.
+	Shortener struct {
+		Enabled bool `yaml:"enabled"`
+		// Host is the base URL of a host serving nothing but short links,
+		// if any; otherwise they are served under /s/.
+		Host string `yaml:"host"`
+		// BaseURL, the instance's public URL, is where the short host
+		// sends its visitors.
+		BaseURL    string `yaml:"base_url"`
+		CodeLength int    `yaml:"code_length"`
+	} `yaml:"shortener"`
+
+	// Cache holds the caching policy for each paste visibility; see
+	// cache.go.
+	Cache struct {
+		Public   CachePolicy `yaml:"public"`
+		Unlisted CachePolicy `yaml:"unlisted"`
+		Private  CachePolicy `yaml:"private"`
+	} `yaml:"cache"`
+
+	// LookupCache is how long accounts and sessions, once read, are kept
+	// in memory; see lookupcache.go.
+	LookupCache struct {
+		Accounts ConfigDuration `yaml:"accounts"`
+		Sessions ConfigDuration `yaml:"sessions"`
+	} `yaml:"lookup_cache"`
+
+	Links struct {
+		// Autolink is LinksAll, LinksExplicit or LinksNone.
+		Autolink string `yaml:"autolink"`
+		// Interstitial sends links in rendered pastes to domains other
+		// than TrustedDomains (and their subdomains) through /out.
+		Interstitial   bool     `yaml:"interstitial"`
+		TrustedDomains []string `yaml:"trusted_domains"`
+	} `yaml:"links"`
+
+	Moderation struct {
+		// Approval holds pastes written by anyone but verified accounts
+		// until an admin approves them; Webhook, if set, is sent a notice
+		// of each.
+		Approval bool   `yaml:"approval"`
+		Webhook  string `yaml:"webhook"`
+	} `yaml:"moderation"`
+
+	Networks struct {
+		// Named maps the names of networks to the address ranges (CIDRs)
+		// they cover, for pastes to be restricted to; Custom lets pastes
+		// be restricted to any ranges.
+		Named  map[string][]string `yaml:"named"`
+		Custom bool                `yaml:"custom"`
+	} `yaml:"networks"`
+
+	Privacy struct {
+		// IPMode is how IP addresses are stored: IPModeFull,
+		// IPModeTruncate (to IPv4Prefix or IPv6Prefix bits) or IPModeHash
+		// (keyed, the key changing every HashRotation).
+		IPMode       string         `yaml:"ip_mode"`
+		IPv4Prefix   int            `yaml:"ipv4_prefix"`
+		IPv6Prefix   int            `yaml:"ipv6_prefix"`
+		HashRotation ConfigDuration `yaml:"hash_rotation"`
+		// Retention caps how long any record of a visitor is kept; 0
+		// leaves each to its own setting.
+		Retention     ConfigDuration `yaml:"retention"`
+		SweepInterval ConfigDuration `yaml:"sweep_interval"`
+		// Analytics allows records of how particular pastes are viewed
+		// (access logs); aggregate metrics are kept either way.
+		Analytics bool `yaml:"analytics"`
+	} `yaml:"privacy"`
+
+	HTTP struct {
+		// TLSCert and TLSKey, if set, make spectre serve HTTPS (and HTTP/2)
+		// on -addr itself.
+		TLSCert      string `yaml:"tls_cert"`
+		TLSKey       string `yaml:"tls_key"`
+		DisableHTTP2 bool   `yaml:"disable_http2"`
+		// AltSvc is sent as the Alt-Svc header, e.g. to advertise HTTP/3.
+		AltSvc string `yaml:"alt_svc"`
+		// TrustRequestID keeps the X-Request-ID requests come with;
+		// LogRequests logs every request. See requestid.go.
+		TrustRequestID bool `yaml:"trust_request_id"`
+		LogRequests    bool `yaml:"log_requests"`
+		// TrustedProxies (CIDRs or addresses) may say who a request is
+		// from with CF-Connecting-IP or X-Forwarded-For. See proxy.go.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+	} `yaml:"http"`
+
+	Timeouts struct {
+		// ReadHeader, Read, Write and Idle bound a client connection;
+		// Handler the work done for a request, and Store each call it
+		// makes into the paste store. ColdStore bounds a request to an
+		// S3 cold store. Routes overrides Read, Write and Handler by path
+		// prefix. 0 means no limit. See deadline.go.
+		ReadHeader ConfigDuration           `yaml:"read_header"`
+		Read       ConfigDuration           `yaml:"read"`
+		Write      ConfigDuration           `yaml:"write"`
+		Idle       ConfigDuration           `yaml:"idle"`
+		Handler    ConfigDuration           `yaml:"handler"`
+		Store      ConfigDuration           `yaml:"store"`
+		ColdStore  ConfigDuration           `yaml:"cold_store"`
+		Routes     map[string]RouteTimeouts `yaml:"routes"`
+	} `yaml:"timeouts"`
+
+	Limits struct {
+		// Maximum request body sizes, in bytes, for web forms, API and
+		// federation requests, and replication pushes (which carry whole
+		// pastes). 0 means no limit.
+		Form   int64 `yaml:"form"`
+		API    int64 `yaml:"api"`
+		Upload int64 `yaml:"upload"`
+	} `yaml:"limits"`
+
+	Bandwidth struct {
+		// Paste and IP are how many bytes of raw bodies a paste, and a
+		// source address, may be sent within Window; 0 means no limit.
+		// Past them, downloads are throttled to ThrottleRate bytes a
+		// second, or, if Action is "block", refused.
+		Window       ConfigDuration `yaml:"window"`
+		Paste        int64          `yaml:"paste"`
+		IP           int64          `yaml:"ip"`
+		Action       string         `yaml:"action"`
+		ThrottleRate int64          `yaml:"throttle_rate"`
+	} `yaml:"bandwidth"`
+
+	Hotlink struct {
+		// Action is what raw bodies requested from other sites' pages
+		// get: HotlinkAllow, HotlinkInterstitial, HotlinkThrottle or
+		// HotlinkBlock. Rules give referring domains actions of their
+		// own; AllowedDomains are always allowed.
+		Action         string        `yaml:"action"`
+		AllowedDomains []string      `yaml:"allowed_domains"`
+		Rules          []HotlinkRule `yaml:"rules"`
+		ThrottleRate   int64         `yaml:"throttle_rate"`
+	} `yaml:"hotlink"`
+
+	API struct {
+		// IdempotencyWindow is how long an Idempotency-Key is remembered.
+		IdempotencyWindow ConfigDuration `yaml:"idempotency_window"`
+		// RateLimit is how many API requests an account, or an address,
+		// may make within RateWindow; 0 means no limit. See ratelimit.go.
+		RateLimit  int            `yaml:"rate_limit"`
+		RateWindow ConfigDuration `yaml:"rate_window"`
+	} `yaml:"api"`
+
+	Render struct {
+		// Pastes larger than MaxInput bytes, with a line longer than
+		// MaxLineLength, or with Markdown nested deeper than MaxNesting are
+		// shown as plain text (the first MaxInput bytes of it). So are
+		// pastes whose formatter takes longer than Timeout or produces
+		// more than MaxOutput bytes.
+		MaxInput      int64          `yaml:"max_input"`
+		MaxLineLength int            `yaml:"max_line_length"`
+		MaxNesting    int            `yaml:"max_nesting"`
+		MaxOutput     int            `yaml:"max_output"`
+		Timeout       ConfigDuration `yaml:"timeout"`
+		// Pastes of more than FoldLines lines show their first
+		// ChunkLines, and fetch the rest a chunk at a time; 0 never
+		// folds.
+		FoldLines  int `yaml:"fold_lines"`
+		ChunkLines int `yaml:"chunk_lines"`
+	} `yaml:"render"`
+
+	Format struct {
+		// MaxSize is the largest paste, in bytes, that is formatted on
+		// demand; 0 disables formatting. See format.go.
+		MaxSize int64 `yaml:"max_size"`
+	} `yaml:"format"`
+
+	Validation struct {
+		// Languages are the IDs of the languages (of json, yaml and xml)
+		// whose pastes are checked for syntax errors; see validate.go.
+		Languages []string `yaml:"languages"`
+		// Pastes larger than MaxSize bytes aren't checked, nor are those
+		// whose check takes longer than Timeout.
+		MaxSize int64          `yaml:"max_size"`
+		Timeout ConfigDuration `yaml:"timeout"`
+	} `yaml:"validation"`
+
+	Accessibility struct {
+		// HighContrast shows every visitor the high-contrast theme, not
+		// only those whose browsers ask for more contrast.
+		HighContrast bool `yaml:"high_contrast"`
+		// Audit outlines controls and images without accessible names,
+		// and logs them to the browser console.
+		Audit bool `yaml:"audit"`
+	} `yaml:"accessibility"`
+
+	Store struct {
+		// Replicas are read-only copies of the paste directory (for example,
+		// network mounts of a mirror) among which paste reads are spread.
+		Replicas []string `yaml:"replicas"`
+		// ReplicaStaleness is how long after a write a paste is read from
+		// the primary instead, to cover replication lag.
+		ReplicaStaleness ConfigDuration `yaml:"replica_staleness"`
+	} `yaml:"store"`
+
+	Archive struct {
+		// After is how long a paste must go unread and unmodified before
+		// its body is moved to cold storage; 0 disables archival.
+		After    ConfigDuration `yaml:"after"`
+		Interval ConfigDuration `yaml:"interval"`
+		// Prefix is prepended to paste IDs to form cold storage keys.
+		Prefix string `yaml:"prefix"`
+		// Directory, if set, is the cold store. Otherwise S3 is used.
+		Directory string `yaml:"directory"`
+		S3        struct {
+			Endpoint  string `yaml:"endpoint"`
+			Region    string `yaml:"region"`
+			Bucket    string `yaml:"bucket"`
+			AccessKey string `yaml:"access_key"`
+			SecretKey string `yaml:"secret_key"`
+		} `yaml:"s3"`
+	} `yaml:"archive"`
+
+	Pack struct {
+		// MaxSize is the largest body that is packed; 0 disables packing.
+		MaxSize int64 `yaml:"max_size"`
+		// After is how long a paste must go unmodified before it is packed.
+		After    ConfigDuration `yaml:"after"`
+		Interval ConfigDuration `yaml:"interval"`
+		// PackSize is how large a pack file may grow.
+		PackSize int64 `yaml:"pack_size"`
+		// CompactBelow is the percentage of a pack still in use below which
+		// it is compacted.
+		CompactBelow int `yaml:"compact_below"`
+	} `yaml:"pack"`
+
+	Pins struct {
+		// MaxPerAccount is how many pastes an account may pin; 0 disables
+		// pinning.
+		MaxPerAccount int `yaml:"max_per_account"`
+	} `yaml:"pins"`
+
+	Push struct {
+		// Peers are the instances pastes may be pushed to; see push.go.
+		Peers []PushPeer `yaml:"peers"`
+	} `yaml:"push"`
+
+	Upload struct {
+		// Direct lets API clients upload pastes straight to the S3 bucket
+		// configured under archive.s3, up to MaxSize bytes.
+		Direct  bool  `yaml:"direct"`
+		MaxSize int64 `yaml:"max_size"`
+		// URLExpiry is how long pre-signed upload and download URLs last.
+		URLExpiry ConfigDuration `yaml:"url_expiry"`
+	} `yaml:"upload"`
+
+	SCIM struct {
+		// Token authenticates identity providers; empty disables SCIM.
+		Token string `yaml:"token"`
+		// GroupPermissions maps SCIM group display names to the
+		// permissions ("admin") their members have.
+		GroupPermissions map[string][]string `yaml:"group_permissions"`
+	} `yaml:"scim"`
+
+	Replication struct {
+		// Role is "primary", "secondary", or empty to disable replication.
+		Role string `yaml:"role"`
+		// Token authenticates replication requests in both directions.
+		Token string `yaml:"token"`
+		// JournalSize is how many changes the primary remembers for
+		// secondaries that pull.
+		JournalSize int `yaml:"journal_size"`
+		// PushTo lists secondaries to which the primary posts changes.
+		PushTo []string `yaml:"push_to"`
+		// Primary is the URL from which a secondary pulls changes.
+		Primary      string         `yaml:"primary"`
+		PollInterval ConfigDuration `yaml:"poll_interval"`
+		// Conflict is "newest" or "primary"; see ReplicationConflictNewest.
+		Conflict string `yaml:"conflict"`
+	} `yaml:"replication"`
+
+	Changes struct {
+		// Enabled journals paste changes for /api/v1/changes; see
+		// changes.go.
+		Enabled     bool `yaml:"enabled"`
+		JournalSize int  `yaml:"journal_size"`
+		// Tokens are the bearer tokens that may read the feed, besides
+		// admins.
+		Tokens []string `yaml:"tokens"`
+	} `yaml:"changes"`
+
+	ActivityPub struct {
+		// Enabled lets users publish their unencrypted pastes to the
+		// Fediverse. BaseURL, the instance's public URL, is required.
+		Enabled bool   `yaml:"enabled"`
+		BaseURL string `yaml:"base_url"`
+	} `yaml:"activitypub"`
+
+	GC struct {
+		// Interval between orphan sweeps; 0 disables the background sweep.
+		Interval ConfigDuration `yaml:"interval"`
+		// Clean controls whether orphans are removed or merely reported.
+		Clean bool `yaml:"clean"`
+	} `yaml:"gc"`
+
+	Interlinks struct {
+		// IndexInterval is how often the backlinks index is rebuilt from
+		// scratch; 0 leaves it to be kept up to date as pastes change.
+		IndexInterval ConfigDuration `yaml:"index_interval"`
+	} `yaml:"interlinks"`
+
+	// Features maps feature flags to their rollouts: "on", "off" or a
+	// percentage of accounts ("25%"). See /admin/features.
+	Features map[string]string `yaml:"features"`
+
+	Jobs struct {
+		// Workers is how many jobs may run at once.
+		Workers int `yaml:"workers"`
+		// Retries is how many more times a failed job is tried, waiting
+		// RetryBackoff before the first retry and twice as long before
+		// each one after (up to an hour).
+		Retries      int            `yaml:"retries"`
+		RetryBackoff ConfigDuration `yaml:"retry_backoff"`
+		// History is how many finished runs to list at /admin/jobs.
+		History int `yaml:"history"`
+	} `yaml:"jobs"`
+
+	Notifications struct {
+		// BaseURL, the instance's public URL, is used to link to pastes.
+		BaseURL string `yaml:"base_url"`
+		// Channels are sent the events they want.
+		Channels []*NotificationChannel `yaml:"channels"`
+		// AllowedHosts are the hosts accounts' channels may post to; any,
+		// if empty.
+		AllowedHosts []string `yaml:"allowed_hosts"`
+	} `yaml:"notifications"`
+
+	Domains struct {
+		// Enabled lets accounts serve their pastes on domains of their
+		// own; see domains.go. It has no effect on private instances.
+		Enabled bool `yaml:"enabled"`
+		// Target is the host custom domains are to be pointed at.
+		Target string `yaml:"target"`
+		// BaseURL, the instance's public URL, is where requests to a
+		// custom domain that it doesn't serve are sent.
+		BaseURL string `yaml:"base_url"`
+		ACME    struct {
+			// Enabled has certificates issued for verified domains.
+			Enabled bool   `yaml:"enabled"`
+			Email   string `yaml:"email"`
+			// DirectoryURL is the CA's; Let's Encrypt's, if empty.
+			DirectoryURL string `yaml:"directory_url"`
+		} `yaml:"acme"`
+	} `yaml:"domains"`
+
+	Events struct {
+		// AuditLog, if set, is the file (relative to the data directory)
+		// to which every event is appended, as a line of JSON.
+		AuditLog string `yaml:"audit_log"`
+		// Webhooks are sent the events they want as JSON.
+		Webhooks []EventWebhook `yaml:"webhooks"`
+	} `yaml:"events"`
+
+	Errors struct {
+		// SentryDSN, if set, sends recovered panics to Sentry (or anything
+		// speaking its store API).
+		SentryDSN string `yaml:"sentry_dsn"`
+		// Webhook, if set, is sent each recovered panic as JSON.
+		Webhook string `yaml:"webhook"`
+	} `yaml:"errors"`
+}
+
+var instanceConfig _Configuration
+
+func defaultConfiguration() _Configuration {
+	c := _Configuration{}
+	c.Registration.Mode = RegistrationInvite
+	c.Registration.InviteLifetime = ConfigDuration(7 * 24 * time.Hour)
+	c.ProofOfWork.Difficulty = 20
+	c.ProofOfWork.Lifetime = ConfigDuration(5 * time.Minute)
+	c.Abuse.BurstCount = 10
+	c.Abuse.BurstWindow = ConfigDuration(10 * time.Minute)
+	c.Abuse.CardNumbers = 5
+	c.Abuse.BlockDuration = ConfigDuration(1 * time.Hour)
+	c.Abuse.HoneypotField = "website"
+	c.Abuse.TrapPaths = []string{"/wp-login.php", "/xmlrpc.php", "/.env"}
+	c.Abuse.CrawlerTrap = "/lemon/"
+	c.Reputation.Timeout = ConfigDuration(2 * time.Second)
+	c.Reputation.Cache = ConfigDuration(1 * time.Hour)
+	c.Reputation.SuspectScore = 0.5
+	c.Reputation.BlockScore = 0.9
+	c.Reputation.PowPenalty = 4
+	c.Tombstones.Expired = ConfigDuration(7 * 24 * time.Hour)
+	c.Expiration.Presets = []ExpirationPreset{
+		{Value: "10m", Label: "Ten Minutes"},
+		{Value: "1h", Label: "an Hour"},
+		{Value: "1d", Label: "a Day"},
+		{Value: "2d", Label: "two Days"},
+	}
+	c.API.IdempotencyWindow = ConfigDuration(24 * time.Hour)
+	c.API.RateWindow = ConfigDuration(10 * time.Minute)
+	c.Bandwidth.Window = ConfigDuration(time.Hour)
+	c.Bandwidth.Action = BandwidthActionThrottle
+	c.Bandwidth.ThrottleRate = 64 * 1024
+	c.Hotlink.Action = HotlinkAllow
+	c.Hotlink.ThrottleRate = 16 * 1024
+	c.Expiration.Never = true
+	c.Expiration.Default = "-1"
+	c.Trash.Deleted = ConfigDuration(1 * time.Minute)
+	c.AccessLog.Retention = ConfigDuration(7 * 24 * time.Hour)
+	c.AccessLog.MaxEvents = 1000
+	c.Cache.Public = CachePolicy{HTML: "public, max-age=300", Raw: "public, max-age=3600", Surrogate: "max-age=86400"}
+	c.Cache.Unlisted = CachePolicy{HTML: "public, max-age=60", Raw: "public, max-age=300", Surrogate: "max-age=3600"}
+	c.Cache.Private = CachePolicy{HTML: "private, no-store", Raw: "private, no-store", Surrogate: "no-store"}
+	c.HTTP.TrustRequestID = true
+	c.HTTP.TrustedProxies = []string{"127.0.0.1", "::1"}
+	c.Stats.Interval = ConfigDuration(6 * time.Hour)
+	c.Stats.MaxAge = ConfigDuration(5 * time.Minute)
+	c.LookupCache.Accounts = ConfigDuration(30 * time.Second)
+	c.LookupCache.Sessions = ConfigDuration(10 * time.Second)
+	c.RawHost.Expiry = ConfigDuration(1 * time.Hour)
+	c.RawHost.MaxSignedExpiry = ConfigDuration(7 * 24 * time.Hour)
+	c.Shortener.CodeLength = 6
+	c.Links.Autolink = LinksAll
+	c.Privacy.IPMode = IPModeFull
+	c.Privacy.IPv4Prefix = 24
+	c.Privacy.IPv6Prefix = 48
+	c.Privacy.HashRotation = ConfigDuration(24 * time.Hour)
+	c.Privacy.SweepInterval = ConfigDuration(1 * time.Hour)
+	c.Privacy.Analytics = true
+	c.Timeouts.ReadHeader = ConfigDuration(10 * time.Second)
+	c.Timeouts.Read = ConfigDuration(5 * time.Minute)
+	c.Timeouts.Write = ConfigDuration(5 * time.Minute)
+	c.Timeouts.Idle = ConfigDuration(2 * time.Minute)
+	c.Timeouts.Handler = ConfigDuration(1 * time.Minute)
+	c.Timeouts.Store = ConfigDuration(15 * time.Second)
+	c.Timeouts.ColdStore = ConfigDuration(5 * time.Minute)
+	unlimited := ConfigDuration(0)
+	c.Timeouts.Routes = map[string]RouteTimeouts{
+		"/api/v1/changes": {Read: &unlimited, Write: &unlimited, Handler: &unlimited},
+	}
+	c.Limits.Form = 2 << 20
+	c.Limits.API = 2 << 20
+	c.Limits.Upload = 64 << 20
+	c.Render.MaxInput = 1 << 20
+	c.Render.MaxLineLength = 16384
+	c.Render.MaxNesting = 100
+	c.Render.MaxOutput = 16 << 20
+	c.Render.Timeout = ConfigDuration(2 * time.Second)
+	c.Render.FoldLines = 5000
+	c.Render.ChunkLines = 2000
+	c.Validation.Languages = []string{"json", "yaml", "xml"}
+	c.Validation.MaxSize = 1 << 20
+	c.Validation.Timeout = ConfigDuration(2 * time.Second)
+	c.Format.MaxSize = 1 << 20
+	c.Store.ReplicaStaleness = ConfigDuration(1 * time.Minute)
+	c.Archive.Interval = ConfigDuration(1 * time.Hour)
+	c.Archive.Prefix = "pastes/"
+	c.Pack.After = ConfigDuration(1 * time.Hour)
+	c.Pack.Interval = ConfigDuration(1 * time.Hour)
+	c.Pack.PackSize = 64 << 20
+	c.Pack.CompactBelow = 50
+	c.Pins.MaxPerAccount = 10
+	c.Archive.S3.Region = "us-east-1"
+	c.Upload.MaxSize = 1 << 30
+	c.Upload.URLExpiry = ConfigDuration(1 * time.Hour)
+	c.Replication.JournalSize = 10000
+	c.Changes.JournalSize = 10000
+	c.Replication.PollInterval = ConfigDuration(10 * time.Second)
+	c.Replication.Conflict = ReplicationConflictNewest
+	c.GC.Interval = ConfigDuration(6 * time.Hour)
+	c.Interlinks.IndexInterval = ConfigDuration(24 * time.Hour)
+	c.Jobs.Workers = 2
+	c.Jobs.Retries = 3
+	c.Jobs.RetryBackoff = ConfigDuration(1 * time.Minute)
+	c.Jobs.History = 50
+	return c
+}
+
+// configurationError is why config.yml was last refused, if it was; the
+// configuration in effect is then the one before it.
+var configurationError error
+
+func loadConfiguration() {
+	c := defaultConfiguration()
+	err := YAMLUnmarshalFile("config.yml", &c)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	for _, validate := range []func(*_Configuration) error{
+		validateExpirationConfig,
+		validateRetentionConfig,
+		validateBandwidthConfig,
+		validateHotlinkConfig,
+		validateNetworksConfig,
+		validateProxiesConfig,
+		validatePushConfig,
+		validateValidationConfig,
+		validateTimeoutsConfig,
+		validateRenderConfig,
+		validateAPIRateConfig,
+		validateShortenerConfig,
+		validateBrandingConfig,
+		validateDefaultsConfig,
+		validateFeaturesConfig,
+	} {
+		if err == nil {
+			err = validate(&c)
+		}
+	}
+	if err != nil {
+		glog.Error("Failed to load config.yml: ", err)
+		configurationError = err
+		return
+	}
+	instanceConfig = c
+	configurationError = nil
+	glog.Info("Loaded configuration.")
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+
+	// Load eagerly; the stores built in main's init consult the configuration.
+	loadConfiguration()
+	RegisterReloadFunction(loadConfiguration)
+}
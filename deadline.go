@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Requests don't wait forever on a stuck backend or a stalled client. A
+// connection has as long as timeouts.read_header and timeouts.read to send
+// a request, and timeouts.idle to send the next; a response has as long as
+// timeouts.write to be written. The work for a request is bounded by
+// timeouts.handler: each call into a paste store (and from the expirator)
+// is bounded by the request's context and by timeouts.store, and answered
+// with a 504 when either runs out; highlighting is bounded the same way by
+// render.timeout, and falls back to plain text. timeouts.routes overrides
+// read, write and handler for the paths under a prefix, such as the change
+// stream, which stays open for as long as its client wants.
+//
+// net/http can only bound a whole server's writes, so spectre sets the
+// connection's deadlines itself, for each request, and only for HTTP/1.x:
+// an HTTP/2 connection carries many requests at once.
+//
+// A store call can't be taken back once it has started (a read from a hung
+// NFS mount won't return for anyone), so a call that runs out is left to
+// finish on its own. Each stage admits only so many calls at once, so that
+// when its backend hangs, requests give up at their deadlines instead of
+// piling up behind it.
+
+// maxStoreCalls is how many store calls may be under way at once.
+const maxStoreCalls = 256
+
+// DeadlineExceededError is returned when a stage of a request runs out of
+// time.
+type DeadlineExceededError struct {
+	Stage string
+}
+
+func (e DeadlineExceededError) Error() string {
+	return fmt.Sprintf("The %s took too long to answer. Try again in a moment.", e.Stage)
+}
+
+func (e DeadlineExceededError) StatusCode() int {
+	return http.StatusGatewayTimeout
+}
+
+func (e DeadlineExceededError) APIErrorCode() string {
+	return APIErrorTimeout
+}
+
+type deadlineStage struct {
+	Name    string
+	timeout func() time.Duration
+
+	calls chan struct{}
+}
+
+// storeStage bounds a call into a paste store, including rehydrating a body
+// from cold storage.
+var storeStage = &deadlineStage{
+	Name:    "store",
+	timeout: func() time.Duration { return instanceConfig.Timeouts.Store.Duration() },
+	calls:   make(chan struct{}, maxStoreCalls),
+}
+
+// Do calls fn, giving up when ctx is done or the stage's timeout passes;
+// fn is given the context it was cut short by, to clean up after itself.
+// A panic in fn is returned as its error.
+func (s *deadlineStage) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if timeout := s.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	select {
+	case s.calls <- struct{}{}:
+	case <-ctx.Done():
+		healthServer.IncrementMetric("deadline." + s.Name + ".saturated")
+		return DeadlineExceededError{Stage: s.Name}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-s.calls }()
+		defer func() {
+			if rec := recover(); rec != nil {
+				if err, ok := rec.(error); ok {
+					done <- err
+				} else {
+					done <- fmt.Errorf("%v", rec)
+				}
+			}
+		}()
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || err != ctx.Err() {
+			return err
+		}
+	case <-ctx.Done():
+	}
+	healthServer.IncrementMetric("deadline." + s.Name + ".exceeded")
+	return DeadlineExceededError{Stage: s.Name}
+}
+
+// getPaste is pasteStore.Get, bounded by ctx.
+func getPaste(ctx context.Context, id PasteID, key []byte) (*Paste, error) {
+	var p *Paste
+	var getErr error
+	if err := storeStage.Do(ctx, func(context.Context) error {
+		p, getErr = pasteStore.Get(id, key)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return p, getErr
+}
+
+// newPaste is pasteStore.New, bounded by ctx.
+func newPaste(ctx context.Context, encrypted bool) (*Paste, error) {
+	var p *Paste
+	err := storeStage.Do(ctx, func(context.Context) (err error) {
+		p, err = pasteStore.New(encrypted)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// openPaste is p.Reader, bounded by ctx.
+func openPaste(ctx context.Context, p *Paste) (*PasteReader, error) {
+	var reader *PasteReader
+	err := storeStage.Do(ctx, func(ctx context.Context) (err error) {
+		reader, err = p.Reader()
+		if err == nil && ctx.Err() != nil {
+			// Nobody is waiting for it any more.
+			reader.Close()
+			return ctx.Err()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// destroyPaste is p.Destroy, bounded by ctx.
+func destroyPaste(ctx context.Context, p *Paste) error {
+	return storeStage.Do(ctx, func(context.Context) error {
+		return p.Destroy()
+	})
+}
+
+// savePasteInputContext is savePasteInput, bounded by ctx. It refuses to
+// change an immutable paste.
+func savePasteInputContext(ctx context.Context, p *Paste, in *PasteInput, newPaste bool) error {
+	if !newPaste {
+		if err := checkPasteMutable(p); err != nil {
+			return err
+		}
+	}
+	return storeStage.Do(ctx, func(context.Context) error {
+		savePasteInput(p, in, newPaste)
+		return nil
+	})
+}
+
+// RouteTimeouts overrides the timeouts for the paths under a prefix; what
+// it leaves out is the same as for every other request. 0 means no limit.
+type RouteTimeouts struct {
+	Read    *ConfigDuration `yaml:"read"`
+	Write   *ConfigDuration `yaml:"write"`
+	Handler *ConfigDuration `yaml:"handler"`
+}
+
+// requestTimeouts are the read, write and handler timeouts for path: those
+// of the longest prefix of it in timeouts.routes, or the defaults.
+func requestTimeouts(path string) (read, write, handler time.Duration) {
+	tc := instanceConfig.Timeouts
+	read, write, handler = tc.Read.Duration(), tc.Write.Duration(), tc.Handler.Duration()
+	longest := -1
+	var route RouteTimeouts
+	for prefix, rt := range tc.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			longest, route = len(prefix), rt
+		}
+	}
+	if route.Read != nil {
+		read = route.Read.Duration()
+	}
+	if route.Write != nil {
+		write = route.Write.Duration()
+	}
+	if route.Handler != nil {
+		handler = route.Handler.Duration()
+	}
+	return
+}
+
+type connContextKey struct{}
+
+// withConn is an http.Server's ConnContext, keeping each request's
+// connection where requestTimeoutHandler can find it.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// requestTimeoutHandler applies a request's timeouts.
+type requestTimeoutHandler struct {
+	http.Handler
+}
+
+func (h requestTimeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	read, write, handler := requestTimeouts(r.URL.Path)
+
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok && r.ProtoMajor == 1 {
+		// net/http leaves the write deadline alone, so it must be set
+		// (or cleared) for every request on the connection; the read
+		// deadline it has already set only needs changing for a route.
+		if write > 0 {
+			conn.SetWriteDeadline(start.Add(write))
+		} else {
+			conn.SetWriteDeadline(time.Time{})
+		}
+		if read != instanceConfig.Timeouts.Read.Duration() {
+			if read > 0 {
+				conn.SetReadDeadline(start.Add(read))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+		}
+	}
+
+	if handler > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), handler)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func validateTimeoutsConfig(c *_Configuration) error {
+	tc := c.Timeouts
+	for name, d := range map[string]ConfigDuration{
+		"read_header": tc.ReadHeader, "read": tc.Read, "write": tc.Write, "idle": tc.Idle,
+		"handler": tc.Handler, "store": tc.Store, "cold_store": tc.ColdStore,
+	} {
+		if d < 0 {
+			return fmt.Errorf("timeouts: %s can't be negative", name)
+		}
+	}
+	for prefix, rt := range tc.Routes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("timeouts: route %q isn't a path", prefix)
+		}
+		for _, d := range []*ConfigDuration{rt.Read, rt.Write, rt.Handler} {
+			if d != nil && *d < 0 {
+				return fmt.Errorf("timeouts: route %q has a negative timeout", prefix)
+			}
+		}
+	}
+	return nil
+}
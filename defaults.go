@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// The paste form starts out in defaults.language, for visitors who haven't
+// saved a language of their own (plain text, if it isn't set). Visitors
+// sent to it from particular domains (a CI system's, say) can be given a
+// language and an expiration of their own by defaults.referrers; these win
+// over what the visitor saved, as whoever links to the form from there
+// knows what will be pasted. Languages this instance doesn't know are
+// ignored.
+
+type ReferrerDefaults struct {
+	Domain     string `yaml:"domain"`
+	Language   string `yaml:"language"`
+	Expiration string `yaml:"expiration"`
+}
+
+// knownLanguageID returns the ID of the language named name, or "".
+func knownLanguageID(name string) string {
+	if name == "" {
+		return ""
+	}
+	if lang := LanguageNamed(name); lang != unknownLanguage {
+		return lang.ID
+	}
+	return ""
+}
+
+// referrerDefaults returns the defaults for the paste form for r, going by
+// its Referer, or nil.
+func referrerDefaults(r *http.Request) *ReferrerDefaults {
+	if r == nil || len(instanceConfig.Defaults.Referrers) == 0 {
+		return nil
+	}
+	referrer, err := url.Parse(r.Referer())
+	if err != nil || referrer.Host == "" {
+		return nil
+	}
+	host := referrer.Hostname()
+	for _, rule := range instanceConfig.Defaults.Referrers {
+		if hostInDomains(host, []string{rule.Domain}) {
+			d := rule
+			d.Language = knownLanguageID(d.Language)
+			healthServer.IncrementMetric("defaults.referrer")
+			return &d
+		}
+	}
+	return nil
+}
+
+func validateDefaultsConfig(c *_Configuration) error {
+	for _, rule := range c.Defaults.Referrers {
+		if rule.Domain == "" {
+			return fmt.Errorf("defaults.referrers: every rule needs a domain")
+		}
+		if rule.Expiration != "" {
+			if _, err := matchExpiration(c, rule.Expiration); err != nil {
+				return fmt.Errorf("defaults.referrers: %s: expiration %v", rule.Domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterTemplateFunction("languageDefault", func() string { return knownLanguageID(instanceConfig.Defaults.Language) })
+	RegisterTemplateFunction("referrerDefaults", func(ri *RenderContext) *ReferrerDefaults { return referrerDefaults(ri.Request) })
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Every paste's body has a SHA-256 digest, kept in its metadata, which
+// gives the paste an identity that doesn't depend on its ID: tombstones
+// record it, and so can deduplication. Clients can check what they
+// downloaded against the Digest and Repr-Digest headers on raw bodies, the
+// sha256 in a paste's JSON, or /api/v1/pastes/<id>/digest, which also says
+// whether the paste is immutable (see immutable.go), and so whether the
+// digest will always hold.
+//
+// The stored digest of an encrypted paste is that of its ciphertext, which
+// gives nothing away; what clients are told is the digest of the body they
+// are given, which is worked out anew for each request.
+
+// pasteDigest returns the hex SHA-256 of p's body as it is served.
+func pasteDigest(p *Paste) (string, error) {
+	if !p.Encrypted {
+		return filesystemPasteStore.bodyDigest(p.ID)
+	}
+	reader, err := p.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// setDigestHeaders sets the Digest (RFC 3230) and Repr-Digest (RFC 9530)
+// headers for a response carrying p's body and nothing else.
+func setDigestHeaders(w http.ResponseWriter, p *Paste) {
+	digest, err := pasteDigest(p)
+	if err != nil {
+		return
+	}
+	sum, _ := hex.DecodeString(digest)
+	encoded := base64.StdEncoding.EncodeToString(sum)
+	w.Header().Set("Digest", "SHA-256="+encoded)
+	w.Header().Set("Repr-Digest", "sha-256=:"+encoded+":")
+}
+
+// apiPasteDigestHandler answers with the digest of a paste's body, and,
+// given the form value sha256, whether it matches.
+func apiPasteDigestHandler(w http.ResponseWriter, r *http.Request) {
+	o, err := lookupPasteWithRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p := o.(*Paste)
+	if err := checkSeal(p, r); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	digest, err := pasteDigest(p)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"id":        p.ID,
+		"algorithm": "sha-256",
+		"sha256":    digest,
+		"immutable": p.immutable,
+	}
+	if want := r.FormValue("sha256"); want != "" {
+		want = strings.ToLower(want)
+		if _, err := hex.DecodeString(want); err != nil || len(want) != sha256.Size*2 {
+			writeAPIError(w, apiError(APIErrorValidation, "sha256 must be %d hexadecimal digits", sha256.Size*2).With("field", "sha256"))
+			return
+		}
+		response["matches"] = want == digest
+	}
+	writeAPIResponse(w, http.StatusOK, response)
+}
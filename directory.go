@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+)
+
+// An instance can announce itself at /.well-known/spectre: what it is
+// called, the API version it speaks, the policies a client should know
+// about before sending it anything, the other instances it knows of, and
+// where its stats are (see stats.go), if it publishes them.
+// Clients use announcements to choose (or discover) an instance to paste
+// to. Instances announce nothing unless directory.announce is set.
+
+const APIVersion = "v1"
+
+type InstanceAnnouncement struct {
+	Name        string           `json:"name"`
+	URL         string           `json:"url,omitempty"`
+	Description string           `json:"description,omitempty"`
+	APIVersion  string           `json:"api_version"`
+	Policies    InstancePolicies `json:"policies"`
+	Peers       []string         `json:"peers"`
+	// Stats is the URL of the instance's stats, if it publishes them.
+	Stats string `json:"stats,omitempty"`
+}
+
+type InstancePolicies struct {
+	Private       bool   `json:"private"`
+	Registration  string `json:"registration"`
+	MaxPasteSize  int64  `json:"max_paste_size"`
+	MaxUploadSize int64  `json:"max_upload_size,omitempty"`
+	ProofOfWork   bool   `json:"proof_of_work"`
+	Encryption    bool   `json:"encryption"`
+}
+
+func announcementForRequest(r *http.Request) *InstanceAnnouncement {
+	peers := instanceConfig.Directory.Peers
+	if peers == nil {
+		peers = []string{}
+	}
+	a := &InstanceAnnouncement{
+		Name:        brandingFor(r).Name,
+		URL:         BaseURLForRequest(r).String(),
+		Description: instanceConfig.Directory.Description,
+		APIVersion:  APIVersion,
+		Policies: InstancePolicies{
+			Private:      instanceConfig.Instance.Private,
+			Registration: instanceConfig.Registration.Mode,
+			MaxPasteSize: int64(PASTE_MAXIMUM_LENGTH),
+			ProofOfWork:  instanceConfig.ProofOfWork.Enabled,
+			// Only the web form encrypts, and only over HTTPS.
+			Encryption: Env() == EnvironmentDevelopment || RequestIsHTTPS(r),
+		},
+		Peers: peers,
+	}
+	if instanceConfig.Stats.Enabled {
+		u := BaseURLForRequest(r)
+		u.Path = "/api/v1/stats"
+		a.Stats = u.String()
+	}
+	if _, ok := filesystemPasteStore.ColdStore.(PresigningColdStore); ok && instanceConfig.Upload.Direct {
+		a.Policies.MaxUploadSize = instanceConfig.Upload.MaxSize
+	}
+	return a
+}
+
+func instanceAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	if !instanceConfig.Directory.Announce {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeAPIResponse(w, http.StatusOK, announcementForRequest(r))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// `spectre doctor` checks, end to end, that the instance can do what it is
+// configured to: every preflight check, and then what the preflight checks
+// leave to the first request that needs it (paste metadata, the cache
+// policies, each host it posts to, ACME issuance, the certificate's
+// lifetime, push peers and the replication primary). It prints a line for
+// each, and exits non-zero if any failed. It writes nothing but scratch
+// files, which it removes, and posts nothing: hosts are only connected to.
+
+const doctorTimeout = 10 * time.Second
+
+// doctorSkip is a check that doesn't apply to this instance.
+type doctorSkip string
+
+func (s doctorSkip) Error() string { return string(s) }
+
+// doctorWarning is a check that passed, with something to look at.
+type doctorWarning string
+
+func (w doctorWarning) Error() string { return string(w) }
+
+type doctorCheck struct {
+	Name string
+	fn   func() error
+}
+
+func doctorChecks() []doctorCheck {
+	var checks []doctorCheck
+	for _, check := range preflightChecks {
+		check := check
+		checks = append(checks, doctorCheck{check.Name, func() error { return runPreflightCheck(check) }})
+	}
+	return append(checks,
+		doctorCheck{"paste metadata", doctorPasteMetadata},
+		doctorCheck{"packs", doctorPacks},
+		doctorCheck{"cache policies", doctorCachePolicies},
+		doctorCheck{"mail", func() error {
+			return doctorSkip("spectre sends no mail; alerts and notifications go to webhooks")
+		}},
+		doctorCheck{"webhooks", doctorWebhooks},
+		doctorCheck{"acme", doctorACME},
+		doctorCheck{"certificate", doctorCertificate},
+		doctorCheck{"push peers", doctorPushPeers},
+		doctorCheck{"replication", doctorReplication},
+	)
+}
+
+// doctorPasteMetadata makes sure the paste directory's filesystem keeps
+// extended attributes, in which paste metadata lives.
+func doctorPasteMetadata() error {
+	file, err := ioutil.TempFile(filepath.Join(arguments.root, "pastes"), ".doctor-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err := putMetadata(file.Name(), "doctor", "ok"); err != nil {
+		return fmt.Errorf("can't set extended attributes in %s (mount it with user_xattr): %v", filepath.Dir(file.Name()), err)
+	}
+	if v := getMetadata(file.Name(), "doctor", ""); v != "ok" {
+		return fmt.Errorf("extended attributes in %s don't read back", filepath.Dir(file.Name()))
+	}
+	return nil
+}
+
+func doctorPacks() error {
+	if instanceConfig.Pack.MaxSize <= 0 {
+		return doctorSkip("packing is off (pack.max_size)")
+	}
+	dir := filepath.Join(arguments.root, "packs")
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return checkWritable(arguments.root)
+	}
+	return checkWritable(dir)
+}
+
+// cacheDirectives are the Cache-Control and Surrogate-Control directives a
+// cache policy may use, and whether they take a number of seconds.
+var cacheDirectives = map[string]bool{
+	"public": false, "private": false, "no-cache": false, "no-store": false,
+	"no-transform": false, "must-revalidate": false, "proxy-revalidate": false,
+	"immutable": false, "max-age": true, "s-maxage": true,
+	"stale-while-revalidate": true, "stale-if-error": true,
+}
+
+func doctorCachePolicies() error {
+	policies := map[string]CachePolicy{
+		VisibilityPublic:   instanceConfig.Cache.Public,
+		VisibilityUnlisted: instanceConfig.Cache.Unlisted,
+		VisibilityPrivate:  instanceConfig.Cache.Private,
+	}
+	var problems []string
+	for visibility, policy := range policies {
+		for kind, value := range map[string]string{"html": policy.HTML, "raw": policy.Raw, "surrogate": policy.Surrogate} {
+			for _, directive := range strings.Split(value, ",") {
+				directive = strings.TrimSpace(directive)
+				if directive == "" {
+					continue
+				}
+				name, arg := directive, ""
+				if i := strings.IndexByte(directive, '='); i >= 0 {
+					name, arg = directive[:i], directive[i+1:]
+				}
+				seconds, known := cacheDirectives[strings.ToLower(name)]
+				if _, err := strconv.Atoi(arg); !known || seconds != (arg != "") || (seconds && err != nil) {
+					problems = append(problems, fmt.Sprintf("cache.%s.%s: %q", visibility, kind, directive))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("directives caches won't understand: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// doctorDial connects to rawurl's host.
+func doctorDial(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%q isn't a URL", rawurl)
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), doctorTimeout)
+	if err != nil {
+		return fmt.Errorf("%s: %v", u.Host, err)
+	}
+	return conn.Close()
+}
+
+func doctorWebhooks() error {
+	var hooks []string
+	hooks = append(hooks, instanceConfig.Moderation.Webhook, instanceConfig.Errors.Webhook)
+	for _, hook := range instanceConfig.Events.Webhooks {
+		hooks = append(hooks, hook.URL)
+	}
+	for _, channel := range instanceConfig.Notifications.Channels {
+		hooks = append(hooks, channel.URL)
+	}
+	checked := 0
+	var failed []string
+	for _, hook := range hooks {
+		if hook == "" {
+			continue
+		}
+		checked++
+		if err := doctorDial(hook); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if checked == 0 {
+		return doctorSkip("none configured")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("can't reach %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func doctorACME() error {
+	ac := instanceConfig.Domains.ACME
+	if !customDomainsEnabled() || !ac.Enabled {
+		return doctorSkip("custom domain certificates are off (domains.acme.enabled)")
+	}
+	if instanceConfig.Domains.Target == "" {
+		return fmt.Errorf("domains.target is empty; accounts won't know where to point their domains")
+	}
+	if err := checkWritable(arguments.root); err != nil {
+		return fmt.Errorf("certificates can't be cached: %v", err)
+	}
+	directory := ac.DirectoryURL
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+	}
+	client := &http.Client{Timeout: doctorTimeout}
+	resp, err := client.Get(directory)
+	if err != nil {
+		return fmt.Errorf("can't reach the CA: %v", err)
+	}
+	defer resp.Body.Close()
+	var dir struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&dir) != nil || dir.NewAccount == "" {
+		return fmt.Errorf("%s isn't an ACME directory (%s)", directory, resp.Status)
+	}
+	if ac.Email == "" {
+		return doctorWarning("domains.acme.email is empty; the CA can't warn of expiring certificates")
+	}
+	return nil
+}
+
+func doctorCertificate() error {
+	hc := instanceConfig.HTTP
+	if hc.TLSCert == "" {
+		return doctorSkip("no certificate is configured (http.tls_cert)")
+	}
+	pair, err := tls.LoadX509KeyPair(hc.TLSCert, hc.TLSKey)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		return fmt.Errorf("expired on %s", leaf.NotAfter.UTC().Format("2006-01-02"))
+	case left < 14*24*time.Hour:
+		return doctorWarning(fmt.Sprintf("expires on %s", leaf.NotAfter.UTC().Format("2006-01-02")))
+	}
+	return nil
+}
+
+func doctorPushPeers() error {
+	if len(instanceConfig.Push.Peers) == 0 {
+		return doctorSkip("none configured")
+	}
+	var failed []string
+	for i := range instanceConfig.Push.Peers {
+		peer := &instanceConfig.Push.Peers[i]
+		req, err := http.NewRequest("GET", strings.TrimRight(peer.URL, "/")+"/api/v1/expirations", nil)
+		if err == nil {
+			var v interface{}
+			err = peerRequest(peer, req, &v)
+		}
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func doctorReplication() error {
+	rc := instanceConfig.Replication
+	switch rc.Role {
+	case "":
+		return doctorSkip("this instance doesn't replicate")
+	case "secondary":
+		if rc.Primary == "" {
+			return nil
+		}
+		return doctorDial(rc.Primary)
+	}
+	var failed []string
+	for _, secondary := range rc.PushTo {
+		if err := doctorDial(secondary); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("can't reach %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func runDoctor(args []string) error {
+	failed := 0
+	for _, check := range doctorChecks() {
+		start := time.Now()
+		err := check.fn()
+		status, detail := "ok", ""
+		switch err := err.(type) {
+		case nil:
+		case doctorSkip:
+			status, detail = "skip", err.Error()
+		case doctorWarning:
+			status, detail = "warn", err.Error()
+		default:
+			status, detail = "FAIL", err.Error()
+			failed++
+		}
+		line := fmt.Sprintf("%-4s  %-16s %6v", status, check.Name, time.Since(start).Round(time.Millisecond))
+		if detail != "" {
+			line += "  " + detail
+		}
+		fmt.Println(line)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+func init() {
+	RegisterCommand("doctor", "check the stores, cache policies, webhooks, ACME and peers end to end, and report", runDoctor)
+}
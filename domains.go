@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DHowett/ghostbin/account"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Accounts can serve their pastes on a domain of their own (domains.enabled):
+// they add it on their session page, point it at the instance
+// (domains.target) and prove it is theirs with a TXT record at
+// _spectre.<domain> carrying the token they were given. Once verified, the
+// domain's front page lists the account's public pastes, and the pastes it
+// can edit are served at /paste/<id> as they are on the instance. Anything
+// else asked of the domain (logging in, the API, other accounts' pastes) is
+// sent to the instance's own URL (domains.base_url), so that no session is
+// ever set up on a domain the instance doesn't control. Encrypted pastes,
+// whose keys live in the instance's cookies, aren't served there.
+//
+// With domains.acme.enabled, certificates for verified domains are issued
+// (and renewed) over ACME, answering the CA's TLS-ALPN challenge on -addr,
+// which must then be the HTTPS port; they are kept under -root in acme/.
+// The instance's own certificate (http.tls_cert) is served for every other
+// name.
+
+// MaxCustomDomains is how many domains an account can add.
+const MaxCustomDomains = 3
+
+// customDomainVerificationPrefix begins the TXT record proving a domain.
+const customDomainVerificationPrefix = "spectre-verification="
+
+var customDomainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
+
+type CustomDomain struct {
+	Name    string
+	Account string
+	// Token is to be published in the domain's verification record.
+	Token    string
+	Verified bool
+	Added    time.Time
+}
+
+// VerificationRecord returns the name of the TXT record proving d.
+func (d *CustomDomain) VerificationRecord() string {
+	return "_spectre." + d.Name
+}
+
+// VerificationValue returns the value of the TXT record proving d.
+func (d *CustomDomain) VerificationValue() string {
+	return customDomainVerificationPrefix + d.Token
+}
+
+type DomainStore struct {
+	// Domains maps domain names to their mappings. Until a domain is
+	// verified, any number of accounts can claim it (so that no one can
+	// hold a domain hostage by adding it first); Pending maps domain
+	// names to those claims, by account. The first claim to be verified
+	// moves to Domains, and the rest are dropped.
+	Domains map[string]*CustomDomain
+	Pending map[string]map[string]*CustomDomain
+
+	filename string
+	mu       sync.RWMutex
+}
+
+// save must be called with s.mu held.
+func (s *DomainStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save custom domains: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+// claim returns the named account's claim to domain, or nil. It must be
+// called with s.mu held.
+func (s *DomainStore) claim(name, domain string) *CustomDomain {
+	if d, ok := s.Domains[domain]; ok && d.Account == name {
+		return d
+	}
+	return s.Pending[domain][name]
+}
+
+// ForAccount returns the named account's domains, in order.
+func (s *DomainStore) ForAccount(name string) []CustomDomain {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var domains []CustomDomain
+	for _, d := range s.Domains {
+		if d.Account == name {
+			domains = append(domains, *d)
+		}
+	}
+	for _, claims := range s.Pending {
+		if d, ok := claims[name]; ok {
+			domains = append(domains, *d)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	return domains
+}
+
+// Verified returns the verified domain named host, or nil.
+func (s *DomainStore) Verified(host string) *CustomDomain {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if d, ok := s.Domains[host]; ok && d.Verified {
+		c := *d
+		return &c
+	}
+	return nil
+}
+
+func (s *DomainStore) Add(name, domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.claim(name, domain) != nil {
+		return fmt.Errorf("You have already added %s.", domain)
+	}
+	if _, taken := s.Domains[domain]; taken {
+		return fmt.Errorf("%s belongs to another account.", domain)
+	}
+	n := 0
+	for _, d := range s.Domains {
+		if d.Account == name {
+			n++
+		}
+	}
+	for _, claims := range s.Pending {
+		if _, ok := claims[name]; ok {
+			n++
+		}
+	}
+	if n >= MaxCustomDomains {
+		return fmt.Errorf("You can have at most %d domains.", MaxCustomDomains)
+	}
+	token, err := generateRandomBase32String(20, 32)
+	if err != nil {
+		return err
+	}
+	if s.Pending[domain] == nil {
+		s.Pending[domain] = make(map[string]*CustomDomain)
+	}
+	s.Pending[domain][name] = &CustomDomain{Name: domain, Account: name, Token: token, Added: time.Now()}
+	return s.save()
+}
+
+func (s *DomainStore) Remove(name, domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.claim(name, domain)
+	if d == nil {
+		return fmt.Errorf("You haven't added %s.", domain)
+	}
+	if d.Verified {
+		delete(s.Domains, domain)
+	} else if delete(s.Pending[domain], name); len(s.Pending[domain]) == 0 {
+		delete(s.Pending, domain)
+	}
+	return s.save()
+}
+
+// Verify looks up the named account's domain's verification record,
+// marking it verified if it holds the domain's token.
+func (s *DomainStore) Verify(name, domain string) error {
+	s.mu.RLock()
+	d := s.claim(name, domain)
+	var c CustomDomain
+	if d != nil {
+		c = *d
+	}
+	s.mu.RUnlock()
+	if d == nil {
+		return fmt.Errorf("You haven't added %s.", domain)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	records, err := net.DefaultResolver.LookupTXT(ctx, c.VerificationRecord())
+	if err != nil {
+		return fmt.Errorf("Couldn't look up %s: %v", c.VerificationRecord(), err)
+	}
+	found := false
+	for _, record := range records {
+		found = found || strings.TrimSpace(record) == c.VerificationValue()
+	}
+	if !found {
+		return fmt.Errorf("%s doesn't carry %s yet.", c.VerificationRecord(), c.VerificationValue())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.claim(name, domain); d != nil && d.Token == c.Token && !d.Verified {
+		// Whoever controls the domain's DNS now has it, even if someone
+		// else verified it before.
+		d.Verified = true
+		s.Domains[domain] = d
+		delete(s.Pending, domain)
+	}
+	return s.save()
+}
+
+// Forget removes the named account's domains.
+func (s *DomainStore) Forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for domain, d := range s.Domains {
+		if d.Account == name {
+			delete(s.Domains, domain)
+			changed = true
+		}
+	}
+	for domain, claims := range s.Pending {
+		if _, ok := claims[name]; ok {
+			if delete(claims, name); len(claims) == 0 {
+				delete(s.Pending, domain)
+			}
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+func LoadDomainStore(filename string) *DomainStore {
+	var s *DomainStore
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode custom domains: ", err)
+		}
+	}
+	if s == nil {
+		s = &DomainStore{}
+	}
+	if s.Domains == nil {
+		s.Domains = make(map[string]*CustomDomain)
+	}
+	if s.Pending == nil {
+		s.Pending = make(map[string]map[string]*CustomDomain)
+	}
+	// Unverified domains used to be kept with the rest.
+	for domain, d := range s.Domains {
+		if !d.Verified {
+			delete(s.Domains, domain)
+			s.Pending[domain] = map[string]*CustomDomain{d.Account: d}
+		}
+	}
+	s.filename = filename
+	return s
+}
+
+var domainStore *DomainStore
+
+func customDomainsEnabled() bool {
+	return instanceConfig.Domains.Enabled && !instanceConfig.Instance.Private
+}
+
+// instanceHosts returns the hosts the instance itself answers to, which
+// can't be claimed.
+func instanceHosts() []string {
+	var hosts []string
+	for _, base := range []string{instanceConfig.Domains.BaseURL, instanceConfig.RawHost.URL, instanceConfig.Shortener.Host, instanceConfig.Domains.Target} {
+		if u, err := url.Parse(base); err == nil && u.Host != "" {
+			hosts = append(hosts, strings.ToLower(u.Hostname()))
+		} else if base != "" && !strings.Contains(base, "/") {
+			hosts = append(hosts, strings.ToLower(base))
+		}
+	}
+	return hosts
+}
+
+// parseCustomDomain validates a domain as an account submitted it.
+func parseCustomDomain(s string) (string, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	if !customDomainPattern.MatchString(s) || len(s) > 253 {
+		return "", fmt.Errorf("%q isn't a domain name.", s)
+	}
+	for _, host := range instanceHosts() {
+		if domainMatches(s, host) {
+			return "", fmt.Errorf("%s belongs to this instance.", s)
+		}
+	}
+	return s, nil
+}
+
+// requestHost returns r's host, without its port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// customDomainForRequest returns the verified custom domain r was made to,
+// or nil.
+func customDomainForRequest(r *http.Request) *CustomDomain {
+	if !customDomainsEnabled() {
+		return nil
+	}
+	return domainStore.Verified(requestHost(r))
+}
+
+// customDomainOwner returns the account behind d, unless it is disabled.
+func customDomainOwner(d *CustomDomain) *account.User {
+	user := userStore.Get(d.Account)
+	if user == nil || accountDisabled(user) {
+		return nil
+	}
+	return user
+}
+
+// parseCustomDomainPastePath returns the ID of the paste a path on a custom
+// domain asks for: /paste/{id}, /paste/{id}.json or one of the paste's
+// read-only pages.
+func parseCustomDomainPastePath(p string) (PasteID, bool) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "paste" || parts[1] == "" {
+		return "", false
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "raw", "download", "export", "lines", "search", "log":
+		default:
+			return "", false
+		}
+	}
+	return PasteIDFromString(strings.TrimSuffix(parts[1], ".json")), true
+}
+
+// customDomainServesPaste reports whether the paste with the given ID may
+// be served on d.
+func customDomainServesPaste(d *CustomDomain, owner *account.User, id PasteID) bool {
+	perms, _ := owner.Values["permissions"].(*PastePermissionSet)
+	if perms == nil {
+		return false
+	}
+	if perm, ok := perms.Get(id); !ok || !perm["edit"] {
+		return false
+	}
+	p, err := pasteStore.Get(id, nil)
+	return err == nil && !p.Encrypted
+}
+
+// customDomainPastes returns the public pastes to list on d's front page,
+// newest first.
+func customDomainPastes(owner *account.User) []*Paste {
+	perms, _ := owner.Values["permissions"].(*PastePermissionSet)
+	if perms == nil {
+		return nil
+	}
+	var pastes []*Paste
+	for id, perm := range perms.Entries {
+		if !perm["edit"] {
+			continue
+		}
+		if p, err := pasteStore.Get(id, nil); err == nil && pasteListedPublicly(p) && !p.Sealed() {
+			pastes = append(pastes, p)
+		}
+	}
+	sort.Slice(pastes, func(i, j int) bool { return pastes[i].LastModified().After(pastes[j].LastModified()) })
+	return pastes
+}
+
+// publicFileExists reports whether p names one of the files in public/.
+func publicFileExists(p string) bool {
+	if p == "/" || strings.HasSuffix(p, "/") {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join("public", filepath.FromSlash(path.Clean(p))))
+	return err == nil && !fi.IsDir()
+}
+
+// customDomainHandler serves the requests made to custom domains, passing
+// everything else on.
+type customDomainHandler struct {
+	http.Handler
+	router http.Handler
+}
+
+func (h customDomainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d := customDomainForRequest(r)
+	if d == nil {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	owner := customDomainOwner(d)
+	readOnly := r.Method == "GET" || r.Method == "HEAD"
+	if owner != nil && readOnly {
+		if r.URL.Path == "/" {
+			healthServer.IncrementMetric("domain.listed")
+			RenderPage(w, r, "domain", customDomainPastes(owner))
+			return
+		}
+		if publicFileExists(r.URL.Path) || r.URL.Path == "/languages.json" {
+			h.router.ServeHTTP(w, r)
+			return
+		}
+		if id, ok := parseCustomDomainPastePath(r.URL.Path); ok && customDomainServesPaste(d, owner, id) {
+			healthServer.IncrementMetric("domain.served")
+			h.router.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	base, err := url.Parse(instanceConfig.Domains.BaseURL)
+	if err != nil || base.Host == "" || !readOnly {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Location", base.ResolveReference(&url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery}).String())
+	w.WriteHeader(http.StatusFound)
+}
+
+func customDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUser(r)
+	if user == nil || !customDomainsEnabled() {
+		RenderError(fmt.Errorf("You need to log in to add a domain."), http.StatusForbidden, w)
+		return
+	}
+
+	var err error
+	var success string
+	switch {
+	case r.FormValue("remove") != "":
+		err = domainStore.Remove(user.Name, r.FormValue("remove"))
+		success = "Domain removed."
+	case r.FormValue("verify") != "":
+		domain := r.FormValue("verify")
+		if err = domainStore.Verify(user.Name, domain); err == nil {
+			healthServer.IncrementMetric("domain.verified")
+		}
+		success = domain + " is verified; your public pastes are served there."
+	default:
+		var domain string
+		if domain, err = parseCustomDomain(r.FormValue("domain")); err == nil {
+			err = domainStore.Add(user.Name, domain)
+		}
+		success = "Publish the TXT record below to verify " + domain + "."
+	}
+	if err != nil {
+		SetFlash(w, "error", err.Error())
+	} else {
+		SetFlash(w, "success", success)
+	}
+
+	w.Header().Set("Location", "/session")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var acmeManager *autocert.Manager
+
+// newACMEManager returns the manager issuing custom domains' certificates.
+func newACMEManager() *autocert.Manager {
+	ac := instanceConfig.Domains.ACME
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(filepath.Join(arguments.root, "acme")),
+		Email:  ac.Email,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if domainStore.Verified(strings.ToLower(host)) == nil {
+				return fmt.Errorf("%s is not a verified custom domain", host)
+			}
+			return nil
+		},
+	}
+	if ac.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: ac.DirectoryURL}
+	}
+	return m
+}
+
+// customDomainTLSConfig adds certificates for custom domains to config,
+// which serves fallback (the instance's own certificate, if it has one)
+// for every other name.
+func customDomainTLSConfig(config *tls.Config, fallback *tls.Certificate) {
+	config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if fallback != nil && domainStore.Verified(strings.ToLower(hello.ServerName)) == nil {
+			return fallback, nil
+		}
+		return acmeManager.GetCertificate(hello)
+	}
+}
+
+func init() {
+	RegisterTemplateFunction("customDomainsEnabled", customDomainsEnabled)
+	RegisterTemplateFunction("customDomains", func(user *account.User) []CustomDomain {
+		if user == nil {
+			return nil
+		}
+		return domainStore.ForAccount(user.Name)
+	})
+	RegisterTemplateFunction("customDomainTarget", func() string { return instanceConfig.Domains.Target })
+	RegisterTemplateFunction("customDomainName", func(r *http.Request) string { return requestHost(r) })
+	SubscribeEvent(func(ev *Event) {
+		if user := userStore.Get(ev.Account); user != nil {
+			domainStore.Forget(user.Name)
+		}
+	}, EventAccountDeprovisioned)
+
+	arguments.register()
+	arguments.parse()
+	domainStore = LoadDomainStore(filepath.Join(arguments.root, "domains.gob"))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainClaims(t *testing.T) {
+	s := LoadDomainStore(filepath.Join(t.TempDir(), "domains.gob"))
+
+	// Anyone can claim a domain until it is verified...
+	if err := s.Add("squatter", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("owner", "example.com"); err != nil {
+		t.Fatalf("a second account couldn't claim an unverified domain: %v", err)
+	}
+	if err := s.Add("owner", "example.com"); err == nil {
+		t.Errorf("an account claimed a domain twice")
+	}
+	if s.Verified("example.com") != nil {
+		t.Errorf("an unverified domain is served")
+	}
+
+	// ...after which it is only the verifier's.
+	s.mu.Lock()
+	d := s.Pending["example.com"]["owner"]
+	d.Verified = true
+	s.Domains["example.com"] = d
+	delete(s.Pending, "example.com")
+	s.save()
+	s.mu.Unlock()
+	if err := s.Add("squatter", "example.com"); err == nil {
+		t.Errorf("a verified domain was claimed by another account")
+	}
+	if got := s.Verified("example.com"); got == nil || got.Account != "owner" {
+		t.Errorf("verified domain: got %+v", got)
+	}
+	if domains := s.ForAccount("squatter"); len(domains) != 0 {
+		t.Errorf("the losing claim was kept: %+v", domains)
+	}
+
+	if err := s.Remove("squatter", "example.com"); err == nil {
+		t.Errorf("an account removed another's domain")
+	}
+	if err := s.Remove("owner", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Verified("example.com") != nil {
+		t.Errorf("a removed domain is still served")
+	}
+}
+
+func TestDomainStoreMovesUnverifiedDomainsToPending(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "domains.gob")
+	old := LoadDomainStore(filename)
+	old.Domains["old.example"] = &CustomDomain{Name: "old.example", Account: "a", Token: "t"}
+	old.Domains["done.example"] = &CustomDomain{Name: "done.example", Account: "b", Token: "u", Verified: true}
+	old.Pending = nil
+	old.mu.Lock()
+	old.save()
+	old.mu.Unlock()
+
+	s := LoadDomainStore(filename)
+	if _, ok := s.Domains["old.example"]; ok {
+		t.Errorf("an unverified domain was left with the verified ones")
+	}
+	if d := s.Pending["old.example"]["a"]; d == nil || d.Token != "t" {
+		t.Errorf("an unverified domain's claim was lost: %+v", s.Pending)
+	}
+	if s.Verified("done.example") == nil {
+		t.Errorf("a verified domain was lost")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// What happens to pastes and accounts is published as events on the event
+// bus, and whatever has to follow (forgetting cached renderings, tombstones,
+// the replication journal, retracting ActivityPub posts, notifying
+// moderators) subscribes to the kinds of event it cares about instead of
+// being called from where the change is made. New integrations need only
+// subscribe.
+//
+// Subscribers are called in the order they subscribed, on the goroutine
+// publishing the event, before the change is reported to whoever made it;
+// paste.destroying is published before a paste's files are removed, while
+// it can still be read. Anything slow (a webhook, say) must be handed off.
+// Events are also appended to events.audit_log, if set, as JSON lines, and
+// posted to each of events.webhooks that wants them.
+
+type EventKind string
+
+const (
+	EventPasteCreated    EventKind = "paste.created"
+	EventPasteModified   EventKind = "paste.modified"
+	EventPastePending    EventKind = "paste.pending"
+	EventPasteExpired    EventKind = "paste.expired"
+	EventPasteDestroying EventKind = "paste.destroying"
+	EventPasteDestroyed  EventKind = "paste.destroyed"
+
+	EventAccountCreated       EventKind = "account.created"
+	EventAccountVerified      EventKind = "account.verified"
+	EventAccountDeprovisioned EventKind = "account.deprovisioned"
+)
+
+type Event struct {
+	Kind    EventKind              `json:"event"`
+	Time    time.Time              `json:"time"`
+	PasteID PasteID                `json:"paste,omitempty"`
+	Account string                 `json:"account,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+
+	// Paste is the paste a paste event is about.
+	Paste *Paste `json:"-"`
+}
+
+type EventHandler func(*Event)
+
+type eventSubscription struct {
+	kinds   map[EventKind]bool
+	handler EventHandler
+}
+
+var eventBus struct {
+	subscriptions []eventSubscription
+	mu            sync.RWMutex
+}
+
+// SubscribeEvent calls handler for every event of the given kinds, or for
+// every event if no kinds are given.
+func SubscribeEvent(handler EventHandler, kinds ...EventKind) {
+	sub := eventSubscription{handler: handler}
+	if len(kinds) > 0 {
+		sub.kinds = make(map[EventKind]bool)
+		for _, kind := range kinds {
+			sub.kinds[kind] = true
+		}
+	}
+	eventBus.mu.Lock()
+	eventBus.subscriptions = append(eventBus.subscriptions, sub)
+	eventBus.mu.Unlock()
+}
+
+// PublishEvent hands ev to its subscribers.
+func PublishEvent(ev *Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Paste != nil && ev.PasteID == "" {
+		ev.PasteID = ev.Paste.ID
+	}
+	eventBus.mu.RLock()
+	subscriptions := eventBus.subscriptions
+	eventBus.mu.RUnlock()
+	for _, sub := range subscriptions {
+		if sub.kinds == nil || sub.kinds[ev.Kind] {
+			sub.handler(ev)
+		}
+	}
+	healthServer.IncrementMetric("event." + string(ev.Kind))
+}
+
+// publishesPasteEvent returns a paste store callback publishing kind.
+func publishesPasteEvent(kind EventKind) PasteCallback {
+	return func(p *Paste) {
+		ev := &Event{Kind: kind, Paste: p, Account: p.actor}
+		if kind == EventPasteDestroyed {
+			reason := p.deletionReason
+			if reason == "" {
+				reason = "deleted"
+				if p.expired {
+					reason = TrashReasonExpired
+				}
+			}
+			ev.Details = map[string]interface{}{"reason": reason}
+		}
+		PublishEvent(ev)
+	}
+}
+
+// attributeChange names r's account, if any, as the one changing p.
+func attributeChange(r *http.Request, p *Paste) {
+	if user := GetUser(r); user != nil {
+		p.actor = user.Name
+	}
+}
+
+// onPasteEvent adapts fn to handle paste events.
+func onPasteEvent(fn func(*Paste)) EventHandler {
+	return func(ev *Event) {
+		fn(ev.Paste)
+	}
+}
+
+type EventWebhook struct {
+	URL string `yaml:"url"`
+	// Events lists the kinds of event to post; all of them if empty.
+	Events []EventKind `yaml:"events"`
+}
+
+var eventWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (hook EventWebhook) wants(kind EventKind) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, k := range hook.Events {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func postEventWebhook(url string, body []byte) {
+	resp, err := eventWebhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		glog.Error("Failed to post event: ", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		glog.Errorf("Failed to post event: %s answered %s", url, resp.Status)
+	}
+}
+
+var auditLog struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+func openAuditLog() {
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.file != nil {
+		auditLog.file.Close()
+		auditLog.file = nil
+	}
+	filename := instanceConfig.Events.AuditLog
+	if filename == "" {
+		return
+	}
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(arguments.root, filename)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		glog.Error("Failed to open the audit log: ", err)
+		return
+	}
+	auditLog.file = file
+}
+
+func recordEvent(ev *Event) {
+	var body []byte
+	encode := func() []byte {
+		if body == nil {
+			body, _ = json.Marshal(ev)
+			body = append(body, '\n')
+		}
+		return body
+	}
+
+	auditLog.mu.Lock()
+	if auditLog.file != nil {
+		if _, err := auditLog.file.Write(encode()); err != nil {
+			glog.Error("Failed to write to the audit log: ", err)
+		}
+	}
+	auditLog.mu.Unlock()
+
+	for _, hook := range instanceConfig.Events.Webhooks {
+		if hook.wants(ev.Kind) {
+			go postEventWebhook(hook.URL, encode())
+		}
+	}
+}
+
+func init() {
+	SubscribeEvent(recordEvent)
+	RegisterReloadFunction(openAuditLog)
+}
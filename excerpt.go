@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A paste's raw body can be asked for a range of its lines (lines=10-40,
+// lines=10 or lines=10-), so that documentation can embed a living excerpt
+// of it. A range running past the end of the paste stops there; one
+// starting past it is refused with a 416. The excerpt carries the paste's
+// revision as its ETag and its range and line count in X-Paste-Lines.
+//
+// Since a paste's earlier revisions aren't kept, an excerpt can be pinned
+// to the revision it was taken from (rev): once the paste changes, the
+// excerpt is refused with a 412 naming the current revision, instead of
+// quietly showing whatever lines have moved into the range.
+
+// PasteLineRange is a range of a paste's lines, counted from 1; End is 0 if
+// the range runs to the end of the paste.
+type PasteLineRange struct {
+	Start, End int
+}
+
+func (lr PasteLineRange) String() string {
+	if lr.End == 0 {
+		return strconv.Itoa(lr.Start) + "-"
+	}
+	return strconv.Itoa(lr.Start) + "-" + strconv.Itoa(lr.End)
+}
+
+// PasteLineRangeError is returned for ranges starting past the end of the
+// paste.
+type PasteLineRangeError struct {
+	ID    PasteID
+	Lines int
+}
+
+func (e PasteLineRangeError) Error() string {
+	return fmt.Sprintf("Paste %v only has %d lines.", e.ID, e.Lines)
+}
+
+func (e PasteLineRangeError) StatusCode() int {
+	return http.StatusRequestedRangeNotSatisfiable
+}
+
+// parseLineRange validates a range of lines as requested; "" asks for none.
+func parseLineRange(s string) (*PasteLineRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	invalid := PasteInputError{"lines", "must be a line or range of lines, like 10, 10-40 or 10-"}
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	start, err := strconv.Atoi(from)
+	if err != nil || start < 1 {
+		return nil, invalid
+	}
+	end := 0
+	if to != "" {
+		if end, err = strconv.Atoi(to); err != nil || end < start {
+			return nil, invalid
+		}
+	}
+	return &PasteLineRange{start, end}, nil
+}
+
+// writePasteExcerpt writes lr's lines of p to out, setting w's headers
+// first.
+func writePasteExcerpt(out io.Writer, w http.ResponseWriter, r *http.Request, p *Paste, lr *PasteLineRange) {
+	revision := pasteRevision(p)
+	if rev := r.FormValue("rev"); rev != "" && rev != revision {
+		w.Header().Set("Cache-Control", "no-store")
+		panic(PastePreconditionFailedError{ID: p.ID, Revision: revision})
+	}
+
+	reader, err := openPaste(r.Context(), p)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	var excerpt strings.Builder
+	n := 0
+	br := bufio.NewReader(reader)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			n++
+			if n >= lr.Start && (lr.End == 0 || n <= lr.End) {
+				excerpt.WriteString(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+	}
+	if lr.Start > n {
+		panic(PasteLineRangeError{p.ID, n})
+	}
+
+	end := lr.End
+	if end == 0 || end > n {
+		end = n
+	}
+	w.Header().Set("X-Paste-Lines", fmt.Sprintf("%d-%d/%d", lr.Start, end, n))
+	if revision != "" {
+		w.Header().Set("ETag", pasteETag(revision))
+	}
+	healthServer.IncrementMetric("paste.excerpted")
+	io.WriteString(out, excerpt.String())
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Admins can exempt pastes from everything that would otherwise take them
+// down on its own: their expiration, their retention class's bound, their
+// view limit and the bandwidth quotas. An exemption is for one paste (its
+// ID), or for a collection of them: every paste an account can edit
+// ("account:name"), such as the status page's postmortems. Each records
+// why, and who made it; they are listed at /admin/retention, and managed
+// there or through the API. An exempt paste can still be deleted by hand.
+//
+// An exempt paste keeps the expiration it was given: it is just not acted
+// on. Lifting the exemption schedules it again, counted from then.
+
+const exemptionAccountPrefix = "account:"
+
+type RetentionExemption struct {
+	Subject   string    `json:"subject"`
+	Reason    string    `json:"reason"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// Account returns the name of the account whose pastes ex covers, or "".
+func (ex *RetentionExemption) Account() string {
+	if !strings.HasPrefix(ex.Subject, exemptionAccountPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(ex.Subject, exemptionAccountPrefix)
+}
+
+type RetentionExemptionStore struct {
+	Exemptions map[string]*RetentionExemption
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *RetentionExemptionStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save retention exemptions: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+// parseExemptionSubject validates a subject as an admin submitted it.
+func parseExemptionSubject(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, exemptionAccountPrefix) {
+		if userStore.Get(strings.TrimPrefix(s, exemptionAccountPrefix)) == nil {
+			return "", fmt.Errorf("there is no account %q", strings.TrimPrefix(s, exemptionAccountPrefix))
+		}
+		return s, nil
+	}
+	id := PasteIDFromString(s)
+	if id == "" || strings.ContainsAny(s, "/ ") {
+		return "", fmt.Errorf("%q is neither a paste ID nor account:name", s)
+	}
+	if p, _ := pasteStore.Get(id, nil); p == nil {
+		return "", PasteNotFoundError{ID: id}
+	}
+	return id.String(), nil
+}
+
+// Put adds an exemption, replacing any for the same subject.
+func (s *RetentionExemptionStore) Put(ex *RetentionExemption) error {
+	subject, err := parseExemptionSubject(ex.Subject)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(ex.Reason) == "" {
+		return fmt.Errorf("an exemption needs a reason")
+	}
+	ex.Subject = subject
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Exemptions[ex.Subject] = ex
+	healthServer.IncrementMetric("retention.exempted")
+	return s.save()
+}
+
+func (s *RetentionExemptionStore) Delete(subject string) (*RetentionExemption, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ex, ok := s.Exemptions[subject]
+	if !ok {
+		return nil, false
+	}
+	delete(s.Exemptions, subject)
+	s.save()
+	return ex, true
+}
+
+// List returns every exemption, the newest first.
+func (s *RetentionExemptionStore) List() []*RetentionExemption {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exemptions := make([]*RetentionExemption, 0, len(s.Exemptions))
+	for _, ex := range s.Exemptions {
+		exemptions = append(exemptions, ex)
+	}
+	sort.Slice(exemptions, func(i, j int) bool { return exemptions[i].Created.After(exemptions[j].Created) })
+	return exemptions
+}
+
+// accountEditablePastes returns the pastes the named account can edit.
+func accountEditablePastes(name string) []PasteID {
+	user := userStore.Get(name)
+	if user == nil {
+		return nil
+	}
+	perms, _ := user.Values["permissions"].(*PastePermissionSet)
+	if perms == nil {
+		return nil
+	}
+	var ids []PasteID
+	for id, perm := range perms.Entries {
+		if perm["edit"] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// For returns the exemption that covers the paste with the given ID, or
+// nil.
+func (s *RetentionExemptionStore) For(id PasteID) *RetentionExemption {
+	s.mu.Lock()
+	if ex, ok := s.Exemptions[id.String()]; ok {
+		s.mu.Unlock()
+		return ex
+	}
+	var accounts []*RetentionExemption
+	for subject, ex := range s.Exemptions {
+		if strings.HasPrefix(subject, exemptionAccountPrefix) {
+			accounts = append(accounts, ex)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ex := range accounts {
+		for _, owned := range accountEditablePastes(ex.Account()) {
+			if owned == id {
+				return ex
+			}
+		}
+	}
+	return nil
+}
+
+func LoadRetentionExemptionStore(filename string) *RetentionExemptionStore {
+	var s *RetentionExemptionStore
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode retention exemptions: ", err)
+		}
+	}
+	if s == nil {
+		s = &RetentionExemptionStore{}
+	}
+	if s.Exemptions == nil {
+		s.Exemptions = make(map[string]*RetentionExemption)
+	}
+	s.filename = filename
+	return s
+}
+
+var retentionExemptions *RetentionExemptionStore
+
+// retentionExempt reports whether p is exempt from expiration and quotas.
+func retentionExempt(p *Paste) bool {
+	return retentionExemptions.For(p.ID) != nil
+}
+
+// rescheduleExemptPastes gives the pastes ex held on to their expirations
+// again, once it has been lifted.
+func rescheduleExemptPastes(ex *RetentionExemption) {
+	ids := []PasteID{PasteID(ex.Subject)}
+	if name := ex.Account(); name != "" {
+		ids = accountEditablePastes(name)
+	}
+	for _, id := range ids {
+		p, _ := pasteStore.Get(id, nil)
+		if p == nil || p.trashed != "" || retentionExempt(p) || pasteExpirator.ObjectHasExpiration(p) {
+			continue
+		}
+		if p.Expiration != "" && p.Expiration != "-1" {
+			setPasteExpiration(p, p.Expiration)
+		}
+	}
+}
+
+func liftRetentionExemption(subject string) bool {
+	ex, ok := retentionExemptions.Delete(subject)
+	if ok {
+		rescheduleExemptPastes(ex)
+	}
+	return ok
+}
+
+func adminRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	RenderPage(w, r, "admin_retention", retentionExemptions.List())
+}
+
+func adminRetentionExemptHandler(w http.ResponseWriter, r *http.Request) {
+	ex := &RetentionExemption{Subject: r.FormValue("subject"), Reason: r.FormValue("reason"), Created: time.Now(), CreatedBy: GetUser(r).Name}
+	if err := retentionExemptions.Put(ex); err != nil {
+		SetFlash(w, "error", err.Error())
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("%s is exempt from expiration and quotas.", ex.Subject))
+	}
+	w.Header().Set("Location", "/admin/retention")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func adminRetentionLiftHandler(w http.ResponseWriter, r *http.Request) {
+	subject := mux.Vars(r)["subject"]
+	if liftRetentionExemption(subject) {
+		SetFlash(w, "success", fmt.Sprintf("Lifted the exemption for %s.", subject))
+	}
+	w.Header().Set("Location", "/admin/retention")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func apiRetentionExemptionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"exemptions": retentionExemptions.List(),
+	})
+}
+
+// apiRetentionExemptHandler adds an exemption, from the form values
+// subject and reason.
+func apiRetentionExemptHandler(w http.ResponseWriter, r *http.Request) {
+	ex := &RetentionExemption{Subject: r.FormValue("subject"), Reason: r.FormValue("reason"), Created: time.Now(), CreatedBy: GetUser(r).Name}
+	if err := retentionExemptions.Put(ex); err != nil {
+		if _, ok := err.(PasteNotFoundError); ok {
+			writeAPIError(w, err)
+		} else {
+			writeAPIError(w, apiError(APIErrorValidation, "%v", err))
+		}
+		return
+	}
+	writeAPIResponse(w, http.StatusCreated, ex)
+}
+
+func apiRetentionLiftHandler(w http.ResponseWriter, r *http.Request) {
+	subject := mux.Vars(r)["subject"]
+	if !liftRetentionExemption(subject) {
+		writeAPIError(w, apiError(APIErrorNotFound, "%s isn't exempt", subject))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	retentionExemptions = LoadRetentionExemptionStore(filepath.Join(arguments.root, "exemptions.gob"))
+
+	RegisterTemplateFunction("retentionExemption", func(ri *RenderContext, p *Paste) *RetentionExemption {
+		if !userHasPermission(ri.Request, "admin") {
+			return nil
+		}
+		return retentionExemptions.For(p.ID)
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+// For capacity planning, the expirator's schedule (as of its last flush)
+// can be bucketed by hour or by day: how many pastes are due to expire in
+// each, and how many bytes of paste bodies that frees on the filesystem
+// (archived bodies, in cold storage, count for nothing). Admins get the
+// coming week by day on /admin, and any span at
+// /api/v1/admin/expirations/histogram?bucket=hour&span=2d.
+
+// MaxHistogramBuckets bounds span/bucket.
+const MaxHistogramBuckets = 24 * 31
+
+type ExpirationBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Bytes int64     `json:"bytes"`
+
+	// Percent is Count as a share of the largest bucket's, for drawing.
+	Percent int `json:"-"`
+}
+
+// Size returns b's bytes for display.
+func (b ExpirationBucket) Size() ByteSize {
+	return ByteSize(b.Bytes)
+}
+
+type ExpirationHistogram struct {
+	Bucket  string             `json:"bucket"`
+	Span    string             `json:"span"`
+	Buckets []ExpirationBucket `json:"buckets"`
+	Count   int                `json:"count"`
+	Bytes   int64              `json:"bytes"`
+}
+
+// Size returns h's bytes for display.
+func (h *ExpirationHistogram) Size() ByteSize {
+	return ByteSize(h.Bytes)
+}
+
+// expirationHistogram buckets the expirations scheduled in the coming span.
+// Those overdue are counted in the first bucket.
+func expirationHistogram(store *FilesystemPasteStore, expirationFilename string, bucket, span time.Duration) (*ExpirationHistogram, error) {
+	schedule, err := ReadExpirationSchedule(expirationFilename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	start := time.Now().UTC().Truncate(bucket)
+	n := int((time.Now().Add(span).Sub(start) + bucket - 1) / bucket)
+	h := &ExpirationHistogram{
+		Bucket:  bucket.String(),
+		Span:    span.String(),
+		Buckets: make([]ExpirationBucket, n),
+	}
+	for i := range h.Buckets {
+		h.Buckets[i].Start = start.Add(time.Duration(i) * bucket)
+	}
+	for id, t := range schedule {
+		i := int(t.Sub(start) / bucket)
+		if i >= n {
+			continue
+		}
+		if i < 0 {
+			i = 0
+		}
+		var size int64
+		if fi, err := os.Stat(store.filenameForID(PasteID(id))); err == nil {
+			size = fi.Size()
+		}
+		h.Buckets[i].Count++
+		h.Buckets[i].Bytes += size
+		h.Count++
+		h.Bytes += size
+	}
+
+	max := 0
+	for _, b := range h.Buckets {
+		if b.Count > max {
+			max = b.Count
+		}
+	}
+	if max > 0 {
+		for i := range h.Buckets {
+			h.Buckets[i].Percent = h.Buckets[i].Count * 100 / max
+		}
+	}
+	return h, nil
+}
+
+func apiExpirationHistogramHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := 24 * time.Hour
+	switch r.FormValue("bucket") {
+	case "", "day":
+	case "hour":
+		bucket = time.Hour
+	default:
+		writeAPIError(w, apiError(APIErrorValidation, "bucket must be hour or day"))
+		return
+	}
+	span := 7 * 24 * time.Hour
+	if s := r.FormValue("span"); s != "" {
+		d, err := ParseDuration(s)
+		if err != nil || d <= 0 {
+			writeAPIError(w, apiError(APIErrorValidation, "span %q is not a duration", s))
+			return
+		}
+		span = d
+	}
+	if span/bucket > MaxHistogramBuckets {
+		writeAPIError(w, apiError(APIErrorValidation, "span can be at most %d buckets", MaxHistogramBuckets))
+		return
+	}
+
+	h, err := expirationHistogram(filesystemPasteStore, garbageCollector.ExpirationFilename, bucket, span)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, h)
+}
+
+func init() {
+	RegisterTemplateFunction("expirationHistogram", func() *ExpirationHistogram {
+		h, _ := expirationHistogram(filesystemPasteStore, garbageCollector.ExpirationFilename, 24*time.Hour, 7*24*time.Hour)
+		return h
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DHowett/ghostbin/account"
+)
+
+// Pastes move between instances as an export directory:
+//
+//   manifest.json   {"format": "spectre-export", "version": 1,
+//                    "source": <brand>, "exported": <time>}
+//   pastes.jsonl    one ExportRecord per line
+//   bodies/<id>     each paste's body, exactly as stored
+//
+// Bodies are copied as stored, so encrypted pastes stay encrypted and keep
+// working with their passwords. Metadata holds the paste's stored metadata
+// (language, title, expiration and encryption parameters) by name. Trashed
+// pastes aren't exported.
+//
+// Importing keeps each paste's ID unless the destination already has a
+// paste by that ID, in which case the paste gets a new one and the pair is
+// written to redirects.txt in the export directory, one "old new" per line.
+// Encrypted pastes are bound to their IDs; those that can't keep theirs are
+// skipped.
+
+const (
+	ExportFormat  = "spectre-export"
+	ExportVersion = 1
+)
+
+// importScheduleTimeout bounds the wait for the expirator to save imported
+// pastes' expirations.
+const importScheduleTimeout = 30 * time.Second
+
+type ExportManifest struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Source   string    `json:"source"`
+	Exported time.Time `json:"exported"`
+}
+
+type ExportRecord struct {
+	ID       PasteID           `json:"id"`
+	Modified time.Time         `json:"modified"`
+	Metadata map[string]string `json:"metadata"`
+	SHA256   string            `json:"sha256"`
+}
+
+func exportBodyFilename(dir string, id PasteID) string {
+	return filepath.Join(dir, "bodies", id.String())
+}
+
+// accountPasteIDs returns the IDs of the pastes the named account may edit.
+func accountPasteIDs(name string) ([]PasteID, error) {
+	user := userStore.Get(name)
+	if user == nil {
+		return nil, fmt.Errorf("no such account %q", name)
+	}
+	perms, _ := user.Values["permissions"].(*PastePermissionSet)
+	var ids []PasteID
+	if perms != nil {
+		for id, perm := range perms.Entries {
+			if perm["edit"] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// ExportPastes writes the pastes named by ids, or every paste if ids is nil,
+// to dir, returning how many it wrote.
+func ExportPastes(dir string, ids []PasteID, progress func(PasteID)) (int, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "bodies"), 0700); err != nil {
+		return 0, err
+	}
+	manifest, _ := json.Marshal(&ExportManifest{
+		Format:   ExportFormat,
+		Version:  ExportVersion,
+		Source:   Brand(),
+		Exported: time.Now().UTC(),
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0600); err != nil {
+		return 0, err
+	}
+
+	file, err := os.Create(filepath.Join(dir, "pastes.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	enc := json.NewEncoder(file)
+
+	n := 0
+	export := func(id PasteID) error {
+		snapshot, err := filesystemPasteStore.Snapshot(id)
+		if err != nil {
+			if _, ok := err.(PasteNotFoundError); ok {
+				return nil
+			}
+			return err
+		}
+		if snapshot.Metadata["trashed"] != "" {
+			return nil
+		}
+		delete(snapshot.Metadata, "accessed")
+
+		if err := ioutil.WriteFile(exportBodyFilename(dir, id), snapshot.Body, 0600); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(snapshot.Body)
+		if err := enc.Encode(&ExportRecord{
+			ID:       id,
+			Modified: snapshot.Modified.UTC(),
+			Metadata: snapshot.Metadata,
+			SHA256:   hex.EncodeToString(sum[:]),
+		}); err != nil {
+			return err
+		}
+		n++
+		progress(id)
+		return nil
+	}
+
+	if ids == nil {
+		err = filesystemPasteStore.Walk(export)
+	} else {
+		for _, id := range ids {
+			if err = export(id); err != nil {
+				break
+			}
+		}
+	}
+	return n, err
+}
+
+// ImportPastes reads the pastes exported to dir into the store, granting
+// them to the named account if name isn't "". It returns how many it
+// imported. It returns once the imported pastes' expirations are saved.
+func ImportPastes(dir string, name string, progress func(from, to PasteID)) (n int, err error) {
+	var manifest ExportManifest
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json")); err != nil {
+		return 0, err
+	} else if err := json.Unmarshal(b, &manifest); err != nil {
+		return 0, err
+	}
+	if manifest.Format != ExportFormat || manifest.Version > ExportVersion {
+		return 0, fmt.Errorf("%s is not a spectre export this version can read", dir)
+	}
+
+	var user *account.User
+	var perms *PastePermissionSet
+	if name != "" {
+		if user = userStore.Get(name); user == nil {
+			return 0, fmt.Errorf("no such account %q", name)
+		}
+		perms, _ = user.Values["permissions"].(*PastePermissionSet)
+		if perms == nil {
+			perms = &PastePermissionSet{Entries: make(map[PasteID]PastePermission)}
+			user.Values["permissions"] = perms
+		}
+	}
+
+	file, err := os.Open(filepath.Join(dir, "pastes.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	redirects, err := os.Create(filepath.Join(dir, "redirects.txt"))
+	if err != nil {
+		return 0, err
+	}
+	defer redirects.Close()
+
+	rescheduled := false
+	defer func() {
+		if rescheduled {
+			if werr := pasteExpirationFile.WaitSaved(importScheduleTimeout); err == nil {
+				err = werr
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record ExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return n, err
+		}
+		body, err := ioutil.ReadFile(exportBodyFilename(dir, record.ID))
+		if err != nil {
+			return n, err
+		}
+		if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) != record.SHA256 {
+			return n, fmt.Errorf("the body of %s doesn't match its digest", record.ID)
+		}
+
+		id := record.ID
+		if _, err := os.Stat(filesystemPasteStore.filenameForID(id)); err == nil {
+			if record.Metadata["hmac"] != "" {
+				fmt.Fprintf(os.Stderr, "Skipped encrypted paste %s: its ID is taken.\n", id)
+				continue
+			}
+			if id, err = filesystemPasteStore.GenerateNewPasteID(false); err != nil {
+				return n, err
+			}
+			fmt.Fprintf(redirects, "%s %s\n", record.ID, id)
+		}
+
+		if err := filesystemPasteStore.Restore(&PasteSnapshot{
+			ID:       id,
+			Modified: record.Modified,
+			Metadata: record.Metadata,
+			Body:     body,
+		}); err != nil {
+			return n, err
+		}
+		if scheduleRestoredExpiration(filesystemPasteStore, id) {
+			rescheduled = true
+		}
+		if perms != nil {
+			perms.Put(id, PastePermission{"edit": true, "grant": true})
+		}
+		n++
+		progress(record.ID, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+
+	if user != nil {
+		return n, user.Save()
+	}
+	return n, nil
+}
+
+func init() {
+	RegisterCommand("export", "export pastes (all, or an account's) to a directory: export <dir> [account]", func(args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf("usage: export <dir> [account]")
+		}
+		var ids []PasteID
+		if len(args) > 1 {
+			var err error
+			if ids, err = accountPasteIDs(args[1]); err != nil {
+				return err
+			}
+		}
+		n, err := ExportPastes(args[0], ids, func(id PasteID) {
+			fmt.Println(id)
+		})
+		fmt.Printf("Exported %d pastes.\n", n)
+		return err
+	})
+
+	RegisterCommand("import", "import an export directory, granting its pastes to an account (stop the server first): import <dir> [account]", func(args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf("usage: import <dir> [account]")
+		}
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+		n, err := ImportPastes(args[0], name, func(from, to PasteID) {
+			if from != to {
+				fmt.Printf("%s -> %s\n", from, to)
+			} else {
+				fmt.Println(to)
+			}
+		})
+		fmt.Printf("Imported %d pastes.\n", n)
+		return err
+	})
+}
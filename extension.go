@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DHowett/ghostbin/account"
+)
+
+// A "paste selection" browser extension pastes what's selected on a page
+// in one click. It authenticates with a token made for it on /session (the
+// extension has no cookies of ours to send), and sends the page's URL along
+// with the text, which is kept with the paste as its source:
+//
+//	POST /api/v1/extension/pastes
+//	Authorization: Bearer <token>
+//
+//	text=...&source_url=https://example.com/page[&lang=&title=&expire=]
+//
+// and is answered with just the paste's URLs, for the extension to copy or
+// open. GET /api/v1/extension/token tells an extension's settings page
+// whether its token still works. Both answer cross-origin requests, since
+// they are authenticated by the token alone.
+
+const (
+	// MaxExtensionTokens is how many extension tokens an account can have.
+	MaxExtensionTokens = 10
+
+	// MaxSourceURLLength bounds a paste's source URL.
+	MaxSourceURLLength = 2048
+)
+
+// parseSourceURL validates the URL a paste was clipped from; "" is none.
+func parseSourceURL(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if len(s) > MaxSourceURLLength {
+		return "", PasteInputError{"source_url", fmt.Sprintf("must be at most %d bytes", MaxSourceURLLength)}
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", PasteInputError{"source_url", "must be an http or https URL"}
+	}
+	// Credentials in a URL are nobody else's business.
+	u.User = nil
+	return u.String(), nil
+}
+
+// sourceHost returns the host of a paste's source URL, for display.
+func sourceHost(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return source
+	}
+	return u.Host
+}
+
+type ExtensionToken struct {
+	Name    string
+	Hash    string
+	Created time.Time
+}
+
+// ID identifies the token on /session without giving it away.
+func (t ExtensionToken) ID() string {
+	return t.Hash[:12]
+}
+
+func hashExtensionToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func userExtensionTokens(user *account.User) []ExtensionToken {
+	if user == nil {
+		return nil
+	}
+	tokens, _ := user.Values["extension.tokens"].([]ExtensionToken)
+	return tokens
+}
+
+// addExtensionToken makes user a token named name, and returns it; only
+// its hash is kept.
+func addExtensionToken(user *account.User, name string) (string, error) {
+	name = sanitizeTitle(name)
+	if name == "" {
+		name = "Browser extension"
+	}
+	if len(name) > 64 {
+		return "", fmt.Errorf("That name is too long.")
+	}
+	tokens := userExtensionTokens(user)
+	if len(tokens) >= MaxExtensionTokens {
+		return "", fmt.Errorf("You can have at most %d extension tokens.", MaxExtensionTokens)
+	}
+	secret, err := generateRandomBase32String(20, 32)
+	if err != nil {
+		return "", err
+	}
+	user.Values["extension.tokens"] = append(tokens, ExtensionToken{Name: name, Hash: hashExtensionToken(secret), Created: time.Now()})
+	if err := user.Save(); err != nil {
+		return "", err
+	}
+	// The account is named in the token, so that it can be found without
+	// searching every account for the hash.
+	return base64.RawURLEncoding.EncodeToString([]byte(user.Name)) + "." + secret, nil
+}
+
+func removeExtensionToken(user *account.User, id string) error {
+	var kept []ExtensionToken
+	for _, token := range userExtensionTokens(user) {
+		if token.ID() != id {
+			kept = append(kept, token)
+		}
+	}
+	user.Values["extension.tokens"] = kept
+	return user.Save()
+}
+
+// extensionTokenUser returns the account a request's bearer token belongs
+// to, and the token.
+func extensionTokenUser(r *http.Request) (*account.User, *ExtensionToken) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	i := strings.IndexByte(bearer, '.')
+	if i < 0 {
+		return nil, nil
+	}
+	name, err := base64.RawURLEncoding.DecodeString(bearer[:i])
+	if err != nil {
+		return nil, nil
+	}
+	user := userStore.Get(string(name))
+	if user == nil || accountDisabled(user) {
+		return nil, nil
+	}
+	hash := hashExtensionToken(bearer[i+1:])
+	for _, token := range userExtensionTokens(user) {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) == 1 {
+			return user, &token
+		}
+	}
+	return nil, nil
+}
+
+type extensionTokenContextKey struct{}
+
+// requiresExtensionToken admits requests bearing an extension token, as
+// the account it belongs to.
+func requiresExtensionToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		user, token := extensionTokenUser(r)
+		if user == nil {
+			healthServer.IncrementMetric("extension.refused")
+			writeAPIError(w, apiError(APIErrorForbidden, "missing or unknown extension token"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, extensionTokenContextKey{}, token)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func apiExtensionTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.Context().Value(extensionTokenContextKey{}).(*ExtensionToken)
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"name":    token.Name,
+		"created": token.Created.UTC(),
+	})
+}
+
+func apiExtensionPasteHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := parsePasteInput(r.FormValue)
+	if err == nil {
+		err = checkRetentionClass(r, in)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(strings.TrimSpace(in.Body)) == 0 {
+		writeAPIError(w, apiError(APIErrorValidation, "text must not be empty").With("field", "text"))
+		return
+	}
+
+	p, err := createAPIPaste(r, in)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	user := GetUser(r)
+	perms := GetPastePermissions(r)
+	perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
+	user.Values["permissions"] = perms
+	perms.Save(w, r)
+
+	publishPaste(r, p)
+
+	healthServer.IncrementMetric("paste.created")
+	healthServer.IncrementMetric("paste.created.extension")
+	base := BaseURLForRequest(r)
+	raw, _ := url.Parse(rawPasteURL("raw", p))
+	writeAPIResponse(w, http.StatusCreated, map[string]interface{}{
+		"id":      p.ID,
+		"url":     base.ResolveReference(&url.URL{Path: pasteURL("show", p)}).String(),
+		"raw_url": base.ResolveReference(raw).String(),
+	})
+}
+
+// extensionTokensHandler makes (the form value name) or revokes (revoke,
+// a token's ID) an extension token on the session's account.
+func extensionTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUser(r)
+	if user == nil {
+		RenderError(fmt.Errorf("You need to log in to make extension tokens."), http.StatusForbidden, w)
+		return
+	}
+
+	if id := r.FormValue("revoke"); id != "" {
+		if err := removeExtensionToken(user, id); err != nil {
+			SetFlash(w, "error", err.Error())
+		} else {
+			SetFlash(w, "success", "Token revoked.")
+		}
+	} else if token, err := addExtensionToken(user, r.FormValue("name")); err != nil {
+		SetFlash(w, "error", err.Error())
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Your extension's token is %s. Copy it now; it won't be shown again.", token))
+	}
+
+	w.Header().Set("Location", "/session")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func init() {
+	gob.Register([]ExtensionToken(nil))
+	RegisterTemplateFunction("extensionTokens", userExtensionTokens)
+	RegisterTemplateFunction("sourceHost", sourceHost)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// For testing how the server copes with a slow or failing store, faults can
+// be injected into the paste store and the cold store with the hidden
+// -faults flag. It takes comma-separated rules, op=fault[+fault], where op
+// is one of new, get, save, destroy, read, write and walk (the paste store),
+// cold.put, cold.get and cold.delete (the cold store), or * for any of
+// them, and each fault is a latency ("200ms") or a rate of failure ("5%"):
+//
+//	spectre -faults 'get=50ms,save=200ms+5%,destroy=100%'
+//
+// Given as @filename, the rules are read from that file, and read again
+// whenever the configuration is reloaded, so that a test can change them
+// under a running server. Injected failures are *os.PathErrors, like the
+// store's own, so that they take the paths real ones would; each is
+// counted in the metric fault.<op>.
+//
+// Faults are injected by the filesystem store itself, so that they reach
+// everything that uses it: handlers, and archival, packing, the GC, the
+// jobs and the commands alike. Rewriting a body in place (archiving,
+// rehydrating or packing it, or moving it into its shard) is a write.
+//
+// The flag is left out of the usage message; it has no business on a
+// production instance.
+
+var errInjectedFault = errors.New("injected fault")
+
+var hiddenFlags = map[string]bool{"faults": true}
+
+type faultRule struct {
+	latency time.Duration
+	rate    float64
+}
+
+var faultRules struct {
+	rules map[string]faultRule
+	mu    sync.RWMutex
+}
+
+var faultOps = []string{"new", "get", "save", "destroy", "read", "write", "walk", "cold.put", "cold.get", "cold.delete", "*"}
+
+func parseFaultRules(s string) (map[string]faultRule, error) {
+	rules := make(map[string]faultRule)
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("fault rule %q is not op=fault", field)
+		}
+		op := strings.TrimSpace(field[:i])
+		known := false
+		for _, o := range faultOps {
+			known = known || o == op
+		}
+		if !known {
+			return nil, fmt.Errorf("fault rule %q: op must be one of %s", field, strings.Join(faultOps, ", "))
+		}
+		var rule faultRule
+		for _, fault := range strings.Split(field[i+1:], "+") {
+			fault = strings.TrimSpace(fault)
+			if strings.HasSuffix(fault, "%") {
+				pct, err := strconv.ParseFloat(strings.TrimSuffix(fault, "%"), 64)
+				if err != nil || pct < 0 || pct > 100 {
+					return nil, fmt.Errorf("fault rule %q: %q is not a percentage", field, fault)
+				}
+				rule.rate = pct / 100
+			} else {
+				d, err := ParseDuration(fault)
+				if err != nil || d < 0 {
+					return nil, fmt.Errorf("fault rule %q: %q is neither a latency nor a percentage", field, fault)
+				}
+				rule.latency = d
+			}
+		}
+		rules[op] = rule
+	}
+	return rules, nil
+}
+
+// loadFaultRules (re)reads the rules given by -faults.
+func loadFaultRules() {
+	spec := arguments.faults
+	if strings.HasPrefix(spec, "@") {
+		b, err := ioutil.ReadFile(spec[1:])
+		if err != nil {
+			glog.Error("Failed to read fault rules: ", err)
+			return
+		}
+		spec = string(b)
+	}
+	rules, err := parseFaultRules(spec)
+	if err != nil {
+		glog.Error("Failed to load fault rules: ", err)
+		return
+	}
+
+	ops := make([]string, 0, len(rules))
+	for op := range rules {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	glog.Warningf("Injecting storage faults into %s.", strings.Join(ops, ", "))
+
+	faultRules.mu.Lock()
+	faultRules.rules = rules
+	faultRules.mu.Unlock()
+}
+
+// injectFault delays op on path, and fails it, as the rules say.
+func injectFault(op, path string) error {
+	faultRules.mu.RLock()
+	rule, ok := faultRules.rules[op]
+	if !ok {
+		rule = faultRules.rules["*"]
+	}
+	faultRules.mu.RUnlock()
+
+	if rule.latency > 0 {
+		time.Sleep(rule.latency)
+	}
+	if rule.rate > 0 && rand.Float64() < rule.rate {
+		healthServer.IncrementMetric("fault." + op)
+		return &os.PathError{Op: op, Path: path, Err: errInjectedFault}
+	}
+	return nil
+}
+
+// fault delays op on path, and fails it, as the rules say, if store is
+// to have faults injected into it.
+func (store *FilesystemPasteStore) fault(op, path string) error {
+	if !store.Faults {
+		return nil
+	}
+	return injectFault(op, path)
+}
+
+// faultyColdStore injects faults into a cold store.
+type faultyColdStore struct {
+	ColdStore
+}
+
+func (c *faultyColdStore) Put(key string, r io.Reader, size int64) error {
+	if err := injectFault("cold.put", key); err != nil {
+		return err
+	}
+	return c.ColdStore.Put(key, r, size)
+}
+
+func (c *faultyColdStore) Get(key string) (io.ReadCloser, error) {
+	if err := injectFault("cold.get", key); err != nil {
+		return nil, err
+	}
+	return c.ColdStore.Get(key)
+}
+
+func (c *faultyColdStore) Delete(key string) error {
+	if err := injectFault("cold.delete", key); err != nil {
+		return err
+	}
+	return c.ColdStore.Delete(key)
+}
+
+// faultyPresigningColdStore is faultyColdStore for cold stores that can
+// presign URLs, which are left as they are.
+type faultyPresigningColdStore struct {
+	faultyColdStore
+	presigner PresigningColdStore
+}
+
+func (c *faultyPresigningColdStore) Presign(method, key string, expiry time.Duration) (string, error) {
+	return c.presigner.Presign(method, key, expiry)
+}
+
+func (c *faultyPresigningColdStore) Stat(key string) (int64, error) {
+	return c.presigner.Stat(key)
+}
+
+// withFaultyColdStore wraps cold to inject faults, keeping its ability to
+// presign URLs.
+func withFaultyColdStore(cold ColdStore) ColdStore {
+	if presigner, ok := cold.(PresigningColdStore); ok {
+		return &faultyPresigningColdStore{faultyColdStore{cold}, presigner}
+	}
+	return &faultyColdStore{cold}
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+
+	if arguments.faults != "" {
+		RegisterReloadFunction(loadFaultRules)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFaultRules(t *testing.T) {
+	rules, err := parseFaultRules("get=50ms, save=200ms+5%\n# a comment\ndestroy=100%,cold.put=1d,*=0%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]faultRule{
+		"get":      {latency: 50 * time.Millisecond},
+		"save":     {latency: 200 * time.Millisecond, rate: 0.05},
+		"destroy":  {rate: 1},
+		"cold.put": {latency: 24 * time.Hour},
+		"*":        {},
+	}
+	if len(rules) != len(want) {
+		t.Errorf("got %d rules, want %d: %v", len(rules), len(want), rules)
+	}
+	for op, rule := range want {
+		if got, ok := rules[op]; !ok || got != rule {
+			t.Errorf("%s: got %+v, want %+v", op, got, rule)
+		}
+	}
+
+	for _, bad := range []string{
+		"get",
+		"fetch=10ms",
+		"get=101%",
+		"get=-1%",
+		"get=-10ms",
+		"get=soon",
+		"get=10ms+",
+	} {
+		if _, err := parseFaultRules(bad); err == nil {
+			t.Errorf("%q: accepted", bad)
+		}
+	}
+}
+
+func useFaultRules(t *testing.T, spec string) {
+	rules, err := parseFaultRules(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faultRules.mu.Lock()
+	saved := faultRules.rules
+	faultRules.rules = rules
+	faultRules.mu.Unlock()
+	t.Cleanup(func() {
+		faultRules.mu.Lock()
+		faultRules.rules = saved
+		faultRules.mu.Unlock()
+	})
+}
+
+func TestInjectedStoreFaults(t *testing.T) {
+	useFaultRules(t, "get=100%,*=0%")
+	store := NewFilesystemPasteStore(t.TempDir())
+
+	id := PasteID("abcde")
+	filename := store.filenameForID(id)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte("body"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A store that isn't told to take faults doesn't.
+	if _, err := store.Get(id, nil); errors.Is(err, errInjectedFault) {
+		t.Fatalf("get without faults: %v", err)
+	}
+
+	store.Faults = true
+	_, err := store.Get(id, nil)
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Op != "get" || !errors.Is(err, errInjectedFault) {
+		t.Fatalf("get: got %v, want an injected *os.PathError", err)
+	}
+	if pathErr.Path != filename {
+		t.Errorf("injected fault names %q, not the paste's file", pathErr.Path)
+	}
+	// Ops without a rule of their own follow "*".
+	body, err := store.openBody(id)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	body.Close()
+}
+
+func TestInjectedFaultLatency(t *testing.T) {
+	useFaultRules(t, "read=30ms")
+	start := time.Now()
+	if err := injectFault("read", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("read took %v, want at least 30ms", elapsed)
+	}
+	// Without a rule for an op, or for *, nothing happens.
+	if err := injectFault("write", "x"); err != nil {
+		t.Errorf("write: %v", err)
+	}
+}
+
+func TestInjectedColdStoreFaults(t *testing.T) {
+	useFaultRules(t, "cold.put=100%")
+	cold := withFaultyColdStore(&DirectoryColdStore{Path: t.TempDir()})
+	if err := cold.Put("key", strings.NewReader("body"), 4); !errors.Is(err, errInjectedFault) {
+		t.Errorf("put: got %v, want an injected fault", err)
+	}
+	if _, err := cold.Get("key"); errors.Is(err, errInjectedFault) {
+		t.Errorf("get: got an injected fault without a rule for it")
+	}
+}
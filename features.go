@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Risky features sit behind flags so that they can be rolled out a little
+// at a time. A flag's rollout is "on", "off" or a percentage ("25%") of
+// accounts, chosen by hashing the account's name so that each account
+// stays on one side of the line as the percentage grows. Anonymous
+// visitors only see features that are fully on.
+//
+// The rollout comes from the features section of config.yml unless an
+// admin has set one at /admin/features; admins can also turn a feature on
+// or off for particular accounts, whatever its rollout.
+
+const (
+	RolloutOn  = "on"
+	RolloutOff = "off"
+)
+
+type Feature struct {
+	Name        string
+	Description string
+	// Default is the rollout used when neither config.yml nor an admin
+	// has set one.
+	Default string
+}
+
+var features = make(map[string]*Feature)
+
+// RegisterFeature declares a feature flag. Call it from a package-level
+// variable's declaration rather than from init, so that every flag is known
+// by the time config.yml, which names them, is first loaded.
+func RegisterFeature(name, description, dflt string) *Feature {
+	f := &Feature{Name: name, Description: description, Default: dflt}
+	features[name] = f
+	return f
+}
+
+func validateFeaturesConfig(c *_Configuration) error {
+	for name, rollout := range c.Features {
+		if _, ok := features[name]; !ok {
+			return fmt.Errorf("features: there is no feature flag %q", name)
+		}
+		if _, err := parseRollout(rollout); err != nil {
+			return fmt.Errorf("features: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// parseRollout returns the percentage of accounts a rollout covers.
+func parseRollout(rollout string) (int, error) {
+	switch rollout {
+	case RolloutOn:
+		return 100, nil
+	case RolloutOff, "":
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(rollout, "%"))
+	if err != nil || !strings.HasSuffix(rollout, "%") || n < 0 || n > 100 {
+		return 0, fmt.Errorf("%q is not a rollout (on, off or a percentage like 25%%)", rollout)
+	}
+	return n, nil
+}
+
+// rolloutBucket places an account in [0, 100) for a feature.
+func rolloutBucket(feature, accountName string) int {
+	sum := sha1.Sum([]byte(feature + "|" + accountName))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+type FeatureOverrides struct {
+	// Rollout overrides config.yml; "" defers to it.
+	Rollout string
+	// Accounts maps stored account names to whether they have the
+	// feature, whatever the rollout.
+	Accounts map[string]bool
+}
+
+type FeatureStore struct {
+	Features map[string]*FeatureOverrides
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *FeatureStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = gob.NewEncoder(file).Encode(s)
+	if err != nil {
+		glog.Error("Failed to save feature flags: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+// overrides returns the overrides for a feature, creating them. It must be
+// called with s.mu held.
+func (s *FeatureStore) overrides(name string) *FeatureOverrides {
+	o, ok := s.Features[name]
+	if !ok {
+		o = &FeatureOverrides{Accounts: make(map[string]bool)}
+		s.Features[name] = o
+	}
+	return o
+}
+
+func (s *FeatureStore) SetRollout(name, rollout string) error {
+	if rollout != "" {
+		if _, err := parseRollout(rollout); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides(name).Rollout = rollout
+	return s.save()
+}
+
+func (s *FeatureStore) SetAccount(name, accountName string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides(name).Accounts[accountName] = enabled
+	return s.save()
+}
+
+func (s *FeatureStore) ClearAccount(name, accountName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.overrides(name).Accounts, accountName)
+	return s.save()
+}
+
+// Rollout returns a feature's rollout and where it came from: "admin",
+// "config" or "default".
+func (s *FeatureStore) Rollout(name string) (string, string) {
+	s.mu.Lock()
+	o, ok := s.Features[name]
+	s.mu.Unlock()
+	if ok && o.Rollout != "" {
+		return o.Rollout, "admin"
+	}
+	if rollout, ok := instanceConfig.Features[name]; ok {
+		return rollout, "config"
+	}
+	if f, ok := features[name]; ok {
+		return f.Default, "default"
+	}
+	return RolloutOff, "default"
+}
+
+// Enabled reports whether the named account (or, if accountName is "",
+// an anonymous visitor) has a feature.
+func (s *FeatureStore) Enabled(name, accountName string) bool {
+	if accountName != "" {
+		s.mu.Lock()
+		o, ok := s.Features[name]
+		var enabled, overridden bool
+		if ok {
+			enabled, overridden = o.Accounts[accountName]
+		}
+		s.mu.Unlock()
+		if overridden {
+			return enabled
+		}
+	}
+
+	// A rollout that doesn't parse is off.
+	rollout, _ := s.Rollout(name)
+	percent, _ := parseRollout(rollout)
+	if percent >= 100 || accountName == "" {
+		return percent >= 100
+	}
+	return rolloutBucket(name, accountName) < percent
+}
+
+// Accounts returns the accounts with overrides for a feature.
+func (s *FeatureStore) Accounts(name string) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := make(map[string]bool)
+	if o, ok := s.Features[name]; ok {
+		for k, v := range o.Accounts {
+			accounts[k] = v
+		}
+	}
+	return accounts
+}
+
+func LoadFeatureStore(filename string) *FeatureStore {
+	var s *FeatureStore
+	file, err := os.Open(filename)
+	if err == nil {
+		err := gob.NewDecoder(file).Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode feature flags: ", err)
+		}
+	}
+	if s == nil {
+		s = &FeatureStore{}
+	}
+	if s.Features == nil {
+		s.Features = make(map[string]*FeatureOverrides)
+	}
+	s.filename = filename
+	return s
+}
+
+// featureEnabled reports whether the feature is enabled for r's user.
+func featureEnabled(r *http.Request, name string) bool {
+	accountName := ""
+	if user := GetUser(r); user != nil {
+		accountName = user.Name
+	}
+	return featureStore.Enabled(name, accountName)
+}
+
+type featureStatus struct {
+	*Feature
+	Rollout  string
+	Source   string
+	Accounts map[string]bool
+}
+
+func adminFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	var list []featureStatus
+	for _, f := range features {
+		rollout, source := featureStore.Rollout(f.Name)
+		list = append(list, featureStatus{f, rollout, source, featureStore.Accounts(f.Name)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	RenderPage(w, r, "admin_features", list)
+}
+
+func adminFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		w.Header().Set("Location", "/admin/features")
+		w.WriteHeader(http.StatusSeeOther)
+	}()
+
+	name := mux.Vars(r)["name"]
+	if _, ok := features[name]; !ok {
+		SetFlash(w, "error", "There is no feature called "+name+".")
+		return
+	}
+
+	var err error
+	if username := r.FormValue("username"); username != "" {
+		user := userStore.Get(username)
+		if user == nil {
+			SetFlash(w, "error", "Couldn't find "+username+".")
+			return
+		}
+		switch r.FormValue("account") {
+		case RolloutOn, RolloutOff:
+			err = featureStore.SetAccount(name, user.Name, r.FormValue("account") == RolloutOn)
+		default:
+			err = featureStore.ClearAccount(name, user.Name)
+		}
+	} else {
+		err = featureStore.SetRollout(name, strings.TrimSpace(r.FormValue("rollout")))
+	}
+	if err != nil {
+		SetFlash(w, "error", err.Error())
+		return
+	}
+	SetFlash(w, "success", "Updated "+name+".")
+}
+
+var featureStore *FeatureStore
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	featureStore = LoadFeatureStore(filepath.Join(arguments.root, "features.gob"))
+
+	RegisterTemplateFunction("feature", func(ri *RenderContext, name string) bool {
+		return featureEnabled(ri.Request, name)
+	})
+}
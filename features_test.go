@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestValidateFeaturesConfig(t *testing.T) {
+	for _, tc := range []struct {
+		features map[string]string
+		ok       bool
+	}{
+		{map[string]string{"activitypub": "on"}, true},
+		{map[string]string{"activitypub": "25%"}, true},
+		{map[string]string{"activitypub": "off"}, true},
+		{map[string]string{"activitypub": "150%"}, false},
+		{map[string]string{"activitypub": "25"}, false},
+		{map[string]string{"activitypub": "yes"}, false},
+		{map[string]string{"activitypbu": "on"}, false},
+	} {
+		c := defaultConfiguration()
+		c.Features = tc.features
+		if err := validateFeaturesConfig(&c); (err == nil) != tc.ok {
+			t.Errorf("%v: got %v, want ok %v", tc.features, err, tc.ok)
+		}
+	}
+}
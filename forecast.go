@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
+)
+
+// Before changing how long pastes live, operators can see what would go:
+// an expiration forecast lists the pastes that would expire within a
+// horizon, without destroying anything. It is built from the expirator's
+// schedule (as of its last flush) and from the pastes themselves, and
+// gives each paste's reason:
+//
+//	scheduled  its own expiration comes due
+//	trash      it is in the trash, and will be purged
+//	retention  its retention class's maximum, counted from when it was
+//	           last modified, comes due before its own expiration
+//
+// A forecast may be given retention maximums to try ("ephemeral=1h",
+// "archive=" for no bound) in place of those in config.yml, to see what a
+// change to retention.classes would do to the pastes already stored. Those
+// pastes are held to a new maximum as their expirations are next set.
+//
+// Forecasts are served to admins at /api/v1/admin/expirations/forecast,
+// and logged by the expiration-forecast job.
+
+// MaxForecastPastes is how many pastes a forecast lists; all of them are
+// counted.
+const MaxForecastPastes = 1000
+
+const (
+	ForecastScheduled = "scheduled"
+	ForecastTrash     = "trash"
+	ForecastRetention = "retention"
+)
+
+type ForecastEntry struct {
+	ID      PasteID   `json:"id"`
+	Expires time.Time `json:"expires"`
+	Reason  string    `json:"reason"`
+	Class   string    `json:"class,omitempty"`
+}
+
+type ExpirationForecast struct {
+	Horizon   string          `json:"horizon"`
+	Generated time.Time       `json:"generated"`
+	Counts    map[string]int  `json:"counts"`
+	Pastes    []ForecastEntry `json:"pastes"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// parseRetentionOverrides parses retention maximums to try, as
+// class=max[,class=max...].
+func parseRetentionOverrides(s string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not class=max", field)
+		}
+		name, max := strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:])
+		if RetentionClassNamed(name) == nil {
+			return nil, fmt.Errorf("no retention class is named %q", name)
+		}
+		if max != "" {
+			if d, err := ParseDuration(max); err != nil || d <= 0 {
+				return nil, fmt.Errorf("retention class %q: max %q is not a duration", name, max)
+			}
+		}
+		overrides[name] = max
+	}
+	return overrides, nil
+}
+
+// retentionDeadline returns when p's retention class, with its maximum
+// overridden as given, would have it expire, or the zero time if it
+// wouldn't.
+func retentionDeadline(p *Paste, overrides map[string]string) time.Time {
+	class := RetentionClassNamed(p.Retention)
+	if class == nil {
+		return time.Time{}
+	}
+	max := class.Max
+	if o, ok := overrides[class.Name]; ok {
+		max = o
+	}
+	d, err := ParseDuration(max)
+	if err != nil || d <= 0 {
+		return time.Time{}
+	}
+	return p.LastModified().Add(d)
+}
+
+// forecastExpirations lists the pastes in store that would expire within
+// horizon.
+func forecastExpirations(store *FilesystemPasteStore, expirationFilename string, horizon time.Duration, overrides map[string]string) (*ExpirationForecast, error) {
+	schedule, err := ReadExpirationSchedule(expirationFilename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	now := time.Now()
+	until := now.Add(horizon)
+	forecast := &ExpirationForecast{
+		Horizon:   horizon.String(),
+		Generated: now,
+		Counts:    make(map[string]int),
+	}
+	err = store.Walk(func(id PasteID) error {
+		filename := store.filenameForID(id)
+		fi, err := os.Stat(filename)
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		p := &Paste{ID: id, mtime: fi.ModTime()}
+		if _, err := parsePasteMetadata(p, readPasteMetadata(filename)); err != nil {
+			return nil
+		}
+
+		entry := ForecastEntry{ID: id}
+		expires, ok := schedule[gotimeout.ExpirableID(id)]
+		if !ok {
+			// Scheduled since the last flush, perhaps.
+			expires = p.ExpirationTime()
+		}
+		if !expires.IsZero() {
+			entry.Expires, entry.Reason = expires, ForecastScheduled
+			if p.trashed != "" {
+				entry.Reason = ForecastTrash
+			}
+		}
+		if p.trashed == "" {
+			// Compared with the paste's own expiration, which is counted
+			// from the same time; the schedule can lag it by a moment.
+			own := p.ExpirationTime()
+			if deadline := retentionDeadline(p, overrides); !deadline.IsZero() && (own.IsZero() || deadline.Before(own)) {
+				entry.Expires, entry.Reason, entry.Class = deadline, ForecastRetention, p.Retention
+			}
+		}
+		if entry.Expires.IsZero() || entry.Expires.After(until) {
+			return nil
+		}
+
+		forecast.Counts[entry.Reason]++
+		forecast.Pastes = append(forecast.Pastes, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(forecast.Pastes, func(i, j int) bool { return forecast.Pastes[i].Expires.Before(forecast.Pastes[j].Expires) })
+	if len(forecast.Pastes) > MaxForecastPastes {
+		forecast.Pastes, forecast.Truncated = forecast.Pastes[:MaxForecastPastes], true
+	}
+	return forecast, nil
+}
+
+// Total returns how many pastes would expire.
+func (f *ExpirationForecast) Total() int {
+	n := 0
+	for _, c := range f.Counts {
+		n += c
+	}
+	return n
+}
+
+// parseForecastArgs reads a forecast's horizon (a week, if it is "") and
+// retention maximums to try.
+func parseForecastArgs(horizon, retention string) (time.Duration, map[string]string, error) {
+	d := 7 * 24 * time.Hour
+	if horizon != "" {
+		var err error
+		if d, err = ParseDuration(horizon); err != nil || d <= 0 {
+			return 0, nil, fmt.Errorf("horizon %q is not a duration", horizon)
+		}
+	}
+	overrides, err := parseRetentionOverrides(retention)
+	if err != nil {
+		return 0, nil, err
+	}
+	return d, overrides, nil
+}
+
+func apiExpirationForecastHandler(w http.ResponseWriter, r *http.Request) {
+	horizon, overrides, err := parseForecastArgs(r.FormValue("horizon"), r.FormValue("retention"))
+	if err != nil {
+		writeAPIError(w, apiError(APIErrorValidation, "%v", err))
+		return
+	}
+	forecast, err := forecastExpirations(filesystemPasteStore, garbageCollector.ExpirationFilename, horizon, overrides)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, forecast)
+}
+
+func init() {
+	RegisterJob("expiration-forecast", "Log the pastes that would expire within horizon (a week), trying retention maximums (class=max,...) if given; nothing is destroyed.", func(run *JobRun) error {
+		horizon, overrides, err := parseForecastArgs(run.Args["horizon"], run.Args["retention"])
+		if err != nil {
+			return err
+		}
+		forecast, err := forecastExpirations(filesystemPasteStore, garbageCollector.ExpirationFilename, horizon, overrides)
+		if err != nil {
+			return err
+		}
+		for _, entry := range forecast.Pastes {
+			if entry.Class != "" {
+				glog.Infof("FORECAST: %s expires %v (%s %s)", entry.ID, entry.Expires.UTC(), entry.Reason, entry.Class)
+			} else {
+				glog.Infof("FORECAST: %s expires %v (%s)", entry.ID, entry.Expires.UTC(), entry.Reason)
+			}
+		}
+		run.SetResult("%d pastes would expire in %v: %d scheduled, %d in the trash, %d by retention class", forecast.Total(), horizon, forecast.Counts[ForecastScheduled], forecast.Counts[ForecastTrash], forecast.Counts[ForecastRetention])
+		return nil
+	}, "horizon", "retention")
+}
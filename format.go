@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// JSON, XML and SQL pastes can be shown reformatted:
+//
+//	GET /paste/{id}/formatted             the formatted body, as text
+//	GET /api/v1/pastes/{id}/formatted     the same, as JSON
+//
+// leaving the paste as it is. Its editors can instead save the formatted
+// body over the original, as a new revision (POST to either; the API takes
+// If-Match, or the form value revision, as an update does). Only pastes of
+// up to format.max_size bytes are formatted, and only those that parse: a
+// paste that doesn't is refused with where it went wrong.
+
+// pasteFormatters format bodies by language ID.
+var pasteFormatters = map[string]func([]byte) ([]byte, error){
+	"json":       formatJSON,
+	"xml":        formatXML,
+	"sql":        formatSQL,
+	"mysql":      formatSQL,
+	"postgresql": formatSQL,
+}
+
+// PasteFormatError is a paste that couldn't be formatted as its language.
+type PasteFormatError struct {
+	ID         PasteID
+	Language   string
+	Diagnostic PasteDiagnostic
+}
+
+func (e PasteFormatError) Error() string {
+	return fmt.Sprintf("Paste %v can't be formatted: it isn't valid %s (line %d: %s).", e.ID, e.Language, e.Diagnostic.Line, e.Diagnostic.Message)
+}
+
+func (e PasteFormatError) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+func (e PasteFormatError) APIErrorCode() string {
+	return APIErrorValidation
+}
+
+func (e PasteFormatError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{"diagnostics": []PasteDiagnostic{e.Diagnostic}}
+}
+
+// diagnosticError carries a formatter's complaint to PasteFormatError.
+type diagnosticError PasteDiagnostic
+
+func (e diagnosticError) Error() string {
+	return e.Message
+}
+
+func firstDiagnostic(diagnostics []PasteDiagnostic) error {
+	if len(diagnostics) == 0 {
+		return nil
+	}
+	return diagnosticError(diagnostics[0])
+}
+
+func formatJSON(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		return nil, firstDiagnostic(validateJSON(body))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// formatXML indents elements by hand, as encoding/xml's encoder would
+// rewrite namespace prefixes. Text is trimmed; an element holding only text
+// stays on one line.
+func formatXML(body []byte) ([]byte, error) {
+	if err := firstDiagnostic(validateXML(body)); err != nil {
+		return nil, err
+	}
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.CharsetReader = func(charset string, r io.Reader) (io.Reader, error) { return r, nil }
+
+	var buf bytes.Buffer
+	depth := 0
+	open, text := false, false // the last thing written was a start tag; text inside it
+	newline := func() {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(strings.Repeat("  ", depth))
+	}
+	name := func(n xml.Name) string {
+		if n.Space != "" {
+			return n.Space + ":" + n.Local
+		}
+		return n.Local
+	}
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, firstDiagnostic(validateXML(body))
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			newline()
+			buf.WriteString("<" + name(t.Name))
+			for _, a := range t.Attr {
+				buf.WriteString(" " + name(a.Name) + `="`)
+				xml.EscapeText(&buf, []byte(a.Value))
+				buf.WriteString(`"`)
+			}
+			buf.WriteString(">")
+			depth++
+			open, text = true, false
+		case xml.EndElement:
+			depth--
+			if !open {
+				newline()
+			}
+			buf.WriteString("</" + name(t.Name) + ">")
+			open, text = false, false
+		case xml.CharData:
+			trimmed := bytes.TrimSpace(t)
+			if len(trimmed) == 0 {
+				continue
+			}
+			if !open || text {
+				newline()
+			}
+			xml.EscapeText(&buf, trimmed)
+			text = open
+		case xml.Comment:
+			newline()
+			buf.WriteString("<!--" + string(t) + "-->")
+			open, text = false, false
+		case xml.ProcInst:
+			newline()
+			buf.WriteString("<?" + t.Target)
+			if len(t.Inst) > 0 {
+				buf.WriteString(" " + string(t.Inst))
+			}
+			buf.WriteString("?>")
+			open, text = false, false
+		case xml.Directive:
+			newline()
+			buf.WriteString("<!" + string(t) + ">")
+			open, text = false, false
+		}
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+var sqlKeywords = map[string]bool{}
+
+// sqlClauses begin a line of their own; sqlJoins, too, unless they follow
+// another (LEFT OUTER JOIN).
+var sqlClauses = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "ORDER": true,
+	"HAVING": true, "LIMIT": true, "OFFSET": true, "UNION": true, "EXCEPT": true,
+	"INTERSECT": true, "VALUES": true, "SET": true, "RETURNING": true,
+	"INSERT": true, "UPDATE": true, "DELETE": true, "WITH": true,
+}
+
+var sqlJoins = map[string]bool{
+	"JOIN": true, "LEFT": true, "RIGHT": true, "INNER": true, "OUTER": true,
+	"FULL": true, "CROSS": true, "NATURAL": true,
+}
+
+func init() {
+	for _, k := range strings.Fields(`ALL ALTER AND AS ASC BETWEEN BY CASE CAST
+		CHECK COLUMN CONSTRAINT CREATE DEFAULT DESC DISTINCT DROP ELSE END
+		EXISTS FOREIGN IF IN INDEX INTO IS KEY LIKE NOT NULL ON OR PRIMARY
+		REFERENCES TABLE THEN UNIQUE USING VIEW WHEN`) {
+		sqlKeywords[k] = true
+	}
+	for k := range sqlClauses {
+		sqlKeywords[k] = true
+	}
+	for k := range sqlJoins {
+		sqlKeywords[k] = true
+	}
+}
+
+func sqlWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c == '@' || c == '.' || c >= 0x80
+}
+
+// sqlTokens splits SQL into words, quoted strings and identifiers,
+// comments and punctuation, dropping whitespace.
+func sqlTokens(s string) ([]string, error) {
+	unterminated := func(start int, what string) error {
+		line, column := lineAndColumn([]byte(s), int64(start))
+		return diagnosticError(PasteDiagnostic{Line: line, Column: column, Message: "unterminated " + what})
+	}
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case strings.HasPrefix(s[i:], "--"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, unterminated(start, "comment")
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			i++
+			for ; i < len(s); i++ {
+				if s[i] == c {
+					// A doubled quote is an escaped one.
+					if i+1 < len(s) && s[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			if i >= len(s) {
+				return nil, unterminated(start, "quoted "+string(c))
+			}
+			i++
+		case sqlWordByte(c):
+			for i < len(s) && sqlWordByte(s[i]) {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "::") || strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">=") || strings.HasPrefix(s[i:], "<>") || strings.HasPrefix(s[i:], "!=") || strings.HasPrefix(s[i:], "||"):
+			i += 2
+		default:
+			i++
+		}
+		tokens = append(tokens, s[start:i])
+	}
+	return tokens, nil
+}
+
+// formatSQL puts each clause on a line of its own, and each of the columns
+// of a SELECT and the conditions joined by AND and OR on one under it,
+// indenting subqueries by their depth. Keywords are capitalized.
+func formatSQL(body []byte) ([]byte, error) {
+	tokens, err := sqlTokens(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	// clauses holds the clause being written at each depth of parentheses.
+	clauses := []string{""}
+	prev, between := "", false
+	newline := func(indent int) {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(strings.Repeat("  ", indent))
+		prev = "\n"
+	}
+	for _, tok := range tokens {
+		depth := len(clauses) - 1
+		indent := 2 * depth
+		word := strings.ToUpper(tok)
+		if !sqlKeywords[word] {
+			word = tok
+		}
+		switch {
+		case strings.HasPrefix(tok, "--"):
+			if prev != "\n" && buf.Len() > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(tok)
+			newline(indent)
+			continue
+		case tok == ";":
+			buf.WriteString(";\n")
+			clauses, prev, between = []string{""}, "", false
+			continue
+		case sqlClauses[word]:
+			if prev != "(" {
+				newline(indent)
+			}
+			clauses[depth] = word
+		case sqlJoins[word] && !sqlJoins[strings.ToUpper(prev)]:
+			newline(indent)
+			clauses[depth] = word
+		case (word == "AND" && !between) || word == "OR":
+			newline(indent + 1)
+		case word == "BETWEEN":
+			between = true
+		case word == "AND":
+			between = false
+		}
+
+		switch {
+		case prev == "\n" || buf.Len() == 0:
+		case tok == "," || tok == ")" || tok == "." || tok == "::" || prev == "(" || prev == "." || prev == "::":
+		case tok == "(" && !sqlKeywords[strings.ToUpper(prev)] && !strings.ContainsAny(prev[:1], "=<>!+-*/,|'\""):
+			// A function call.
+		default:
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(word)
+		prev = tok
+
+		switch {
+		case tok == "(":
+			clauses = append(clauses, "")
+		case tok == ")" && depth > 0:
+			clauses = clauses[:depth]
+		case tok == "," && clauses[depth] == "SELECT":
+			newline(indent + 1)
+		}
+	}
+	out := bytes.TrimRight(buf.Bytes(), " \n")
+	return append(out, '\n'), nil
+}
+
+// pasteFormattable reports whether p can be shown formatted.
+func pasteFormattable(p *Paste) bool {
+	return p.Language != nil && pasteFormatters[p.Language.ID] != nil && !p.direct && instanceConfig.Format.MaxSize > 0
+}
+
+// formatPaste returns p's body formatted.
+func formatPaste(p *Paste) ([]byte, error) {
+	if !pasteFormattable(p) {
+		return nil, apiError(APIErrorValidation, "paste %v isn't in a language that can be formatted", p.ID)
+	}
+	reader, err := p.Reader()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(reader, instanceConfig.Format.MaxSize+1))
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > instanceConfig.Format.MaxSize {
+		return nil, apiError(APIErrorTooLarge, "paste %v is too large to format (over %v)", p.ID, ByteSize(instanceConfig.Format.MaxSize))
+	}
+	formatted, err := pasteFormatters[p.Language.ID](body)
+	if d, ok := err.(diagnosticError); ok {
+		healthServer.IncrementMetric("paste.format.failed")
+		return nil, PasteFormatError{p.ID, p.Language.Name, PasteDiagnostic(d)}
+	}
+	if err == nil {
+		healthServer.IncrementMetric("paste.formatted")
+	}
+	return formatted, err
+}
+
+// pasteFormattedHandler shows p's body formatted, as text.
+func pasteFormattedHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	formatted, err := formatPaste(p)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(formatted)
+}
+
+// saveFormattedPaste formats p's body, and saves it over the original.
+// The caller holds p's update lock.
+func saveFormattedPaste(r *http.Request, p *Paste) error {
+	if err := checkPastePrecondition(r, p); err != nil {
+		return err
+	}
+	formatted, err := formatPaste(p)
+	if err != nil {
+		return err
+	}
+	return replacePasteBody(r, p, string(formatted))
+}
+
+func pasteFormat(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	defer lockPasteUpdates(p.ID)()
+	if err := saveFormattedPaste(r, p); err != nil {
+		panic(err)
+	}
+	SetFlash(w, "success", fmt.Sprintf("Paste %v reformatted.", p.ID))
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// apiPasteFormattedHandler returns a paste's body formatted (GET), or saves
+// it formatted (POST).
+func apiPasteFormattedHandler(w http.ResponseWriter, r *http.Request) {
+	o, err := lookupPasteWithRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p := o.(*Paste)
+
+	if r.Method == "POST" {
+		if !isEditAllowed(p, r) {
+			writeAPIError(w, PasteAccessDeniedError{"edit", p.ID})
+			return
+		}
+		if p.Encrypted {
+			writeAPIError(w, apiError(APIErrorValidation, "encrypted pastes can only be edited with the web form"))
+			return
+		}
+		defer lockPasteUpdates(p.ID)()
+		if err := saveFormattedPaste(r, p); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		revision := pasteRevision(p)
+		w.Header().Set("ETag", pasteETag(revision))
+		resp := map[string]interface{}{
+			"id":       p.ID,
+			"url":      pasteURL("show", p),
+			"revision": revision,
+			"status":   pasteStatus(p),
+		}
+		if p.diagnostics != nil {
+			resp["diagnostics"] = p.diagnostics
+		}
+		writeAPIResponse(w, http.StatusOK, resp)
+		return
+	}
+
+	if err := checkSeal(p, r); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	served, err := countView(p, r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer served()
+	formatted, err := formatPaste(p)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"id":       p.ID,
+		"language": p.Language.ID,
+		"revision": pasteRevision(p),
+		"body":     string(formatted),
+	})
+}
+
+func init() {
+	RegisterTemplateFunction("pasteFormattable", pasteFormattable)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Bodies younger than this are left alone; a paste being created has its
+// body written before its metadata.
+const GC_GRACE_PERIOD time.Duration = 5 * time.Minute
+
+type OrphanKind string
+
+const (
+	OrphanBodyWithoutMetadata    OrphanKind = "body_without_metadata"
+	OrphanMetadataWithoutBody    OrphanKind = "metadata_without_body"
+	OrphanExpirationWithoutPaste OrphanKind = "expiration_without_paste"
+	OrphanPasteMissingExpiration OrphanKind = "paste_missing_expiration"
+	OrphanGrantWithoutPaste      OrphanKind = "grant_without_paste"
+	OrphanReportWithoutPaste     OrphanKind = "report_without_paste"
+)
+
+var orphanKinds = []OrphanKind{
+	OrphanBodyWithoutMetadata,
+	OrphanMetadataWithoutBody,
+	OrphanExpirationWithoutPaste,
+	OrphanPasteMissingExpiration,
+	OrphanGrantWithoutPaste,
+	OrphanReportWithoutPaste,
+}
+
+type Orphan struct {
+	Kind OrphanKind
+	ID   string
+}
+
+func (o Orphan) String() string {
+	return string(o.Kind) + " " + o.ID
+}
+
+type GCReport struct {
+	Started  time.Time
+	Finished time.Time
+	Clean    bool
+	Orphans  []Orphan
+	Cleaned  int
+	Errors   []string
+}
+
+func (r *GCReport) Counts() map[OrphanKind]int {
+	counts := make(map[OrphanKind]int)
+	for _, o := range r.Orphans {
+		counts[o.Kind]++
+	}
+	return counts
+}
+
+// GarbageCollector finds data left behind by crashes and partial writes:
+// paste bodies whose metadata was never written, metadata whose body was
+// truncated away, expirations (and grants, and reports) for pastes that no
+// longer exist, and expiring pastes whose expiration handle was lost.
+type GarbageCollector struct {
+	Store              *FilesystemPasteStore
+	ExpirationFilename string
+
+	mu         sync.Mutex
+	lastReport *GCReport
+}
+
+func (gc *GarbageCollector) LastReport() *GCReport {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.lastReport
+}
+
+func (gc *GarbageCollector) pasteExists(id PasteID) bool {
+	_, err := os.Stat(gc.Store.filenameForID(id))
+	return err == nil
+}
+
+func (gc *GarbageCollector) sweepBodies(report *GCReport) error {
+	return gc.Store.Walk(func(id PasteID) error {
+		filename := gc.Store.filenameForID(id)
+		fi, err := os.Stat(filename)
+		if err != nil || fi.IsDir() || time.Since(fi.ModTime()) < GC_GRACE_PERIOD {
+			return nil
+		}
+
+		kind := OrphanKind("")
+		if !hasMetadata(filename, "language") {
+			kind = OrphanBodyWithoutMetadata
+		} else if fi.Size() == 0 && gc.Store.archivedKey(filename) == "" && gc.Store.packedPointer(filename) == "" {
+			kind = OrphanMetadataWithoutBody
+		}
+
+		if kind != "" {
+			report.Orphans = append(report.Orphans, Orphan{kind, id.String()})
+			if report.Clean {
+				if err := gc.Store.Destroy(&Paste{ID: id, store: gc.Store, deletionReason: "orphaned (" + string(kind) + ")"}); err != nil {
+					report.Errors = append(report.Errors, err.Error())
+				} else {
+					report.Cleaned++
+				}
+			}
+			return nil
+		}
+
+		p, err := gc.Store.Get(id, nil)
+		if p == nil {
+			return nil
+		}
+		if p.Expiration != "" && p.Expiration != "-1" && !pasteExpirator.ObjectHasExpiration(p) {
+			report.Orphans = append(report.Orphans, Orphan{OrphanPasteMissingExpiration, id.String()})
+			if report.Clean {
+				// An expiration in the past fires immediately.
+				pasteExpirator.ExpireObject(p, p.ExpirationTime().Sub(time.Now()))
+				report.Cleaned++
+			}
+		}
+		return nil
+	})
+}
+
+func (gc *GarbageCollector) sweepExpirations(report *GCReport) error {
+	schedule, err := ReadExpirationSchedule(gc.ExpirationFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for eid := range schedule {
+		id := PasteID(eid)
+		if gc.pasteExists(id) {
+			continue
+		}
+		report.Orphans = append(report.Orphans, Orphan{OrphanExpirationWithoutPaste, id.String()})
+		if report.Clean {
+			pasteExpirator.CancelObjectExpiration(&Paste{ID: id})
+			report.Cleaned++
+		}
+	}
+	return nil
+}
+
+func (gc *GarbageCollector) sweepGrants(report *GCReport) {
+	var orphaned []GrantID
+	for grantKey, id := range grantStore.All() {
+		if !gc.pasteExists(id) {
+			orphaned = append(orphaned, grantKey)
+		}
+	}
+
+	for _, grantKey := range orphaned {
+		report.Orphans = append(report.Orphans, Orphan{OrphanGrantWithoutPaste, string(grantKey)})
+		if report.Clean {
+			grantStore.Delete(grantKey)
+			report.Cleaned++
+		}
+	}
+}
+
+func (gc *GarbageCollector) sweepReports(report *GCReport) {
+	var orphaned []PasteID
+	for id := range reportStore.All() {
+		if !gc.pasteExists(id) {
+			orphaned = append(orphaned, id)
+		}
+	}
+
+	for _, id := range orphaned {
+		report.Orphans = append(report.Orphans, Orphan{OrphanReportWithoutPaste, id.String()})
+		if report.Clean {
+			reportStore.Delete(id)
+			report.Cleaned++
+		}
+	}
+}
+
+// Sweep runs a single pass over all stores. When clean is false, orphans are
+// only reported.
+func (gc *GarbageCollector) Sweep(clean bool) *GCReport {
+	report := &GCReport{
+		Started: time.Now(),
+		Clean:   clean,
+	}
+
+	if err := gc.sweepBodies(report); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	if err := gc.sweepExpirations(report); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	gc.sweepGrants(report)
+	gc.sweepReports(report)
+
+	report.Finished = time.Now()
+
+	gc.mu.Lock()
+	gc.lastReport = report
+	gc.mu.Unlock()
+
+	for _, o := range report.Orphans {
+		glog.Info("GC: Orphan ", o)
+	}
+	for _, e := range report.Errors {
+		glog.Error("GC: ", e)
+	}
+	glog.Infof("GC: Found %d orphans, cleaned %d in %v.", len(report.Orphans), report.Cleaned, report.Finished.Sub(report.Started))
+
+	healthServer.IncrementMetric("gc.runs")
+	counts := report.Counts()
+	for _, kind := range orphanKinds {
+		healthServer.SetMetric(fmt.Sprintf("gc.orphans.%s", kind), counts[kind])
+	}
+	return report
+}
+
+func adminGCHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := jobRunner.Enqueue("gc", map[string]string{"clean": r.FormValue("clean")}); err != nil {
+		SetFlash(w, "error", err.Error())
+	} else {
+		SetFlash(w, "success", "Sweep queued; see Jobs for its progress.")
+	}
+	w.Header().Set("Location", "/admin")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var garbageCollector *GarbageCollector
+
+func init() {
+	RegisterJob("gc", "Sweep for orphaned data (removing it if gc.clean is set, or clean is true).", func(run *JobRun) error {
+		clean := instanceConfig.GC.Clean
+		if v, ok := run.Args["clean"]; ok {
+			clean = v == "true"
+		}
+		report := garbageCollector.Sweep(clean)
+		run.SetResult("found %d orphans, cleaned %d", len(report.Orphans), report.Cleaned)
+		return nil
+	}, "clean")
+}
@@ -1,5 +1,7 @@
 module github.com/DHowett/ghostbin
 
+go 1.16
+
 require (
 	github.com/DHowett/go-xattr v0.0.0-20181227225257-7d72f4cdfe6d
 	github.com/DHowett/gotimeout v0.0.0-20161206082608-24e8dccd7474
@@ -10,9 +12,14 @@ require (
 	github.com/gorilla/sessions v1.1.3
 	github.com/microcosm-cc/bluemonday v1.0.2
 	github.com/russross/blackfriday v1.5.2
-	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc
-	gopkg.in/yaml.v2 v2.2.2
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	golang.org/x/net v0.0.0-20181220203305-927f97764cc3 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
 )
 
 replace github.com/gorilla/sessions => github.com/cj123/sessions v1.1.5
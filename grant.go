@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/DHowett/gotimeout"
@@ -14,6 +15,7 @@ type GrantStore struct {
 	Grants     map[GrantID]PasteID
 	ExpiryJunk *gotimeout.HandleMap
 
+	mu        sync.Mutex
 	filename  string
 	expirator *gotimeout.Expirator
 }
@@ -21,6 +23,13 @@ type GrantStore struct {
 type GrantID string
 
 func (r *GrantStore) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.save()
+}
+
+// save must be called with mu held.
+func (r *GrantStore) save() error {
 	asideFilename := r.filename + ".atomic"
 	file, err := os.Create(asideFilename)
 	if err != nil {
@@ -42,10 +51,14 @@ func (r *GrantStore) Save() error {
 func (r *GrantStore) NewGrant(id PasteID) GrantID {
 	newKey, _ := generateRandomBase32String(20, 32)
 	grantKey := GrantID(newKey)
+	r.mu.Lock()
 	r.Grants[grantKey] = id
+	r.save()
+	r.mu.Unlock()
 
+	// The expirator takes its own lock before calling back into the store,
+	// so it must never be called with mu held.
 	r.expirator.ExpireObject(grantKey, 48*time.Hour)
-	r.Save()
 
 	return grantKey
 	//GrantID returned
@@ -53,15 +66,31 @@ func (r *GrantStore) NewGrant(id PasteID) GrantID {
 
 func (r *GrantStore) Delete(p GrantID) {
 	r.expirator.CancelObjectExpiration(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.Grants, p)
-	r.Save()
+	r.save()
 }
 
 func (r *GrantStore) Get(p GrantID) (PasteID, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	pid, ok := r.Grants[p]
 	return pid, ok
 }
 
+// All returns a copy of every outstanding grant, safe to range over while
+// grants are being created and redeemed.
+func (r *GrantStore) All() map[GrantID]PasteID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grants := make(map[GrantID]PasteID, len(r.Grants))
+	for k, v := range r.Grants {
+		grants[k] = v
+	}
+	return grants
+}
+
 func LoadGrantStore(filename string) *GrantStore {
 	var gs *GrantStore
 	grant_file, err := os.Open(filename)
@@ -86,8 +115,7 @@ func LoadGrantStore(filename string) *GrantStore {
 
 // grantKey passed in and made sure it exists.
 func (e *GrantStore) GetExpirable(grantKey gotimeout.ExpirableID) gotimeout.Expirable {
-	_, ok := e.Grants[GrantID(grantKey)]
-	if !ok {
+	if _, ok := e.Get(GrantID(grantKey)); !ok {
 		return nil
 	}
 	return GrantID(grantKey)
@@ -108,12 +136,16 @@ func (e *GrantStore) RequiresFlush() bool {
 }
 
 func (e *GrantStore) SaveExpirationHandles(hm *gotimeout.HandleMap) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.ExpiryJunk = hm
-	e.Save()
+	e.save()
 	return nil
 }
 
 func (e *GrantStore) LoadExpirationHandles() (*gotimeout.HandleMap, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.ExpiryJunk, nil
 }
 
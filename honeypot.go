@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Some traps for automated clients, each of which earns whoever springs it
+// an abuse block:
+//
+//   - the paste form carries a field, abuse.honeypot_field, that people
+//     never see and so never fill in;
+//   - probes for software spectre doesn't run (abuse.trap_paths);
+//   - pages carry an invisible link into abuse.crawler_trap, which
+//     robots.txt tells crawlers to keep out of.
+
+// honeypotFilled reports whether the request filled in the honeypot field.
+func honeypotFilled(r *http.Request) bool {
+	field := instanceConfig.Abuse.HoneypotField
+	return instanceConfig.Abuse.Enabled && field != "" && r.FormValue(field) != ""
+}
+
+func isTrapPath(path string) bool {
+	if trap := instanceConfig.Abuse.CrawlerTrap; trap != "" && strings.HasPrefix(path, trap) {
+		return true
+	}
+	for _, trap := range instanceConfig.Abuse.TrapPaths {
+		if path == trap {
+			return true
+		}
+	}
+	return false
+}
+
+// blockTrapped blocks the request's sources for springing a trap. If all
+// there is to go on is a trusted proxy's own address (it didn't say whom it
+// was forwarding for), that address is shared by everyone behind the proxy,
+// so the hit is only logged.
+func blockTrapped(r *http.Request, reason string) {
+	for _, source := range abuseSources(r) {
+		if strings.HasPrefix(source, "ip:") && !sourceIPVerified(r) {
+			glog.Warningf("Not blocking %s, a trusted proxy, for a trap (%s)", source, reason)
+			healthServer.IncrementMetric("abuse.trapped.unverified")
+			continue
+		}
+		abuseBlockStore.Block(source, reason, privacyRetention(instanceConfig.Abuse.BlockDuration.Duration()))
+	}
+	healthServer.IncrementMetric("abuse.trapped")
+}
+
+type honeypotHandler struct {
+	http.Handler
+}
+
+func (h honeypotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !instanceConfig.Abuse.Enabled {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	if isTrapPath(r.URL.Path) {
+		blockTrapped(r, fmt.Sprintf("requested %s", r.URL.Path))
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Path == "/robots.txt" && instanceConfig.Abuse.CrawlerTrap != "" {
+		robots, err := ioutil.ReadFile(filepath.Join("public", "robots.txt"))
+		if err != nil {
+			glog.Error("Failed to read robots.txt: ", err)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(robots)
+		fmt.Fprintf(w, "Disallow: %s\n", instanceConfig.Abuse.CrawlerTrap)
+		return
+	}
+
+	h.Handler.ServeHTTP(w, r)
+}
+
+func init() {
+	RegisterTemplateFunction("honeypotField", func() string {
+		if !instanceConfig.Abuse.Enabled {
+			return ""
+		}
+		return instanceConfig.Abuse.HoneypotField
+	})
+	RegisterTemplateFunction("crawlerTrap", func() string {
+		if !instanceConfig.Abuse.Enabled {
+			return ""
+		}
+		return instanceConfig.Abuse.CrawlerTrap
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrapBlocksOnlyVerifiedAddresses(t *testing.T) {
+	savedAbuse, savedProxies := instanceConfig.Abuse, instanceConfig.HTTP.TrustedProxies
+	defer func() { instanceConfig.Abuse, instanceConfig.HTTP.TrustedProxies = savedAbuse, savedProxies }()
+	instanceConfig.Abuse.Enabled = true
+	instanceConfig.Abuse.TrapPaths = []string{"/wp-login.php"}
+	instanceConfig.HTTP.TrustedProxies = []string{"10.0.0.1"}
+
+	handler := honeypotHandler{http.NotFoundHandler()}
+	for _, tc := range []struct {
+		remote, xff string
+		source      string
+		blocked     bool
+	}{
+		{"203.0.113.9:4000", "", "ip:203.0.113.9", true},
+		{"10.0.0.1:4000", "198.51.100.2", "ip:198.51.100.2", true},
+		{"10.0.0.1:4000", "", "ip:10.0.0.1", false},
+	} {
+		r := httptest.NewRequest("GET", "/wp-login.php", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if _, blocked := abuseBlockStore.Get(tc.source); blocked != tc.blocked {
+			t.Errorf("%s: blocked %v, want %v", tc.source, blocked, tc.blocked)
+		}
+		abuseBlockStore.Unblock(tc.source)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Raw bodies requested from pages on other sites (as told by Referer) are
+// hot-linked: embedded, or offered for download, at the operator's
+// expense. hotlink.action decides what they get: HotlinkAllow serves them
+// as usual, HotlinkInterstitial a page on which the viewer must follow a
+// link to the body, HotlinkThrottle the body at hotlink.throttle_rate, and
+// HotlinkBlock a 403. hotlink.rules can give referring domains (and their
+// subdomains) actions of their own; hotlink.allowed_domains are always
+// allowed. Requests without a Referer, and from the instance's own pages,
+// are never hot-linked.
+
+const (
+	HotlinkAllow        = "allow"
+	HotlinkInterstitial = "interstitial"
+	HotlinkThrottle     = "throttle"
+	HotlinkBlock        = "block"
+)
+
+type HotlinkRule struct {
+	Domain string `yaml:"domain"`
+	Action string `yaml:"action"`
+}
+
+type HotlinkBlockedError struct {
+	Referrer string
+}
+
+func (e HotlinkBlockedError) Error() string {
+	return "This paste can't be embedded in " + e.Referrer + ". Open it on " + Brand() + " instead."
+}
+
+func (e HotlinkBlockedError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+// hostInDomains reports whether host is one of domains or a subdomain of
+// one.
+func hostInDomains(host string, domains []string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// hotlinkPolicyActive reports whether raw bodies depend on their Referer.
+func hotlinkPolicyActive() bool {
+	return instanceConfig.Hotlink.Action != HotlinkAllow || len(instanceConfig.Hotlink.Rules) > 0
+}
+
+// hotlinkAction returns what r, a request for a raw body, is to get, and
+// the host of the site that hot-linked it.
+func hotlinkAction(r *http.Request) (string, string) {
+	cfg := &instanceConfig.Hotlink
+	referrer, err := url.Parse(r.Referer())
+	if err != nil || referrer.Host == "" {
+		return HotlinkAllow, ""
+	}
+	host := referrer.Hostname()
+
+	own := []string{strings.Split(r.Host, ":")[0]}
+	if raw := rawHost(); raw != nil {
+		own = append(own, raw.Hostname())
+	}
+	if base, err := url.Parse(instanceConfig.ActivityPub.BaseURL); err == nil && base.Host != "" {
+		own = append(own, base.Hostname())
+	}
+	for _, o := range own {
+		if strings.EqualFold(host, o) {
+			return HotlinkAllow, ""
+		}
+	}
+	if hostInDomains(host, cfg.AllowedDomains) {
+		return HotlinkAllow, ""
+	}
+	for _, rule := range cfg.Rules {
+		if hostInDomains(host, []string{rule.Domain}) {
+			return rule.Action, host
+		}
+	}
+	return cfg.Action, host
+}
+
+// throttledResponseWriter sends its body through a throttledWriter.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	out io.Writer
+}
+
+func (t throttledResponseWriter) Write(b []byte) (int, error) {
+	return t.out.Write(b)
+}
+
+// checksHotlink applies the hot-linking policy to requests for raw bodies.
+// It comes before redirectsToRawHost, so that hot-links to the main host
+// get their interstitial there.
+func checksHotlink(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		if !hotlinkPolicyActive() {
+			fn(o, w, r)
+			return
+		}
+		// Shared caches must keep hot-linked and other answers apart.
+		w.Header().Add("Vary", "Referer")
+
+		action, referrer := hotlinkAction(r)
+		if action != HotlinkAllow {
+			healthServer.IncrementMetric("hotlink." + action)
+		}
+		switch action {
+		case HotlinkThrottle:
+			w = throttledResponseWriter{w, &throttledWriter{w: w, rate: instanceConfig.Hotlink.ThrottleRate}}
+		case HotlinkInterstitial:
+			w.Header().Set("Cache-Control", "no-store")
+			// The link onward must carry this page as its referrer.
+			w.Header().Set("Referrer-Policy", "same-origin")
+			RenderPage(w, r, "hotlink", map[string]interface{}{
+				"Paste":     o.(*Paste),
+				"Referrer":  referrer,
+				"URL":       r.URL.String(),
+				"OnRawHost": onRawHost(r),
+			})
+			return
+		case HotlinkBlock:
+			w.Header().Set("Cache-Control", "no-store")
+			panic(HotlinkBlockedError{referrer})
+		}
+		fn(o, w, r)
+	}
+}
+
+func validateHotlinkConfig(c *_Configuration) error {
+	valid := func(action string) bool {
+		switch action {
+		case HotlinkAllow, HotlinkInterstitial, HotlinkThrottle, HotlinkBlock:
+			return true
+		}
+		return false
+	}
+	if !valid(c.Hotlink.Action) {
+		return fmt.Errorf("hotlink.action must be allow, interstitial, throttle or block, not %q", c.Hotlink.Action)
+	}
+	throttles := c.Hotlink.Action == HotlinkThrottle
+	for _, rule := range c.Hotlink.Rules {
+		if rule.Domain == "" || !valid(rule.Action) {
+			return fmt.Errorf("hotlink.rules: %q: needs a domain and an action of allow, interstitial, throttle or block", rule.Domain)
+		}
+		throttles = throttles || rule.Action == HotlinkThrottle
+	}
+	if throttles && c.Hotlink.ThrottleRate <= 0 {
+		return fmt.Errorf("hotlink.throttle_rate must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API clients that retry (over flaky networks, from CI) can send an
+// Idempotency-Key header when creating a paste. A repeated key within
+// api.idempotency_window gets the paste the first request created, with
+// Idempotent-Replayed: true, instead of a duplicate; the same key with a
+// different paste is a conflict. Keys belong to the account or, for
+// anonymous clients, the address that used them.
+
+const MaxIdempotencyKeyLength = 255
+
+type idempotentPaste struct {
+	ID          PasteID
+	Fingerprint string
+}
+
+// idempotencyKeysInFlight holds the keys whose first request is still
+// being served.
+var idempotencyKeysInFlight struct {
+	sync.Mutex
+	keys map[string]bool
+}
+
+// idempotencyKeyForRequest returns r's idempotency key, scoped to its
+// sender, or "" if it has none.
+func idempotencyKeyForRequest(r *http.Request) (string, error) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		return "", apiError(APIErrorValidation, "Idempotency-Key must be at most %d characters", MaxIdempotencyKeyLength)
+	}
+	for _, c := range key {
+		if c < 0x20 || c > 0x7e {
+			return "", apiError(APIErrorValidation, "Idempotency-Key must be printable ASCII")
+		}
+	}
+	scope := "ip:" + StoredIPForRequest(r)
+	if user := GetUser(r); user != nil {
+		scope = "user:" + user.Name
+	}
+	return "IDEM|" + scope + "|" + key, nil
+}
+
+// fingerprint identifies the paste in; a key's repeats must carry the same
+// one.
+func (in *PasteInput) fingerprint() string {
+	h := sha256.New()
+	seal := ""
+	if !in.SealedUntil.IsZero() {
+		seal = in.SealedUntil.UTC().Format(time.RFC3339)
+	}
+	values := []string{in.Body, in.Language, in.Title, in.License, in.Expiration, in.Retention, seal, strings.Join(in.Networks, ","), strconv.Itoa(in.ViewLimit)}
+	if in.Immutable {
+		values = append(values, "immutable")
+	}
+	for _, v := range values {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claimIdempotencyKey returns the paste key has already created, or, if it
+// has created none, claims it for the caller, which must then release it.
+func claimIdempotencyKey(key, fingerprint string) (*Paste, error) {
+	idempotencyKeysInFlight.Lock()
+	defer idempotencyKeysInFlight.Unlock()
+
+	if v, ok := ephStore.Get(key); ok {
+		record := v.(idempotentPaste)
+		if record.Fingerprint != fingerprint {
+			return nil, apiError(APIErrorConflict, "Idempotency-Key was already used for a different paste")
+		}
+		p, err := pasteStore.Get(record.ID, nil)
+		if err == nil {
+			return p, nil
+		}
+		// The paste is gone; make another.
+		ephStore.Delete(key)
+	}
+
+	if idempotencyKeysInFlight.keys[key] {
+		return nil, apiError(APIErrorConflict, "a request with this Idempotency-Key is in progress")
+	}
+	if idempotencyKeysInFlight.keys == nil {
+		idempotencyKeysInFlight.keys = make(map[string]bool)
+	}
+	idempotencyKeysInFlight.keys[key] = true
+	return nil, nil
+}
+
+// rememberIdempotencyKey records that key created p.
+func rememberIdempotencyKey(key, fingerprint string, p *Paste) {
+	ephStore.Put(key, idempotentPaste{p.ID, fingerprint}, privacyRetention(instanceConfig.API.IdempotencyWindow.Duration()))
+}
+
+func releaseIdempotencyKey(key string) {
+	idempotencyKeysInFlight.Lock()
+	delete(idempotencyKeysInFlight.keys, key)
+	idempotencyKeysInFlight.Unlock()
+}
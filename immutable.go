@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A paste created with immutable=1 can never be changed: its body, title,
+// language, license and expiration stay as they were created, so that its
+// revision and digest (see digest.go) can be cited as a reference to what
+// it said. It can still be deleted, and still expires. Pastes can't be made
+// immutable later, and immutable ones can't be made mutable; the flag is
+// kept as the paste's "immutable" metadata.
+
+type PasteImmutableError struct {
+	ID PasteID
+}
+
+func (e PasteImmutableError) Error() string {
+	return "Paste " + e.ID.String() + " is immutable, and can't be changed."
+}
+
+func (e PasteImmutableError) StatusCode() int {
+	return http.StatusConflict
+}
+
+func (e PasteImmutableError) APIErrorCode() string {
+	return APIErrorConflict
+}
+
+func (e PasteImmutableError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{"immutable": true}
+}
+
+func (p *Paste) Immutable() bool {
+	return p.immutable
+}
+
+// parseImmutable parses the immutable form value.
+func parseImmutable(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "0", "false", "off":
+		return false, nil
+	case "1", "true", "on":
+		return true, nil
+	}
+	return false, PasteInputError{"immutable", "must be true or false"}
+}
+
+// checkPasteMutable refuses to change an immutable paste.
+func checkPasteMutable(p *Paste) error {
+	if p.immutable {
+		healthServer.IncrementMetric("paste.immutable.refused")
+		return PasteImmutableError{p.ID}
+	}
+	return nil
+}
+
+// refusesImmutable is for the pages that change a paste.
+func refusesImmutable(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		if err := checkPasteMutable(o.(*Paste)); err != nil {
+			panic(err)
+		}
+		fn(o, w, r)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Everything a client says about a paste passes through parsePasteInput
+// before it reaches the store, and everything the store says about one
+// passes through parsePasteMetadata before it reaches a handler. Both are
+// pure functions of their input, so that anything malformed is refused
+// with an error rather than a panic somewhere downstream.
+
+const (
+	MaxTitleLength    = 256
+	MaxLanguageLength = 64
+	MaxPasswordLength = 1024
+)
+
+// PasteInputError reports a malformed paste submission.
+type PasteInputError struct {
+	Field  string
+	Reason string
+}
+
+func (e PasteInputError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+func (e PasteInputError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e PasteInputError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{"field": e.Field}
+}
+
+// PasteInput is a validated paste submission. Body may be empty; what that
+// means is up to the caller.
+type PasteInput struct {
+	Body       string
+	Language   string
+	Title      string
+	License    string
+	Expiration string
+	Retention  string
+	Password   string
+	// SealedUntil is when the paste is to be unsealed, if it is to be
+	// sealed; Unseal is set if it is to be unsealed now.
+	SealedUntil time.Time
+	Unseal      bool
+	// Networks are those to which the paste is to be restricted.
+	Networks []string
+	// ViewLimit is how many views the paste is to be limited to, if it is
+	// to be; NoViewLimit is set if its limit is to be lifted.
+	ViewLimit   int
+	NoViewLimit bool
+	// Source is the URL of the page the paste was clipped from, if any.
+	Source string
+	// Immutable is set if a new paste is never to be changed.
+	Immutable bool
+}
+
+// parseExpiration validates an expiration as submitted: "" (none given),
+// or one of the configured presets (or "-1", never, if that is allowed).
+// Durations equal to a preset's are given as the preset.
+func parseExpiration(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return s, nil
+	}
+	s, err := matchExpiration(&instanceConfig, s)
+	if err != nil {
+		return "", PasteInputError{"expire", err.Error()}
+	}
+	return s, nil
+}
+
+// sanitizeTitle strips a title of line breaks and other control characters.
+func sanitizeTitle(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
+// parsePasteInput validates a paste submission, given a function returning
+// its form values by name. Every error it returns is an HTTPError.
+func parsePasteInput(value func(string) string) (*PasteInput, error) {
+	in := &PasteInput{
+		Body:     value("text"),
+		Language: strings.TrimSpace(value("lang")),
+		Title:    sanitizeTitle(value("title")),
+		License:  strings.TrimSpace(value("license")),
+		Password: value("password"),
+	}
+
+	if !utf8.ValidString(in.Body) {
+		return nil, PasteInputError{"text", "must be UTF-8"}
+	}
+	if pasteLen := ByteSize(len(in.Body)); pasteLen > PASTE_MAXIMUM_LENGTH {
+		return nil, PasteTooLargeError(pasteLen)
+	}
+	if len(in.Language) > MaxLanguageLength {
+		return nil, PasteInputError{"lang", "is not a language"}
+	}
+	if !utf8.ValidString(in.Title) || utf8.RuneCountInString(in.Title) > MaxTitleLength {
+		return nil, PasteInputError{"title", fmt.Sprintf("must be UTF-8 and at most %d characters", MaxTitleLength)}
+	}
+	if in.License != "" {
+		license := LicenseNamed(in.License)
+		if license == nil {
+			return nil, PasteInputError{"license", "is not a license this instance knows"}
+		}
+		in.License = license.ID
+	}
+	if len(in.Password) > MaxPasswordLength {
+		return nil, PasteInputError{"password", "is too long"}
+	}
+
+	var err error
+	if in.Expiration, err = parseExpiration(value("expire")); err != nil {
+		return nil, err
+	}
+	if in.Retention, err = parseRetention(value("retention")); err != nil {
+		return nil, err
+	}
+	if in.SealedUntil, in.Unseal, err = parseSeal(value("sealed_until")); err != nil {
+		return nil, err
+	}
+	if in.Networks, err = parseNetworks(value("networks")); err != nil {
+		return nil, err
+	}
+	if in.ViewLimit, in.NoViewLimit, err = parseViewLimit(value("views")); err != nil {
+		return nil, err
+	}
+	if in.Source, err = parseSourceURL(value("source_url")); err != nil {
+		return nil, err
+	}
+	if in.Immutable, err = parseImmutable(value("immutable")); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// readPasteMetadata reads a paste file's metadata, leaving out anything
+// that isn't set.
+func readPasteMetadata(filename string) map[string]string {
+	md := make(map[string]string, len(pasteMetadataNames)+1)
+	for _, name := range append(pasteMetadataNames, "direct") {
+		if v := getMetadata(filename, name, ""); v != "" {
+			md[name] = v
+		}
+	}
+	return md
+}
+
+// parsePasteMetadata fills in p from its stored metadata, returning the
+// MAC with which to check an encrypted paste's key. p.ID and p.mtime must
+// already be set.
+func parsePasteMetadata(p *Paste, md map[string]string) ([]byte, error) {
+	var hmac []byte
+	if md["hmac"] != "" {
+		p.encryptionMethod = md["encryption_version"]
+		if p.encryptionMethod == "" {
+			p.encryptionMethod = "1"
+		}
+		if _, ok := encryptionMethodHandlers[p.encryptionMethod]; !ok {
+			return nil, fmt.Errorf("unknown encryption version %q", p.encryptionMethod)
+		}
+		p.Encrypted = true
+
+		if salt := md["encryption_salt"]; salt == "" {
+			p.encryptionSalt = []byte(p.ID.String())
+		} else {
+			saltb, err := base32Encoder.DecodeString(salt)
+			if err != nil {
+				return nil, fmt.Errorf("bad encryption salt: %v", err)
+			}
+			p.encryptionSalt = saltb
+		}
+
+		var err error
+		if hmac, err = base32Encoder.DecodeString(md["hmac"]); err != nil {
+			return nil, fmt.Errorf("bad hmac: %v", err)
+		}
+	}
+
+	language := md["language"]
+	if language == "" {
+		language = "text"
+	}
+	p.Language = LanguageNamed(language)
+	p.Expiration = md["expiration"]
+	p.Retention = md["retention"]
+	p.Title = md["title"]
+	if license := LicenseNamed(md["license"]); license != nil {
+		p.License = license.ID
+	}
+	p.direct = md["direct"] != ""
+	p.pending = md["pending"] != ""
+	p.editToken = md["edit_token"]
+	p.Source = md["source_url"]
+	p.pinnedBy = md["pinned_by"]
+	p.pushedTo = strings.Fields(md["pushed_to"])
+	p.diagnostics = parsePasteDiagnostics(md["diagnostics"])
+	p.immutable = md["immutable"] != ""
+	if left, err := strconv.Atoi(md["views_left"]); err == nil {
+		p.viewLimited, p.viewsLeft = true, left
+	}
+	if md["networks"] != "" {
+		p.Networks = strings.Split(md["networks"], ",")
+	}
+	p.trashed = md["trashed"]
+	if until, err := strconv.ParseInt(md["sealed_until"], 10, 64); err == nil {
+		p.sealedUntil = time.Unix(until, 0)
+		p.sealedBy = md["sealed_by"]
+	}
+	if p.trashed != "" {
+		if until, err := strconv.ParseInt(md["trashed_until"], 10, 64); err == nil {
+			p.trashedUntil = time.Unix(until, 0)
+		}
+	}
+
+	if p.Expiration != "" && p.Expiration != "-1" {
+		if dur, err := ParseDuration(p.Expiration); err == nil && dur > 0 {
+			p.exptime = p.mtime.Add(dur)
+		}
+	}
+	return hmac, nil
+}
@@ -0,0 +1,157 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func FuzzParsePasteInput(f *testing.F) {
+	f.Add("hello, world", "text", "greeting", "", "", "", "", "", "", "", "")
+	f.Add("package main\n", "go", "main.go", "MIT", "1h", "", "", "10.0.0.0/8", "5", "https://example.com/", "true")
+	f.Add("", " python ", "line\nbreak\x00", "not-a-license", "-1", "forever", "2038-01-19T03:14:07Z", "bogus/99", "-3", "javascript:alert(1)", "maybe")
+	f.Add("\xff\xfe", strings.Repeat("x", MaxLanguageLength+1), strings.Repeat("é", MaxTitleLength+1), "", "fortnight", "", "now", ",,", "none", "//", "0")
+
+	f.Fuzz(func(t *testing.T, text, lang, title, license, expire, retention, sealedUntil, networks, views, source, immutable string) {
+		values := map[string]string{
+			"text":         text,
+			"lang":         lang,
+			"title":        title,
+			"license":      license,
+			"expire":       expire,
+			"retention":    retention,
+			"sealed_until": sealedUntil,
+			"networks":     networks,
+			"views":        views,
+			"source_url":   source,
+			"immutable":    immutable,
+		}
+		in, err := parsePasteInput(func(name string) string { return values[name] })
+		if err != nil {
+			if _, ok := err.(HTTPError); !ok {
+				t.Fatalf("error %v (%T) is not an HTTPError", err, err)
+			}
+			return
+		}
+		if !utf8.ValidString(in.Body) {
+			t.Errorf("accepted a body that isn't UTF-8")
+		}
+		if len(in.Language) > MaxLanguageLength {
+			t.Errorf("accepted a %d-byte language", len(in.Language))
+		}
+		if LanguageNamed(in.Language) == nil {
+			t.Errorf("language %q resolves to nothing", in.Language)
+		}
+		if !utf8.ValidString(in.Title) || utf8.RuneCountInString(in.Title) > MaxTitleLength {
+			t.Errorf("accepted title %q", in.Title)
+		}
+		if strings.ContainsAny(in.Title, "\r\n\x00") {
+			t.Errorf("title %q has control characters", in.Title)
+		}
+		if len(in.Password) > MaxPasswordLength {
+			t.Errorf("accepted a %d-byte password", len(in.Password))
+		}
+	})
+}
+
+// FuzzLanguageNamed checks that any name a client gives resolves to a
+// language (unknownLanguage, if nothing else), and that a language found
+// by one of its names is found again by its ID.
+func FuzzLanguageNamed(f *testing.F) {
+	for _, name := range []string{"", "text", "go", "golang", "Python", "c++", "unknown", "\x00", "../../etc/passwd"} {
+		f.Add(name)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		lang := LanguageNamed(name)
+		if lang == nil {
+			t.Fatalf("%q resolves to nothing", name)
+		}
+		if lang == unknownLanguage {
+			return
+		}
+		if again := LanguageNamed(lang.ID); again != lang {
+			t.Errorf("%q resolves to %q, which resolves to %q", name, lang.ID, again.ID)
+		}
+	})
+}
+
+func FuzzParsePasteMetadata(f *testing.F) {
+	f.Add("", "", "", "text", "", "", "", "", "", "", "")
+	f.Add("MFRGGZDFMZTWQ2LK", "2", "MFRGGZDFMZTWQ2LKNNWG23TPOBYXE43U", "go", "1h", "3", "10.0.0.0/8,::1/128", "2000000000", "expired", "1", `[{"line":1,"message":"oops"}]`)
+	f.Add("not base32!", "9", "also not base32", "", "-1", "x", ",", "-1", "", "soon", "{")
+	f.Add("MFRGGZDFMZTWQ2LK", "", "", "\x00", "99999999999999999999h", "-5", "", "notanumber", "trashed", "-9223372036854775808", "null")
+
+	f.Fuzz(func(t *testing.T, hmac, version, salt, language, expiration, viewsLeft, networks, sealedUntil, trashed, trashedUntil, diagnostics string) {
+		md := map[string]string{
+			"hmac":               hmac,
+			"encryption_version": version,
+			"encryption_salt":    salt,
+			"language":           language,
+			"expiration":         expiration,
+			"views_left":         viewsLeft,
+			"networks":           networks,
+			"sealed_until":       sealedUntil,
+			"trashed":            trashed,
+			"trashed_until":      trashedUntil,
+			"diagnostics":        diagnostics,
+		}
+		p := &Paste{ID: PasteIDFromString("abcde"), mtime: time.Now()}
+		if _, err := parsePasteMetadata(p, md); err != nil {
+			return
+		}
+		if p.Language == nil {
+			t.Errorf("paste has no language")
+		}
+		if p.Encrypted {
+			if _, ok := encryptionMethodHandlers[p.encryptionMethod]; !ok {
+				t.Errorf("paste is encrypted with unknown method %q", p.encryptionMethod)
+			}
+		}
+	})
+}
+
+// FuzzAPIPasteBody sends whatever it is given as a paste submission to the
+// API, through the request size limits (which parse the form) and into
+// parsePasteInput, as apiPasteCreateHandler would. Whatever it is, it
+// must be refused with a client error or accepted, never panic.
+func FuzzAPIPasteBody(f *testing.F) {
+	f.Add("application/x-www-form-urlencoded", []byte(url.Values{"text": {"hello"}, "lang": {"text"}}.Encode()))
+	f.Add("application/x-www-form-urlencoded", []byte("text=%zz&lang=%"))
+	f.Add("text/plain", []byte("a raw body"))
+	f.Add("multipart/form-data", []byte("--x\r\nContent-Disposition: form-data; name=\"text\"\r\n\r\nhi\r\n--x--\r\n"))
+	f.Add("multipart/form-data; boundary=x", []byte("--x\r\nContent-Disposition: form-data; name=\"text\"\r\n\r\nunterminated"))
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("text", "hello from a multipart form")
+	mw.WriteField("title", "\xff")
+	mw.Close()
+	f.Add(mw.FormDataContentType(), buf.Bytes())
+
+	handler := requestSizeLimitHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := parsePasteInput(r.FormValue); err != nil {
+			w.WriteHeader(err.(HTTPError).StatusCode())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})}
+
+	f.Fuzz(func(t *testing.T, contentType string, body []byte) {
+		r := httptest.NewRequest("POST", "/api/v1/pastes", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code >= 500 {
+			t.Errorf("got %d (%s)", w.Code, w.Body)
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Markdown pastes can refer to one another wiki-style, as [[paste-id]],
+// which renders as a link titled with the paste referred to (or its ID, if
+// its title isn't for everyone to see). References inside code are left as
+// they are. Renderings are cached, so a title shown is the one the paste had
+// when the referring paste was rendered; creating or destroying a paste
+// forgets the renderings of the pastes that refer to it.
+//
+// Each paste's page lists the pastes that refer to it, from backlinkIndex.
+// The index is kept up to date from paste events, and the
+// backlinks job rebuilds it from scratch (every interlinks.index_interval)
+// to catch whatever was missed. Only unencrypted, public pastes are listed:
+// pastes that are sealed, restricted to networks, view-limited, pending
+// approval or in the trash are indexed but not shown.
+
+// maxIndexedBody is how much of a paste's body is read for references.
+const maxIndexedBody = 1 << 20
+
+var (
+	pasteReferencePattern = regexp.MustCompile(`\[\[([A-Za-z0-9]+)\]\]`)
+	codeSpanPattern       = regexp.MustCompile("(`+)[^`]*`+")
+	codeFencePattern      = regexp.MustCompile("^ {0,3}(```|~~~)")
+)
+
+var backlinkIndex *BacklinkIndex
+
+type BacklinkIndex struct {
+	// Links maps each paste to the pastes it refers to.
+	Links map[PasteID][]PasteID
+
+	filename string
+	// backlinks maps each paste to the pastes that refer to it.
+	backlinks map[PasteID]map[PasteID]bool
+	mu        sync.RWMutex
+}
+
+// save must be called with s.mu held.
+func (s *BacklinkIndex) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save backlinks: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+// unlink must be called with s.mu held.
+func (s *BacklinkIndex) unlink(source PasteID) {
+	for _, target := range s.Links[source] {
+		delete(s.backlinks[target], source)
+		if len(s.backlinks[target]) == 0 {
+			delete(s.backlinks, target)
+		}
+	}
+	delete(s.Links, source)
+}
+
+// link must be called with s.mu held.
+func (s *BacklinkIndex) link(source PasteID, targets []PasteID) {
+	if len(targets) == 0 {
+		return
+	}
+	s.Links[source] = targets
+	for _, target := range targets {
+		if s.backlinks[target] == nil {
+			s.backlinks[target] = make(map[PasteID]bool)
+		}
+		s.backlinks[target][source] = true
+	}
+}
+
+// Set records the pastes source refers to.
+func (s *BacklinkIndex) Set(source PasteID, targets []PasteID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(targets) == 0 && len(s.Links[source]) == 0 {
+		return
+	}
+	s.unlink(source)
+	s.link(source, targets)
+	s.save()
+}
+
+// Forget removes id's references from the index.
+func (s *BacklinkIndex) Forget(id PasteID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Links[id]; !ok {
+		return
+	}
+	s.unlink(id)
+	s.save()
+}
+
+// Replace replaces the whole index with links.
+func (s *BacklinkIndex) Replace(links map[PasteID][]PasteID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Links = make(map[PasteID][]PasteID)
+	s.backlinks = make(map[PasteID]map[PasteID]bool)
+	for source, targets := range links {
+		s.link(source, targets)
+	}
+	s.save()
+}
+
+// Backlinks returns the IDs of the pastes that refer to target, in order.
+func (s *BacklinkIndex) Backlinks(target PasteID) []PasteID {
+	s.mu.RLock()
+	ids := make([]PasteID, 0, len(s.backlinks[target]))
+	for id := range s.backlinks[target] {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func LoadBacklinkIndex(filename string) *BacklinkIndex {
+	var s *BacklinkIndex
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode backlinks: ", err)
+		}
+	}
+	if s == nil {
+		s = &BacklinkIndex{}
+	}
+	links := s.Links
+	s.Links = make(map[PasteID][]PasteID)
+	s.backlinks = make(map[PasteID]map[PasteID]bool)
+	for source, targets := range links {
+		s.link(source, targets)
+	}
+	s.filename = filename
+	return s
+}
+
+// pasteReferences returns the pastes body refers to, leaving out
+// references in fenced code blocks and code spans.
+func pasteReferences(body io.Reader, self PasteID) []PasteID {
+	var refs []PasteID
+	seen := map[PasteID]bool{self: true}
+	fence := ""
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxIndexedBody)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := codeFencePattern.FindStringSubmatch(line); m != nil {
+			if fence == "" {
+				fence = m[1]
+			} else if fence == m[1] {
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+		line = codeSpanPattern.ReplaceAllString(line, "")
+		for _, m := range pasteReferencePattern.FindAllStringSubmatch(line, -1) {
+			id := PasteIDFromString(m[1])
+			if !seen[id] {
+				seen[id] = true
+				refs = append(refs, id)
+			}
+		}
+	}
+	return refs
+}
+
+// indexPasteReferences records the pastes p refers to, if it is a Markdown
+// paste whose body the server can read.
+func indexPasteReferences(p *Paste) []PasteID {
+	if p.Encrypted || p.direct || p.Language == nil || p.Language.Formatter != "markdown" {
+		return nil
+	}
+	r, err := p.Reader()
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	return pasteReferences(io.LimitReader(r, maxIndexedBody), p.ID)
+}
+
+// pasteListedPublicly reports whether p's title may be shown to anyone.
+func pasteListedPublicly(p *Paste) bool {
+	return !p.Encrypted && p.trashed == "" && len(p.Networks) == 0 && !p.viewLimited && !p.pending
+}
+
+// forgetReferringRenders forgets the renderings of the pastes that refer to
+// id, so that they pick up its new title (or its absence).
+func forgetReferringRenders(id PasteID) {
+	for _, source := range backlinkIndex.Backlinks(id) {
+		forgetRenderedPaste(source)
+	}
+}
+
+// interlinkSavedPaste is called as a paste is created or modified.
+func interlinkSavedPaste(p *Paste) {
+	backlinkIndex.Set(p.ID, indexPasteReferences(p))
+	forgetReferringRenders(p.ID)
+}
+
+// interlinkDestroyedPaste is called as a paste is destroyed.
+func interlinkDestroyedPaste(p *Paste) {
+	backlinkIndex.Forget(p.ID)
+	forgetReferringRenders(p.ID)
+}
+
+// linkPasteReferences turns the references in rendered Markdown into links.
+func linkPasteReferences(rendered string) string {
+	return pasteReferencePattern.ReplaceAllStringFunc(rendered, func(ref string) string {
+		id := PasteIDFromString(ref[2 : len(ref)-2])
+		p, err := filesystemPasteStore.Get(id, nil)
+		if p == nil || p.trashed != "" {
+			return `<span class="paste-reference-missing">` + ref + `</span>`
+		}
+		title := id.String()
+		if err == nil && pasteListedPublicly(p) && p.Title != "" {
+			title = p.Title
+		}
+		return `<a href="/paste/` + html.EscapeString(id.String()) + `">` + html.EscapeString(title) + `</a>`
+	})
+}
+
+// escapePasteReferences keeps references in code from being linked.
+func escapePasteReferences(s string) string {
+	return strings.Replace(s, "[[", "&#91;&#91;", -1)
+}
+
+type PasteBacklink struct {
+	ID    PasteID
+	Title string
+}
+
+// pasteBacklinks returns the pastes that refer to p which may be listed.
+func pasteBacklinks(p *Paste) []PasteBacklink {
+	var links []PasteBacklink
+	for _, id := range backlinkIndex.Backlinks(p.ID) {
+		source, err := filesystemPasteStore.Get(id, nil)
+		if err != nil || !pasteListedPublicly(source) || source.Sealed() {
+			continue
+		}
+		links = append(links, PasteBacklink{ID: source.ID, Title: source.Title})
+	}
+	return links
+}
+
+func init() {
+	RegisterTemplateFunction("pasteBacklinks", pasteBacklinks)
+	SubscribeEvent(onPasteEvent(interlinkSavedPaste), EventPasteCreated, EventPasteModified)
+	SubscribeEvent(onPasteEvent(interlinkDestroyedPaste), EventPasteDestroyed)
+
+	RegisterJob("backlinks", "Rebuild the index of references between pastes.", func(run *JobRun) error {
+		var ids []PasteID
+		if err := filesystemPasteStore.Walk(func(id PasteID) error {
+			ids = append(ids, id)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		links := make(map[PasteID][]PasteID)
+		n := 0
+		for i, id := range ids {
+			p, err := filesystemPasteStore.Get(id, nil)
+			if err == nil {
+				if refs := indexPasteReferences(p); len(refs) > 0 {
+					links[id] = refs
+					n += len(refs)
+				}
+			}
+			run.Progress(int64(i+1), int64(len(ids)))
+		}
+		backlinkIndex.Replace(links)
+		healthServer.SetMetric("backlinks.references", n)
+		run.SetResult("indexed %d references from %d pastes", n, len(links))
+		return nil
+	})
+
+	arguments.register()
+	arguments.parse()
+
+	backlinkIndex = LoadBacklinkIndex(filepath.Join(arguments.root, "backlinks.gob"))
+}
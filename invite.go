@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Depending on registration.mode, new accounts may need an invite, which an
+// admin hands out as a link. Each invite is good for one account and
+// expires unused after registration.invite_lifetime; redeemed invites are
+// kept, recording which account (by its stored, mangled name) used them.
+
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+type InviteCode string
+
+type Invite struct {
+	Code      InviteCode
+	Created   time.Time
+	CreatedBy string
+
+	UsedBy string
+	UsedAt time.Time
+}
+
+func (i *Invite) Used() bool {
+	return i.UsedBy != ""
+}
+
+func (i *Invite) Expires() time.Time {
+	return i.Created.Add(instanceConfig.Registration.InviteLifetime.Duration())
+}
+
+type InviteStore struct {
+	Invites    map[InviteCode]*Invite
+	ExpiryJunk *gotimeout.HandleMap
+
+	filename  string
+	expirator *gotimeout.Expirator
+	mu        sync.Mutex
+}
+
+// save must be called with r.mu held.
+func (r *InviteStore) save() error {
+	asideFilename := r.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(r)
+	if err != nil {
+		glog.Error("Failed to save invites: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, r.filename)
+}
+
+func (r *InviteStore) NewInvite(createdBy string, lifetime time.Duration) InviteCode {
+	newKey, _ := generateRandomBase32String(20, 32)
+	code := InviteCode(newKey)
+
+	r.mu.Lock()
+	r.Invites[code] = &Invite{Code: code, Created: time.Now(), CreatedBy: createdBy}
+	r.save()
+	r.mu.Unlock()
+
+	r.expirator.ExpireObject(code, lifetime)
+	return code
+}
+
+func (r *InviteStore) Get(code InviteCode) (*Invite, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	invite, ok := r.Invites[code]
+	return invite, ok
+}
+
+// Valid reports whether code names an invite that has not been used.
+func (r *InviteStore) Valid(code InviteCode) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	invite, ok := r.Invites[code]
+	return ok && !invite.Used()
+}
+
+// Redeem marks the invite as used by the named account, returning false if it has
+// already been used or no longer exists. Redeemed invites don't expire.
+func (r *InviteStore) Redeem(code InviteCode, accountName string) bool {
+	r.mu.Lock()
+	invite, ok := r.Invites[code]
+	if !ok || invite.Used() {
+		r.mu.Unlock()
+		return false
+	}
+	invite.UsedBy = accountName
+	invite.UsedAt = time.Now()
+	r.save()
+	r.mu.Unlock()
+
+	r.expirator.CancelObjectExpiration(code)
+	healthServer.IncrementMetric("invite.redeemed")
+	return true
+}
+
+// Release undoes Redeem for an account that could not be created after all,
+// making the invite usable again for what remains of its lifetime.
+func (r *InviteStore) Release(code InviteCode, accountName string) {
+	r.mu.Lock()
+	invite, ok := r.Invites[code]
+	if !ok || invite.UsedBy != accountName {
+		r.mu.Unlock()
+		return
+	}
+	invite.UsedBy = ""
+	invite.UsedAt = time.Time{}
+	r.save()
+	expires := invite.Expires()
+	r.mu.Unlock()
+
+	r.expirator.ExpireObject(code, time.Until(expires))
+}
+
+// List returns every invite, newest first.
+func (r *InviteStore) List() []*Invite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	invites := make([]*Invite, 0, len(r.Invites))
+	for _, invite := range r.Invites {
+		invites = append(invites, invite)
+	}
+	sort.Sort(invitesByCreation(invites))
+	return invites
+}
+
+type invitesByCreation []*Invite
+
+func (l invitesByCreation) Len() int           { return len(l) }
+func (l invitesByCreation) Less(i, j int) bool { return l[i].Created.After(l[j].Created) }
+func (l invitesByCreation) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (r *InviteStore) Delete(code InviteCode) {
+	r.expirator.CancelObjectExpiration(code)
+	r.mu.Lock()
+	delete(r.Invites, code)
+	r.save()
+	r.mu.Unlock()
+}
+
+func readInviteStore(filename string) *InviteStore {
+	var is *InviteStore
+	invite_file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(invite_file)
+		err := dec.Decode(&is)
+		invite_file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode invites: ", err)
+		}
+	}
+	if is == nil {
+		is = &InviteStore{}
+	}
+	if is.Invites == nil {
+		is.Invites = make(map[InviteCode]*Invite)
+	}
+	for code, invite := range is.Invites {
+		invite.Code = code
+	}
+	is.filename = filename
+	return is
+}
+
+func LoadInviteStore(filename string) *InviteStore {
+	is := readInviteStore(filename)
+	is.expirator = gotimeout.NewExpiratorWithStorage(is, is)
+	return is
+}
+
+// Merge picks up invites written to the store's file by another process
+// (`spectre invite` run beside a live server).
+func (r *InviteStore) Merge() {
+	other := readInviteStore(r.filename)
+	added := make(map[InviteCode]*Invite)
+	r.mu.Lock()
+	for code, invite := range other.Invites {
+		if _, ok := r.Invites[code]; !ok {
+			r.Invites[code] = invite
+			added[code] = invite
+		}
+	}
+	if len(added) > 0 {
+		r.save()
+	}
+	r.mu.Unlock()
+
+	for code, invite := range added {
+		if !invite.Used() {
+			r.expirator.ExpireObject(code, invite.Expires().Sub(time.Now()))
+		}
+	}
+}
+
+func (e *InviteStore) GetExpirable(id gotimeout.ExpirableID) gotimeout.Expirable {
+	if invite, ok := e.Get(InviteCode(id)); !ok || invite.Used() {
+		return nil
+	}
+	return InviteCode(id)
+}
+
+func (e *InviteStore) DestroyExpirable(ex gotimeout.Expirable) {
+	if code, ok := ex.(InviteCode); ok {
+		e.Delete(code)
+	}
+}
+
+func (c InviteCode) ExpirationID() gotimeout.ExpirableID {
+	return gotimeout.ExpirableID(c)
+}
+
+func (e *InviteStore) RequiresFlush() bool {
+	return true
+}
+
+func (e *InviteStore) SaveExpirationHandles(hm *gotimeout.HandleMap) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ExpiryJunk = hm
+	return e.save()
+}
+
+func (e *InviteStore) LoadExpirationHandles() (*gotimeout.HandleMap, error) {
+	return e.ExpiryJunk, nil
+}
+
+func inviteURL(code InviteCode) string {
+	u, _ := router.Get("invite").URL("code", string(code))
+	return u.String()
+}
+
+func adminInviteHandler(w http.ResponseWriter, r *http.Request) {
+	code := inviteStore.NewInvite(GetUser(r).Name, instanceConfig.Registration.InviteLifetime.Duration())
+	SetFlash(w, "success", fmt.Sprintf("New invite: %s (valid for %v).", inviteURL(code), instanceConfig.Registration.InviteLifetime.Duration()))
+	w.Header().Set("Location", "/admin/invites")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func adminInviteDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	inviteStore.Delete(InviteCode(mux.Vars(r)["code"]))
+	SetFlash(w, "success", "Invite deleted.")
+	w.Header().Set("Location", "/admin/invites")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// inviteHandler shows the registration form for an invite link.
+func inviteHandler(w http.ResponseWriter, r *http.Request) {
+	code := InviteCode(mux.Vars(r)["code"])
+	invite, ok := inviteStore.Get(code)
+	if !ok || invite.Used() || instanceConfig.Registration.Mode != RegistrationInvite {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	RenderPage(w, r, "invite", &struct {
+		Code  InviteCode
+		Valid bool
+	}{code, ok && !invite.Used() && instanceConfig.Registration.Mode == RegistrationInvite})
+}
+
+var inviteStore *InviteStore
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	inviteStore = LoadInviteStore(filepath.Join(arguments.root, "invites.gob"))
+
+	RegisterReloadFunction(inviteStore.Merge)
+
+	RegisterCommand("invite", "print a new invite code (for the first account, say; SIGHUP a running server to pick it up)", func(args []string) error {
+		code := inviteStore.NewInvite("", instanceConfig.Registration.InviteLifetime.Duration())
+		fmt.Printf("%s (/invite/%s)\n", code, code)
+		// Give the expirator a chance to record the invite's expiration.
+		time.Sleep(2 * time.Second)
+		return nil
+	})
+}
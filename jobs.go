@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Background work runs as jobs: a registered function, run on one of a few
+// workers, retried with backoff when it fails, and recorded so that admins
+// can see at /admin/jobs what ran, what's running and what went wrong.
+//
+// Periodic jobs are scheduled on an expirator, re-arming themselves each
+// time they fire; their next run is kept in jobs.gob so that a restart
+// doesn't push them back a whole interval. Runs still queued or running
+// when the server stops are queued again when it starts, and a job that
+// records checkpoints can pick up from its last one.
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobRetrying  = "retrying"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+type JobFunc func(run *JobRun) error
+
+type Job struct {
+	Name        string
+	Description string
+	// Args names the arguments an admin may give when starting the job.
+	Args []string
+	fn   JobFunc
+}
+
+var jobs = make(map[string]*Job)
+
+// RegisterJob declares a job. Call it from init.
+func RegisterJob(name, description string, fn JobFunc, args ...string) {
+	jobs[name] = &Job{Name: name, Description: description, Args: args, fn: fn}
+}
+
+type JobRun struct {
+	ID      string
+	Job     string
+	Args    map[string]string
+	State   string
+	Attempt int
+
+	// Done and Total report progress; Total is 0 when it isn't known.
+	Done, Total int64
+	// Checkpoint is the job's own record of how far it got, kept across
+	// retries and restarts.
+	Checkpoint string
+	Result     string
+	Error      string
+
+	Queued, Started, Finished time.Time
+
+	runner *JobRunner
+}
+
+// Progress records how far the run has got.
+func (run *JobRun) Progress(done, total int64) {
+	run.runner.mu.Lock()
+	run.Done, run.Total = done, total
+	run.runner.mu.Unlock()
+}
+
+// SetCheckpoint records (and saves) how far the run has got, for it to
+// resume from if it is interrupted.
+func (run *JobRun) SetCheckpoint(checkpoint string) {
+	run.runner.mu.Lock()
+	run.Checkpoint = checkpoint
+	run.runner.save()
+	run.runner.mu.Unlock()
+}
+
+// SetResult records a summary of what the run did.
+func (run *JobRun) SetResult(format string, args ...interface{}) {
+	run.runner.mu.Lock()
+	run.Result = fmt.Sprintf(format, args...)
+	run.runner.mu.Unlock()
+}
+
+// Active reports whether the run has yet to succeed or fail.
+func (run JobRun) Active() bool {
+	return run.State != JobSucceeded && run.State != JobFailed
+}
+
+type JobRunner struct {
+	// Pending holds the runs that are queued, running or waiting to be
+	// retried.
+	Pending map[string]*JobRun
+	// NextRuns holds when each scheduled job next runs.
+	NextRuns map[string]time.Time
+
+	filename  string
+	mu        sync.Mutex
+	queue     chan *JobRun
+	history   []*JobRun
+	intervals map[string]time.Duration
+	expirator *gotimeout.Expirator
+}
+
+// save must be called with r.mu held.
+func (r *JobRunner) save() error {
+	asideFilename := r.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = gob.NewEncoder(file).Encode(r)
+	if err != nil {
+		glog.Error("Failed to save jobs: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, r.filename)
+}
+
+func (r *JobRunner) active(name string) bool {
+	for _, run := range r.Pending {
+		if run.Job == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue queues a run of the named job.
+func (r *JobRunner) Enqueue(name string, args map[string]string) (*JobRun, error) {
+	if _, ok := jobs[name]; !ok {
+		return nil, fmt.Errorf("there is no job called %s", name)
+	}
+	id, err := generateRandomBase32String(10, 16)
+	if err != nil {
+		return nil, err
+	}
+	run := &JobRun{ID: id, Job: name, Args: args, State: JobQueued, Queued: time.Now(), runner: r}
+
+	r.mu.Lock()
+	r.Pending[id] = run
+	r.save()
+	r.mu.Unlock()
+
+	healthServer.IncrementMetric("job." + name + ".queued")
+	go func() { r.queue <- run }()
+	return run, nil
+}
+
+func backoffForAttempt(attempt int) time.Duration {
+	backoff := instanceConfig.Jobs.RetryBackoff.Duration()
+	for i := 1; i < attempt && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	return backoff
+}
+
+func (r *JobRunner) execute(run *JobRun) {
+	job := jobs[run.Job]
+
+	r.mu.Lock()
+	run.State = JobRunning
+	run.Attempt++
+	run.Started = time.Now()
+	r.save()
+	r.mu.Unlock()
+
+	err := func() (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = fmt.Errorf("panicked (error %s): %v", recordPanic(rec, nil).ID, rec)
+			}
+		}()
+		return job.fn(run)
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		run.Error = err.Error()
+		if run.Attempt <= instanceConfig.Jobs.Retries {
+			run.State = JobRetrying
+			r.save()
+			backoff := backoffForAttempt(run.Attempt)
+			glog.Warningf("JOBS: %s (%s) failed, retrying in %v: %v", run.Job, run.ID, backoff, err)
+			healthServer.IncrementMetric("job." + run.Job + ".retried")
+			time.AfterFunc(backoff, func() { r.queue <- run })
+			return
+		}
+		run.State = JobFailed
+		glog.Errorf("JOBS: %s (%s) failed after %d attempts: %v", run.Job, run.ID, run.Attempt, err)
+	} else {
+		run.State = JobSucceeded
+		run.Error = ""
+	}
+	run.Finished = time.Now()
+	healthServer.IncrementMetric("job." + run.Job + "." + run.State)
+
+	delete(r.Pending, run.ID)
+	r.save()
+	r.history = append(r.history, run)
+	if keep := instanceConfig.Jobs.History; len(r.history) > keep {
+		r.history = r.history[len(r.history)-keep:]
+	}
+}
+
+type jobSchedule string
+
+func (s jobSchedule) ExpirationID() gotimeout.ExpirableID {
+	return gotimeout.ExpirableID(s)
+}
+
+// Schedule runs the named job every interval.
+func (r *JobRunner) Schedule(name string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	r.mu.Lock()
+	r.intervals[name] = interval
+	next, ok := r.NextRuns[name]
+	if now := time.Now(); !ok || next.After(now.Add(interval)) {
+		next = now.Add(interval)
+		r.NextRuns[name] = next
+		r.save()
+	}
+	r.mu.Unlock()
+
+	r.expirator.ExpireObject(jobSchedule(name), next.Sub(time.Now()))
+}
+
+func (r *JobRunner) GetExpirable(id gotimeout.ExpirableID) gotimeout.Expirable {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.intervals[string(id)]; !ok {
+		return nil
+	}
+	return jobSchedule(id)
+}
+
+// DestroyExpirable is called when a scheduled job comes due. It queues the
+// job, unless a run is already pending, and re-arms the schedule.
+func (r *JobRunner) DestroyExpirable(ex gotimeout.Expirable) {
+	name := string(ex.(jobSchedule))
+	r.mu.Lock()
+	interval := r.intervals[name]
+	r.NextRuns[name] = time.Now().Add(interval)
+	active := r.active(name)
+	r.save()
+	r.mu.Unlock()
+
+	r.expirator.ExpireObject(ex, interval)
+	if !active {
+		r.Enqueue(name, nil)
+	}
+}
+
+// Start starts the workers and queues again the runs that were pending
+// when the server last stopped.
+func (r *JobRunner) Start(workers int) {
+	r.mu.Lock()
+	var pending []*JobRun
+	for id, run := range r.Pending {
+		if _, ok := jobs[run.Job]; !ok {
+			delete(r.Pending, id)
+			continue
+		}
+		run.runner = r
+		run.State = JobQueued
+		pending = append(pending, run)
+	}
+	r.save()
+	r.mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Queued.Before(pending[j].Queued) })
+	for _, run := range pending {
+		glog.Info("JOBS: Resuming ", run.Job, " (", run.ID, ")")
+		go func(run *JobRun) { r.queue <- run }(run)
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for run := range r.queue {
+				r.execute(run)
+			}
+		}()
+	}
+}
+
+type jobStatus struct {
+	*Job
+	Interval time.Duration
+	NextRun  time.Time
+}
+
+// Status returns the registered jobs and copies of the pending and recent
+// runs, newest first.
+func (r *JobRunner) Status() ([]jobStatus, []JobRun) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var statuses []jobStatus
+	for _, job := range jobs {
+		statuses = append(statuses, jobStatus{job, r.intervals[job.Name], r.NextRuns[job.Name]})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	var runs []JobRun
+	for _, run := range r.Pending {
+		runs = append(runs, *run)
+	}
+	for _, run := range r.history {
+		runs = append(runs, *run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Queued.After(runs[j].Queued) })
+	return statuses, runs
+}
+
+func LoadJobRunner(filename string) *JobRunner {
+	var r *JobRunner
+	file, err := os.Open(filename)
+	if err == nil {
+		err := gob.NewDecoder(file).Decode(&r)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode jobs: ", err)
+		}
+	}
+	if r == nil {
+		r = &JobRunner{}
+	}
+	if r.Pending == nil {
+		r.Pending = make(map[string]*JobRun)
+	}
+	if r.NextRuns == nil {
+		r.NextRuns = make(map[string]time.Time)
+	}
+	r.filename = filename
+	r.queue = make(chan *JobRun)
+	r.intervals = make(map[string]time.Duration)
+	r.expirator = gotimeout.NewExpiratorWithStorage(gotimeout.NoopAdapter{}, r)
+	return r
+}
+
+func adminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, runs := jobRunner.Status()
+	RenderPage(w, r, "admin_jobs", &struct {
+		Jobs []jobStatus
+		Runs []JobRun
+	}{statuses, runs})
+}
+
+func adminJobRunHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	args := make(map[string]string)
+	if job, ok := jobs[name]; ok {
+		for _, arg := range job.Args {
+			if v := r.FormValue(arg); v != "" {
+				args[arg] = v
+			}
+		}
+	}
+	if run, err := jobRunner.Enqueue(name, args); err != nil {
+		SetFlash(w, "error", err.Error())
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Queued %s (%s).", name, run.ID))
+	}
+	w.Header().Set("Location", "/admin/jobs")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var jobRunner *JobRunner
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	jobRunner = LoadJobRunner(filepath.Join(arguments.root, "jobs.gob"))
+
+	RegisterJob("export", "Export pastes (all, or an account's) to a directory on the server.", func(run *JobRun) error {
+		var ids []PasteID
+		if account := run.Args["account"]; account != "" {
+			var err error
+			if ids, err = accountPasteIDs(account); err != nil {
+				return err
+			}
+		}
+		if run.Args["dir"] == "" {
+			return fmt.Errorf("export needs a dir")
+		}
+		var done int64
+		n, err := ExportPastes(run.Args["dir"], ids, func(PasteID) {
+			done++
+			run.Progress(done, int64(len(ids)))
+		})
+		run.SetResult("exported %d pastes", n)
+		return err
+	}, "dir", "account")
+}
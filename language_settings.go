@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// How a language's pastes are shown can be tuned per language: the width
+// of a tab, whether long lines wrap, and whether languages that are
+// rendered (Markdown) are shown as source instead. Settings come from the
+// language_settings section of config.yml, where "default" covers any
+// language not named, unless an admin has set them at /admin/languages.
+// They are applied when a paste is viewed, so they reach old pastes too.
+
+type LanguageSettings struct {
+	// TabWidth is the width of a tab in columns; 0 leaves it to the
+	// browser.
+	TabWidth int `yaml:"tab_width"`
+	// Wrap wraps long lines (without line numbers, which can't follow
+	// them).
+	Wrap bool `yaml:"wrap"`
+	// Source shows rendered languages as source.
+	Source bool `yaml:"source"`
+}
+
+const DefaultLanguageSettings = "default"
+
+type LanguageSettingsStore struct {
+	// Languages maps language IDs to the settings admins gave them.
+	Languages map[string]LanguageSettings
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *LanguageSettingsStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = gob.NewEncoder(file).Encode(s)
+	if err != nil {
+		glog.Error("Failed to save language settings: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+func (s *LanguageSettingsStore) Set(id string, settings LanguageSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Languages[id] = settings
+	return s.save()
+}
+
+func (s *LanguageSettingsStore) Clear(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Languages, id)
+	return s.save()
+}
+
+// Settings returns the settings for a language and where they came from:
+// "admin", "config" or "" (built in).
+func (s *LanguageSettingsStore) Settings(id string) (LanguageSettings, string) {
+	s.mu.Lock()
+	settings, ok := s.Languages[id]
+	if !ok {
+		settings, ok = s.Languages[DefaultLanguageSettings]
+	}
+	s.mu.Unlock()
+	if ok {
+		return settings, "admin"
+	}
+	if settings, ok := instanceConfig.LanguageSettings[id]; ok {
+		return settings, "config"
+	}
+	if settings, ok := instanceConfig.LanguageSettings[DefaultLanguageSettings]; ok {
+		return settings, "config"
+	}
+	return LanguageSettings{}, ""
+}
+
+func LoadLanguageSettingsStore(filename string) *LanguageSettingsStore {
+	var s *LanguageSettingsStore
+	file, err := os.Open(filename)
+	if err == nil {
+		err := gob.NewDecoder(file).Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode language settings: ", err)
+		}
+	}
+	if s == nil {
+		s = &LanguageSettingsStore{}
+	}
+	if s.Languages == nil {
+		s.Languages = make(map[string]LanguageSettings)
+	}
+	s.filename = filename
+	return s
+}
+
+// viewLanguage returns the language as its pastes are to be shown: a copy
+// with its settings applied, or the language itself if they change
+// nothing.
+func viewLanguage(language *Language) *Language {
+	if language == nil {
+		return nil
+	}
+	settings, _ := languageSettingsStore.Settings(language.ID)
+	rendered := language.Formatter != "" && language.Formatter != "text"
+	if !(settings.Source && rendered) && !(settings.Wrap && !language.SuppressLineNumbers) {
+		return language
+	}
+	view := *language
+	if settings.Source && rendered {
+		view.Formatter = "text"
+		view.DisplayStyle = ""
+		view.SuppressLineNumbers = false
+	}
+	if settings.Wrap {
+		view.SuppressLineNumbers = true
+	}
+	return &view
+}
+
+// invalidateRenderings drops every cached rendering, which may have been
+// made under other settings.
+func invalidateRenderings() {
+	renderCache.mu.Lock()
+	renderCache.generation++
+	renderCache.mu.Unlock()
+}
+
+type languageSettingsStatus struct {
+	ID       string
+	Name     string
+	Settings LanguageSettings
+	Source   string
+}
+
+func adminLanguagesHandler(w http.ResponseWriter, r *http.Request) {
+	var list []languageSettingsStatus
+	add := func(id, name string) {
+		settings, source := languageSettingsStore.Settings(id)
+		list = append(list, languageSettingsStatus{id, name, settings, source})
+	}
+	add(DefaultLanguageSettings, "Every other language")
+
+	seen := map[string]bool{DefaultLanguageSettings: true}
+	var ids []string
+	languageSettingsStore.mu.Lock()
+	for id := range languageSettingsStore.Languages {
+		ids = append(ids, id)
+	}
+	languageSettingsStore.mu.Unlock()
+	for id := range instanceConfig.LanguageSettings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		name := id
+		if language := LanguageNamed(id); language != unknownLanguage {
+			name = language.Name
+		}
+		add(id, name)
+	}
+	RenderPage(w, r, "admin_languages", list)
+}
+
+func adminLanguageHandler(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		w.Header().Set("Location", "/admin/languages")
+		w.WriteHeader(http.StatusSeeOther)
+	}()
+
+	id := r.FormValue("language")
+	if id != DefaultLanguageSettings {
+		language := LanguageNamed(id)
+		if language == unknownLanguage {
+			SetFlash(w, "error", fmt.Sprintf("There is no language called %q.", id))
+			return
+		}
+		id = language.ID
+	}
+
+	var err error
+	if r.FormValue("clear") != "" {
+		err = languageSettingsStore.Clear(id)
+	} else {
+		tabWidth, convErr := strconv.Atoi(r.FormValue("tab_width"))
+		if r.FormValue("tab_width") == "" {
+			tabWidth, convErr = 0, nil
+		}
+		if convErr != nil || tabWidth < 0 || tabWidth > 16 {
+			SetFlash(w, "error", "The tab width must be a number from 0 to 16.")
+			return
+		}
+		err = languageSettingsStore.Set(id, LanguageSettings{
+			TabWidth: tabWidth,
+			Wrap:     r.FormValue("wrap") != "",
+			Source:   r.FormValue("source") != "",
+		})
+	}
+	if err != nil {
+		SetFlash(w, "error", err.Error())
+		return
+	}
+	invalidateRenderings()
+	SetFlash(w, "success", "Updated "+id+".")
+}
+
+var languageSettingsStore *LanguageSettingsStore
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	languageSettingsStore = LoadLanguageSettingsStore(filepath.Join(arguments.root, "language_settings.gob"))
+
+	RegisterTemplateFunction("viewLanguage", viewLanguage)
+	RegisterTemplateFunction("languageSettings", func(language *Language) LanguageSettings {
+		if language == nil {
+			language = unknownLanguage
+		}
+		settings, _ := languageSettingsStore.Settings(language.ID)
+		return settings
+	})
+	// Settings in config.yml may have changed.
+	RegisterReloadFunction(invalidateRenderings)
+}
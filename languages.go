@@ -90,13 +90,19 @@ func (f *Formatter) Format(ctx context.Context, stream io.Reader, lang string) (
 }
 
 func commandFormatter(ctx context.Context, formatter *Formatter, stream io.Reader, args ...string) (output string, err error) {
-	var outbuf, errbuf bytes.Buffer
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	outbuf := &cappedBuffer{limit: instanceConfig.Render.MaxOutput, cancel: cancel}
+	var errbuf bytes.Buffer
 	command := exec.CommandContext(ctx, args[0], args[1:]...)
 	command.Stdin = stream
-	command.Stdout = &outbuf
+	command.Stdout = outbuf
 	command.Stderr = &errbuf
 	command.Env = formatter.Env
 	err = command.Run()
+	if outbuf.overflowed {
+		err = errRenderOutputTooLarge
+	}
 	output = strings.TrimSpace(outbuf.String())
 	if err != nil {
 		output = strings.TrimSpace(errbuf.String())
@@ -116,22 +122,24 @@ var formatFunctions map[string]FormatFunc = map[string]FormatFunc{
 	"markdown":         markdownFormatter,
 }
 
-func FormatStream(r io.Reader, language *Language) (string, error) {
+// FormatStreamContext formats the contents of r as language, giving up when
+// ctx is done.
+func FormatStreamContext(ctx context.Context, r io.Reader, language *Language) (string, error) {
 	var formatter *Formatter
 	var ok bool
 	if formatter, ok = languageConfig.Formatters[language.Formatter]; !ok {
 		formatter = languageConfig.Formatters["default"]
 	}
-
-	timeoutContext, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	return formatter.Format(timeoutContext, r, language.ID)
+	return formatter.Format(ctx, r, language.ID)
 }
 
-func FormatPaste(p *Paste) (string, error) {
-	reader, _ := p.Reader()
+func FormatPaste(ctx context.Context, p *Paste) (string, error) {
+	reader, err := openPaste(ctx, p)
+	if err != nil {
+		return "", err
+	}
 	defer reader.Close()
-	return FormatStream(reader, p.Language)
+	return FormatBudgeted(ctx, reader, viewLanguage(p.Language))
 }
 
 func loadLanguageConfig() {
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Authors can say how a paste may be reused by attaching a license to it.
+// The license is shown on the paste's page, returned by the API, and, on
+// request (?license_header=1), written as a comment at the top of the raw
+// body or download, so that it travels with copies.
+
+type License struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// SPDX is the license's SPDX identifier.
+	SPDX   string `json:"spdx"`
+	URL    string `json:"url,omitempty"`
+	Notice string `json:"-"`
+}
+
+var licenses = []*License{
+	{ID: "mit", Name: "MIT License", SPDX: "MIT", URL: "https://opensource.org/licenses/MIT",
+		Notice: "Permission is granted, free of charge, to deal in this work without restriction, under the terms of the MIT License."},
+	{ID: "apache-2.0", Name: "Apache License 2.0", SPDX: "Apache-2.0", URL: "https://www.apache.org/licenses/LICENSE-2.0",
+		Notice: "Licensed under the Apache License, Version 2.0."},
+	{ID: "bsd-3-clause", Name: "BSD 3-Clause License", SPDX: "BSD-3-Clause", URL: "https://opensource.org/licenses/BSD-3-Clause",
+		Notice: "Redistribution and use, with or without modification, are permitted under the terms of the BSD 3-Clause License."},
+	{ID: "gpl-3.0", Name: "GNU GPL v3", SPDX: "GPL-3.0-or-later", URL: "https://www.gnu.org/licenses/gpl-3.0.html",
+		Notice: "This is free software under the GNU General Public License, version 3 or later."},
+	{ID: "cc0-1.0", Name: "CC0 (public domain)", SPDX: "CC0-1.0", URL: "https://creativecommons.org/publicdomain/zero/1.0/",
+		Notice: "To the extent possible under law, the author has waived all copyright and related rights to this work."},
+	{ID: "cc-by-4.0", Name: "CC BY 4.0", SPDX: "CC-BY-4.0", URL: "https://creativecommons.org/licenses/by/4.0/",
+		Notice: "Licensed under Creative Commons Attribution 4.0 International."},
+	{ID: "proprietary", Name: "Proprietary", SPDX: "LicenseRef-Proprietary",
+		Notice: "Proprietary and confidential. All rights reserved; no license is granted."},
+}
+
+// LicenseNamed returns the license with the given ID (or SPDX identifier),
+// or nil.
+func LicenseNamed(id string) *License {
+	for _, l := range licenses {
+		if strings.EqualFold(l.ID, id) || strings.EqualFold(l.SPDX, id) {
+			return l
+		}
+	}
+	return nil
+}
+
+// licenseCommentPrefixes gives the line comment of languages whose comments
+// don't start with "#". Languages without line comments have their header
+// set off with a rule instead.
+var licenseCommentPrefixes = map[string]string{
+	"c": "//", "cpp": "//", "csharp": "//", "d": "//", "dart": "//", "fsharp": "//",
+	"go": "//", "groovy": "//", "java": "//", "js": "//", "kotlin": "//",
+	"objective-c": "//", "objective-c++": "//", "php": "//", "rust": "//",
+	"scala": "//", "swift": "//", "ts": "//", "verilog": "//",
+	"ada": "--", "haskell": "--", "lua": "--", "sql": "--", "postgresql": "--", "mysql": "--",
+	"clojure": ";", "common-lisp": ";", "ini": ";", "nasm": ";", "scheme": ";",
+	"erlang": "%", "matlab": "%", "tex": "%",
+	"vim":  "\"",
+	"ansi": "", "css": "", "diff": "", "html": "", "json": "", "markdown": "", "text": "", "xml": "",
+}
+
+// licenseHeader returns the comment to put at the top of p's body.
+func licenseHeader(p *Paste, license *License) string {
+	prefix := "#"
+	if p.Language != nil {
+		if pre, ok := licenseCommentPrefixes[p.Language.ID]; ok {
+			prefix = pre
+		}
+	}
+	lines := []string{"SPDX-License-Identifier: " + license.SPDX, license.Notice}
+	if license.URL != "" {
+		lines = append(lines, license.URL)
+	}
+	if prefix == "" {
+		return strings.Join(lines, "\n") + "\n" + strings.Repeat("-", 72) + "\n\n"
+	}
+	return prefix + " " + strings.Join(lines, "\n"+prefix+" ") + "\n\n"
+}
+
+// wantsLicenseHeader reports whether a request for p's raw body asked for
+// its license as a header.
+func wantsLicenseHeader(r *http.Request, p *Paste) bool {
+	return p.License != "" && r.URL.Query().Get("license_header") != ""
+}
+
+func init() {
+	RegisterTemplateFunction("licenses", func() []*License { return licenses })
+	RegisterTemplateFunction("pasteLicense", func(p *Paste) *License { return LicenseNamed(p.License) })
+}
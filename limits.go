@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Request bodies are limited by the kind of route they are sent to. Bodies
+// that declare their length are refused before any of them is read; the
+// rest are cut off once they pass the limit.
+
+const (
+	RequestSizeClassForm   = "form"
+	RequestSizeClassAPI    = "api"
+	RequestSizeClassUpload = "upload"
+)
+
+// requestSizeClasses maps path prefixes to size classes, most specific
+// first. Anything else is a web form.
+var requestSizeClasses = []struct {
+	prefix string
+	class  string
+}{
+	{"/replication/apply", RequestSizeClassUpload},
+	{"/replication/", RequestSizeClassAPI},
+	{"/api/", RequestSizeClassAPI},
+	{"/scim/", RequestSizeClassAPI},
+	{"/ap/", RequestSizeClassAPI},
+}
+
+func requestSizeClass(r *http.Request) string {
+	for _, c := range requestSizeClasses {
+		if strings.HasPrefix(r.URL.Path, c.prefix) {
+			return c.class
+		}
+	}
+	return RequestSizeClassForm
+}
+
+func requestSizeLimit(class string) int64 {
+	switch class {
+	case RequestSizeClassAPI:
+		return instanceConfig.Limits.API
+	case RequestSizeClassUpload:
+		return instanceConfig.Limits.Upload
+	}
+	return instanceConfig.Limits.Form
+}
+
+type RequestTooLargeError int64
+
+func (e RequestTooLargeError) Error() string {
+	return fmt.Sprintf("Your request exceeds the maximum of %v.", ByteSize(e))
+}
+
+func (e RequestTooLargeError) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+type MalformedRequestError struct {
+	err error
+}
+
+func (e MalformedRequestError) Error() string {
+	return fmt.Sprintf("Your request could not be understood: %v", e.err)
+}
+
+func (e MalformedRequestError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// limitedBody cuts a request body off once it passes limit and remembers
+// that it did, so callers need not pick the cause out of whatever error a
+// parser wrapped around it.
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+	exceeded  bool
+}
+
+func newLimitedBody(rc io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{ReadCloser: rc, limit: limit, remaining: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, RequestTooLargeError(b.limit)
+	}
+	// Read one byte past the limit, so that a body of exactly the limit
+	// isn't mistaken for one over it.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		b.exceeded = true
+		return n, RequestTooLargeError(b.limit)
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+type requestSizeLimitHandler struct {
+	http.Handler
+}
+
+func (h requestSizeLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	class := requestSizeClass(r)
+	limit := requestSizeLimit(class)
+	if limit <= 0 {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	refuse := func(err error, status int) {
+		if class == RequestSizeClassForm {
+			RenderError(err, status, w)
+		} else {
+			writeAPIError(w, err)
+		}
+	}
+	tooLarge := func() {
+		healthServer.IncrementMetric("request.too_large." + class)
+		// Don't let the server drain the rest of a body we've refused.
+		w.Header().Set("Connection", "close")
+		refuse(RequestTooLargeError(limit), http.StatusRequestEntityTooLarge)
+	}
+
+	if r.ContentLength > limit {
+		tooLarge()
+		return
+	}
+	body := newLimitedBody(r.Body, limit)
+	r.Body = body
+
+	// Handlers read forms with FormValue, which swallows errors; parse them
+	// here so that an oversized form is reported as such.
+	if r.Method == "POST" || r.Method == "PUT" {
+		var err error
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/x-www-form-urlencoded":
+			err = r.ParseForm()
+		case "multipart/form-data":
+			err = r.ParseMultipartForm(limit)
+		}
+		if body.exceeded {
+			tooLarge()
+			return
+		} else if err != nil {
+			healthServer.IncrementMetric("request.malformed." + class)
+			refuse(MalformedRequestError{err}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.Handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestSizeLimitUnknownLength(t *testing.T) {
+	saved := instanceConfig.Limits.API
+	defer func() { instanceConfig.Limits.API = saved }()
+	instanceConfig.Limits.API = 16
+
+	handler := requestSizeLimitHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{"text=" + strings.Repeat("a", 11), http.StatusCreated},
+		{"text=" + strings.Repeat("a", 12), http.StatusRequestEntityTooLarge},
+		{"text=%zz", http.StatusBadRequest},
+	} {
+		// Hide the length, so that the body has to be read to be refused.
+		r := httptest.NewRequest("POST", "/api/v1/pastes", io.MultiReader(strings.NewReader(tc.body)))
+		r.ContentLength = -1
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%d-byte body: got %d, want %d", len(tc.body), w.Code, tc.want)
+		}
+	}
+}
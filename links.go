@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Links in rendered pastes that lead off the instance can be sent by way of
+// an interstitial page (/out) that shows where they really go, unless they
+// lead to one of links.trusted_domains (or a subdomain of one). Either way
+// they carry rel="nofollow noopener noreferrer".
+//
+// links.autolink decides which links are rendered at all: LinksAll, the
+// default, also turns bare URLs into links; LinksExplicit only renders
+// links written as such; LinksNone leaves pastes inert, keeping only the
+// text of their links.
+
+const (
+	LinksAll      = "all"
+	LinksExplicit = "explicit"
+	LinksNone     = "none"
+)
+
+var (
+	anchorPattern    = regexp.MustCompile(`<a [^>]*>`)
+	anchorTagPattern = regexp.MustCompile(`</?a(?: [^>]*)?>`)
+	hrefPattern      = regexp.MustCompile(`href="([^"]*)"`)
+	relPattern       = regexp.MustCompile(` rel="[^"]*"`)
+)
+
+// linkTrusted reports whether links to u may skip the interstitial.
+func linkTrusted(u *url.URL) bool {
+	return hostInDomains(u.Hostname(), instanceConfig.Links.TrustedDomains)
+}
+
+func outboundURL(u *url.URL) string {
+	return "/out?url=" + url.QueryEscape(u.String())
+}
+
+// rewriteOutboundLinks rewrites the links in sanitized HTML that lead off
+// the instance, or removes every link if links.autolink is LinksNone.
+func rewriteOutboundLinks(in string) string {
+	if instanceConfig.Links.Autolink == LinksNone {
+		return anchorTagPattern.ReplaceAllString(in, "")
+	}
+	return anchorPattern.ReplaceAllStringFunc(in, func(anchor string) string {
+		m := hrefPattern.FindStringSubmatch(anchor)
+		if m == nil {
+			return anchor
+		}
+		u, err := url.Parse(html.UnescapeString(m[1]))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return anchor
+		}
+
+		if instanceConfig.Links.Interstitial && !linkTrusted(u) {
+			anchor = strings.Replace(anchor, m[0], `href="`+html.EscapeString(outboundURL(u))+`"`, 1)
+		}
+		anchor = relPattern.ReplaceAllString(anchor, "")
+		return anchor[:len(anchor)-1] + ` rel="nofollow noopener noreferrer">`
+	})
+}
+
+func outboundLinkHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse(r.FormValue("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		RenderError(fmt.Errorf("That isn't a link we can take you to."), http.StatusBadRequest, w)
+		return
+	}
+	RenderPage(w, r, "outbound", u)
+}
+
+func init() {
+	// Renderings bake in the link settings.
+	RegisterReloadFunction(func() {
+		renderCache.mu.Lock()
+		if renderCache.c != nil {
+			renderCache.c.Clear()
+		}
+		renderCache.pinned = nil
+		renderCache.mu.Unlock()
+	})
+}
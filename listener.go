@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// With a certificate configured, spectre terminates TLS itself and serves
+// HTTP/2 to clients that negotiate it. HTTP/3 needs a QUIC-terminating
+// frontend; http.alt_svc lets spectre advertise it.
+
+type altSvcHandler struct {
+	http.Handler
+}
+
+func (h altSvcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if altSvc := instanceConfig.HTTP.AltSvc; altSvc != "" {
+		w.Header().Set("Alt-Svc", altSvc)
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+var (
+	serverMu   sync.Mutex
+	httpServer *http.Server
+)
+
+// stopServing closes the listener and waits, until ctx is done, for the
+// requests in flight to finish.
+func stopServing(ctx context.Context) error {
+	serverMu.Lock()
+	s := httpServer
+	serverMu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.Shutdown(ctx)
+}
+
+func listenAndServe(addr string, handler http.Handler) error {
+	// Writes, and reads for the routes that override them, are bounded
+	// by requestTimeoutHandler; see deadline.go.
+	tc := instanceConfig.Timeouts
+	s := &http.Server{
+		Addr:              addr,
+		Handler:           altSvcHandler{requestTimeoutHandler{handler}},
+		ReadHeaderTimeout: tc.ReadHeader.Duration(),
+		ReadTimeout:       tc.Read.Duration(),
+		IdleTimeout:       tc.Idle.Duration(),
+		ConnContext:       withConn,
+	}
+	serverMu.Lock()
+	httpServer = s
+	serverMu.Unlock()
+
+	hc := instanceConfig.HTTP
+	acme := customDomainsEnabled() && instanceConfig.Domains.ACME.Enabled
+	if hc.TLSCert == "" && !acme {
+		return s.ListenAndServe()
+	}
+
+	s.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if hc.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto keeps net/http from offering h2.
+		s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	} else {
+		s.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	glog.Info("Serving TLS on ", addr, "; HTTP/2 enabled: ", !hc.DisableHTTP2)
+	if acme {
+		var fallback *tls.Certificate
+		if hc.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(hc.TLSCert, hc.TLSKey)
+			if err != nil {
+				return err
+			}
+			fallback = &cert
+		}
+		acmeManager = newACMEManager()
+		customDomainTLSConfig(s.TLSConfig, fallback)
+		glog.Info("Issuing certificates for custom domains over ACME.")
+		return s.ListenAndServeTLS("", "")
+	}
+	return s.ListenAndServeTLS(hc.TLSCert, hc.TLSKey)
+}
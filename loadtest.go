@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/DHowett/ghostbin/loadtest"
+)
+
+func init() {
+	RegisterCommand("loadtest", "exercise a running instance and report latencies: loadtest [-c n] [-n n] [-d dur] [-size bytes] [-views n] [-expire preset] <url>", func(args []string) error {
+		var opts loadtest.Options
+		fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+		fs.IntVar(&opts.Concurrency, "c", 4, "clients working at once")
+		fs.IntVar(&opts.Iterations, "n", 0, "pastes to create (default: as many as -d allows, or 100)")
+		fs.DurationVar(&opts.Duration, "d", 0, "stop after this long")
+		fs.IntVar(&opts.PasteSize, "size", 1024, "paste size in bytes")
+		fs.IntVar(&opts.Views, "views", 4, "views (page and raw) of each paste")
+		fs.StringVar(&opts.Expire, "expire", "", "give pastes this expiration preset (e.g. 10m), and check that they expire")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if opts.Expire != "" {
+			d, err := ParseDuration(opts.Expire)
+			if err != nil {
+				return fmt.Errorf("-expire: %v", err)
+			}
+			opts.ExpireAfter = d
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: loadtest [flags] <url>")
+		}
+		opts.BaseURL = fs.Arg(0)
+
+		report, err := loadtest.Run(opts)
+		report.WriteTo(os.Stdout)
+		if err != nil {
+			return fmt.Errorf("some requests failed; the first: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,307 @@
+// Package loadtest drives a running spectre instance through its HTTP
+// interface (creating pastes, viewing them and waiting for them to expire)
+// and reports how long each kind of request took, so that changes to the
+// server's performance can be measured.
+package loadtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations, in the order they are reported.
+const (
+	OpCreate = "create"
+	OpView   = "view"
+	OpRaw    = "raw"
+	OpExpire = "expire"
+)
+
+var operations = []string{OpCreate, OpView, OpRaw, OpExpire}
+
+type Options struct {
+	// BaseURL is the instance's base URL, e.g. http://localhost:8080.
+	BaseURL string
+	// Concurrency is the number of clients working at once.
+	Concurrency int
+	// Iterations is how many pastes to create in all (by default, as many
+	// as Duration allows, or 100); Duration, if set, stops the test early.
+	Iterations int
+	Duration   time.Duration
+	// PasteSize is the size of each paste's body, in bytes.
+	PasteSize int
+	// Views is how many times each paste is viewed, both as a page and raw,
+	// after it is created.
+	Views int
+	// Expire, if set, is the expiration given to every paste: the value of
+	// one of the instance's expiration presets, e.g. "10m". ExpireAfter is
+	// how long that is; once the pastes are created, the test waits that
+	// long for them to expire and checks that they have.
+	Expire      string
+	ExpireAfter time.Duration
+
+	HTTPClient *http.Client
+}
+
+// Result summarizes the requests of one operation.
+type Result struct {
+	Op     string
+	Count  int
+	Errors int
+	Min    time.Duration
+	Mean   time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+type Report struct {
+	Elapsed time.Duration
+	Results []Result
+}
+
+// WriteTo writes the report as a table.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-8s %7s %7s %10s %10s %10s %10s %10s %10s\n", "op", "count", "errors", "min", "mean", "p50", "p90", "p99", "max")
+	for _, res := range r.Results {
+		fmt.Fprintf(&b, "%-8s %7d %7d %10v %10v %10v %10v %10v %10v\n", res.Op, res.Count, res.Errors,
+			round(res.Min), round(res.Mean), round(res.P50), round(res.P90), round(res.P99), round(res.Max))
+	}
+	fmt.Fprintf(&b, "\nElapsed: %v\n", round(r.Elapsed))
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func round(d time.Duration) time.Duration {
+	return d - d%(10*time.Microsecond)
+}
+
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func (rec *recorder) record(op string, start time.Time, err error) {
+	elapsed := time.Now().Sub(start)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err != nil {
+		rec.errors[op]++
+		return
+	}
+	rec.latencies[op] = append(rec.latencies[op], elapsed)
+}
+
+func (rec *recorder) results() []Result {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var results []Result
+	for _, op := range operations {
+		latencies := rec.latencies[op]
+		if len(latencies) == 0 && rec.errors[op] == 0 {
+			continue
+		}
+		res := Result{Op: op, Count: len(latencies) + rec.errors[op], Errors: rec.errors[op]}
+		if len(latencies) > 0 {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			var total time.Duration
+			for _, l := range latencies {
+				total += l
+			}
+			percentile := func(p int) time.Duration {
+				return latencies[(len(latencies)-1)*p/100]
+			}
+			res.Min, res.Max = latencies[0], latencies[len(latencies)-1]
+			res.Mean = total / time.Duration(len(latencies))
+			res.P50, res.P90, res.P99 = percentile(50), percentile(90), percentile(99)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+type tester struct {
+	Options
+	rec *recorder
+}
+
+func (t *tester) get(path string, want ...int) error {
+	resp, err := t.HTTPClient.Get(t.BaseURL + path)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	for _, status := range want {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("GET %s: %s", path, resp.Status)
+}
+
+// checkPreset returns an error unless the instance offers value as an
+// expiration preset.
+func (t *tester) checkPreset(value string) error {
+	resp, err := t.HTTPClient.Get(t.BaseURL + "/api/v1/expirations")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /api/v1/expirations: %s", resp.Status)
+	}
+	var expirations struct {
+		Presets []struct {
+			Value string `json:"value"`
+		} `json:"presets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&expirations); err != nil {
+		return fmt.Errorf("GET /api/v1/expirations: %v", err)
+	}
+	var offered []string
+	for _, preset := range expirations.Presets {
+		if preset.Value == value {
+			return nil
+		}
+		offered = append(offered, preset.Value)
+	}
+	return fmt.Errorf("the instance has no expiration preset %q (it has %s)", value, strings.Join(offered, ", "))
+}
+
+func (t *tester) create(body string) (string, error) {
+	form := url.Values{"text": {body}, "lang": {"text"}}
+	if t.Expire != "" {
+		form.Set("expire", t.Expire)
+	}
+	resp, err := t.HTTPClient.PostForm(t.BaseURL+"/api/v1/pastes", form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("create: %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(reply, &created); err != nil {
+		return "", fmt.Errorf("create: %v in %q", err, reply)
+	}
+	if created.ID == "" {
+		return "", fmt.Errorf("create: no ID in %q", reply)
+	}
+	return created.ID, nil
+}
+
+func randomBody(size int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789 \n"
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// Run runs the load test. Errors from individual requests are counted in
+// the report; the first of them is returned as well, to help explain them.
+func Run(opts Options) (*Report, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.PasteSize <= 0 {
+		opts.PasteSize = 1024
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	opts.BaseURL = strings.TrimRight(opts.BaseURL, "/")
+
+	t := &tester{Options: opts, rec: &recorder{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}}
+	if opts.Expire != "" {
+		if err := t.checkPreset(opts.Expire); err != nil {
+			return &Report{}, err
+		}
+	}
+	var errMu sync.Mutex
+	var firstErr error
+	check := func(op string, start time.Time, err error) error {
+		t.rec.record(op, start, err)
+		if err != nil {
+			errMu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errMu.Unlock()
+		}
+		return err
+	}
+
+	start := time.Now()
+	var deadline time.Time
+	if opts.Duration > 0 {
+		deadline = start.Add(opts.Duration)
+	}
+
+	var remaining int64 = int64(opts.Iterations)
+	if opts.Iterations <= 0 {
+		remaining = math.MaxInt64
+		if opts.Duration <= 0 {
+			remaining = 100
+		}
+	}
+	var mu sync.Mutex
+	var created []string
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&remaining, -1) >= 0 && (deadline.IsZero() || time.Now().Before(deadline)) {
+				opStart := time.Now()
+				id, err := t.create(randomBody(opts.PasteSize))
+				if check(OpCreate, opStart, err) != nil {
+					continue
+				}
+				mu.Lock()
+				created = append(created, id)
+				mu.Unlock()
+
+				for v := 0; v < opts.Views; v++ {
+					opStart = time.Now()
+					check(OpView, opStart, t.get("/paste/"+id, http.StatusOK))
+					opStart = time.Now()
+					check(OpRaw, opStart, t.get("/paste/"+id+"/raw", http.StatusOK))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if opts.Expire != "" && len(created) > 0 {
+		// Give the expirator a moment past the last paste's expiration.
+		time.Sleep(opts.ExpireAfter + 2*time.Second)
+		for _, id := range created {
+			opStart := time.Now()
+			check(OpExpire, opStart, t.get("/paste/"+id+"/raw", http.StatusNotFound, http.StatusGone))
+		}
+	}
+
+	report := &Report{Elapsed: time.Now().Sub(start), Results: t.rec.results()}
+	return report, firstErr
+}
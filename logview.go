@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pastes that look like logs (most of their first lines start with a
+// timestamp in one of the formats below) get a log view, at
+// /paste/<id>/log and /api/v1/pastes/<id>/log. It filters entries by
+// level and by time, and rewrites their timestamps into a chosen time
+// zone. Lines without a timestamp (stack traces, wrapped messages) belong
+// to the entry before them.
+
+// logDetectLines is how many non-empty lines are looked at to decide
+// whether a paste is a log.
+const logDetectLines = 50
+
+type logFormat struct {
+	Name string
+	// pattern matches the timestamp, in its first group, and (for glog)
+	// the level, in a group named "level".
+	pattern *regexp.Regexp
+	layouts []string
+	// yearless timestamps are given the year of the paste.
+	yearless bool
+}
+
+var logFormats = []*logFormat{
+	{
+		Name:    "iso8601",
+		pattern: regexp.MustCompile(`^\W{0,2}(\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)`),
+		layouts: []string{"2006-01-02T15:04:05.999999999Z07:00", "2006-01-02T15:04:05.999999999Z0700", "2006-01-02T15:04:05.999999999"},
+	},
+	{
+		Name:    "common",
+		pattern: regexp.MustCompile(`\[(\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\]`),
+		layouts: []string{"02/Jan/2006:15:04:05 -0700"},
+	},
+	{
+		Name:     "syslog",
+		pattern:  regexp.MustCompile(`^(?:<\d+>)?([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})`),
+		layouts:  []string{"Jan _2 15:04:05"},
+		yearless: true,
+	},
+	{
+		Name:     "glog",
+		pattern:  regexp.MustCompile(`^(?P<level>[IWEF])(\d{4} \d{2}:\d{2}:\d{2}\.\d{6})`),
+		layouts:  []string{"0102 15:04:05.000000"},
+		yearless: true,
+	},
+}
+
+// Log levels, least severe first.
+var logLevels = []string{"trace", "debug", "info", "notice", "warning", "error", "critical", "fatal"}
+
+var (
+	logLevelPattern = regexp.MustCompile(`(?i)\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|CRIT|CRITICAL|FATAL|PANIC|EMERG|ALERT)\b`)
+	logLevelAliases = map[string]string{
+		"warn": "warning", "err": "error", "crit": "critical",
+		"panic": "fatal", "emerg": "fatal", "alert": "critical",
+		"i": "info", "w": "warning", "e": "error", "f": "fatal",
+	}
+)
+
+// logLevelIndex returns the severity of a level name, or -1.
+func logLevelIndex(name string) int {
+	name = strings.ToLower(name)
+	if alias, ok := logLevelAliases[name]; ok {
+		name = alias
+	}
+	for i, level := range logLevels {
+		if level == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// LogEntry is a line with a timestamp, and the lines after it without one.
+type LogEntry struct {
+	Line  int       `json:"line"`
+	Time  time.Time `json:"time"`
+	Level string    `json:"level,omitempty"`
+	Text  string    `json:"text"`
+
+	level int
+	// stamp is where the timestamp is in the first line of Text.
+	stamp []int
+}
+
+// LogFilter selects and rewrites log entries.
+type LogFilter struct {
+	// Level is the least severe level shown; entries without a level
+	// are shown only when it is unset.
+	Level string
+	From  time.Time
+	To    time.Time
+	// Location is the zone timestamps are rewritten into, if any;
+	// Source is the zone of timestamps that don't give theirs.
+	Location *time.Location
+	Source   *time.Location
+}
+
+// detectLogFormat returns the format most of the first lines of r are in,
+// or nil.
+func detectLogFormat(r io.Reader) *logFormat {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, instanceConfig.Render.MaxLineLength+1)
+	counts := make([]int, len(logFormats))
+	lines := 0
+	for lines < logDetectLines && scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines++
+		for i, format := range logFormats {
+			if format.pattern.MatchString(line) {
+				counts[i]++
+			}
+		}
+	}
+	var best *logFormat
+	bestCount := 0
+	for i, count := range counts {
+		if count > bestCount {
+			best, bestCount = logFormats[i], count
+		}
+	}
+	if lines == 0 || bestCount*2 < lines {
+		return nil
+	}
+	return best
+}
+
+// pasteLogFormat returns the log format of p, or nil if it isn't a log.
+func pasteLogFormat(p *Paste) *logFormat {
+	if p.direct {
+		return nil
+	}
+	reader, err := p.Reader()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	return detectLogFormat(reader)
+}
+
+// parseTime parses a timestamp in format, giving those without a year
+// the year of ref (or the one before, if that would put them after ref).
+func (f *logFormat) parseTime(s string, source *time.Location, ref time.Time) (time.Time, bool) {
+	s = strings.Replace(s, ",", ".", 1)
+	if f.Name == "iso8601" && len(s) > 10 && s[10] == ' ' {
+		s = s[:10] + "T" + s[11:]
+	}
+	for _, layout := range f.layouts {
+		t, err := time.ParseInLocation(layout, s, source)
+		if err != nil {
+			continue
+		}
+		if f.yearless {
+			ref = ref.In(source)
+			t = time.Date(ref.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), source)
+			if t.After(ref.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// parseLog splits the log in r into entries. Lines before the first
+// timestamp are left out.
+func parseLog(r io.Reader, format *logFormat, source *time.Location, ref time.Time) ([]*LogEntry, error) {
+	var entries []*LogEntry
+	var current *LogEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, int(PASTE_MAXIMUM_LENGTH)+1)
+	levelGroup := format.pattern.SubexpIndex("level")
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		m := format.pattern.FindStringSubmatchIndex(line)
+		var t time.Time
+		ok := false
+		stampGroup := 1
+		if levelGroup == 1 {
+			stampGroup = 2
+		}
+		if m != nil {
+			t, ok = format.parseTime(line[m[2*stampGroup]:m[2*stampGroup+1]], source, ref)
+		}
+		if !ok {
+			if current != nil {
+				current.Text += "\n" + line
+			}
+			continue
+		}
+
+		current = &LogEntry{Line: n, Time: t, Text: line, level: -1, stamp: m[2*stampGroup : 2*stampGroup+2]}
+		if levelGroup > 0 && m[2*levelGroup] >= 0 {
+			current.level = logLevelIndex(line[m[2*levelGroup]:m[2*levelGroup+1]])
+		} else if lm := logLevelPattern.FindStringSubmatch(line[m[1]:]); lm != nil {
+			current.level = logLevelIndex(lm[1])
+		}
+		if current.level >= 0 {
+			current.Level = logLevels[current.level]
+		}
+		entries = append(entries, current)
+	}
+	return entries, scanner.Err()
+}
+
+// Apply returns the entries that pass f, with their timestamps rewritten.
+func (f *LogFilter) Apply(entries []*LogEntry) []*LogEntry {
+	minLevel := logLevelIndex(f.Level)
+	var out []*LogEntry
+	for _, e := range entries {
+		if minLevel >= 0 && e.level < minLevel {
+			continue
+		}
+		if (!f.From.IsZero() && e.Time.Before(f.From)) || (!f.To.IsZero() && e.Time.After(f.To)) {
+			continue
+		}
+		if f.Location != nil {
+			rewritten := *e
+			rewritten.Time = e.Time.In(f.Location)
+			rewritten.Text = e.Text[:e.stamp[0]] + rewritten.Time.Format("2006-01-02T15:04:05.000Z07:00") + e.Text[e.stamp[1]:]
+			e = &rewritten
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// parseLogTime parses a time given to filter by, in loc unless it gives
+// its zone.
+func parseLogTime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	var err error
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// logFilterForRequest reads a LogFilter from r's form values: level, from,
+// to, tz (to rewrite timestamps into, and to read from and to in) and
+// source_tz (of timestamps without a zone; UTC if unset).
+func logFilterForRequest(r *http.Request) (*LogFilter, error) {
+	f := &LogFilter{Level: r.FormValue("level"), Source: time.UTC}
+	if f.Level != "" && logLevelIndex(f.Level) < 0 {
+		return nil, PasteInputError{"level", "must be one of " + strings.Join(logLevels, ", ")}
+	}
+	for _, z := range []struct {
+		field string
+		loc   **time.Location
+	}{{"tz", &f.Location}, {"source_tz", &f.Source}} {
+		if name := r.FormValue(z.field); name != "" {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				return nil, PasteInputError{z.field, "is not a time zone"}
+			}
+			*z.loc = loc
+		}
+	}
+	in := time.UTC
+	if f.Location != nil {
+		in = f.Location
+	}
+	for _, t := range []struct {
+		field string
+		time  *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := r.FormValue(t.field); v != "" {
+			parsed, err := parseLogTime(v, in)
+			if err != nil {
+				return nil, PasteInputError{t.field, "must be a time such as 2006-01-02 15:04:05"}
+			}
+			*t.time = parsed
+		}
+	}
+	return f, nil
+}
+
+// PasteLog is a paste's log view.
+type PasteLog struct {
+	Paste   *Paste
+	Format  string
+	Filter  *LogFilter
+	Total   int
+	Entries []*LogEntry
+}
+
+// Text returns the entries shown, one after another.
+func (l *PasteLog) Text() string {
+	texts := make([]string, len(l.Entries))
+	for i, e := range l.Entries {
+		texts[i] = e.Text
+	}
+	return strings.Join(texts, "\n")
+}
+
+func pasteLog(p *Paste, r *http.Request) (*PasteLog, error) {
+	format := pasteLogFormat(p)
+	if format == nil {
+		return nil, apiError(APIErrorNotFound, "paste %v doesn't look like a log", p.ID)
+	}
+	filter, err := logFilterForRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := p.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	entries, err := parseLog(reader, format, filter.Source, p.LastModified())
+	if err != nil {
+		return nil, err
+	}
+	healthServer.IncrementMetric("paste.log_viewed")
+	return &PasteLog{p, format.Name, filter, len(entries), filter.Apply(entries)}, nil
+}
+
+func pasteLogHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	l, err := pasteLog(o.(*Paste), r)
+	if err != nil {
+		panic(err)
+	}
+	RenderPage(w, r, "paste_log", l)
+}
+
+// apiPasteLogHandler answers with a paste's log entries; form values are
+// those of logFilterForRequest.
+func apiPasteLogHandler(w http.ResponseWriter, r *http.Request) {
+	o, err := lookupPasteWithRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := checkSeal(o.(*Paste), r); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	served, err := countView(o.(*Paste), r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer served()
+	l, err := pasteLog(o.(*Paste), r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	entries := l.Entries
+	if entries == nil {
+		entries = []*LogEntry{}
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"id":      mux.Vars(r)["id"],
+		"format":  l.Format,
+		"total":   l.Total,
+		"entries": entries,
+	})
+}
+
+func init() {
+	RegisterTemplateFunction("pasteIsLog", func(p *Paste) bool { return pasteLogFormat(p) != nil })
+	RegisterTemplateFunction("logLevels", func() []string { return logLevels })
+}
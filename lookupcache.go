@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Every request looks up its session, and the account it is logged in as,
+// and both live on disk. They are kept in memory for a short while
+// (lookup_cache in config.yml) once read: accounts by CachingUserStore (see
+// auth.go), and sessions by CachingSessionStore, which keeps each session's
+// file as it was read and decodes it anew for each request, so that no two
+// requests share its values.
+//
+// Anything that changes an account or a session through this instance
+// drops it from the cache, so that it is read again; the cache only hides
+// changes made by other instances sharing the data directory, and only for
+// as long as it keeps what it has.
+
+const SESSION_CACHE_MAX_ENTRIES int = 4096
+
+type CachingSessionStore struct {
+	*sessions.FilesystemStore
+	path string
+
+	// mu is held for reading a session file and caching what was read,
+	// and for writing one, so that a session read as it is saved is
+	// neither read half-written nor cached as it was before.
+	mu    sync.Mutex
+	cache *lru.Cache
+}
+
+type cachedSession struct {
+	data   string
+	loaded time.Time
+}
+
+func NewCachingSessionStore(path string, keyPairs ...[]byte) *CachingSessionStore {
+	return &CachingSessionStore{
+		FilesystemStore: sessions.NewFilesystemStore(path, keyPairs...),
+		path:            path,
+		cache: &lru.Cache{
+			MaxEntries: SESSION_CACHE_MAX_ENTRIES,
+		},
+	}
+}
+
+func (s *CachingSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New is FilesystemStore's, reading the session's file through the cache.
+func (s *CachingSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	var err error
+	if c, errCookie := r.Cookie(name); errCookie == nil {
+		err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+		if err == nil {
+			var data string
+			data, err = s.read(session.ID)
+			if err == nil {
+				err = securecookie.DecodeMulti(name, data, &session.Values, s.Codecs...)
+			}
+			if err == nil {
+				session.IsNew = false
+			}
+		}
+	}
+	return session, err
+}
+
+func (s *CachingSessionStore) read(id string) (string, error) {
+	ttl := instanceConfig.LookupCache.Sessions.Duration()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.cache.Get(id); ok && time.Since(v.(*cachedSession).loaded) < ttl {
+		countLookup("session", true)
+		return v.(*cachedSession).data, nil
+	}
+	countLookup("session", false)
+
+	fdata, err := ioutil.ReadFile(filepath.Join(s.path, "session_"+id))
+	if err != nil {
+		return "", err
+	}
+	if ttl > 0 {
+		s.cache.Add(id, &cachedSession{data: string(fdata), loaded: time.Now()})
+	}
+	return string(fdata), nil
+}
+
+// Save saves (or, for a session whose MaxAge is <= 0, erases) session, and
+// drops it from the cache.
+func (s *CachingSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.FilesystemStore.Save(r, w, session)
+	if session.ID != "" {
+		s.cache.Remove(session.ID)
+	}
+	return err
+}
+
+// countLookup counts a lookup of the given kind that hit the cache, or
+// missed it.
+func countLookup(kind string, hit bool) {
+	if healthServer == nil {
+		return
+	}
+	if hit {
+		healthServer.IncrementMetric(kind + ".cache.hit")
+	} else {
+		healthServer.IncrementMetric(kind + ".cache.miss")
+	}
+}
+
+// forgetAccount drops the named account, as events name it, from the
+// account cache.
+func forgetAccount(name string) {
+	store, ok := userStore.(*PromoteFirstUserToAdminStore)
+	if !ok {
+		return
+	}
+	if c, ok := store.AccountStore.(*CachingUserStore); ok {
+		c.Forget(name)
+		c.Forget((&ManglingUserStore{}).mangle(name))
+	}
+}
+
+func init() {
+	SubscribeEvent(func(ev *Event) {
+		if ev.Account != "" {
+			forgetAccount(ev.Account)
+		}
+	}, EventAccountCreated, EventAccountVerified, EventAccountDeprovisioned)
+}
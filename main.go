@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/gob"
 	"encoding/json"
@@ -20,6 +21,7 @@ import (
 	"time"
 
 	"github.com/DHowett/ghostbin/account"
+	"github.com/DHowett/ghostbin/objectstore"
 	"github.com/DHowett/gotimeout"
 	"github.com/golang/glog"
 	"github.com/golang/groupcache/lru"
@@ -32,7 +34,6 @@ var VERSION string = "<local build>"
 
 const PASTE_CACHE_MAX_ENTRIES int = 1000
 const PASTE_MAXIMUM_LENGTH ByteSize = 524288 // 512KiB
-const MAX_EXPIRE_DURATION time.Duration = 2 * 24 * time.Hour
 
 type PasteAccessDeniedError struct {
 	action string
@@ -48,6 +49,16 @@ func (e PasteAccessDeniedError) StatusCode() int {
 	return http.StatusForbidden
 }
 
+type PermissionDeniedError struct{}
+
+func (e PermissionDeniedError) Error() string {
+	return "You are not allowed to be here. >:|"
+}
+
+func (e PermissionDeniedError) StatusCode() int {
+	return http.StatusForbidden
+}
+
 func (e PasteNotFoundError) StatusCode() int {
 	return http.StatusNotFound
 }
@@ -68,10 +79,12 @@ func (e PasteTooLargeError) StatusCode() int {
 
 func getPasteJSONHandler(o Model, w http.ResponseWriter, r *http.Request) {
 	p := o.(*Paste)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-
-	reader, _ := p.Reader()
+	reader, err := openPaste(r.Context(), p)
+	if err != nil {
+		panic(err)
+	}
 	defer reader.Close()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	buf := &bytes.Buffer{}
 	io.Copy(buf, reader)
 
@@ -82,21 +95,69 @@ func getPasteJSONHandler(o Model, w http.ResponseWriter, r *http.Request) {
 		"expiration": p.Expiration,
 		"body":       string(buf.Bytes()),
 	}
+	if retention := pasteRetention(p); retention != nil {
+		pasteMap["retention"] = retention
+	}
+	if license := LicenseNamed(p.License); license != nil {
+		pasteMap["license"] = license
+	}
+	if digest, err := pasteDigest(p); err == nil {
+		pasteMap["sha256"] = digest
+	}
+	if len(p.Networks) > 0 {
+		pasteMap["networks"] = p.Networks
+	}
+	if p.Source != "" {
+		pasteMap["source_url"] = p.Source
+	}
+	if p.viewLimited && isEditAllowed(p, r) {
+		pasteMap["views_left"] = p.viewsLeft
+	}
+	if p.diagnostics != nil {
+		pasteMap["diagnostics"] = p.diagnostics
+	}
+	if p.immutable {
+		pasteMap["immutable"] = true
+	}
+	pasteMap["status"] = pasteStatus(p)
+	if revision := pasteRevision(p); revision != "" {
+		pasteMap["revision"] = revision
+		w.Header().Set("ETag", pasteETag(revision))
+	}
 
 	json, _ := json.Marshal(pasteMap)
 	w.Write(json)
 }
 
 func getPasteRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	lines, err := parseLineRange(r.FormValue("lines"))
+	if err == nil && lines != nil && p.direct {
+		err = PasteInputError{"lines", "can't be picked out of uploaded pastes"}
+	}
+	if err != nil {
+		panic(err)
+	}
+	if url := directBodyURL(p); url != "" {
+		w.Header().Set("Location", url)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	out, done, err := meterRawBody(w, r, p)
+	if err != nil {
+		panic(err)
+	}
+	defer done()
+
 	w.Header().Set("Access-Control-Allow-Origin", "null")
-	w.Header().Set("Vary", "Origin")
+	w.Header().Add("Vary", "Origin")
 
 	w.Header().Set("Content-Security-Policy", "default-src 'none'")
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
 
-	p := o.(*Paste)
 	ext := "txt"
 	if mux.CurrentRoute(r).GetName() == "download" {
 		lang := p.Language
@@ -114,9 +175,22 @@ func getPasteRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Transfer-Encoding", "binary")
 	}
 
-	reader, _ := p.Reader()
+	if lines != nil {
+		writePasteExcerpt(out, w, r, p, lines)
+		return
+	}
+
+	reader, err := openPaste(r.Context(), p)
+	if err != nil {
+		panic(err)
+	}
 	defer reader.Close()
-	io.Copy(w, reader)
+	if wantsLicenseHeader(r, p) {
+		io.WriteString(out, licenseHeader(p, LicenseNamed(p.License)))
+	} else {
+		setDigestHeaders(w, p)
+	}
+	io.Copy(out, reader)
 }
 
 func pasteGrantHandler(o Model, w http.ResponseWriter, r *http.Request) {
@@ -187,7 +261,7 @@ func isEditAllowed(p *Paste, r *http.Request) bool {
 
 func requiresEditPermission(fn ModelRenderFunc) ModelRenderFunc {
 	return func(o Model, w http.ResponseWriter, r *http.Request) {
-		defer errorRecoveryHandler(w)
+		defer errorRecoveryHandler(w, r)
 
 		p := o.(*Paste)
 		accerr := PasteAccessDeniedError{"modify", p.ID}
@@ -198,105 +272,193 @@ func requiresEditPermission(fn ModelRenderFunc) ModelRenderFunc {
 	}
 }
 
+func userHasPermission(r *http.Request, permission string) bool {
+	user := GetUser(r)
+	if user != nil {
+		if o, ok := user.Values["user.permissions"]; ok {
+			if perms, ok := o.(PastePermission); ok && perms[permission] {
+				return true
+			}
+		}
+		// Permissions conferred by SCIM groups; see scim.go.
+		if perms, ok := user.Values["scim.permissions"].(PastePermission); ok {
+			return perms[permission]
+		}
+	}
+	return false
+}
+
 func requiresUserPermission(permission string, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer errorRecoveryHandler(w)
-
-		user := GetUser(r)
-		if user != nil {
-			if o, ok := user.Values["user.permissions"]; ok {
-				if perms, ok := o.(PastePermission); ok {
-					if perms[permission] {
-						handler.ServeHTTP(w, r)
-						return
-					}
-				}
-			}
+		defer errorRecoveryHandler(w, r)
+
+		if userHasPermission(r, permission) {
+			handler.ServeHTTP(w, r)
+			return
 		}
 
 		healthServer.IncrementMetric("permission." + permission + ".failed")
-		panic(fmt.Errorf("You are not allowed to be here. >:|"))
+		panic(PermissionDeniedError{})
 	})
 }
 
 func pasteUpdate(o Model, w http.ResponseWriter, r *http.Request) {
+	if err := checkAbuse(r, r.FormValue("text"), false); err != nil {
+		panic(err)
+	}
+	defer lockPasteUpdates(o.(*Paste).ID)()
+	if err := checkPastePrecondition(r, o.(*Paste)); err != nil {
+		panic(err)
+	}
 	pasteUpdateCore(o, w, r, false)
 	healthServer.IncrementMetric("paste.updated")
 }
 
+// setPasteExpiration schedules p to expire after expireIn, or cancels its
+// expiration if expireIn is "-1", within the bounds of p's retention class.
+func setPasteExpiration(p *Paste, expireIn string) {
+	expireIn = retainedExpiration(p, expireIn)
+	if expireIn != "" && expireIn != "-1" {
+		dur, _ := ParseDuration(expireIn)
+		pasteExpirator.ExpireObject(p, dur)
+	} else {
+		if expireIn == "-1" && pasteExpirator.ObjectHasExpiration(p) {
+			pasteExpirator.CancelObjectExpiration(p)
+		}
+	}
+
+	p.Expiration = expireIn
+}
+
 func pasteUpdateCore(o Model, w http.ResponseWriter, r *http.Request, newPaste bool) {
 	p := o.(*Paste)
-	body := r.FormValue("text")
-	if len(strings.TrimSpace(body)) == 0 {
+	value := r.FormValue
+	if !newPaste {
+		// A paste keeps the expiration it has, even if it is no longer
+		// one of the presets.
+		value = func(name string) string {
+			if name == "expire" && r.FormValue(name) == p.Expiration {
+				return ""
+			}
+			if name == "sealed_until" && r.FormValue(name) == pasteSealValue(p) {
+				return ""
+			}
+			if name == "views" && r.FormValue(name) == pasteViewsValue(p) {
+				return ""
+			}
+			if name == "retention" && r.FormValue(name) == p.Retention {
+				return ""
+			}
+			return r.FormValue(name)
+		}
+	}
+	in, err := parsePasteInput(value)
+	if err == nil {
+		err = checkRetentionClass(r, in)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	if len(strings.TrimSpace(in.Body)) == 0 {
 		w.Header().Set("Location", pasteURL("delete", p))
 		w.WriteHeader(http.StatusFound)
 		return
 	}
 
-	pasteLen := ByteSize(len(body))
-	if pasteLen > PASTE_MAXIMUM_LENGTH {
-		panic(PasteTooLargeError(pasteLen))
+	attributeChange(r, p)
+	holdForApproval(r, p)
+	if err := savePasteInputContext(r.Context(), p, in, newPaste); err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// savePasteInput writes in to p. Unless p is new, an empty expiration or
+// language leaves p's as it is.
+func savePasteInput(p *Paste, in *PasteInput, newPaste bool) {
+	expiration := in.Expiration
+	if newPaste {
+		expiration = defaultExpiration(expiration)
+		p.Retention = defaultRetention(in.Retention)
+		p.immutable = in.Immutable
+	} else if expiration == "" {
+		expiration = p.Expiration
+	}
+	if in.Retention != "" {
+		p.Retention = in.Retention
 	}
 
 	if !newPaste {
 		// If this is an update (instead of a new paste), blow away the hash.
-		tok := "P|H|" + p.ID.String()
-		v, _ := ephStore.Get(tok)
-		if hash, ok := v.(string); ok {
-			ephStore.Delete(hash)
-			ephStore.Delete(tok)
-		}
+		forgetPasteHash(p.ID)
 	}
 
-	pw, _ := p.Writer()
-	pw.Write([]byte(body))
-	if r.FormValue("lang") != "" {
-		p.Language = LanguageNamed(r.FormValue("lang"))
+	pw, err := p.Writer()
+	if err != nil {
+		panic(err)
+	}
+	pw.Write([]byte(in.Body))
+	if in.Language != "" {
+		p.Language = LanguageNamed(in.Language)
 	}
 
 	if p.Language == nil {
 		p.Language = unknownLanguage
 	}
+	validatePasteBody(p, []byte(in.Body))
 
-	expireIn := r.FormValue("expire")
-	if expireIn != "" && expireIn != "-1" {
-		dur, _ := ParseDuration(expireIn)
-		if dur > MAX_EXPIRE_DURATION {
-			dur = MAX_EXPIRE_DURATION
-		}
-		pasteExpirator.ExpireObject(p, dur)
-	} else {
-		if expireIn == "-1" && pasteExpirator.ObjectHasExpiration(p) {
-			pasteExpirator.CancelObjectExpiration(p)
-		}
-	}
-
-	p.Expiration = expireIn
+	setPasteExpiration(p, expiration)
+	sealPaste(p, in)
+	limitPasteViews(p, in)
 
-	p.Title = r.FormValue("title")
+	p.Title = pasteTitle(p, in)
+	p.License = in.License
+	p.Networks = in.Networks
+	if in.Source != "" {
+		p.Source = in.Source
+	}
 
 	pw.Close() // Saves p
+}
 
-	w.Header().Set("Location", pasteURL("show", p))
-	w.WriteHeader(http.StatusSeeOther)
+// replacePasteBody saves body over p's, leaving the rest of p as it is.
+func replacePasteBody(r *http.Request, p *Paste, body string) error {
+	current := map[string]string{"text": body, "title": p.Title, "license": p.License, "networks": pasteNetworksValue(p)}
+	in, err := parsePasteInput(func(name string) string { return current[name] })
+	if err != nil {
+		return err
+	}
+	attributeChange(r, p)
+	if err := savePasteInputContext(r.Context(), p, in, false); err != nil {
+		return err
+	}
+	healthServer.IncrementMetric("paste.updated")
+	return nil
 }
 
 func pasteCreate(w http.ResponseWriter, r *http.Request) {
-	body := r.FormValue("text")
+	in, err := parsePasteInput(r.FormValue)
+	if err != nil {
+		RenderError(err, err.(HTTPError).StatusCode(), w)
+		return
+	}
+
+	body := in.Body
 	if len(strings.TrimSpace(body)) == 0 {
 		// 400 here, 200 above (one is displayed to the user, one could be an API response.)
 		RenderError(fmt.Errorf("Hey, put some text in that paste."), 400, w)
 		return
 	}
 
-	pasteLen := ByteSize(len(body))
-	if pasteLen > PASTE_MAXIMUM_LENGTH {
-		err := PasteTooLargeError(pasteLen)
-		RenderError(err, err.StatusCode(), w)
+	if err := checkAbuse(r, body, true); err != nil {
+		RenderError(err, http.StatusForbidden, w)
 		return
 	}
 
-	password := r.FormValue("password")
+	password := in.Password
 	encrypted := password != ""
 
 	if encrypted && (Env() != EnvironmentDevelopment && !RequestIsHTTPS(r)) {
@@ -306,7 +468,7 @@ func pasteCreate(w http.ResponseWriter, r *http.Request) {
 
 	hasher := md5.New()
 	io.WriteString(hasher, body)
-	hashToken := "H|" + SourceIPForRequest(r) + "|" + base32Encoder.EncodeToString(hasher.Sum(nil))
+	hashToken := "H|" + StoredIPForRequest(r) + "|" + base32Encoder.EncodeToString(hasher.Sum(nil))
 
 	if !encrypted {
 		v, _ := ephStore.Get(hashToken)
@@ -316,7 +478,7 @@ func pasteCreate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	p, err := pasteStore.New(password != "")
+	p, err := newPaste(r.Context(), password != "")
 	if err != nil {
 		panic(err)
 	}
@@ -347,12 +509,17 @@ func pasteCreate(w http.ResponseWriter, r *http.Request) {
 		cliSession.Values["paste_keys"] = pasteKeys
 	}
 
+	if GetUser(r) == nil {
+		rememberRecentPaste(r, p)
+	}
+
 	err = sessions.Save(r, w)
 	if err != nil {
 		glog.Errorln(err)
 	}
 
 	pasteUpdateCore(p, w, r, true)
+	publishPaste(r, p)
 
 	healthServer.IncrementMetric("paste.created")
 }
@@ -361,7 +528,19 @@ func pasteDelete(o Model, w http.ResponseWriter, r *http.Request) {
 	p := o.(*Paste)
 
 	oldId := p.ID
-	p.Destroy()
+	p.deletionReason = "deleted by its owner"
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() == "admindelete" {
+		p.deletionReason = "deleted by an administrator"
+	} else if grace := instanceConfig.Trash.Deleted.Duration(); grace > 0 && trashPaste(p, p.deletionReason, grace) {
+		// The owner keeps their permissions, so that they can undo this.
+		SetFlashWithAction(w, "success", fmt.Sprintf("Paste %v deleted.", oldId), "Undo", pasteURL("restore", p))
+		w.Header().Set("Location", "/")
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	if err := destroyPaste(r.Context(), p); err != nil {
+		panic(err)
+	}
 
 	perms := GetPastePermissions(r)
 	perms.Delete(oldId)
@@ -394,7 +573,29 @@ func lookupPasteWithRequest(r *http.Request) (Model, error) {
 	}
 
 	enc := false
-	p, err := pasteStore.Get(id, key)
+	p, err := getPaste(r.Context(), id, key)
+	if p != nil && p.trashed != "" {
+		return nil, PasteNotFoundError{ID: id}
+	}
+	if p != nil {
+		if err := checkNetworks(p, r); err != nil {
+			return nil, err
+		}
+		if err := checkViewsLeft(p, r); err != nil {
+			return nil, err
+		}
+		if err := checkPending(p, r); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := err.(PasteNotFoundError); ok {
+		if location, ok := redirectStore.LocationForRequest(r, id); ok {
+			return nil, MovedLookupError{Location: location}
+		}
+		if t, ok := tombstoneStore.Get(id); ok {
+			return nil, PasteGoneError{Tombstone: t}
+		}
+	}
 	if _, ok := err.(PasteEncryptedError); ok {
 		enc = true
 	}
@@ -460,6 +661,10 @@ func authenticatePastePOSTHandler(w http.ResponseWriter, r *http.Request) {
 		RenderError(err, http.StatusNotFound, w)
 		return
 	}
+	if err := checkNetworks(p, r); err != nil {
+		RenderError(err, http.StatusForbidden, w)
+		return
+	}
 
 	key := p.EncryptionKeyWithPassword(password)
 	if key != nil {
@@ -488,7 +693,7 @@ func authenticatePastePOSTHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func throttleAuthForRequest(r *http.Request) bool {
-	ip := SourceIPForRequest(r)
+	ip := StoredIPForRequest(r)
 
 	id := mux.Vars(r)["id"]
 
@@ -501,12 +706,16 @@ func throttleAuthForRequest(r *http.Request) bool {
 	} else {
 		var n int32
 		at = &n
-		ephStore.Put(tok, at, 1*time.Minute)
+		ephStore.Put(tok, at, privacyRetention(1*time.Minute))
 	}
 
 	*at++
 
-	if *at >= 5 {
+	attempts := int32(5)
+	if ipSuspect(r) {
+		attempts = 2
+	}
+	if *at >= attempts {
 		// If they've tried and failed too much, renew the throttle
 		// at five minutes, to make them cool off.
 
@@ -540,37 +749,78 @@ func partialGetHandler(w http.ResponseWriter, r *http.Request) {
 type RenderedPaste struct {
 	body       template.HTML
 	renderTime time.Time
+	generation int
+
+	linesOnce sync.Once
+	lines     []string
 }
 
 var renderCache struct {
 	mu sync.RWMutex
 	c  *lru.Cache
+	// pinned holds the renderings of pinned pastes, which aren't subject
+	// to the LRU's eviction.
+	pinned map[PasteID]*RenderedPaste
+	// generation is bumped to invalidate every cached rendering at once.
+	generation int
+}
+
+func renderPaste(ctx context.Context, p *Paste) template.HTML {
+	if p.direct {
+		return template.HTML(`This paste is too large to display here. <a href="` + template.HTMLEscapeString(rawPasteURL("raw", p)) + `">View it raw.</a>`)
+	}
+
+	rendered := renderedPaste(ctx, p)
+	if rendered == nil {
+		return template.HTML("There was an error rendering this paste.")
+	}
+	if pasteFolds(p, rendered) {
+		return rendered.chunk(0)
+	}
+	return rendered.body
 }
 
-func renderPaste(p *Paste) template.HTML {
+// renderedPaste returns p's rendering, from the render cache if it is up
+// to date, or nil if p can't be rendered. Pastes are rendered outside the
+// cache's lock, so that a slow one doesn't hold up the rest.
+func renderedPaste(ctx context.Context, p *Paste) *RenderedPaste {
 	renderCache.mu.RLock()
 	var cached *RenderedPaste
 	var cval interface{}
 	var ok bool
-	if renderCache.c != nil {
+	if cached, ok = renderCache.pinned[p.ID]; !ok && renderCache.c != nil {
 		if cval, ok = renderCache.c.Get(p.ID); ok {
 			cached = cval.(*RenderedPaste)
 		}
 	}
+	generation := renderCache.generation
 	renderCache.mu.RUnlock()
 
-	if !ok || cached.renderTime.Before(p.LastModified()) {
-		defer renderCache.mu.Unlock()
-		renderCache.mu.Lock()
-		out, err := FormatPaste(p)
+	if !ok || cached.renderTime.Before(p.LastModified()) || cached.generation != generation {
+		out, err := FormatPaste(ctx, p)
 
 		if err != nil {
 			glog.Errorf("Render for %s failed: (%s) output: %s", p.ID, err.Error(), out)
-			return template.HTML("There was an error rendering this paste.")
+			return nil
+		}
+
+		rendered := &RenderedPaste{body: template.HTML(out), renderTime: time.Now(), generation: generation}
+		if ctx.Err() != nil {
+			// The request gave up (or ran out of time) mid-render, so what
+			// we have is likely the plain-text fallback; don't let it stand
+			// in for the real rendering.
+			return rendered
 		}
 
-		rendered := template.HTML(out)
-		if !p.Encrypted {
+		defer renderCache.mu.Unlock()
+		renderCache.mu.Lock()
+		if !p.Encrypted && p.Pinned() {
+			if renderCache.pinned == nil {
+				renderCache.pinned = make(map[PasteID]*RenderedPaste)
+			}
+			renderCache.pinned[p.ID] = rendered
+			glog.Info("RENDER CACHE: Pinned ", p.ID)
+		} else if !p.Encrypted {
 			if renderCache.c == nil {
 				renderCache.c = &lru.Cache{
 					MaxEntries: PASTE_CACHE_MAX_ENTRIES,
@@ -579,44 +829,63 @@ func renderPaste(p *Paste) template.HTML {
 					},
 				}
 			}
-			renderCache.c.Add(p.ID, &RenderedPaste{body: rendered, renderTime: time.Now()})
+			renderCache.c.Add(p.ID, rendered)
 			glog.Info("RENDER CACHE: Cached ", p.ID)
 		}
 
 		return rendered
 	} else {
-		return cached.body
+		return cached
 	}
 }
 
-func pasteDestroyCallback(p *Paste) {
-	tok := "P|H|" + p.ID.String()
+// forgetRenderedPaste drops a paste's cached rendering, reporting whether
+// there was a render cache at all.
+func forgetRenderedPaste(id PasteID) bool {
+	defer renderCache.mu.Unlock()
+	renderCache.mu.Lock()
+	delete(renderCache.pinned, id)
+	if renderCache.c == nil {
+		return false
+	}
+	renderCache.c.Remove(id)
+	return true
+}
+
+// forgetPasteHash stops new pastes with the same body as id from being
+// folded into it.
+func forgetPasteHash(id PasteID) {
+	tok := "P|H|" + id.String()
 	v, _ := ephStore.Get(tok)
 	if hash, ok := v.(string); ok {
 		ephStore.Delete(hash)
 		ephStore.Delete(tok)
 	}
+}
+
+func pasteDestroyCallback(p *Paste) {
+	forgetPasteHash(p.ID)
+	accessLogStore.Forget(p.ID)
+	moderationQueue.Remove(p.ID)
 
 	pasteExpirator.CancelObjectExpiration(p)
 
-	defer renderCache.mu.Unlock()
-	renderCache.mu.Lock()
-	if renderCache.c == nil {
+	// Clear the cached render when a paste is destroyed
+	if !forgetRenderedPaste(p.ID) {
 		return
 	}
-
-	glog.Info("RENDER CACHE: Removing ", p.ID, " due to destruction.")
-	// Clear the cached render when a paste is destroyed
-	renderCache.c.Remove(p.ID)
+	glog.Info("RENDER CACHE: Removed ", p.ID, " due to destruction.")
 
 	reportStore.Delete(p.ID)
 
 	healthServer.IncrementMetric("paste.deleted")
 }
 
-var pasteStore *FilesystemPasteStore
+var pasteStore PasteStore
+var filesystemPasteStore *FilesystemPasteStore
 var pasteExpirator *gotimeout.Expirator
-var sessionStore *sessions.FilesystemStore
+var pasteExpirationFile *ExpirationFile
+var sessionStore sessions.Store
 var clientOnlySessionStore *sessions.CookieStore
 var clientLongtermSessionStore *sessions.CookieStore
 var ephStore *gotimeout.Map
@@ -624,10 +893,13 @@ var userStore account.AccountStore
 var pasteRouter *mux.Router
 var router *mux.Router
 var healthServer *HealthServer
+var launchTime time.Time
 
 type args struct {
 	root, addr string
 	rebuild    bool
+	// faults are the storage faults to inject; see faults.go.
+	faults string
 
 	registrationOnce sync.Once
 	parseOnce        sync.Once
@@ -638,6 +910,7 @@ func (a *args) register() {
 		flag.StringVar(&a.root, "root", "./", "path to generated file storage")
 		flag.StringVar(&a.addr, "addr", "0.0.0.0:8080", "bind address and port")
 		flag.BoolVar(&a.rebuild, "rebuild", false, "rebuild all templates for each request")
+		flag.StringVar(&a.faults, "faults", "", "storage faults to inject, for testing")
 	})
 }
 
@@ -661,7 +934,9 @@ func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	RegisterTemplateFunction("encryptionAllowed", func(ri *RenderContext) bool { return Env() == EnvironmentDevelopment || RequestIsHTTPS(ri.Request) })
 	RegisterTemplateFunction("editAllowed", func(ri *RenderContext) bool { return isEditAllowed(ri.Obj.(*Paste), ri.Request) })
-	RegisterTemplateFunction("render", renderPaste)
+	RegisterTemplateFunction("accessLogAvailable", accessLogsAvailable)
+	SubscribeEvent(onPasteEvent(pasteDestroyCallback), EventPasteDestroyed)
+	RegisterTemplateFunction("render", func(ri *RenderContext, p *Paste) template.HTML { return renderPaste(ri.Request.Context(), p) })
 	RegisterTemplateFunction("pasteURL", pasteURL)
 	RegisterTemplateFunction("pasteWillExpire", func(p *Paste) bool {
 		return p.Expiration != "" && p.Expiration != "-1"
@@ -703,6 +978,7 @@ func init() {
 		return b.String()
 	})
 	RegisterTemplateFunction("requestVariable", requestVariable)
+	RegisterTemplateFunction("lastGCReport", func() *GCReport { return garbageCollector.LastReport() })
 
 	sesdir := filepath.Join(arguments.root, "sessions")
 	os.Mkdir(sesdir, 0700)
@@ -716,9 +992,10 @@ func init() {
 			glog.Fatal("session.key not found, and an attempt to create one failed: ", err)
 		}
 	}
-	sessionStore = sessions.NewFilesystemStore(sesdir, sessionKey)
-	sessionStore.Options.Path = "/"
-	sessionStore.Options.MaxAge = 86400 * 365
+	cachingSessionStore := NewCachingSessionStore(sesdir, sessionKey)
+	cachingSessionStore.Options.Path = "/"
+	cachingSessionStore.Options.MaxAge = 86400 * 365
+	sessionStore = cachingSessionStore
 
 	clientKeyFile := filepath.Join(arguments.root, "client_session_enc.key")
 	clientOnlySessionEncryptionKey, err := SlurpFile(clientKeyFile)
@@ -745,12 +1022,110 @@ func init() {
 
 	pastedir := filepath.Join(arguments.root, "pastes")
 	os.Mkdir(pastedir, 0700)
-	pasteStore = NewFilesystemPasteStore(pastedir)
-	pasteStore.PasteDestroyCallback = PasteCallback(pasteDestroyCallback)
+	filesystemPasteStore = NewFilesystemPasteStore(pastedir)
+	filesystemPasteStore.Faults = arguments.faults != ""
+	filesystemPasteStore.PasteCreateCallback = publishesPasteEvent(EventPasteCreated)
+	filesystemPasteStore.PasteModifyCallback = publishesPasteEvent(EventPasteModified)
+	filesystemPasteStore.PasteDestroyingCallback = publishesPasteEvent(EventPasteDestroying)
+	filesystemPasteStore.PasteDestroyCallback = publishesPasteEvent(EventPasteDestroyed)
+	// Packed pastes are read from their packs even with packing disabled.
+	filesystemPasteStore.Packs = &PackStore{
+		Path:        filepath.Join(arguments.root, "packs"),
+		MaxPackSize: instanceConfig.Pack.PackSize,
+	}
+	if instanceConfig.Pack.MaxSize > 0 {
+		pastePacker = &Packer{
+			Store:        filesystemPasteStore,
+			MaxSize:      instanceConfig.Pack.MaxSize,
+			After:        instanceConfig.Pack.After.Duration(),
+			CompactBelow: instanceConfig.Pack.CompactBelow,
+		}
+	}
+	accessLogStore = LoadAccessLogStore(filepath.Join(arguments.root, "access.gob"))
+	tombstoneStore = LoadTombstoneStore(filepath.Join(arguments.root, "tombstones.gob"))
+	pasteStore = filesystemPasteStore
+
+	if len(instanceConfig.Store.Replicas) > 0 {
+		replicas := make([]PasteStore, len(instanceConfig.Store.Replicas))
+		for i, path := range instanceConfig.Store.Replicas {
+			replica := NewFilesystemPasteStore(path)
+			replica.Packs = filesystemPasteStore.Packs
+			replica.Faults = filesystemPasteStore.Faults
+			replicas[i] = replica
+		}
+		pasteStore = NewReplicatedPasteStore(filesystemPasteStore, replicas, instanceConfig.Store.ReplicaStaleness.Duration())
+	}
 
-	pasteExpirator = gotimeout.NewExpirator(filepath.Join(arguments.root, "expiry.gob"), &ExpiringPasteStore{pasteStore})
+	expirationFilename := filepath.Join(arguments.root, "expiry.gob")
+	noteExpirationsAtBoot(expirationFilename)
+	pasteExpirationFile = NewExpirationFile(expirationFilename)
+	pasteExpirator = gotimeout.NewExpiratorWithStorage(pasteExpirationFile, &ExpiringPasteStore{pasteStore})
+	pasteUnsealer = gotimeout.NewExpirator(filepath.Join(arguments.root, "unseal.gob"), &UnsealingPasteStore{pasteStore})
 	ephStore = gotimeout.NewMap()
 
+	if instanceConfig.Archive.After > 0 || instanceConfig.Upload.Direct {
+		if dir := instanceConfig.Archive.Directory; dir != "" {
+			filesystemPasteStore.ColdStore = &DirectoryColdStore{Path: dir}
+		} else {
+			s3 := instanceConfig.Archive.S3
+			filesystemPasteStore.ColdStore = &objectstore.Client{
+				Endpoint:   s3.Endpoint,
+				Region:     s3.Region,
+				Bucket:     s3.Bucket,
+				AccessKey:  s3.AccessKey,
+				SecretKey:  s3.SecretKey,
+				HTTPClient: &http.Client{Timeout: instanceConfig.Timeouts.ColdStore.Duration()},
+			}
+		}
+	}
+	if filesystemPasteStore.ColdStore != nil && arguments.faults != "" {
+		filesystemPasteStore.ColdStore = withFaultyColdStore(filesystemPasteStore.ColdStore)
+	}
+	if instanceConfig.Archive.After > 0 {
+		pasteArchiver = &Archiver{
+			Store: filesystemPasteStore,
+			After: instanceConfig.Archive.After.Duration(),
+		}
+	}
+	if _, ok := filesystemPasteStore.ColdStore.(PresigningColdStore); instanceConfig.Upload.Direct && !ok {
+		glog.Error("Direct uploads need an S3 cold store (archive.s3); they will be refused.")
+	}
+
+	switch rc := instanceConfig.Replication; rc.Role {
+	case "":
+	case "primary", "secondary":
+		replicator = &Replicator{
+			Store:         filesystemPasteStore,
+			Token:         rc.Token,
+			Primary:       rc.Primary,
+			Conflict:      rc.Conflict,
+			StateFilename: filepath.Join(arguments.root, "replication.state"),
+		}
+		if rc.Role == "primary" {
+			replicator.Journal = LoadReplicationJournal(filepath.Join(arguments.root, "replication.gob"), rc.JournalSize)
+			replicator.Journal.watch()
+		}
+	default:
+		glog.Fatal("Unknown replication role ", rc.Role)
+	}
+	if instanceConfig.Changes.Enabled {
+		startChangeJournal(filepath.Join(arguments.root, "changes.gob"), instanceConfig.Changes.JournalSize)
+	}
+
+	if instanceConfig.ActivityPub.Enabled && instanceConfig.Instance.Private {
+		glog.Error("ActivityPub publishing is disabled on private instances.")
+	} else if instanceConfig.ActivityPub.Enabled {
+		if instanceConfig.ActivityPub.BaseURL == "" {
+			glog.Fatal("activitypub.base_url must be set to enable ActivityPub")
+		}
+		activityPub = NewActivityPub(instanceConfig.ActivityPub.BaseURL, LoadActivityPubStore(filepath.Join(arguments.root, "activitypub.gob")))
+	}
+
+	garbageCollector = &GarbageCollector{
+		Store:              filesystemPasteStore,
+		ExpirationFilename: expirationFilename,
+	}
+
 	accountPath := filepath.Join(arguments.root, "accounts")
 	os.Mkdir(accountPath, 0700)
 	userStore = &PromoteFirstUserToAdminStore{
@@ -771,15 +1146,21 @@ func main() {
 			select {
 			case err := <-pasteExpirator.ErrorChannel:
 				glog.Error("Expirator Error: ", err.Error())
+			case err := <-pasteUnsealer.ErrorChannel:
+				glog.Error("Unsealer Error: ", err.Error())
 			}
 		}
 	}()
 
-	launchTime := time.Now()
+	launchTime = time.Now()
 	healthServer = &HealthServer{}
 
 	healthServer.SetMetric("version", VERSION)
 
+	if flag.NArg() > 0 {
+		os.Exit(RunCommand(flag.Args()))
+	}
+
 	healthServer.RegisterComputedMetric("goroutines", func() interface{} {
 		return runtime.NumGoroutine()
 	})
@@ -791,6 +1172,11 @@ func main() {
 	healthServer.RegisterComputedMetric("paste.expiring", func() interface{} {
 		return pasteExpirator.Len()
 	})
+	healthServer.RegisterComputedMetric("paste.cache.pinned", func() interface{} {
+		renderCache.mu.RLock()
+		defer renderCache.mu.RUnlock()
+		return len(renderCache.pinned)
+	})
 	healthServer.RegisterComputedMetric("paste.cache", func() interface{} {
 		if renderCache.c != nil {
 			return renderCache.c.Len()
@@ -802,6 +1188,63 @@ func main() {
 		return int(time.Now().Sub(launchTime) / time.Second)
 	})
 
+	startErrorReporters()
+	startReputationProviders()
+
+	if pasteArchiver != nil {
+		jobRunner.Schedule("archive", instanceConfig.Archive.Interval.Duration())
+	}
+	if pastePacker != nil {
+		jobRunner.Schedule("pack", instanceConfig.Pack.Interval.Duration())
+	}
+
+	if activityPub != nil {
+		go activityPub.Run()
+	}
+
+	if replicator != nil {
+		if replicator.Journal != nil {
+			for _, target := range instanceConfig.Replication.PushTo {
+				go replicator.RunPush(target)
+			}
+		} else if interval := instanceConfig.Replication.PollInterval.Duration(); replicator.Primary != "" && interval > 0 {
+			go replicator.RunPull(interval)
+		}
+	}
+
+	if interval := instanceConfig.Privacy.SweepInterval.Duration(); interval > 0 {
+		jobRunner.Schedule("privacy-sweep", interval)
+	}
+
+	if interval := instanceConfig.GC.Interval.Duration(); interval > 0 {
+		jobRunner.Schedule("gc", interval)
+	}
+
+	if interval := instanceConfig.Interlinks.IndexInterval.Duration(); interval > 0 {
+		jobRunner.Schedule("backlinks", interval)
+	}
+
+	beginRecovery(len(jobRunner.Pending))
+	jobRunner.Start(instanceConfig.Jobs.Workers)
+	startInstanceStats()
+
+	http.Handle("/", newRootHandler())
+
+	if !runPreflight() {
+		glog.Fatal("Preflight checks failed; not starting.")
+	}
+
+	var addr string = arguments.addr
+	if err := listenAndServe(addr, http.DefaultServeMux); err != http.ErrServerClosed {
+		glog.Fatal(err)
+	}
+	// Stopping; shutdown exits once everything is saved.
+	select {}
+}
+
+// newRootHandler sets up the routes, and returns the handler serving them,
+// behind everything every request passes through.
+func newRootHandler() http.Handler {
 	router = mux.NewRouter()
 	pasteRouter = router.PathPrefix("/paste").Subrouter()
 
@@ -815,14 +1258,27 @@ func main() {
 
 	pasteRouter.Methods("GET").
 		Path("/{id}.json").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, ModelRenderFunc(getPasteJSONHandler))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, cachesPaste(true, checksSeal(countsView(ModelRenderFunc(getPasteJSONHandler)))))).
 		Name("show")
 
 	pasteRouter.Methods("GET").
 		Path("/{id}").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, RenderPageForModel("paste_show"))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, logsAccess(cachesPaste(false, countsView(RenderPageForModel("paste_show")))))).
 		Name("show")
 
+	pasteRouter.Methods("GET").
+		Path("/{id}/lines").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, cachesPaste(false, checksSeal(ModelRenderFunc(pasteLinesHandler))))).
+		Name("lines")
+	pasteRouter.Methods("GET").
+		Path("/{id}/search").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, cachesPaste(false, checksSeal(ModelRenderFunc(pasteSearchHandler))))).
+		Name("search")
+	pasteRouter.Methods("GET").
+		Path("/{id}/log").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, cachesPaste(false, checksSeal(countsView(ModelRenderFunc(pasteLogHandler)))))).
+		Name("log")
+
 	pasteRouter.Methods("POST").
 		Path("/{id}/grant/new").
 		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(ModelRenderFunc(pasteGrantHandler)))).
@@ -837,20 +1293,40 @@ func main() {
 
 	pasteRouter.Methods("GET").
 		Path("/{id}/raw").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, ModelRenderFunc(getPasteRawHandler))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, checksHotlink(redirectsToRawHost(logsAccess(cachesPaste(true, checksSeal(countsView(ModelRenderFunc(getPasteRawHandler))))))))).
 		Name("raw")
 	pasteRouter.Methods("GET").
 		Path("/{id}/download").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, ModelRenderFunc(getPasteRawHandler))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, checksHotlink(redirectsToRawHost(logsAccess(cachesPaste(true, checksSeal(countsView(ModelRenderFunc(getPasteRawHandler))))))))).
 		Name("download")
+	pasteRouter.Methods("GET").
+		Path("/{id}/export").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, checksHotlink(redirectsToRawHost(logsAccess(cachesPaste(true, checksSeal(countsView(ModelRenderFunc(pastePlainTextHandler))))))))).
+		Name("export")
+
+	pasteRouter.Methods("GET").
+		Path("/{id}/formatted").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, logsAccess(cachesPaste(true, checksSeal(countsView(ModelRenderFunc(pasteFormattedHandler))))))).
+		Name("formatted")
+	pasteRouter.Methods("POST").
+		Path("/{id}/formatted").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(refusesImmutable(pasteFormat))))
+
+	pasteRouter.Methods("GET").
+		Path("/{id}/scan").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteScanHandler))).
+		Name("scan")
+	pasteRouter.Methods("POST").
+		Path("/{id}/scan").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(refusesImmutable(pasteRedact))))
 
 	pasteRouter.Methods("GET").
 		Path("/{id}/edit").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(RenderPageForModel("paste_edit")))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(refusesImmutable(RenderPageForModel("paste_edit"))))).
 		Name("edit")
 	pasteRouter.Methods("POST").
 		Path("/{id}/edit").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteUpdate)))
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(refusesImmutable(pasteUpdate))))
 
 	pasteRouter.Methods("GET").
 		Path("/{id}/delete").
@@ -859,6 +1335,26 @@ func main() {
 	pasteRouter.Methods("POST").
 		Path("/{id}/delete").
 		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteDelete)))
+	pasteRouter.Methods("GET").
+		Path("/{id}/access").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteAccessLogHandler))).
+		Name("access")
+	pasteRouter.Methods("POST").
+		Path("/{id}/access").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteAccessLogToggleHandler)))
+
+	pasteRouter.Methods("POST").
+		Path("/{id}/restore").
+		Handler(RequiredModelObjectHandler(lookupTrashedPasteWithRequest, requiresEditPermission(pasteRestore))).
+		Name("restore")
+	pasteRouter.Methods("POST").
+		Path("/{id}/pin").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pastePin))).
+		Name("pin")
+	pasteRouter.Methods("POST").
+		Path("/{id}/short").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteShorten))).
+		Name("short")
 
 	pasteRouter.Methods("POST").
 		Path("/{id}/report").
@@ -880,13 +1376,172 @@ func main() {
 		Path("/{id}/authenticate").
 		Handler(RenderPageHandler("paste_authenticate_disallowed"))
 
+	apiRouter = router.PathPrefix("/api/v1").Subrouter()
+	apiRouter.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, apiError(APIErrorNotFound, "no such endpoint: %s %s", r.Method, r.URL.Path))
+	})
+
+	apiRouter.Methods("GET").
+		Path("/expirations").
+		Handler(http.HandlerFunc(apiExpirationsHandler))
+	apiRouter.Methods("GET").
+		Path("/pow").
+		Handler(http.HandlerFunc(apiProofOfWorkHandler))
+	apiRouter.Methods("GET").
+		Path("/limits").
+		Handler(http.HandlerFunc(apiLimitsHandler))
+	apiRouter.Methods("GET").
+		Path("/stats").
+		Handler(http.HandlerFunc(apiStatsHandler))
+	apiRouter.Methods("GET").
+		Path("/branding").
+		Handler(http.HandlerFunc(apiBrandingHandler))
+	apiRouter.Methods("POST", "PUT").
+		Path("/pastes").
+		Handler(proofOfWorkHandler{http.HandlerFunc(apiPasteCreateHandler)})
+	apiRouter.Methods("PATCH").
+		Path("/pastes/{id}").
+		Handler(http.HandlerFunc(apiPasteUpdateHandler))
+	apiRouter.Methods("DELETE").
+		Path("/pastes/{id}").
+		Handler(http.HandlerFunc(apiPasteDeleteHandler))
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/restore").
+		Handler(http.HandlerFunc(apiPasteRestoreHandler)).
+		Name("paste_restore")
+	apiRouter.Methods("GET").
+		Path("/pastes/{id}/digest").
+		Handler(http.HandlerFunc(apiPasteDigestHandler))
+	apiRouter.Methods("GET", "PUT", "DELETE").
+		Path("/pastes/{id}/signature").
+		Handler(http.HandlerFunc(apiPasteSignatureHandler))
+	apiRouter.Methods("GET", "POST").
+		Path("/pastes/{id}/formatted").
+		Handler(http.HandlerFunc(apiPasteFormattedHandler))
+	apiRouter.Methods("GET", "POST").
+		Path("/pastes/{id}/scan").
+		Handler(http.HandlerFunc(apiPasteScanHandler))
+	apiRouter.Methods("GET").
+		Path("/pastes/{id}/log").
+		Handler(http.HandlerFunc(apiPasteLogHandler))
+	apiRouter.Methods("PUT", "DELETE").
+		Path("/pastes/{id}/pin").
+		Handler(http.HandlerFunc(apiPastePinHandler))
+	apiRouter.Methods("GET", "POST", "DELETE").
+		Path("/pastes/{id}/short").
+		Handler(http.HandlerFunc(apiPasteShortLinkHandler))
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/push").
+		Handler(http.HandlerFunc(apiPastePushHandler))
+	apiRouter.Methods("GET").
+		Path("/push/peers").
+		Handler(http.HandlerFunc(apiPushPeersHandler))
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/raw_url").
+		Handler(http.HandlerFunc(apiPasteRawURLHandler))
+	apiRouter.Methods("GET").
+		Path("/changes").
+		Handler(http.HandlerFunc(apiChangesHandler))
+	apiRouter.Methods("POST").
+		Path("/uploads").
+		Handler(proofOfWorkHandler{http.HandlerFunc(apiUploadCreateHandler)})
+	apiRouter.Methods("POST").
+		Path("/uploads/{token}/finalize").
+		Handler(http.HandlerFunc(apiUploadFinalizeHandler)).
+		Name("upload_finalize")
+
+	apiRouter.Methods("POST", "OPTIONS").
+		Path("/extension/pastes").
+		Handler(requiresExtensionToken(http.HandlerFunc(apiExtensionPasteHandler)))
+	apiRouter.Methods("GET", "OPTIONS").
+		Path("/extension/token").
+		Handler(requiresExtensionToken(http.HandlerFunc(apiExtensionTokenHandler)))
+
+	apiRouter.Methods("GET").
+		Path("/admin/redirects").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiRedirectsHandler)))
+	apiRouter.Methods("POST").
+		Path("/admin/redirects").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiRedirectsCreateHandler)))
+	apiRouter.Methods("DELETE").
+		Path("/admin/redirects/{id}").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiRedirectDeleteHandler)))
+	apiRouter.Methods("GET").
+		Path("/admin/branding").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiAdminBrandingsHandler)))
+	apiRouter.Methods("GET", "PUT", "DELETE").
+		Path("/admin/branding/{host}").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiAdminBrandingHandler)))
+	apiRouter.Methods("GET").
+		Path("/admin/retention").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiRetentionExemptionsHandler)))
+	apiRouter.Methods("POST").
+		Path("/admin/retention").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiRetentionExemptHandler)))
+	apiRouter.Methods("DELETE").
+		Path("/admin/retention/{subject}").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiRetentionLiftHandler)))
+	apiRouter.Methods("GET").
+		Path("/admin/moderation").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiModerationHandler)))
+	apiRouter.Methods("POST").
+		Path("/admin/moderation/{id}/{action:approve|reject}").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiModerationActionHandler)))
+	apiRouter.Methods("GET").
+		Path("/admin/expirations/forecast").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiExpirationForecastHandler)))
+	apiRouter.Methods("GET").
+		Path("/admin/expirations/histogram").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiExpirationHistogramHandler)))
+	apiRouter.Methods("GET").
+		Path("/admin/recovery").
+		Handler(apiRequiresUserPermission("admin", http.HandlerFunc(apiRecoveryHandler)))
+
 	router.Path("/admin").Handler(requiresUserPermission("admin", RenderPageHandler("admin_home")))
 
 	router.Path("/admin/reports").Handler(requiresUserPermission("admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		RenderPage(w, r, "admin_reports", reportStore.Reports)
+		RenderPage(w, r, "admin_reports", reportStore.All())
 	})))
 
+	router.Methods("POST").Path("/admin/gc").Handler(requiresUserPermission("admin", http.HandlerFunc(adminGCHandler)))
+
+	router.Path("/admin/invites").Handler(requiresUserPermission("admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RenderPage(w, r, "admin_invites", inviteStore.List())
+	}))).Methods("GET")
+	router.Methods("POST").Path("/admin/invites").Handler(requiresUserPermission("admin", http.HandlerFunc(adminInviteHandler)))
+	router.Methods("POST").Path("/admin/invites/{code}/delete").Handler(requiresUserPermission("admin", http.HandlerFunc(adminInviteDeleteHandler)))
+	router.Methods("GET").Path("/invite/{code}").Handler(http.HandlerFunc(inviteHandler)).Name("invite")
+
+	router.Path("/admin/blocks").Handler(requiresUserPermission("admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RenderPage(w, r, "admin_blocks", abuseBlockStore.List())
+	}))).Methods("GET")
+	router.Methods("POST").Path("/admin/blocks/{source}/delete").Handler(requiresUserPermission("admin", http.HandlerFunc(adminUnblockHandler)))
+
+	router.Path("/admin/moderation").Handler(requiresUserPermission("admin", http.HandlerFunc(adminModerationHandler))).Methods("GET")
+	router.Methods("POST").Path("/admin/moderation/{id}/{action:approve|reject}").Handler(requiresUserPermission("admin", http.HandlerFunc(adminModerationActionHandler)))
+
+	router.Path("/admin/features").Handler(requiresUserPermission("admin", http.HandlerFunc(adminFeaturesHandler))).Methods("GET")
+	router.Methods("POST").Path("/admin/features/{name}").Handler(requiresUserPermission("admin", http.HandlerFunc(adminFeatureHandler)))
+	router.Path("/admin/languages").Handler(requiresUserPermission("admin", http.HandlerFunc(adminLanguagesHandler))).Methods("GET")
+	router.Methods("POST").Path("/admin/languages").Handler(requiresUserPermission("admin", http.HandlerFunc(adminLanguageHandler)))
+
+	router.Path("/admin/jobs").Handler(requiresUserPermission("admin", http.HandlerFunc(adminJobsHandler))).Methods("GET")
+	router.Methods("POST").Path("/admin/jobs/{name}").Handler(requiresUserPermission("admin", http.HandlerFunc(adminJobRunHandler)))
+
+	router.Path("/admin/retention").Handler(requiresUserPermission("admin", http.HandlerFunc(adminRetentionHandler))).Methods("GET")
+	router.Methods("POST").Path("/admin/retention").Handler(requiresUserPermission("admin", http.HandlerFunc(adminRetentionExemptHandler)))
+	router.Methods("POST").Path("/admin/retention/{subject}/delete").Handler(requiresUserPermission("admin", http.HandlerFunc(adminRetentionLiftHandler)))
+
+	router.Path("/admin/tombstones").Handler(requiresUserPermission("admin", http.HandlerFunc(adminTombstonesHandler))).Methods("GET")
+
+	router.Path("/admin/trash").Handler(requiresUserPermission("admin", http.HandlerFunc(adminTrashHandler))).Methods("GET")
+	router.Methods("POST").
+		Path("/admin/paste/{id}/restore").
+		Handler(requiresUserPermission("admin", RequiredModelObjectHandler(lookupTrashedPasteWithRequest, pasteRestore))).
+		Name("adminrestore")
+
 	router.Methods("POST").Path("/admin/promote").Handler(requiresUserPermission("admin", http.HandlerFunc(adminPromoteHandler)))
+	router.Methods("POST").Path("/admin/verify").Handler(requiresUserPermission("admin", http.HandlerFunc(adminVerifyHandler)))
 
 	router.Methods("POST").
 		Path("/admin/paste/{id}/delete").
@@ -903,7 +1558,18 @@ func main() {
 	router.Path("/paste").Handler(RedirectHandler("/"))
 	router.Path("/session").Handler(http.HandlerFunc(sessionHandler))
 	router.Path("/session/raw").Handler(http.HandlerFunc(sessionHandler))
+	router.Methods("GET").Path("/recent").Handler(http.HandlerFunc(recentHandler))
+	router.Methods("POST").Path("/recent/{id}/delete").Handler(http.HandlerFunc(recentDeleteHandler))
+	router.Methods("POST").Path("/session/signing_keys").Handler(http.HandlerFunc(signingKeysHandler))
+	router.Methods("POST").Path("/session/extension_tokens").Handler(http.HandlerFunc(extensionTokensHandler))
+	router.Methods("POST").Path("/session/notifications").Handler(http.HandlerFunc(notificationChannelsHandler))
+	router.Methods("POST").Path("/session/domains").Handler(http.HandlerFunc(customDomainsHandler))
+	router.Methods("GET", "POST").Path("/share").Handler(http.HandlerFunc(shareHandler))
+	router.Methods("GET").Path("/manifest.webmanifest").Handler(http.HandlerFunc(webManifestHandler))
 	router.Path("/about").Handler(RenderPageHandler("about"))
+	router.Methods("GET").Path("/.well-known/spectre").Handler(http.HandlerFunc(instanceAnnouncementHandler))
+	router.Methods("GET").Path("/out").Handler(http.HandlerFunc(outboundLinkHandler))
+	router.Methods("GET", "HEAD").Path(shortLinkPrefix + "{code}").Handler(http.HandlerFunc(shortLinkHandler))
 	router.Methods("GET", "HEAD").Path("/languages.json").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		http.ServeContent(w, r, "languages.json", languageConfig.modtime, languageConfig.languageJSONReader)
@@ -936,13 +1602,15 @@ func main() {
 	router.Methods("GET").Path("/auth/token").Handler(http.HandlerFunc(authTokenHandler))
 	router.Methods("GET").Path("/auth/token/{token}").Handler(http.HandlerFunc(authTokenPageHandler)).Name("auth_token_login")
 
+	if replicator != nil {
+		replicator.RegisterRoutes(router)
+	}
+	registerSCIMRoutes(router)
+	if activityPub != nil {
+		activityPub.RegisterRoutes(router)
+	}
+
 	router.Path("/").Handler(RenderPageHandler("index"))
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("public")))
-	http.Handle("/", &fourOhFourConsumerHandler{userLookupWrapper{router}})
-
-	var addr string = arguments.addr
-	server := &http.Server{
-		Addr: addr,
-	}
-	server.ListenAndServe()
+	return requestIDHandler{recoveryHandler{requestSizeLimitHandler{&fourOhFourConsumerHandler{userLookupWrapper{apiRateLimitHandler{honeypotHandler{customDomainHandler{shortHostHandler{rawHostHandler{privateInstanceHandler{router}, router}}, router}}}}}}}}
 }
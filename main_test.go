@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// The server's init functions parse the command line and open their
+// stores under -root, and package-level variables are set before any init
+// function runs: so this gives them a directory of their own to open them
+// in, rather than the working tree.
+var testRoot = func() string {
+	testing.Init()
+	dir, err := ioutil.TempDir("", "spectre-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Args = append([]string{os.Args[0], "-root", dir}, os.Args[1:]...)
+	return dir
+}()
+
+func TestMain(m *testing.M) {
+	healthServer = &HealthServer{}
+	code := m.Run()
+	os.RemoveAll(testRoot)
+	os.Exit(code)
+}
@@ -11,33 +11,42 @@ import (
 
 type MkdHtmlRenderer struct {
 	blackfriday.Renderer
+	// ctx bounds the time spent highlighting code blocks; once it is done,
+	// the rest are left plain.
+	ctx context.Context
 }
 
 func (h *MkdHtmlRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string) {
 	language := LanguageNamed(lang)
-	if language == nil {
-		h.Renderer.BlockCode(out, text, lang)
+	if language == nil || h.ctx.Err() != nil {
+		var plain bytes.Buffer
+		h.Renderer.BlockCode(&plain, text, lang)
+		out.WriteString(escapePasteReferences(plain.String()))
 		return
 	}
 	r := bytes.NewReader(text)
-	rendered, err := FormatStream(r, language)
+	rendered, err := FormatStreamContext(h.ctx, r, language)
 	if err == nil {
-		out.WriteString(`<div class="code code-` + language.DisplayStyle + `">` + rendered + `</div>`)
+		out.WriteString(`<pre class="code code-` + language.DisplayStyle + `"><code class="language-` + language.ID + `">` + escapePasteReferences(rendered) + `</code></pre>`)
 	} else {
-		out.WriteString(`<div class="well well-error"><i class="icon icon-warning"></i> <strong>Code block failed to render.</strong><br></div>`)
+		out.WriteString(`<div class="well well-error"><i class="icon icon-warning" aria-hidden="true"></i> <strong>Code block failed to render.</strong><br></div>`)
 	}
 }
 
-func NewMkdHtmlRenderer() *MkdHtmlRenderer {
+func (h *MkdHtmlRenderer) CodeSpan(out *bytes.Buffer, text []byte) {
+	var plain bytes.Buffer
+	h.Renderer.CodeSpan(&plain, text)
+	out.WriteString(escapePasteReferences(plain.String()))
+}
+
+func NewMkdHtmlRenderer(ctx context.Context) *MkdHtmlRenderer {
 	return &MkdHtmlRenderer{blackfriday.HtmlRenderer(blackfriday.HTML_SAFELINK|
-		blackfriday.HTML_NOFOLLOW_LINKS, "", "")}
+		blackfriday.HTML_NOFOLLOW_LINKS, "", ""), ctx}
 }
 
-var mkdHtmlRenderer blackfriday.Renderer
 var sanitationPolicy *bluemonday.Policy
 
 func init() {
-	mkdHtmlRenderer = NewMkdHtmlRenderer()
 	sanitationPolicy = bluemonday.UGCPolicy()
 	sanitationPolicy.AllowAttrs("class").OnElements("div", "i", "span")
 }
@@ -45,12 +54,14 @@ func init() {
 func markdownFormatter(ctx context.Context, formatter *Formatter, stream io.Reader, args ...string) (string, error) {
 	buf := &bytes.Buffer{}
 	io.Copy(buf, stream)
-	md := blackfriday.Markdown(buf.Bytes(), mkdHtmlRenderer,
-		blackfriday.EXTENSION_NO_INTRA_EMPHASIS|
-			blackfriday.EXTENSION_TABLES|
-			blackfriday.EXTENSION_AUTOLINK|
-			blackfriday.EXTENSION_FENCED_CODE|
-			blackfriday.EXTENSION_HEADER_IDS|
-			blackfriday.EXTENSION_LAX_HTML_BLOCKS)
-	return sanitationPolicy.Sanitize(string(md)), nil
+	extensions := blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+		blackfriday.EXTENSION_TABLES |
+		blackfriday.EXTENSION_FENCED_CODE |
+		blackfriday.EXTENSION_HEADER_IDS |
+		blackfriday.EXTENSION_LAX_HTML_BLOCKS
+	if instanceConfig.Links.Autolink == LinksAll {
+		extensions |= blackfriday.EXTENSION_AUTOLINK
+	}
+	md := blackfriday.Markdown(buf.Bytes(), NewMkdHtmlRenderer(ctx), extensions)
+	return rewriteOutboundLinks(sanitationPolicy.Sanitize(linkPasteReferences(string(md)))), nil
 }
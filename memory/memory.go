@@ -0,0 +1,151 @@
+// Package memory has in-memory stand-ins for the stores spectre keeps on
+// disk: accounts, sessions and the expirator's schedule. They behave as the
+// disk-backed ones do (values are encoded as they would be for the disk, so
+// that what couldn't be saved there can't be saved here), and are meant for
+// tests, and for programs built on spectre's packages whose data needn't
+// outlive them.
+//
+// The paste store's stand-in, MemoryPasteStore, is in the server's own
+// package, as the PasteStore interface it implements is.
+package memory
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/DHowett/ghostbin/account"
+	"github.com/DHowett/gotimeout"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// NewAccountStore returns an empty account store.
+func NewAccountStore(challengeProvider account.ChallengeProvider) *account.MemoryStore {
+	return account.NewMemoryStore(challengeProvider)
+}
+
+// SessionStore is sessions.FilesystemStore, keeping each session in memory
+// instead of in a file. The cookie carries the session's ID, signed (and,
+// given a key for it, encrypted) with the store's keys.
+type SessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // default configuration
+
+	mu       sync.RWMutex
+	sessions map[string]string
+}
+
+// NewSessionStore returns a new SessionStore. See sessions.NewCookieStore
+// for a description of keyPairs.
+func NewSessionStore(keyPairs ...[]byte) *SessionStore {
+	return &SessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		sessions: make(map[string]string),
+	}
+}
+
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	var err error
+	if c, errCookie := r.Cookie(name); errCookie == nil {
+		err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+		if err == nil {
+			s.mu.RLock()
+			encoded, ok := s.sessions[session.ID]
+			s.mu.RUnlock()
+			if ok {
+				err = securecookie.DecodeMulti(name, encoded, &session.Values, s.Codecs...)
+				if err == nil {
+					session.IsNew = false
+				}
+			}
+		}
+	}
+	return session, err
+}
+
+// Save keeps session, or forgets it if its MaxAge is <= 0.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		s.mu.Lock()
+		delete(s.sessions, session.ID)
+		s.mu.Unlock()
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sessions[session.ID] = encoded
+	s.mu.Unlock()
+
+	encoded, err = securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Len returns the number of sessions kept.
+func (s *SessionStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
+}
+
+// ExpirationStorage is a gotimeout.StorageAdapter keeping an expirator's
+// schedule in memory, so that an expirator made with it again (as one is
+// after a restart) picks up where the last left off.
+type ExpirationStorage struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (a *ExpirationStorage) RequiresFlush() bool {
+	return true
+}
+
+func (a *ExpirationStorage) SaveExpirationHandles(hm *gotimeout.HandleMap) error {
+	data, err := hm.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.data = data
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *ExpirationStorage) LoadExpirationHandles() (*gotimeout.HandleMap, error) {
+	a.mu.Lock()
+	data := a.data
+	a.mu.Unlock()
+	if data == nil {
+		return nil, nil
+	}
+	hm := &gotimeout.HandleMap{}
+	if err := hm.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return hm, nil
+}
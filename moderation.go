@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// On a locked-down instance (moderation.approval), pastes written by anyone
+// but verified accounts (those with the "verified" or "admin" permission,
+// granted at /admin) are held for approval: until an admin approves one at
+// /admin/moderation, only its editors and admins can see it. Editing an
+// approved paste holds it again. Each paste entering the queue is announced
+// to moderation.webhook, if set, as
+//
+//   {"event": "paste.pending", "id": <id>, "path": "/paste/<id>", "queue": <pastes waiting>}
+//
+// A paste's status ("pending" or "published") is in its JSON and in API
+// responses about it. Approving a paste publishes it over ActivityPub if it
+// would have been published when it was written; rejecting it destroys it.
+
+const (
+	PasteStatusPending   = "pending"
+	PasteStatusPublished = "published"
+)
+
+// PendingPaste is a paste in the moderation queue. Author is the stored
+// (mangled) name of the account that wrote it, if any, and Publisher the
+// account to publish it as once it is approved.
+type PendingPaste struct {
+	ID        PasteID
+	Submitted time.Time
+	Author    string
+	Source    string
+	Publisher string
+}
+
+type ModerationQueue struct {
+	Pending map[PasteID]*PendingPaste
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with q.mu held.
+func (q *ModerationQueue) save() error {
+	asideFilename := q.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := gob.NewEncoder(file).Encode(q); err != nil {
+		glog.Error("Failed to save moderation queue: ", err)
+		return err
+	}
+	return os.Rename(asideFilename, q.filename)
+}
+
+// Hold adds entry to the queue, returning false if its paste was already
+// waiting.
+func (q *ModerationQueue) Hold(entry *PendingPaste) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.Pending[entry.ID]; ok {
+		return false
+	}
+	q.Pending[entry.ID] = entry
+	q.save()
+	return true
+}
+
+func (q *ModerationQueue) SetPublisher(id PasteID, name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, ok := q.Pending[id]; ok {
+		entry.Publisher = name
+		q.save()
+	}
+}
+
+// Remove takes the paste with the given ID out of the queue, returning its
+// entry if it was waiting.
+func (q *ModerationQueue) Remove(id PasteID) *PendingPaste {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.Pending[id]
+	if !ok {
+		return nil
+	}
+	delete(q.Pending, id)
+	q.save()
+	return entry
+}
+
+// List returns the waiting pastes, oldest first.
+func (q *ModerationQueue) List() []*PendingPaste {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]*PendingPaste, 0, len(q.Pending))
+	for _, entry := range q.Pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Submitted.Before(entries[j].Submitted) })
+	return entries
+}
+
+func (q *ModerationQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.Pending)
+}
+
+func LoadModerationQueue(filename string) *ModerationQueue {
+	var q *ModerationQueue
+	if file, err := os.Open(filename); err == nil {
+		if err := gob.NewDecoder(file).Decode(&q); err != nil {
+			glog.Error("Failed to decode moderation queue: ", err)
+		}
+		file.Close()
+	}
+	if q == nil {
+		q = &ModerationQueue{}
+	}
+	if q.Pending == nil {
+		q.Pending = make(map[PasteID]*PendingPaste)
+	}
+	q.filename = filename
+	return q
+}
+
+var moderationQueue *ModerationQueue
+
+// PastePendingError is returned for requests for a paste awaiting approval.
+type PastePendingError struct {
+	ID PasteID
+}
+
+func (e PastePendingError) Error() string {
+	return fmt.Sprintf("Paste %v is awaiting a moderator's approval.", e.ID)
+}
+
+func (e PastePendingError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+func (e PastePendingError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{"status": PasteStatusPending}
+}
+
+func (p *Paste) Pending() bool {
+	return p.pending
+}
+
+func pasteStatus(p *Paste) string {
+	if p.pending {
+		return PasteStatusPending
+	}
+	return PasteStatusPublished
+}
+
+// accountVerified reports whether r's account may publish without approval.
+func accountVerified(r *http.Request) bool {
+	return userHasPermission(r, "verified") || userHasPermission(r, "admin")
+}
+
+// checkPending returns a PastePendingError if p is awaiting approval and r
+// may not see it.
+func checkPending(p *Paste, r *http.Request) error {
+	if p.pending && !isEditAllowed(p, r) && !userHasPermission(r, "admin") {
+		return PastePendingError{p.ID}
+	}
+	return nil
+}
+
+// holdForApproval holds p, which r is about to save, for approval, if r's
+// account isn't verified.
+func holdForApproval(r *http.Request, p *Paste) {
+	if !instanceConfig.Moderation.Approval || accountVerified(r) {
+		return
+	}
+	p.pending = true
+	entry := &PendingPaste{ID: p.ID, Submitted: time.Now(), Source: StoredIPForRequest(r)}
+	if user := GetUser(r); user != nil {
+		entry.Author = user.Name
+	}
+	if moderationQueue.Hold(entry) {
+		healthServer.IncrementMetric("paste.held")
+		PublishEvent(&Event{
+			Kind:    EventPastePending,
+			Paste:   p,
+			Account: entry.Author,
+			Details: map[string]interface{}{"queue": moderationQueue.Len()},
+		})
+	}
+}
+
+var moderationWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func notifyModerators(id PasteID, queued int) {
+	hook := instanceConfig.Moderation.Webhook
+	if hook == "" {
+		return
+	}
+	path, _ := pasteRouter.Get("show").URL("id", id.String())
+	body, _ := json.Marshal(map[string]interface{}{
+		"event": "paste.pending",
+		"id":    id,
+		"path":  path.String(),
+		"queue": queued,
+	})
+	resp, err := moderationWebhookClient.Post(hook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		glog.Error("Failed to notify moderators: ", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		glog.Errorf("Failed to notify moderators: %s answered %s", hook, resp.Status)
+	}
+}
+
+// verifyAccount lets the named account publish without approval.
+func verifyAccount(name string) error {
+	user := userStore.Get(name)
+	if user == nil {
+		return fmt.Errorf("no such account")
+	}
+	perms, ok := user.Values["user.permissions"].(PastePermission)
+	if !ok {
+		perms = PastePermission{}
+	}
+	perms["verified"] = true
+	user.Values["user.permissions"] = perms
+	if err := user.Save(); err != nil {
+		return err
+	}
+	PublishEvent(&Event{Kind: EventAccountVerified, Account: user.Name})
+	return nil
+}
+
+// approvePaste publishes p and, if verify is set, verifies its author.
+func approvePaste(p *Paste, verify bool) error {
+	filename := filesystemPasteStore.filenameForID(p.ID)
+	if err := putMetadata(filename, "pending", ""); err != nil {
+		return err
+	}
+	p.pending = false
+	entry := moderationQueue.Remove(p.ID)
+	filesystemPasteStore.PasteModifyCallback(p)
+	healthServer.IncrementMetric("paste.approved")
+	if entry == nil {
+		return nil
+	}
+
+	if activityPub != nil && entry.Publisher != "" {
+		if p.Sealed() {
+			// The unsealer publishes it.
+			p.sealedBy = entry.Publisher
+			putMetadata(filename, "sealed_by", entry.Publisher)
+		} else if user := userStore.Get(entry.Publisher); user != nil {
+			activityPub.Publish(user, p)
+		}
+	}
+	if verify && entry.Author != "" {
+		return verifyAccount(entry.Author)
+	}
+	return nil
+}
+
+func rejectPaste(p *Paste) error {
+	moderationQueue.Remove(p.ID)
+	p.deletionReason = "rejected by a moderator"
+	healthServer.IncrementMetric("paste.rejected")
+	return p.Destroy()
+}
+
+// ModerationItem is a waiting paste, as listed for moderators.
+type ModerationItem struct {
+	*PendingPaste
+	Paste *Paste
+}
+
+// AuthorHandle returns the ActivityPub address of the paste's author, if
+// it has one.
+func (i *ModerationItem) AuthorHandle() string {
+	if i.Author == "" || activityPub == nil {
+		return ""
+	}
+	if handle := activityPub.HandleForUser(userStore.Get(i.Author)); handle != "" {
+		return "@" + handle + "@" + activityPub.domain()
+	}
+	return ""
+}
+
+// moderationItems lists the waiting pastes, dropping any that are gone.
+func moderationItems() []*ModerationItem {
+	var items []*ModerationItem
+	for _, entry := range moderationQueue.List() {
+		p, _ := pasteStore.Get(entry.ID, nil)
+		if p == nil || !p.pending {
+			moderationQueue.Remove(entry.ID)
+			continue
+		}
+		items = append(items, &ModerationItem{entry, p})
+	}
+	return items
+}
+
+func lookupPendingPaste(r *http.Request) (*Paste, error) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, _ := pasteStore.Get(id, nil)
+	if p == nil || p.trashed != "" {
+		return nil, PasteNotFoundError{ID: id}
+	}
+	if !p.pending {
+		return nil, apiError(APIErrorConflict, "paste %v isn't awaiting approval", id)
+	}
+	return p, nil
+}
+
+func adminModerationHandler(w http.ResponseWriter, r *http.Request) {
+	RenderPage(w, r, "admin_moderation", moderationItems())
+}
+
+func adminModerationActionHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := lookupPendingPaste(r)
+	if err != nil {
+		SetFlash(w, "error", err.Error())
+	} else if mux.Vars(r)["action"] == "reject" {
+		if err := rejectPaste(p); err != nil {
+			SetFlash(w, "error", err.Error())
+		} else {
+			SetFlash(w, "success", fmt.Sprintf("Paste %v rejected.", p.ID))
+		}
+	} else {
+		verify := r.FormValue("verify") != ""
+		if err := approvePaste(p, verify); err != nil {
+			SetFlash(w, "error", err.Error())
+		} else if verify {
+			SetFlash(w, "success", fmt.Sprintf("Paste %v approved, and its author verified.", p.ID))
+		} else {
+			SetFlash(w, "success", fmt.Sprintf("Paste %v approved.", p.ID))
+		}
+	}
+	w.Header().Set("Location", "/admin/moderation")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func adminVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	if err := verifyAccount(username); err != nil {
+		SetFlash(w, "error", "Couldn't find "+username+" to verify.")
+	} else {
+		SetFlash(w, "success", "Verified "+username+".")
+	}
+	w.Header().Set("Location", "/admin")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func apiModerationHandler(w http.ResponseWriter, r *http.Request) {
+	items := moderationItems()
+	pending := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		pending = append(pending, map[string]interface{}{
+			"id":        item.ID,
+			"title":     item.Paste.Title,
+			"submitted": item.Submitted.UTC(),
+			"source":    item.Source,
+			"author":    item.AuthorHandle(),
+		})
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{"pending": pending})
+}
+
+// apiModerationActionHandler approves (with verify, also verifying the
+// author) or rejects a waiting paste.
+func apiModerationActionHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := lookupPendingPaste(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if mux.Vars(r)["action"] == "reject" {
+		if err := rejectPaste(p); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, map[string]interface{}{"id": p.ID, "status": "rejected"})
+		return
+	}
+	if err := approvePaste(p, r.FormValue("verify") != ""); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{"id": p.ID, "status": pasteStatus(p)})
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	moderationQueue = LoadModerationQueue(filepath.Join(arguments.root, "moderation.gob"))
+
+	SubscribeEvent(func(ev *Event) {
+		go notifyModerators(ev.PasteID, ev.Details["queue"].(int))
+	}, EventPastePending)
+
+	RegisterTemplateFunction("moderationQueueLength", func() int {
+		return moderationQueue.Len()
+	})
+	RegisterTemplateFunction("moderationEnabled", func() bool {
+		return instanceConfig.Moderation.Approval
+	})
+}
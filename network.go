@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A paste can be restricted to networks (networks: a comma-separated list of
+// networks named under networks.named, or, if networks.custom allows, of
+// CIDRs), for sharing something semi-sensitive with, say, only those on the
+// corporate VPN on an otherwise public instance. Every route that looks a
+// restricted paste up refuses requests from outside its networks, except
+// those from people who can edit it; restricted pastes are never cached
+// publicly or published over ActivityPub.
+//
+// Named networks are resolved when a paste is requested, so changes to their
+// ranges apply to the pastes already restricted to them, and a paste
+// restricted to a network no longer configured is open only to its editors.
+// Addresses are those SourceIPForRequest gives: a request's own, unless it
+// comes through one of http.trusted_proxies, so a client can't get into a
+// network by claiming an address in it.
+
+// MaxPasteNetworks is how many networks a paste can be restricted to.
+const MaxPasteNetworks = 16
+
+// PasteNetworkError is returned for requests for a restricted paste from
+// outside its networks.
+type PasteNetworkError struct {
+	ID PasteID
+}
+
+func (e PasteNetworkError) Error() string {
+	return fmt.Sprintf("Paste %v can't be viewed from your network.", e.ID)
+}
+
+func (e PasteNetworkError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+func validateNetworksConfig(c *_Configuration) error {
+	for name, cidrs := range c.Networks.Named {
+		if name == "" || strings.ContainsAny(name, ", ") {
+			return fmt.Errorf("networks.named: %q: names can't be empty or contain commas or spaces", name)
+		}
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("networks.named: %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseNetworks validates a paste's networks as submitted; "" leaves it
+// unrestricted.
+func parseNetworks(s string) ([]string, error) {
+	var networks []string
+	seen := make(map[string]bool)
+	for _, n := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if _, ok := instanceConfig.Networks.Named[n]; !ok {
+			_, ipnet, err := net.ParseCIDR(n)
+			if err != nil || !instanceConfig.Networks.Custom {
+				return nil, PasteInputError{"networks", fmt.Sprintf("%q is not a network this instance knows", n)}
+			}
+			n = ipnet.String()
+		}
+		if !seen[n] {
+			seen[n] = true
+			networks = append(networks, n)
+		}
+	}
+	if len(networks) > MaxPasteNetworks {
+		return nil, PasteInputError{"networks", fmt.Sprintf("can name at most %d networks", MaxPasteNetworks)}
+	}
+	return networks, nil
+}
+
+// networkRanges returns the address ranges networks cover.
+func networkRanges(networks []string) []*net.IPNet {
+	var ranges []*net.IPNet
+	for _, n := range networks {
+		cidrs, ok := instanceConfig.Networks.Named[n]
+		if !ok {
+			cidrs = []string{n}
+		}
+		for _, cidr := range cidrs {
+			if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+				ranges = append(ranges, ipnet)
+			}
+		}
+	}
+	return ranges
+}
+
+// requestInNetworks reports whether r comes from within networks.
+func requestInNetworks(r *http.Request, networks []string) bool {
+	parsed := net.ParseIP(SourceIPForRequest(r))
+	if parsed == nil {
+		return false
+	}
+	for _, ipnet := range networkRanges(networks) {
+		if ipnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNetworks returns a PasteNetworkError if r may not see p.
+func checkNetworks(p *Paste, r *http.Request) error {
+	if len(p.Networks) == 0 || requestInNetworks(r, p.Networks) || isEditAllowed(p, r) {
+		return nil
+	}
+	healthServer.IncrementMetric("paste.network_denied")
+	return PasteNetworkError{p.ID}
+}
+
+// pasteNetworksValue returns p's networks as a form value.
+func pasteNetworksValue(p *Paste) string {
+	return strings.Join(p.Networks, ",")
+}
+
+func init() {
+	RegisterTemplateFunction("pasteNetworksValue", pasteNetworksValue)
+	RegisterTemplateFunction("networkNames", func() []string {
+		names := make([]string, 0, len(instanceConfig.Networks.Named))
+		for name := range instanceConfig.Networks.Named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	})
+}
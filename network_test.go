@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestInNetworksIgnoresSpoofedHeaders(t *testing.T) {
+	savedNamed, savedProxies := instanceConfig.Networks.Named, instanceConfig.HTTP.TrustedProxies
+	defer func() { instanceConfig.Networks.Named, instanceConfig.HTTP.TrustedProxies = savedNamed, savedProxies }()
+	instanceConfig.Networks.Named = map[string][]string{"vpn": {"10.8.0.0/16"}}
+	instanceConfig.HTTP.TrustedProxies = []string{"192.0.2.1"}
+
+	for _, tc := range []struct {
+		remote, cf, xff string
+		in              bool
+	}{
+		{"10.8.0.5:4000", "", "", true},
+		{"203.0.113.9:4000", "", "", false},
+		// A client claiming to be on the VPN isn't.
+		{"203.0.113.9:4000", "10.8.0.5", "", false},
+		{"203.0.113.9:4000", "", "10.8.0.5", false},
+		// Nor is one that gets a trusted proxy to pass its claim along.
+		{"192.0.2.1:4000", "", "10.8.0.5, 203.0.113.9", false},
+		// A trusted proxy's word for a client on the VPN is taken.
+		{"192.0.2.1:4000", "", "10.8.0.5", true},
+		{"192.0.2.1:4000", "10.8.0.5", "", true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.cf != "" {
+			r.Header.Set("CF-Connecting-IP", tc.cf)
+		}
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := requestInNetworks(r, []string{"vpn"}); got != tc.in {
+			t.Errorf("from %s (CF-Connecting-IP %q, X-Forwarded-For %q): in the network %v, want %v", tc.remote, tc.cf, tc.xff, got, tc.in)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DHowett/ghostbin/account"
+	"github.com/golang/glog"
+)
+
+// Events can be sent to chat services as notifications, through their
+// incoming webhooks: Slack, Discord, and Matrix by way of a bridge speaking
+// Slack's format (such as hookshot's generic webhooks). Operators route
+// events (moderation alerts, say) to the channels under
+// notifications.channels; accounts can route the events about their own
+// pastes to channels of their own from their session page.
+//
+// An account's pastes are those it creates while it has a channel: each is
+// watched from then on, so that its owner hears of it expiring or being
+// edited by someone they granted access to. Account channels may only post
+// to https URLs on notifications.allowed_hosts (any host, if it is empty),
+// so that they can't be turned on the instance's own network.
+
+const (
+	NotificationSlack   = "slack"
+	NotificationDiscord = "discord"
+	NotificationMatrix  = "matrix"
+)
+
+// MaxNotificationChannels is how many channels an account can have.
+const MaxNotificationChannels = 5
+
+// accountNotificationEvents are the events accounts can be notified of.
+var accountNotificationEvents = []EventKind{
+	EventPasteCreated,
+	EventPasteModified,
+	EventPastePending,
+	EventPasteExpired,
+	EventPasteDestroyed,
+}
+
+type NotificationChannel struct {
+	ID   string
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+	// Events lists the kinds of event to send; all of them if empty.
+	Events []EventKind `yaml:"events"`
+}
+
+func (c *NotificationChannel) wants(kind EventKind) bool {
+	return EventWebhook{Events: c.Events}.wants(kind)
+}
+
+// Host returns the host the channel posts to, for display.
+func (c *NotificationChannel) Host() string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+type NotificationStore struct {
+	// Channels maps account names to their channels.
+	Channels map[string][]*NotificationChannel
+	// Watches maps pastes to the accounts to notify about them.
+	Watches map[PasteID]string
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *NotificationStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save notification channels: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+// ChannelsFor returns the named account's channels.
+func (s *NotificationStore) ChannelsFor(name string) []*NotificationChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*NotificationChannel(nil), s.Channels[name]...)
+}
+
+func (s *NotificationStore) Add(name string, c *NotificationChannel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Channels[name]) >= MaxNotificationChannels {
+		return fmt.Errorf("You can have at most %d notification channels.", MaxNotificationChannels)
+	}
+	id, err := generateRandomBase32String(5, 8)
+	if err != nil {
+		return err
+	}
+	c.ID = id
+	s.Channels[name] = append(s.Channels[name], c)
+	return s.save()
+}
+
+// Remove removes one of the named account's channels; when it has none
+// left, its pastes are no longer watched.
+func (s *NotificationStore) Remove(name, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []*NotificationChannel
+	for _, c := range s.Channels[name] {
+		if c.ID != id {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) > 0 {
+		s.Channels[name] = kept
+	} else {
+		delete(s.Channels, name)
+		for pid, watcher := range s.Watches {
+			if watcher == name {
+				delete(s.Watches, pid)
+			}
+		}
+	}
+	return s.save()
+}
+
+// recipients returns the accounts to notify of ev (with their channels),
+// watching the paste ev created for its author.
+func (s *NotificationStore) recipients(ev *Event) map[string][]*NotificationChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recipients := make(map[string][]*NotificationChannel)
+	if ev.Account != "" && len(s.Channels[ev.Account]) > 0 {
+		recipients[ev.Account] = s.Channels[ev.Account]
+		if ev.Kind == EventPasteCreated && ev.PasteID != "" {
+			s.Watches[ev.PasteID] = ev.Account
+			s.save()
+		}
+	}
+	if watcher, ok := s.Watches[ev.PasteID]; ok && ev.PasteID != "" {
+		recipients[watcher] = s.Channels[watcher]
+		if ev.Kind == EventPasteDestroyed {
+			delete(s.Watches, ev.PasteID)
+			s.save()
+		}
+	}
+	return recipients
+}
+
+func LoadNotificationStore(filename string) *NotificationStore {
+	var s *NotificationStore
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode notification channels: ", err)
+		}
+	}
+	if s == nil {
+		s = &NotificationStore{}
+	}
+	if s.Channels == nil {
+		s.Channels = make(map[string][]*NotificationChannel)
+	}
+	if s.Watches == nil {
+		s.Watches = make(map[PasteID]string)
+	}
+	s.filename = filename
+	return s
+}
+
+var notificationStore *NotificationStore
+
+// validateNotificationChannel checks a channel as an account submitted it.
+func validateNotificationChannel(c *NotificationChannel) error {
+	switch c.Type {
+	case NotificationSlack, NotificationDiscord, NotificationMatrix:
+	default:
+		return fmt.Errorf("Pick Slack, Discord or Matrix.")
+	}
+	u, err := url.Parse(strings.TrimSpace(c.URL))
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("The webhook URL must be an https URL.")
+	}
+	if hosts := instanceConfig.Notifications.AllowedHosts; len(hosts) > 0 {
+		allowed := false
+		for _, host := range hosts {
+			if domainMatches(strings.ToLower(u.Hostname()), host) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("This instance can't post to %s.", u.Hostname())
+		}
+	}
+	for _, kind := range c.Events {
+		if !eventKindIn(kind, accountNotificationEvents) {
+			return fmt.Errorf("%s isn't an event you can be notified of.", kind)
+		}
+	}
+	c.URL = u.String()
+	return nil
+}
+
+func eventKindIn(kind EventKind, kinds []EventKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// notificationText describes ev in a sentence, and in HTML for Matrix.
+func notificationText(ev *Event) (string, string) {
+	var what string
+	switch ev.Kind {
+	case EventPasteCreated:
+		what = "was created."
+	case EventPasteModified:
+		what = "was changed."
+	case EventPastePending:
+		what = fmt.Sprintf("is awaiting approval; %v in the queue.", ev.Details["queue"])
+	case EventPasteExpired:
+		what = "expired."
+	case EventPasteDestroyed:
+		what = fmt.Sprintf("was destroyed (%v).", ev.Details["reason"])
+	case EventAccountCreated:
+		return "A new account was created.", ""
+	case EventAccountVerified:
+		return "An account was verified.", ""
+	case EventAccountDeprovisioned:
+		return "An account was deprovisioned.", ""
+	default:
+		what = "had an event: " + string(ev.Kind)
+	}
+
+	subject := "Paste " + ev.PasteID.String()
+	base := strings.TrimSuffix(instanceConfig.Notifications.BaseURL, "/")
+	if base == "" {
+		return subject + " " + what, ""
+	}
+	u := base + "/paste/" + url.PathEscape(ev.PasteID.String())
+	return subject + " (" + u + ") " + what, `<a href="` + html.EscapeString(u) + `">` + subject + "</a> " + html.EscapeString(what)
+}
+
+var notificationClient = &http.Client{Timeout: 10 * time.Second}
+
+func sendNotification(c *NotificationChannel, ev *Event) {
+	text, htmlText := notificationText(ev)
+	var payload map[string]interface{}
+	switch c.Type {
+	case NotificationDiscord:
+		payload = map[string]interface{}{"content": text}
+	case NotificationMatrix:
+		payload = map[string]interface{}{"text": text}
+		if htmlText != "" {
+			payload["html"] = htmlText
+		}
+	default:
+		payload = map[string]interface{}{"text": text}
+	}
+	body, _ := json.Marshal(payload)
+	resp, err := notificationClient.Post(c.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		glog.Errorf("Failed to notify %s: %v", c.Host(), err)
+		healthServer.IncrementMetric("notification.failed")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		glog.Errorf("Failed to notify %s: it answered %s", c.Host(), resp.Status)
+		healthServer.IncrementMetric("notification.failed")
+		return
+	}
+	healthServer.IncrementMetric("notification.sent")
+}
+
+func notifyEvent(ev *Event) {
+	for _, c := range instanceConfig.Notifications.Channels {
+		if c.wants(ev.Kind) {
+			go sendNotification(c, ev)
+		}
+	}
+	if !eventKindIn(ev.Kind, accountNotificationEvents) {
+		return
+	}
+	for _, channels := range notificationStore.recipients(ev) {
+		for _, c := range channels {
+			if c.wants(ev.Kind) {
+				go sendNotification(c, ev)
+			}
+		}
+	}
+}
+
+func notificationChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUser(r)
+	if user == nil {
+		RenderError(fmt.Errorf("You need to log in to set up notifications."), http.StatusForbidden, w)
+		return
+	}
+
+	if id := r.FormValue("remove"); id != "" {
+		if err := notificationStore.Remove(user.Name, id); err != nil {
+			SetFlash(w, "error", err.Error())
+		} else {
+			SetFlash(w, "success", "Channel removed.")
+		}
+	} else {
+		r.ParseForm()
+		c := &NotificationChannel{Type: r.FormValue("type"), URL: r.FormValue("url")}
+		for _, kind := range r.Form["events"] {
+			c.Events = append(c.Events, EventKind(kind))
+		}
+		if err := validateNotificationChannel(c); err != nil {
+			SetFlash(w, "error", err.Error())
+		} else if err := notificationStore.Add(user.Name, c); err != nil {
+			SetFlash(w, "error", err.Error())
+		} else {
+			SetFlash(w, "success", "Your pastes' events will be sent to "+c.Host()+".")
+		}
+	}
+
+	w.Header().Set("Location", "/session")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func init() {
+	SubscribeEvent(notifyEvent)
+
+	RegisterTemplateFunction("notificationChannels", func(user *account.User) []*NotificationChannel {
+		if user == nil {
+			return nil
+		}
+		channels := notificationStore.ChannelsFor(user.Name)
+		sort.Slice(channels, func(i, j int) bool { return channels[i].Host() < channels[j].Host() })
+		return channels
+	})
+	RegisterTemplateFunction("notificationEvents", func() []EventKind { return accountNotificationEvents })
+
+	arguments.register()
+	arguments.parse()
+	notificationStore = LoadNotificationStore(filepath.Join(arguments.root, "notifications.gob"))
+}
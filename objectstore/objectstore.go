@@ -0,0 +1,252 @@
+// Package objectstore is a minimal client for S3-compatible object storage,
+// signing requests with AWS Signature Version 4.
+package objectstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureAlgorithm = "AWS4-HMAC-SHA256"
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	timeFormat         = "20060102T150405Z"
+	dateFormat         = "20060102"
+)
+
+// Client addresses a single bucket. Objects are addressed path-style
+// (Endpoint/Bucket/key), which every S3-compatible service supports.
+type Client struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	HTTPClient *http.Client
+}
+
+// NotFoundError is returned when the requested object does not exist.
+type NotFoundError struct {
+	Key string
+}
+
+func (e NotFoundError) Error() string {
+	return "object " + e.Key + " not found"
+}
+
+// ResponseError carries an unexpected response from the object store.
+type ResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e ResponseError) Error() string {
+	return fmt.Sprintf("object store returned %d: %s", e.StatusCode, e.Body)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// escapePath encodes an object path the way SigV4 expects: every byte
+// outside the unreserved set is percent-encoded, except the separators.
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (c *Client) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimRight(c.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + c.Bucket + "/" + key
+	u.RawPath = escapePath(u.Path)
+	return u, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (c *Client) scope(t time.Time) string {
+	return t.Format(dateFormat) + "/" + c.Region + "/s3/aws4_request"
+}
+
+func (c *Client) signature(t time.Time, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := signatureAlgorithm + "\n" + t.Format(timeFormat) + "\n" + c.scope(t) + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), t.Format(dateFormat))
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, strings.Replace(url.QueryEscape(k), "+", "%20", -1)+"="+strings.Replace(url.QueryEscape(v), "+", "%20", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sign adds SigV4 authorization headers to a request.
+func (c *Client) sign(req *http.Request, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.Format(timeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + unsignedPayload + "\n" +
+		"x-amz-date:" + t.Format(timeFormat) + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		headers,
+		strings.Join(signedHeaders, ";"),
+		unsignedPayload,
+	}, "\n")
+
+	req.Header.Set("Authorization", signatureAlgorithm+
+		" Credential="+c.AccessKey+"/"+c.scope(t)+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+
+		", Signature="+c.signature(t, canonicalRequest))
+}
+
+func (c *Client) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	u, err := c.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	c.sign(req, time.Now().UTC())
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, NotFoundError{Key: key}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, ResponseError{StatusCode: resp.StatusCode, Body: string(msg)}
+	}
+	return resp, nil
+}
+
+// Put uploads size bytes from r as the object named key.
+func (c *Client) Put(key string, r io.Reader, size int64) error {
+	resp, err := c.do("PUT", key, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Get returns the contents of the object named key.
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat returns the size of the object named key.
+func (c *Client) Stat(key string) (int64, error) {
+	resp, err := c.do("HEAD", key, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
+// Delete removes the object named key. Deleting a missing object is not an
+// error.
+func (c *Client) Delete(key string) error {
+	resp, err := c.do("DELETE", key, nil, 0)
+	if _, ok := err.(NotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Presign returns a URL through which anyone may perform method on the
+// object named key until expiry elapses, without credentials of their own.
+func (c *Client) Presign(method, key string, expiry time.Duration) (string, error) {
+	u, err := c.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+
+	t := time.Now().UTC()
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", signatureAlgorithm)
+	q.Set("X-Amz-Credential", c.AccessKey+"/"+c.scope(t))
+	q.Set("X-Amz-Date", t.Format(timeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	q.Set("X-Amz-Signature", c.signature(t, canonicalRequest))
+	u.RawQuery = canonicalQuery(q)
+	return u.String(), nil
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Most pastes are small, and a small file costs a filesystem at least a
+// whole block (and the directory entry and inode besides). The packer
+// moves the bodies of small pastes, once they have settled, into
+// append-only pack files of many bodies each, leaving each paste's file
+// empty (its metadata, kept in extended attributes, stays put) and
+// pointing at its body:
+//
+//	packed = <pack>:<offset>:<length>:<crc32>
+//
+// Packed bodies are read straight from their pack by offset; writing a
+// paste unpacks it. Every pack has an index (<pack>.idx) listing what was
+// appended to it, from which the packer works out how much of a pack is
+// still pointed at; packs that are mostly dead are compacted into the
+// current pack and removed.
+
+const packBatchSize = 128
+
+// PackStore is a directory of pack files.
+type PackStore struct {
+	Path string
+	// MaxPackSize is how large a pack may grow before another is begun.
+	MaxPackSize int64
+
+	mu          sync.Mutex
+	current     *os.File
+	currentIdx  *os.File
+	currentNum  int
+	currentSize int64
+}
+
+type packPointer struct {
+	Pack   int
+	Offset int64
+	Length int64
+	CRC    uint32
+}
+
+func (pp packPointer) String() string {
+	return fmt.Sprintf("%06d:%d:%d:%08x", pp.Pack, pp.Offset, pp.Length, pp.CRC)
+}
+
+func parsePackPointer(s string) (packPointer, error) {
+	var pp packPointer
+	fields := strings.Split(s, ":")
+	if len(fields) != 4 {
+		return pp, fmt.Errorf("malformed pack pointer %q", s)
+	}
+	pack, err1 := strconv.Atoi(fields[0])
+	offset, err2 := strconv.ParseInt(fields[1], 10, 64)
+	length, err3 := strconv.ParseInt(fields[2], 10, 64)
+	crc, err4 := strconv.ParseUint(fields[3], 16, 32)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || offset < 0 || length < 0 {
+		return pp, fmt.Errorf("malformed pack pointer %q", s)
+	}
+	return packPointer{pack, offset, length, uint32(crc)}, nil
+}
+
+func (ps *PackStore) packFilename(n int) string {
+	return filepath.Join(ps.Path, fmt.Sprintf("%06d.pack", n))
+}
+
+func (ps *PackStore) indexFilename(n int) string {
+	return filepath.Join(ps.Path, fmt.Sprintf("%06d.idx", n))
+}
+
+// packs lists the packs in the store, oldest first.
+func (ps *PackStore) packs() ([]int, error) {
+	var packs []int
+	err := readDirnames(ps.Path, func(name string) error {
+		if strings.HasSuffix(name, ".pack") {
+			if n, err := strconv.Atoi(strings.TrimSuffix(name, ".pack")); err == nil {
+				packs = append(packs, n)
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	sort.Ints(packs)
+	return packs, err
+}
+
+// rotate begins a new pack. ps.mu is held.
+func (ps *PackStore) rotate() error {
+	ps.closeCurrent()
+	if err := os.MkdirAll(ps.Path, 0700); err != nil {
+		return err
+	}
+	packs, err := ps.packs()
+	if err != nil {
+		return err
+	}
+	n := 1
+	if len(packs) > 0 {
+		n = packs[len(packs)-1] + 1
+	}
+
+	pack, err := os.OpenFile(ps.packFilename(n), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	idx, err := os.OpenFile(ps.indexFilename(n), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		pack.Close()
+		return err
+	}
+	ps.current, ps.currentIdx, ps.currentNum, ps.currentSize = pack, idx, n, 0
+	return nil
+}
+
+func (ps *PackStore) closeCurrent() {
+	if ps.current != nil {
+		ps.current.Close()
+		ps.currentIdx.Close()
+		ps.current, ps.currentIdx = nil, nil
+	}
+}
+
+// Append adds id's body to the current pack. It isn't durable until Sync.
+func (ps *PackStore) Append(id PasteID, body []byte) (packPointer, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.current == nil || (ps.currentSize > 0 && ps.currentSize+int64(len(body)) > ps.MaxPackSize) {
+		if err := ps.rotate(); err != nil {
+			return packPointer{}, err
+		}
+	}
+
+	pp := packPointer{ps.currentNum, ps.currentSize, int64(len(body)), crc32.ChecksumIEEE(body)}
+	if _, err := ps.current.Write(body); err != nil {
+		// The pack's tail is in doubt; begin another.
+		ps.closeCurrent()
+		return packPointer{}, err
+	}
+	ps.currentSize += pp.Length
+	if _, err := fmt.Fprintf(ps.currentIdx, "%s %d %d %08x\n", id, pp.Offset, pp.Length, pp.CRC); err != nil {
+		ps.closeCurrent()
+		return packPointer{}, err
+	}
+	return pp, nil
+}
+
+// Sync makes everything appended so far durable.
+func (ps *PackStore) Sync() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.current == nil {
+		return nil
+	}
+	if err := ps.current.Sync(); err != nil {
+		return err
+	}
+	return ps.currentIdx.Sync()
+}
+
+// Read returns the body pp points at.
+func (ps *PackStore) Read(pp packPointer) ([]byte, error) {
+	file, err := os.Open(ps.packFilename(pp.Pack))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	body := make([]byte, pp.Length)
+	if _, err := file.ReadAt(body, pp.Offset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(body) != pp.CRC {
+		return nil, fmt.Errorf("pack %06d is corrupt at offset %d", pp.Pack, pp.Offset)
+	}
+	return body, nil
+}
+
+type packIndexEntry struct {
+	ID      PasteID
+	Pointer packPointer
+}
+
+func (ps *PackStore) readIndex(n int) ([]packIndexEntry, error) {
+	file, err := os.Open(ps.indexFilename(n))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []packIndexEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			// A torn last line, from a crash mid-append.
+			continue
+		}
+		pp, err := parsePackPointer(fmt.Sprintf("%d:%s:%s:%s", n, fields[1], fields[2], fields[3]))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, packIndexEntry{PasteIDFromString(fields[0]), pp})
+	}
+	return entries, scanner.Err()
+}
+
+func (ps *PackStore) isCurrent(n int) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.current != nil && n == ps.currentNum
+}
+
+// remove deletes pack n, unless it is the one being appended to.
+func (ps *PackStore) remove(n int) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.current != nil && n == ps.currentNum {
+		return nil
+	}
+	if err := os.Remove(ps.packFilename(n)); err != nil {
+		return err
+	}
+	return os.Remove(ps.indexFilename(n))
+}
+
+func (store *FilesystemPasteStore) packedPointer(filename string) string {
+	return getMetadata(filename, "packed", "")
+}
+
+// openPacked opens a packed paste's body. If its pack was compacted away
+// as it was being found, it is looked for again where it went.
+func (store *FilesystemPasteStore) openPacked(filename string) (io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		s := store.packedPointer(filename)
+		if s == "" {
+			// Unpacked (rewritten) meanwhile.
+			return os.Open(filename)
+		}
+		pp, err := parsePackPointer(s)
+		if err != nil {
+			return nil, err
+		}
+		body, err := store.Packs.Read(pp)
+		if os.IsNotExist(err) && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		healthServer.IncrementMetric("pack.read")
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// packBody swaps the body of the paste at filename, as it was when fi was
+// taken, for the copy at pp. It reports whether it did; the paste may have
+// changed since.
+func (store *FilesystemPasteStore) packBody(filename string, fi os.FileInfo, pp packPointer) (bool, error) {
+	store.archiveMu.Lock()
+	defer store.archiveMu.Unlock()
+
+	now, err := os.Stat(filename)
+	if err != nil || !now.ModTime().Equal(fi.ModTime()) || now.Size() != fi.Size() || store.archivedKey(filename) != "" || store.packedPointer(filename) != "" {
+		return false, nil
+	}
+	if err := store.replaceBody(filename, strings.NewReader(""), map[string]string{"packed": pp.String()}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Packer packs the bodies of pastes no larger than MaxSize that haven't
+// been modified for After, and compacts packs that are less than
+// CompactBelow percent alive.
+type Packer struct {
+	Store        *FilesystemPasteStore
+	MaxSize      int64
+	After        time.Duration
+	CompactBelow int
+}
+
+type packCandidate struct {
+	filename string
+	fi       os.FileInfo
+	pointer  packPointer
+}
+
+// flush makes a batch of appended bodies durable, then points their
+// pastes at them.
+func (pk *Packer) flush(batch []packCandidate) int {
+	if len(batch) == 0 {
+		return 0
+	}
+	if err := pk.Store.Packs.Sync(); err != nil {
+		glog.Error("Failed to sync pack: ", err)
+		return 0
+	}
+	n := 0
+	for _, c := range batch {
+		ok, err := pk.Store.packBody(c.filename, c.fi, c.pointer)
+		if err != nil {
+			glog.Error("Failed to pack ", c.filename, ": ", err)
+		} else if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Pack packs the pastes due to be.
+func (pk *Packer) Pack() (int, error) {
+	store := pk.Store
+	n := 0
+	var batch []packCandidate
+	err := store.Walk(func(id PasteID) error {
+		filename := store.filenameForID(id)
+		fi, err := os.Stat(filename)
+		if err != nil || fi.IsDir() || fi.Size() == 0 || fi.Size() > pk.MaxSize || time.Since(fi.ModTime()) < pk.After {
+			return nil
+		}
+		if !hasMetadata(filename, "language") || store.archivedKey(filename) != "" || store.packedPointer(filename) != "" {
+			return nil
+		}
+
+		body, err := ioutil.ReadFile(filename)
+		if err != nil || int64(len(body)) != fi.Size() {
+			return nil
+		}
+		pp, err := store.Packs.Append(id, body)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, packCandidate{filename, fi, pp})
+		if len(batch) >= packBatchSize {
+			n += pk.flush(batch)
+			batch = batch[:0]
+		}
+		return nil
+	})
+	n += pk.flush(batch)
+	healthServer.IncrementMetric("pack.runs")
+	if n > 0 {
+		healthServer.AddMetric("pack.packed", n)
+		glog.Infof("PACK: Packed %d pastes.", n)
+	}
+	return n, err
+}
+
+// Compact rewrites the live bodies of packs that are mostly dead into the
+// current pack, and removes them. It returns how many packs it removed.
+func (pk *Packer) Compact() (int, error) {
+	store := pk.Store
+	packs, err := store.Packs.packs()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, num := range packs {
+		if store.Packs.isCurrent(num) {
+			continue
+		}
+		entries, err := store.Packs.readIndex(num)
+		if err != nil {
+			glog.Error("Failed to read index of pack ", num, ": ", err)
+			continue
+		}
+		fi, err := os.Stat(store.Packs.packFilename(num))
+		if err != nil {
+			continue
+		}
+
+		var live []packIndexEntry
+		var liveBytes int64
+		for _, entry := range entries {
+			if store.packedPointer(store.filenameForID(entry.ID)) == entry.Pointer.String() {
+				live = append(live, entry)
+				liveBytes += entry.Pointer.Length
+			}
+		}
+		if fi.Size() > 0 && liveBytes*100 >= int64(pk.CompactBelow)*fi.Size() && len(live) > 0 {
+			continue
+		}
+
+		moved := make([]packPointer, len(live))
+		failed := false
+		for i, entry := range live {
+			body, err := store.Packs.Read(entry.Pointer)
+			if err == nil {
+				moved[i], err = store.Packs.Append(entry.ID, body)
+			}
+			if err != nil {
+				glog.Error("Failed to compact ", entry.ID, " out of pack ", num, ": ", err)
+				failed = true
+				break
+			}
+		}
+		if failed {
+			continue
+		}
+		if err := store.Packs.Sync(); err != nil {
+			return removed, err
+		}
+		for i, entry := range live {
+			filename := store.filenameForID(entry.ID)
+			store.archiveMu.Lock()
+			if store.packedPointer(filename) == entry.Pointer.String() {
+				putMetadata(filename, "packed", moved[i].String())
+			}
+			store.archiveMu.Unlock()
+		}
+		if err := store.Packs.remove(num); err != nil {
+			glog.Error("Failed to remove pack ", num, ": ", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		healthServer.AddMetric("pack.compacted", removed)
+		glog.Infof("PACK: Compacted %d packs.", removed)
+	}
+	return removed, nil
+}
+
+var pastePacker *Packer
+
+func runPacker() (int, int, error) {
+	if pastePacker == nil {
+		return 0, 0, fmt.Errorf("packing is not configured")
+	}
+	packed, err := pastePacker.Pack()
+	if err != nil {
+		return packed, 0, err
+	}
+	compacted, err := pastePacker.Compact()
+	return packed, compacted, err
+}
+
+func init() {
+	RegisterJob("pack", "Pack the bodies of small pastes untouched for pack.after into pack files, and compact mostly dead packs.", func(run *JobRun) error {
+		packed, compacted, err := runPacker()
+		run.SetResult("packed %d pastes, compacted %d packs", packed, compacted)
+		return err
+	})
+
+	RegisterCommand("pack", "pack the bodies of small pastes into pack files, and compact mostly dead packs, now", func(args []string) error {
+		packed, compacted, err := runPacker()
+		fmt.Printf("Packed %d pastes; compacted %d packs.\n", packed, compacted)
+		return err
+	})
+}
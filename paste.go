@@ -3,11 +3,18 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/DHowett/go-xattr"
+	"github.com/golang/glog"
 	"golang.org/x/crypto/scrypt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,6 +28,16 @@ type PasteStore interface {
 	Destroy(*Paste) error
 
 	EncryptionKeyForPasteWithPassword(*Paste, string) []byte
+
+	// Metadata returns the named metadata of the paste with the given ID,
+	// "" if it has none, and SetMetadata sets it; "" clears it. They are
+	// for what is changed apart from the rest of the paste (its pin, its
+	// signature and so on), without a save.
+	Metadata(PasteID, string) (string, error)
+	SetMetadata(PasteID, string, string) error
+	// CountView counts a view against a paste's view limit; see views.go.
+	CountView(PasteID) (int, error)
+
 	readStream(*Paste) (*PasteReader, error)
 	writeStream(*Paste) (*PasteWriter, error)
 }
@@ -79,11 +96,61 @@ type Paste struct {
 	Language   *Language
 	Encrypted  bool
 	Expiration string
-	Title      string
+	// Retention is the name of the paste's retention class, if it has
+	// one; see retention.go.
+	Retention string
+	Title     string
+	// License is the ID of the paste's license, if it has one.
+	License string
+	// Networks, if any, are those to which viewing the paste is
+	// restricted; see network.go.
+	Networks []string
+	// Source, if set, is the URL of the page the paste was clipped from.
+	Source string
 
 	store   PasteStore
 	mtime   time.Time
 	exptime time.Time
+	// expired is set when the paste is being destroyed by the expirator.
+	expired bool
+	// deletionReason, if set, says why the paste is being destroyed.
+	deletionReason string
+	// trashed, if set, says why the paste is in the trash, from which it
+	// will be destroyed at trashedUntil.
+	trashed      string
+	trashedUntil time.Time
+	// direct is set when the paste's body was uploaded straight to the
+	// cold store.
+	direct bool
+	// sealedUntil, if set, is when the paste's body is unsealed, and
+	// sealedBy the account to publish it as then.
+	sealedUntil time.Time
+	sealedBy    string
+	// viewLimited is set if the paste can only be viewed viewsLeft more
+	// times; viewsChanged, if the limit is to be saved with it (as the
+	// count is otherwise kept by CountView).
+	viewLimited  bool
+	viewsLeft    int
+	viewsChanged bool
+	// pending is set while the paste awaits a moderator's approval.
+	pending bool
+	// editToken, if set, is the hex SHA-256 of the token an anonymous
+	// creator holds to find and delete the paste; see recent.go.
+	editToken string
+	// pinnedBy, if set, is the account that pinned the paste; see pin.go.
+	pinnedBy string
+	// pushedTo are the URLs of the copies pushed to other instances; see
+	// push.go.
+	pushedTo []string
+	// immutable is set if the paste can never be changed; see
+	// immutable.go.
+	immutable bool
+	// diagnostics are the syntax errors found in the paste when it was
+	// saved, or nil if it wasn't checked; see validate.go.
+	diagnostics []PasteDiagnostic
+	// actor is the account making the change being saved, if any; it is
+	// named in the change's event.
+	actor string
 
 	encryptionKey    []byte
 	encryptionSalt   []byte
@@ -127,16 +194,67 @@ type PasteCallback func(*Paste)
 type FilesystemPasteStore struct {
 	PasteUpdateCallback  PasteCallback
 	PasteDestroyCallback PasteCallback
-	path                 string
+	// PasteDestroyingCallback is called before a paste's files are removed,
+	// while its body can still be read.
+	PasteDestroyingCallback PasteCallback
+	// PasteCreateCallback and PasteModifyCallback are called after a paste
+	// is first saved, and after any later save, respectively.
+	PasteCreateCallback PasteCallback
+	PasteModifyCallback PasteCallback
+	// ColdStore, if set, receives the bodies of archived pastes.
+	ColdStore ColdStore
+	// Packs, if set, holds the bodies of packed pastes; see pack.go.
+	Packs *PackStore
+	// Faults, if set, has faults injected into the store; see faults.go.
+	Faults bool
+	path   string
+
+	archiveMu sync.Mutex
+	viewsMu   sync.Mutex
+}
+
+// pasteMetadataNames lists every piece of metadata a paste may carry, so
+// that it can be carried over when a paste's body is replaced.
+var pasteMetadataNames = []string{
+	"language",
+	"expiration",
+	"retention",
+	"title",
+	"license",
+	"hmac",
+	"encryption_version",
+	"encryption_salt",
+	"accessed",
+	"trashed",
+	"trashed_until",
+	"sha256",
+	"signature",
+	"signed_by",
+	"sealed_until",
+	"sealed_by",
+	"networks",
+	"views_left",
+	"pending",
+	"edit_token",
+	"source_url",
+	"pinned_by",
+	"pushed_to",
+	"diagnostics",
+	"immutable",
+	"short_code",
+	"short_clicks",
 }
 
 func noopPasteCallback(p *Paste) {}
 
 func NewFilesystemPasteStore(path string) *FilesystemPasteStore {
 	return &FilesystemPasteStore{
-		path:                 path,
-		PasteUpdateCallback:  PasteCallback(noopPasteCallback),
-		PasteDestroyCallback: PasteCallback(noopPasteCallback),
+		path:                    path,
+		PasteUpdateCallback:     PasteCallback(noopPasteCallback),
+		PasteDestroyCallback:    PasteCallback(noopPasteCallback),
+		PasteDestroyingCallback: PasteCallback(noopPasteCallback),
+		PasteCreateCallback:     PasteCallback(noopPasteCallback),
+		PasteModifyCallback:     PasteCallback(noopPasteCallback),
 	}
 }
 
@@ -154,11 +272,143 @@ func (store *FilesystemPasteStore) GenerateNewPasteID(encrypted bool) (PasteID,
 	}
 }
 
-func (store *FilesystemPasteStore) filenameForID(id PasteID) string {
+// Pastes are fanned out across two levels of shard directories (abcde is
+// stored as ab/cd/abcde) so that no single directory holds millions of
+// files. Pastes written before sharding live in the store's root until
+// MigrateToShards moves them; until then they are found there instead.
+const FILESYSTEM_SHARD_WIDTH int = 2
+const FILESYSTEM_SHARD_DEPTH int = 2
+
+func (store *FilesystemPasteStore) shardedFilenameForID(id PasteID) string {
+	s := id.String()
+	if len(s) < FILESYSTEM_SHARD_WIDTH*FILESYSTEM_SHARD_DEPTH {
+		return store.flatFilenameForID(id)
+	}
+
+	components := []string{store.path}
+	for i := 0; i < FILESYSTEM_SHARD_DEPTH; i++ {
+		components = append(components, s[i*FILESYSTEM_SHARD_WIDTH:(i+1)*FILESYSTEM_SHARD_WIDTH])
+	}
+	return filepath.Join(append(components, s)...)
+}
+
+func (store *FilesystemPasteStore) flatFilenameForID(id PasteID) string {
 	return filepath.Join(store.path, id.String())
 }
 
+func (store *FilesystemPasteStore) filenameForID(id PasteID) string {
+	sharded := store.shardedFilenameForID(id)
+	if _, err := os.Stat(sharded); err == nil {
+		return sharded
+	}
+
+	flat := store.flatFilenameForID(id)
+	if fi, err := os.Stat(flat); err == nil && !fi.IsDir() {
+		return flat
+	}
+
+	return sharded
+}
+
+func readDirnames(path string, fn func(string) error) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		names, err := dir.Readdirnames(1024)
+		for _, name := range names {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (store *FilesystemPasteStore) walkShard(path string, depth int, fn func(PasteID) error) error {
+	return readDirnames(path, func(name string) error {
+		if depth < FILESYSTEM_SHARD_DEPTH {
+			if fi, err := os.Lstat(filepath.Join(path, name)); err != nil || !fi.IsDir() {
+				return nil
+			}
+			return store.walkShard(filepath.Join(path, name), depth+1, fn)
+		}
+		if strings.Contains(name, ".") {
+			// Paste IDs never contain dots; this is an aside file.
+			return nil
+		}
+		return fn(PasteIDFromString(name))
+	})
+}
+
+// Walk calls fn for the ID of every paste body in the store, sharded or not.
+func (store *FilesystemPasteStore) Walk(fn func(PasteID) error) error {
+	if err := store.fault("walk", store.path); err != nil {
+		return err
+	}
+	return readDirnames(store.path, func(name string) error {
+		fi, err := os.Lstat(filepath.Join(store.path, name))
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			return store.walkShard(filepath.Join(store.path, name), 1, fn)
+		}
+		if strings.Contains(name, ".") {
+			return nil
+		}
+		return fn(PasteIDFromString(name))
+	})
+}
+
+// MigrateToShards moves every paste still stored in the flat layout into its
+// shard. Renames are atomic and carry the paste's metadata along, so a live
+// server sharing the store keeps serving throughout.
+func (store *FilesystemPasteStore) MigrateToShards(progress func(PasteID)) (int, error) {
+	n := 0
+	err := readDirnames(store.path, func(name string) error {
+		id := PasteIDFromString(name)
+		flat := store.flatFilenameForID(id)
+		fi, err := os.Lstat(flat)
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+
+		sharded := store.shardedFilenameForID(id)
+		if sharded == flat {
+			return nil
+		}
+		if err := store.fault("write", flat); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(sharded), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(flat, sharded); err != nil {
+			return err
+		}
+
+		n++
+		if progress != nil {
+			progress(id)
+		}
+		return nil
+	})
+	return n, err
+}
+
 func (store *FilesystemPasteStore) New(encrypted bool) (p *Paste, err error) {
+	if err = store.fault("new", ""); err != nil {
+		return
+	}
 	id, err := store.GenerateNewPasteID(encrypted)
 	if err != nil {
 		panic(err)
@@ -187,8 +437,32 @@ func getMetadata(fn string, name string, dflt string) string {
 	return string(bytes)
 }
 
+func hasMetadata(fn string, name string) bool {
+	_, err := xattr.Getxattr(fn, "user.paste."+name, 0, 0)
+	return err == nil
+}
+
+func (store *FilesystemPasteStore) Metadata(id PasteID, name string) (string, error) {
+	filename := store.filenameForID(id)
+	if _, err := os.Stat(filename); err != nil {
+		return "", PasteNotFoundError{ID: id}
+	}
+	return getMetadata(filename, name, ""), nil
+}
+
+func (store *FilesystemPasteStore) SetMetadata(id PasteID, name string, value string) error {
+	filename := store.filenameForID(id)
+	if _, err := os.Stat(filename); err != nil {
+		return PasteNotFoundError{ID: id}
+	}
+	return putMetadata(filename, name, value)
+}
+
 func (store *FilesystemPasteStore) Get(id PasteID, key []byte) (p *Paste, err error) {
 	filename := store.filenameForID(id)
+	if err = store.fault("get", filename); err != nil {
+		return
+	}
 	stat, err := os.Stat(filename)
 	if err != nil {
 		err = PasteNotFoundError{ID: id}
@@ -196,42 +470,16 @@ func (store *FilesystemPasteStore) Get(id PasteID, key []byte) (p *Paste, err er
 	}
 
 	paste := &Paste{ID: id, store: store, mtime: stat.ModTime()}
+	hmac, err := parsePasteMetadata(paste, readPasteMetadata(filename))
+	if err != nil {
+		return
+	}
 
-	hmac := getMetadata(filename, "hmac", "")
-	paste.encryptionMethod = getMetadata(filename, "encryption_version", "")
-	if hmac != "" {
-		if paste.encryptionMethod == "" {
-			paste.encryptionMethod = "1"
-		}
-
-		paste.Encrypted = true
-		salt := getMetadata(filename, "encryption_salt", "")
-		if salt == "" {
-			paste.encryptionSalt = []byte(paste.ID.String())
-		} else {
-			saltb, e := base32Encoder.DecodeString(salt)
-			if e != nil {
-				err = e
-				return
-			}
-
-			paste.encryptionSalt = saltb
-		}
-
+	if paste.Encrypted {
 		err = PasteEncryptedError{ID: id}
 		if key != nil {
-			err = nil
-
-			hmacBytes, e := base32Encoder.DecodeString(hmac)
-			if e != nil {
-				err = e
-				return
-			}
-
 			MACMessage := encryptionMethodHandlers[paste.encryptionMethod].generateMACMessage(paste)
-			ok := checkMAC(MACMessage, hmacBytes, key)
-
-			if !ok {
+			if !checkMAC(MACMessage, hmac, key) {
 				err = PasteInvalidKeyError{ID: id}
 				return
 			}
@@ -241,16 +489,6 @@ func (store *FilesystemPasteStore) Get(id PasteID, key []byte) (p *Paste, err er
 		}
 	}
 
-	paste.Language = LanguageNamed(getMetadata(filename, "language", "text"))
-	paste.Expiration = getMetadata(filename, "expiration", "")
-	paste.Title = getMetadata(filename, "title", "")
-
-	if paste.Expiration != "" {
-		if dur, err := ParseDuration(paste.Expiration); err == nil {
-			paste.exptime = paste.mtime.Add(dur)
-		}
-	}
-
 	store.PasteUpdateCallback(paste)
 
 	p = paste
@@ -259,6 +497,10 @@ func (store *FilesystemPasteStore) Get(id PasteID, key []byte) (p *Paste, err er
 
 func (store *FilesystemPasteStore) Save(p *Paste) error {
 	filename := store.filenameForID(p.ID)
+	if err := store.fault("save", filename); err != nil {
+		return err
+	}
+	created := !hasMetadata(filename, "language")
 	if err := putMetadata(filename, "language", p.Language.ID); err != nil {
 		return err
 	}
@@ -273,6 +515,69 @@ func (store *FilesystemPasteStore) Save(p *Paste) error {
 		return err
 	}
 
+	if err := putMetadata(filename, "license", p.License); err != nil {
+		return err
+	}
+
+	if err := putMetadata(filename, "retention", p.Retention); err != nil {
+		return err
+	}
+
+	sealedUntil := ""
+	if !p.sealedUntil.IsZero() {
+		sealedUntil = strconv.FormatInt(p.sealedUntil.Unix(), 10)
+	}
+	if err := putMetadata(filename, "sealed_until", sealedUntil); err != nil {
+		return err
+	}
+	if err := putMetadata(filename, "sealed_by", p.sealedBy); err != nil {
+		return err
+	}
+
+	if err := putMetadata(filename, "networks", strings.Join(p.Networks, ",")); err != nil {
+		return err
+	}
+
+	pending := ""
+	if p.pending {
+		pending = "1"
+	}
+	if err := putMetadata(filename, "pending", pending); err != nil {
+		return err
+	}
+
+	if p.Source != "" {
+		if err := putMetadata(filename, "source_url", p.Source); err != nil {
+			return err
+		}
+	}
+
+	if err := putMetadata(filename, "diagnostics", encodePasteDiagnostics(p.diagnostics)); err != nil {
+		return err
+	}
+
+	if p.immutable {
+		if err := putMetadata(filename, "immutable", "1"); err != nil {
+			return err
+		}
+	}
+
+	if p.editToken != "" {
+		if err := putMetadata(filename, "edit_token", p.editToken); err != nil {
+			return err
+		}
+	}
+
+	if p.viewsChanged {
+		store.viewsMu.Lock()
+		err := putMetadata(filename, "views_left", pasteViewsValue(p))
+		store.viewsMu.Unlock()
+		if err != nil {
+			return err
+		}
+		p.viewsChanged = false
+	}
+
 	if p.Encrypted {
 		MACMessage := encryptionMethodHandlers[p.encryptionMethod].generateMACMessage(p)
 		hmacBytes := constructMAC([]byte(MACMessage), p.encryptionKey)
@@ -290,12 +595,33 @@ func (store *FilesystemPasteStore) Save(p *Paste) error {
 		}
 	}
 
+	if !p.direct {
+		if _, err := store.bodyDigest(p.ID); err != nil {
+			glog.Error("Failed to digest ", p.ID, ": ", err)
+		}
+	}
+
 	store.PasteUpdateCallback(p)
+	if created {
+		store.PasteCreateCallback(p)
+	} else {
+		store.PasteModifyCallback(p)
+	}
 	return nil
 }
 
 func (store *FilesystemPasteStore) Destroy(p *Paste) error {
-	err := os.Remove(store.filenameForID(p.ID))
+	filename := store.filenameForID(p.ID)
+	if err := store.fault("destroy", filename); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+	store.PasteDestroyingCallback(p)
+
+	store.forgetArchivedBody(filename)
+	err := os.Remove(filename)
 	if err != nil {
 		return err
 	}
@@ -305,6 +631,12 @@ func (store *FilesystemPasteStore) Destroy(p *Paste) error {
 }
 
 func (store *FilesystemPasteStore) EncryptionKeyForPasteWithPassword(p *Paste, password string) []byte {
+	return encryptionKeyForPasteWithPassword(p, password)
+}
+
+// encryptionKeyForPasteWithPassword derives the key for p from password,
+// the same way for every store.
+func encryptionKeyForPasteWithPassword(p *Paste, password string) []byte {
 	if password == "" {
 		return nil
 	}
@@ -317,11 +649,67 @@ func (store *FilesystemPasteStore) EncryptionKeyForPasteWithPassword(p *Paste, p
 	return key
 }
 
+// openBody opens a paste's body as stored, without decrypting it,
+// bringing it back from cold storage first if need be. Directly uploaded
+// bodies are read from the cold store in place, and packed bodies from
+// their packs.
+func (store *FilesystemPasteStore) openBody(id PasteID) (io.ReadCloser, error) {
+	filename := store.filenameForID(id)
+	if err := store.fault("read", filename); err != nil {
+		return nil, err
+	}
+	if store.Packs != nil && store.packedPointer(filename) != "" {
+		return store.openPacked(filename)
+	}
+	if store.ColdStore != nil {
+		if key := store.archivedKey(filename); key != "" {
+			if store.isDirect(filename) {
+				return store.ColdStore.Get(key)
+			}
+			if err := store.rehydrate(filename); err != nil {
+				return nil, err
+			}
+		}
+		store.touch(filename)
+	}
+	return os.Open(filename)
+}
+
+// bodyDigest returns the hex SHA-256 of a paste's body as stored (that is,
+// encrypted, for encrypted pastes), without rehydrating it. The digest is
+// kept in the paste's metadata until its body is next written.
+func (store *FilesystemPasteStore) bodyDigest(id PasteID) (string, error) {
+	filename := store.filenameForID(id)
+	if digest := getMetadata(filename, "sha256", ""); digest != "" {
+		return digest, nil
+	}
+	var r io.ReadCloser
+	var err error
+	if key := store.archivedKey(filename); key != "" && store.ColdStore != nil {
+		r, err = store.ColdStore.Get(key)
+	} else if store.Packs != nil && store.packedPointer(filename) != "" {
+		r, err = store.openPacked(filename)
+	} else {
+		r, err = os.Open(filename)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	putMetadata(filename, "sha256", digest)
+	return digest, nil
+}
+
 func (store *FilesystemPasteStore) readStream(p *Paste) (*PasteReader, error) {
-	filename := store.filenameForID(p.ID)
 	var r io.ReadCloser
 	var err error
-	if r, err = os.Open(filename); err != nil {
+	if r, err = store.openBody(p.ID); err != nil {
 		return nil, err
 	}
 
@@ -334,11 +722,31 @@ func (store *FilesystemPasteStore) readStream(p *Paste) (*PasteReader, error) {
 
 func (store *FilesystemPasteStore) writeStream(p *Paste) (*PasteWriter, error) {
 	filename := store.filenameForID(p.ID)
+	if err := store.fault("write", filename); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+
+	// Hold off rehydration, which would otherwise swap the old body back in
+	// underneath us.
+	store.archiveMu.Lock()
 	var w io.WriteCloser
 	var err error
 	if w, err = os.Create(filename); err != nil {
+		store.archiveMu.Unlock()
 		return nil, err
 	}
+	store.forgetArchivedBody(filename)
+	// A packed body is left in its pack, to be compacted away.
+	putMetadata(filename, "packed", "")
+	// The body's digest is worked out again when it is next wanted, and
+	// what signed the old body doesn't sign the new.
+	putMetadata(filename, "sha256", "")
+	putMetadata(filename, "signature", "")
+	putMetadata(filename, "signed_by", "")
+	store.archiveMu.Unlock()
 
 	// N.B. We always write using the newest encryption method.
 	if p.Encrypted {
@@ -399,3 +807,13 @@ var encryptionMethodHandlers = map[string]EncryptionMethodHandlers{
 		},
 	},
 }
+
+func init() {
+	RegisterCommand("migrate-shards", "move pastes from the flat store layout into shard directories", func(args []string) error {
+		n, err := filesystemPasteStore.MigrateToShards(func(id PasteID) {
+			fmt.Println(id)
+		})
+		fmt.Printf("Migrated %d pastes.\n", n)
+		return err
+	})
+}
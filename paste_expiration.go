@@ -1,16 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
 )
 
 type ExpiringPasteStore struct {
 	PasteStore
 }
 
+// The expirator's calls into the store are bounded like a request's, so
+// that one stuck paste doesn't hold up the rest.
+
 func (e *ExpiringPasteStore) GetExpirable(id gotimeout.ExpirableID) gotimeout.Expirable {
-	v, _ := e.PasteStore.Get(PasteID(id), nil)
-	if v == nil {
+	var v *Paste
+	err := storeStage.Do(context.Background(), func(context.Context) error {
+		v, _ = e.PasteStore.Get(PasteID(id), nil)
+		return nil
+	})
+	if err != nil || v == nil {
 		return nil
 	}
 	return v
@@ -18,10 +36,263 @@ func (e *ExpiringPasteStore) GetExpirable(id gotimeout.ExpirableID) gotimeout.Ex
 
 func (e *ExpiringPasteStore) DestroyExpirable(ex gotimeout.Expirable) {
 	if paste, ok := ex.(*Paste); ok {
-		e.PasteStore.Destroy(paste)
+		if paste.trashed == "" && retentionExempt(paste) {
+			// It will be scheduled again if its exemption is lifted.
+			healthServer.IncrementMetric("retention.exempt_kept")
+			return
+		}
+		if paste.trashed == "" {
+			PublishEvent(&Event{Kind: EventPasteExpired, Paste: paste})
+			if grace := instanceConfig.Trash.Expired.Duration(); grace > 0 && trashPaste(paste, TrashReasonExpired, grace) {
+				return
+			}
+		}
+		// A paste coming out of the trash goes for the reason it went in.
+		paste.expired = paste.trashed == "" || paste.trashed == TrashReasonExpired
+		paste.deletionReason = paste.trashed
+		err := storeStage.Do(context.Background(), func(context.Context) error {
+			return e.PasteStore.Destroy(paste)
+		})
+		if err != nil {
+			glog.Error("Failed to destroy expired paste ", paste.ID, ": ", err)
+		}
 	}
 }
 
 func (p *Paste) ExpirationID() gotimeout.ExpirableID {
 	return gotimeout.ExpirableID(p.ID)
 }
+
+// storedExpirationHandle mirrors the wire format of a gotimeout.Handle, which
+// keeps its fields to itself.
+type storedExpirationHandle struct {
+	id             string
+	expirationTime time.Time
+}
+
+func (h *storedExpirationHandle) UnmarshalBinary(b []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(&h.id); err != nil {
+		return err
+	}
+	return dec.Decode(&h.expirationTime)
+}
+
+func (h *storedExpirationHandle) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	if err := enc.Encode(h.id); err != nil {
+		return nil, err
+	}
+	err := enc.Encode(h.expirationTime)
+	return b.Bytes(), err
+}
+
+type storedExpirationHandleMap struct {
+	m map[gotimeout.ExpirableID]*storedExpirationHandle
+}
+
+func (h *storedExpirationHandleMap) UnmarshalBinary(b []byte) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(&h.m)
+}
+
+func (h *storedExpirationHandleMap) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(h.m)
+	return b.Bytes(), err
+}
+
+// ExpirationFile is the paste expirator's gotimeout.StorageAdapter. It keeps
+// the schedule in a gob file as gotimeout's own adapter does (upgrading a
+// schedule in the format before that, too), but can also be waited on, for
+// anything that must not exit before its changes to the schedule are saved.
+type ExpirationFile struct {
+	*gotimeout.GobFileAdapter
+	filename string
+
+	mu    sync.Mutex
+	saved chan struct{}
+}
+
+func NewExpirationFile(filename string) *ExpirationFile {
+	return &ExpirationFile{
+		GobFileAdapter: gotimeout.NewGobFileAdapter(filename),
+		filename:       filename,
+		saved:          make(chan struct{}),
+	}
+}
+
+func (f *ExpirationFile) SaveExpirationHandles(hm *gotimeout.HandleMap) error {
+	err := f.GobFileAdapter.SaveExpirationHandles(hm)
+	f.mu.Lock()
+	close(f.saved)
+	f.saved = make(chan struct{})
+	f.mu.Unlock()
+	return err
+}
+
+func (f *ExpirationFile) LoadExpirationHandles() (*gotimeout.HandleMap, error) {
+	hm, err := f.GobFileAdapter.LoadExpirationHandles()
+	if err == nil || os.IsNotExist(err) {
+		return hm, err
+	}
+
+	file, err := os.Open(f.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var legacy map[gotimeout.ExpirableID]struct {
+		ExpirationTime time.Time
+		ID             gotimeout.ExpirableID
+	}
+	if err := gob.NewDecoder(file).Decode(&legacy); err != nil {
+		return nil, err
+	}
+	stored := &storedExpirationHandleMap{m: make(map[gotimeout.ExpirableID]*storedExpirationHandle)}
+	for id, h := range legacy {
+		stored.m[id] = &storedExpirationHandle{string(h.ID), h.ExpirationTime}
+	}
+	b, err := stored.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	hm = &gotimeout.HandleMap{}
+	return hm, hm.UnmarshalBinary(b)
+}
+
+// nextSave returns a channel closed the next time the schedule is saved.
+func (f *ExpirationFile) nextSave() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.saved
+}
+
+// WaitSaved waits for the next time the schedule is saved, which the
+// expirator does within a second or so of it changing.
+func (f *ExpirationFile) WaitSaved(timeout time.Duration) error {
+	return waitSaved(f.nextSave(), timeout)
+}
+
+func waitSaved(saved <-chan struct{}, timeout time.Duration) error {
+	select {
+	case <-saved:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("the expiration schedule wasn't saved within %v", timeout)
+	}
+}
+
+// flushMarker is scheduled and at once cancelled to have the expirator
+// save its schedule within a second; gotimeout has no way to ask it to
+// save outright.
+type flushMarker struct{}
+
+func (flushMarker) ExpirationID() gotimeout.ExpirableID {
+	return "~flush"
+}
+
+// FlushPasteExpirations has the paste expirator save its schedule, and
+// waits up to timeout for it to do so. Should a save land between the
+// marker being scheduled and cancelled, the marker is saved with the
+// schedule; it finds no paste to expire, so that is harmless.
+func FlushPasteExpirations(timeout time.Duration) error {
+	saved := pasteExpirationFile.nextSave()
+	pasteExpirator.ExpireObject(flushMarker{}, 24*time.Hour)
+	pasteExpirator.CancelObjectExpiration(flushMarker{})
+	return waitSaved(saved, timeout)
+}
+
+// ReadExpirationSchedule returns the expiration times recorded in an
+// expirator's gob file, as of its last flush.
+func ReadExpirationSchedule(filename string) (map[gotimeout.ExpirableID]time.Time, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hm *storedExpirationHandleMap
+	if err := gob.NewDecoder(file).Decode(&hm); err != nil {
+		return nil, err
+	}
+
+	schedule := make(map[gotimeout.ExpirableID]time.Time)
+	if hm != nil {
+		for id, h := range hm.m {
+			schedule[id] = h.expirationTime
+		}
+	}
+	return schedule, nil
+}
+
+// ExpirationPreset is one of the expirations pastes may be given.
+type ExpirationPreset struct {
+	Value string `yaml:"value" json:"value"`
+	Label string `yaml:"label" json:"label"`
+}
+
+func validateExpirationConfig(c *_Configuration) error {
+	for _, preset := range c.Expiration.Presets {
+		if d, err := ParseDuration(preset.Value); err != nil || d <= 0 {
+			return fmt.Errorf("expiration preset %q is not a duration", preset.Value)
+		}
+	}
+	if len(c.Expiration.Presets) == 0 && !c.Expiration.Never {
+		return fmt.Errorf("expiration offers no presets and doesn't allow never")
+	}
+	if _, err := matchExpiration(c, c.Expiration.Default); err != nil {
+		return fmt.Errorf("expiration.default: %v", err)
+	}
+	return nil
+}
+
+// matchExpiration returns the configured expiration s stands for ("-1" or
+// a preset's value), or an error if s is neither.
+func matchExpiration(c *_Configuration, s string) (string, error) {
+	if s == "-1" && c.Expiration.Never {
+		return s, nil
+	}
+	if d, err := ParseDuration(s); err == nil {
+		for _, preset := range c.Expiration.Presets {
+			if pd, _ := ParseDuration(preset.Value); pd == d {
+				return preset.Value, nil
+			}
+		}
+	}
+
+	allowed := make([]string, 0, len(c.Expiration.Presets)+1)
+	for _, preset := range c.Expiration.Presets {
+		allowed = append(allowed, preset.Value)
+	}
+	if c.Expiration.Never {
+		allowed = append(allowed, "-1")
+	}
+	return "", fmt.Errorf("must be one of %s", strings.Join(allowed, ", "))
+}
+
+// defaultExpiration returns s, or the default expiration if s is "".
+func defaultExpiration(s string) string {
+	if s == "" {
+		return instanceConfig.Expiration.Default
+	}
+	return s
+}
+
+func apiExpirationsHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"presets": instanceConfig.Expiration.Presets,
+		"never":   instanceConfig.Expiration.Never,
+		"default": instanceConfig.Expiration.Default,
+		"retention": map[string]interface{}{
+			"classes": retentionClassesFor(r),
+			"default": instanceConfig.Retention.Default,
+		},
+	})
+}
+
+func init() {
+	RegisterTemplateFunction("expirationPresets", func() []ExpirationPreset { return instanceConfig.Expiration.Presets })
+	RegisterTemplateFunction("expirationNever", func() bool { return instanceConfig.Expiration.Never })
+	RegisterTemplateFunction("expirationDefault", func() string { return instanceConfig.Expiration.Default })
+}
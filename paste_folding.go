@@ -0,0 +1,160 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pastes longer than render.fold_lines lines are folded: their page shows
+// only the first render.chunk_lines lines, and the rest is fetched a chunk
+// at a time (from /paste/<id>/lines) as the reader scrolls, so that a huge
+// log doesn't make a page of tens of megabytes. Chunks are cut from the
+// paste's whole rendering, so highlighting that spans lines survives the
+// cut. Pastes shown in a rendered style (Markdown) aren't folded, nor are
+// encrypted pastes, whose renderings aren't cached.
+
+// PasteFolding describes how a folded paste's page is to fetch the rest.
+type PasteFolding struct {
+	TotalLines int
+	ChunkLines int
+	URL        string
+}
+
+// Lines returns r's rendering split into lines, each with the markup that
+// is open across its ends closed and reopened, so that any run of them
+// stands alone.
+func (r *RenderedPaste) Lines() []string {
+	r.linesOnce.Do(func() {
+		r.lines = splitRenderedLines(string(r.body))
+	})
+	return r.lines
+}
+
+func splitRenderedLines(body string) []string {
+	var lines []string
+	var open []string
+	var line strings.Builder
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; c {
+		case '<':
+			end := strings.IndexByte(body[i:], '>')
+			if end < 0 {
+				line.WriteString(body[i:])
+				i = len(body)
+				continue
+			}
+			tag := body[i : i+end+1]
+			if strings.HasPrefix(tag, "</") {
+				if len(open) > 0 {
+					open = open[:len(open)-1]
+				}
+			} else if !strings.HasSuffix(tag, "/>") {
+				open = append(open, tag)
+			}
+			line.WriteString(tag)
+			i += end
+		case '\n':
+			for j := len(open) - 1; j >= 0; j-- {
+				line.WriteString("</" + tagName(open[j]) + ">")
+			}
+			lines = append(lines, line.String())
+			line.Reset()
+			for _, tag := range open {
+				line.WriteString(tag)
+			}
+		default:
+			line.WriteByte(c)
+		}
+	}
+	return append(lines, line.String())
+}
+
+// tagName returns the name of the element an opening tag opens.
+func tagName(tag string) string {
+	name := strings.TrimPrefix(tag, "<")
+	if i := strings.IndexAny(name, " \t\n>/"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// chunk returns the nth chunk of r's lines.
+func (r *RenderedPaste) chunk(n int) template.HTML {
+	lines := r.Lines()
+	size := instanceConfig.Render.ChunkLines
+	start, end := n*size, (n+1)*size
+	if start > len(lines) {
+		start = len(lines)
+	}
+	if end > len(lines) {
+		end = len(lines)
+	}
+	return template.HTML(strings.Join(lines[start:end], "\n"))
+}
+
+// pasteFolds reports whether p, rendered as rendered, is to be folded.
+func pasteFolds(p *Paste, rendered *RenderedPaste) bool {
+	cfg := &instanceConfig.Render
+	if cfg.FoldLines <= 0 || cfg.ChunkLines <= 0 || p.Encrypted || p.direct || p.viewLimited {
+		return false
+	}
+	if view := viewLanguage(p.Language); view != nil && view.DisplayStyle != "" {
+		return false
+	}
+	return len(rendered.Lines()) > cfg.FoldLines
+}
+
+// pasteFolding returns how p's page is to fetch the rest of it, or nil if
+// it isn't folded.
+func pasteFolding(ri *RenderContext, p *Paste) *PasteFolding {
+	if instanceConfig.Render.FoldLines <= 0 || p.Encrypted || p.direct {
+		return nil
+	}
+	rendered := renderedPaste(ri.Request.Context(), p)
+	if rendered == nil || !pasteFolds(p, rendered) {
+		return nil
+	}
+	return &PasteFolding{
+		TotalLines: len(rendered.Lines()),
+		ChunkLines: instanceConfig.Render.ChunkLines,
+		URL:        pasteURL("lines", p),
+	}
+}
+
+// pasteLinesHandler answers with a chunk of a folded paste's rendering:
+// the one starting at line start (1, chunk_lines+1, ...).
+func pasteLinesHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	rendered := renderedPaste(r.Context(), p)
+	if rendered == nil || !pasteFolds(p, rendered) {
+		writeAPIError(w, apiError(APIErrorNotFound, "paste %v isn't folded", p.ID))
+		return
+	}
+
+	size := instanceConfig.Render.ChunkLines
+	total := len(rendered.Lines())
+	start, err := strconv.Atoi(r.FormValue("start"))
+	if err != nil || start < 1 || start > total || (start-1)%size != 0 {
+		writeAPIError(w, apiError(APIErrorValidation, "start must be the first line of a chunk: 1, %d, %d, ...", size+1, 2*size+1).With("field", "start"))
+		return
+	}
+	n := (start - 1) / size
+	end := start + size - 1
+	if end > total {
+		end = total
+	}
+
+	healthServer.IncrementMetric("paste.chunks_served")
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"start": start,
+		"end":   end,
+		"total": total,
+		"html":  rendered.chunk(n),
+	})
+}
+
+func init() {
+	RegisterTemplateFunction("pasteFolding", pasteFolding)
+}
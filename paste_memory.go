@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryPasteStore keeps pastes in memory, for tests and for programs
+// whose pastes needn't outlive them. Each paste's metadata is kept as the
+// filesystem store keeps it in extended attributes, and read back through
+// parsePasteMetadata, so that a paste comes back from it as it would from
+// the disk. Archival, packing and the other things done to the filesystem
+// store's files directly don't apply.
+type MemoryPasteStore struct {
+	PasteCreateCallback  PasteCallback
+	PasteModifyCallback  PasteCallback
+	PasteDestroyCallback PasteCallback
+
+	mu     sync.RWMutex
+	pastes map[PasteID]*memoryPaste
+}
+
+type memoryPaste struct {
+	body  []byte
+	md    map[string]string
+	mtime time.Time
+}
+
+func NewMemoryPasteStore() *MemoryPasteStore {
+	return &MemoryPasteStore{
+		PasteCreateCallback:  PasteCallback(noopPasteCallback),
+		PasteModifyCallback:  PasteCallback(noopPasteCallback),
+		PasteDestroyCallback: PasteCallback(noopPasteCallback),
+		pastes:               make(map[PasteID]*memoryPaste),
+	}
+}
+
+func (store *MemoryPasteStore) GenerateNewPasteID(encrypted bool) (PasteID, error) {
+	nbytes, idlen := 4, 5
+	if encrypted {
+		nbytes, idlen = 5, 8
+	}
+
+	for {
+		s, err := generateRandomBase32String(nbytes, idlen)
+		if err != nil {
+			return "", err
+		}
+		store.mu.RLock()
+		_, ok := store.pastes[PasteIDFromString(s)]
+		store.mu.RUnlock()
+		if !ok {
+			return PasteIDFromString(s), nil
+		}
+	}
+}
+
+func (store *MemoryPasteStore) New(encrypted bool) (*Paste, error) {
+	id, err := store.GenerateNewPasteID(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Paste{ID: id, store: store}
+	if encrypted {
+		p.encryptionSalt, _ = generateRandomBytes(16)
+		p.encryptionMethod = CURRENT_ENCRYPTION_METHOD
+	}
+	return p, nil
+}
+
+func (store *MemoryPasteStore) Get(id PasteID, key []byte) (*Paste, error) {
+	store.mu.RLock()
+	mp, ok := store.pastes[id]
+	var md map[string]string
+	var mtime time.Time
+	if ok {
+		md = make(map[string]string, len(mp.md))
+		for name, value := range mp.md {
+			md[name] = value
+		}
+		mtime = mp.mtime
+	}
+	store.mu.RUnlock()
+	if !ok {
+		return nil, PasteNotFoundError{ID: id}
+	}
+
+	p := &Paste{ID: id, store: store, mtime: mtime}
+	hmac, err := parsePasteMetadata(p, md)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Encrypted {
+		if key == nil {
+			return nil, PasteEncryptedError{ID: id}
+		}
+		MACMessage := encryptionMethodHandlers[p.encryptionMethod].generateMACMessage(p)
+		if !checkMAC(MACMessage, hmac, key) {
+			return nil, PasteInvalidKeyError{ID: id}
+		}
+		p.encryptionKey = key
+	}
+	return p, nil
+}
+
+// pasteMetadata returns the metadata FilesystemPasteStore.Save would write
+// for p, leaving out what it would leave alone.
+func pasteMetadata(p *Paste) map[string]string {
+	md := map[string]string{
+		"language":    p.Language.ID,
+		"title":       p.Title,
+		"license":     p.License,
+		"retention":   p.Retention,
+		"sealed_by":   p.sealedBy,
+		"networks":    strings.Join(p.Networks, ","),
+		"diagnostics": encodePasteDiagnostics(p.diagnostics),
+	}
+	if p.Expiration != "" {
+		md["expiration"] = p.Expiration
+	}
+	if !p.sealedUntil.IsZero() {
+		md["sealed_until"] = strconv.FormatInt(p.sealedUntil.Unix(), 10)
+	}
+	if p.pending {
+		md["pending"] = "1"
+	}
+	if p.Source != "" {
+		md["source_url"] = p.Source
+	}
+	if p.immutable {
+		md["immutable"] = "1"
+	}
+	if p.editToken != "" {
+		md["edit_token"] = p.editToken
+	}
+	if p.viewsChanged {
+		md["views_left"] = pasteViewsValue(p)
+	}
+	if p.Encrypted {
+		MACMessage := encryptionMethodHandlers[p.encryptionMethod].generateMACMessage(p)
+		md["hmac"] = base32Encoder.EncodeToString(constructMAC([]byte(MACMessage), p.encryptionKey))
+		md["encryption_version"] = p.encryptionMethod
+		md["encryption_salt"] = base32Encoder.EncodeToString(p.encryptionSalt)
+	}
+	return md
+}
+
+func (store *MemoryPasteStore) Save(p *Paste) error {
+	md := pasteMetadata(p)
+
+	store.mu.Lock()
+	mp, ok := store.pastes[p.ID]
+	if !ok {
+		store.mu.Unlock()
+		return &os.PathError{Op: "save", Path: p.ID.String(), Err: os.ErrNotExist}
+	}
+	created := mp.md == nil
+	if created {
+		mp.md = make(map[string]string)
+	}
+	for name, value := range md {
+		mp.md[name] = value
+	}
+	mp.mtime = time.Now()
+	store.mu.Unlock()
+	p.viewsChanged = false
+
+	if created {
+		store.PasteCreateCallback(p)
+	} else {
+		store.PasteModifyCallback(p)
+	}
+	return nil
+}
+
+func (store *MemoryPasteStore) Destroy(p *Paste) error {
+	store.mu.Lock()
+	_, ok := store.pastes[p.ID]
+	delete(store.pastes, p.ID)
+	store.mu.Unlock()
+	if !ok {
+		return PasteNotFoundError{ID: p.ID}
+	}
+
+	store.PasteDestroyCallback(p)
+	return nil
+}
+
+func (store *MemoryPasteStore) EncryptionKeyForPasteWithPassword(p *Paste, password string) []byte {
+	return encryptionKeyForPasteWithPassword(p, password)
+}
+
+func (store *MemoryPasteStore) Metadata(id PasteID, name string) (string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	mp, ok := store.pastes[id]
+	if !ok {
+		return "", PasteNotFoundError{ID: id}
+	}
+	return mp.md[name], nil
+}
+
+func (store *MemoryPasteStore) SetMetadata(id PasteID, name string, value string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	mp, ok := store.pastes[id]
+	if !ok {
+		return PasteNotFoundError{ID: id}
+	}
+	if mp.md == nil {
+		mp.md = make(map[string]string)
+	}
+	mp.md[name] = value
+	return nil
+}
+
+func (store *MemoryPasteStore) CountView(id PasteID) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	mp, ok := store.pastes[id]
+	if !ok {
+		return 0, PasteNotFoundError{ID: id}
+	}
+	left, err := strconv.Atoi(mp.md["views_left"])
+	if err != nil || left <= 0 {
+		return 0, PasteNotFoundError{ID: id}
+	}
+	left--
+	mp.md["views_left"] = strconv.Itoa(left)
+	return left, nil
+}
+
+func (store *MemoryPasteStore) readStream(p *Paste) (*PasteReader, error) {
+	store.mu.RLock()
+	mp, ok := store.pastes[p.ID]
+	var body []byte
+	if ok {
+		body = mp.body
+	}
+	store.mu.RUnlock()
+	if !ok {
+		return nil, PasteNotFoundError{ID: p.ID}
+	}
+
+	r := ioutil.NopCloser(bytes.NewReader(body))
+	if p.Encrypted {
+		r = encryptionMethodHandlers[p.encryptionMethod].encryptedReadWrapper(p, r)
+	}
+	return &PasteReader{ReadCloser: r, paste: p}, nil
+}
+
+// memoryPasteWriter writes a paste's body as it goes, as a file would be
+// written, so that it is there to be read by the time the paste is saved.
+type memoryPasteWriter struct {
+	store *MemoryPasteStore
+	id    PasteID
+}
+
+func (w *memoryPasteWriter) Write(b []byte) (int, error) {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	mp, ok := w.store.pastes[w.id]
+	if !ok {
+		return 0, &os.PathError{Op: "write", Path: w.id.String(), Err: os.ErrNotExist}
+	}
+	// Readers see only as much of the body as there was when they opened
+	// it; appending never changes that much.
+	mp.body = append(mp.body, b...)
+	mp.mtime = time.Now()
+	return len(b), nil
+}
+
+func (w *memoryPasteWriter) Close() error {
+	return nil
+}
+
+func (store *MemoryPasteStore) writeStream(p *Paste) (*PasteWriter, error) {
+	store.mu.Lock()
+	if mp, ok := store.pastes[p.ID]; ok {
+		mp.body = nil
+		mp.mtime = time.Now()
+	} else {
+		store.pastes[p.ID] = &memoryPaste{mtime: time.Now()}
+	}
+	store.mu.Unlock()
+
+	var w io.WriteCloser = &memoryPasteWriter{store: store, id: p.ID}
+	if p.Encrypted {
+		w = encryptionMethodHandlers[p.encryptionMethod].encryptedWriteWrapper(p, w)
+	}
+	return &PasteWriter{WriteCloser: w, paste: p}, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DHowett/ghostbin/memory"
+	"github.com/gorilla/securecookie"
+)
+
+// useMemoryStores swaps the server's paste, session and account stores for
+// in-memory ones for the length of a test.
+func useMemoryStores(t *testing.T) *MemoryPasteStore {
+	oldPasteStore, oldSessionStore, oldUserStore := pasteStore, sessionStore, userStore
+	t.Cleanup(func() {
+		pasteStore, sessionStore, userStore = oldPasteStore, oldSessionStore, oldUserStore
+	})
+
+	store := NewMemoryPasteStore()
+	pasteStore = store
+	sessionStore = memory.NewSessionStore(securecookie.GenerateRandomKey(32))
+	userStore = &PromoteFirstUserToAdminStore{AccountStore: memory.NewAccountStore(&AuthChallengeProvider{})}
+	return store
+}
+
+func serveTestRequest(t *testing.T, handler http.Handler, method, target string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIPasteLifecycleInMemory(t *testing.T) {
+	store := useMemoryStores(t)
+	handler := newRootHandler()
+
+	w := serveTestRequest(t, handler, "POST", "/api/v1/pastes", url.Values{"text": {"hello, world"}, "lang": {"text"}, "title": {"greeting"}}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	var created struct {
+		ID PasteID `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	cookies := w.Result().Cookies()
+
+	p, err := store.Get(created.ID, nil)
+	if err != nil {
+		t.Fatalf("get %s: %v", created.ID, err)
+	}
+	if p.Title != "greeting" {
+		t.Errorf("title: got %q, want %q", p.Title, "greeting")
+	}
+	w = serveTestRequest(t, handler, "GET", "/paste/"+created.ID.String()+"/raw", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello, world" {
+		t.Errorf("raw: got %d %q, want %d %q", w.Code, w.Body, http.StatusOK, "hello, world")
+	}
+
+	// Only the session that created it may change it.
+	update := url.Values{"text": {"goodbye"}}
+	if w = serveTestRequest(t, handler, "PATCH", "/api/v1/pastes/"+created.ID.String(), update, nil); w.Code != http.StatusForbidden {
+		t.Errorf("update without the session: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w = serveTestRequest(t, handler, "PATCH", "/api/v1/pastes/"+created.ID.String(), update, cookies); w.Code != http.StatusOK {
+		t.Fatalf("update: got %d (%s), want %d", w.Code, w.Body, http.StatusOK)
+	}
+	w = serveTestRequest(t, handler, "GET", "/paste/"+created.ID.String()+"/raw", nil, nil)
+	if w.Body.String() != "goodbye" {
+		t.Errorf("raw after update: got %q, want %q", w.Body, "goodbye")
+	}
+
+	if w = serveTestRequest(t, handler, "DELETE", "/api/v1/pastes/"+created.ID.String(), nil, cookies); w.Code/100 != 2 {
+		t.Fatalf("delete: got %d (%s)", w.Code, w.Body)
+	}
+	if _, err := store.Get(created.ID, nil); err == nil {
+		t.Errorf("get %s after delete: found it", created.ID)
+	}
+}
+
+func TestAuthLoginInMemory(t *testing.T) {
+	useMemoryStores(t)
+	mode := instanceConfig.Registration.Mode
+	instanceConfig.Registration.Mode = RegistrationOpen
+	t.Cleanup(func() { instanceConfig.Registration.Mode = mode })
+	handler := newRootHandler()
+
+	login := func(form url.Values) string {
+		t.Helper()
+		w := serveTestRequest(t, handler, "POST", "/auth/login", form, nil)
+		var reply authReply
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("login: %v (%s)", err, w.Body)
+		}
+		return reply.Status
+	}
+
+	if status := login(url.Values{"type": {"username"}, "username": {"alice"}, "password": {"hunter2"}, "confirm_password": {"hunter2"}}); status != "valid" {
+		t.Fatalf("register: got %q, want %q", status, "valid")
+	}
+	if userStore.Get("alice") == nil {
+		t.Fatalf("alice wasn't saved")
+	}
+	if status := login(url.Values{"type": {"username"}, "username": {"alice"}, "password": {"hunter2"}}); status != "valid" {
+		t.Errorf("login: got %q, want %q", status, "valid")
+	}
+	if status := login(url.Values{"type": {"username"}, "username": {"alice"}, "password": {"wrong"}}); status == "valid" {
+		t.Errorf("login with the wrong password: got %q", status)
+	}
+}
+
+func TestViewLimitInMemory(t *testing.T) {
+	store := useMemoryStores(t)
+	handler := newRootHandler()
+
+	w := serveTestRequest(t, handler, "POST", "/api/v1/pastes", url.Values{"text": {"twice"}, "lang": {"text"}, "views": {"2"}}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	var created struct {
+		ID PasteID `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		w = serveTestRequest(t, handler, "GET", "/paste/"+created.ID.String()+"/raw", nil, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("view %d: got %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+	if left, _ := store.Metadata(created.ID, "views_left"); left != "0" {
+		t.Errorf("views left: got %q, want %q", left, "0")
+	}
+}
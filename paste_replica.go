@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/DHowett/gotimeout"
+)
+
+// ReplicatedPasteStore sends writes to a primary store and spreads reads
+// across read-only replicas of it (for example, mirrors of the primary's
+// paste directory). A paste written within the last Staleness is read from
+// the primary, since the replicas may not have seen the write yet; so is any
+// paste a replica cannot find.
+type ReplicatedPasteStore struct {
+	Primary   PasteStore
+	Replicas  []PasteStore
+	Staleness time.Duration
+
+	next         uint32
+	recentWrites *gotimeout.Map
+}
+
+func NewReplicatedPasteStore(primary PasteStore, replicas []PasteStore, staleness time.Duration) *ReplicatedPasteStore {
+	return &ReplicatedPasteStore{
+		Primary:      primary,
+		Replicas:     replicas,
+		Staleness:    staleness,
+		recentWrites: gotimeout.NewMap(),
+	}
+}
+
+func (r *ReplicatedPasteStore) markWritten(id PasteID) {
+	if r.Staleness > 0 {
+		r.recentWrites.Put(id.String(), true, r.Staleness)
+	}
+}
+
+// readStoreForID returns the store from which a paste should be read.
+func (r *ReplicatedPasteStore) readStoreForID(id PasteID) PasteStore {
+	if len(r.Replicas) == 0 {
+		return r.Primary
+	}
+	if _, recent := r.recentWrites.Get(id.String()); recent {
+		return r.Primary
+	}
+	n := atomic.AddUint32(&r.next, 1)
+	return r.Replicas[int(n)%len(r.Replicas)]
+}
+
+func (r *ReplicatedPasteStore) GenerateNewPasteID(encrypted bool) (PasteID, error) {
+	return r.Primary.GenerateNewPasteID(encrypted)
+}
+
+func (r *ReplicatedPasteStore) New(encrypted bool) (*Paste, error) {
+	p, err := r.Primary.New(encrypted)
+	if p != nil {
+		p.store = r
+	}
+	return p, err
+}
+
+func (r *ReplicatedPasteStore) Get(id PasteID, key []byte) (*Paste, error) {
+	store := r.readStoreForID(id)
+	p, err := store.Get(id, key)
+	if _, ok := err.(PasteNotFoundError); ok && store != r.Primary {
+		healthServer.IncrementMetric("paste.replica.fallbacks")
+		p, err = r.Primary.Get(id, key)
+	} else if store != r.Primary {
+		healthServer.IncrementMetric("paste.replica.reads")
+	}
+
+	if p != nil {
+		// Whichever store found it, saves and deletes must come back through here.
+		p.store = r
+	}
+	return p, err
+}
+
+func (r *ReplicatedPasteStore) Save(p *Paste) error {
+	r.markWritten(p.ID)
+	return r.Primary.Save(p)
+}
+
+func (r *ReplicatedPasteStore) Destroy(p *Paste) error {
+	r.markWritten(p.ID)
+	return r.Primary.Destroy(p)
+}
+
+func (r *ReplicatedPasteStore) EncryptionKeyForPasteWithPassword(p *Paste, password string) []byte {
+	return r.Primary.EncryptionKeyForPasteWithPassword(p, password)
+}
+
+func (r *ReplicatedPasteStore) Metadata(id PasteID, name string) (string, error) {
+	store := r.readStoreForID(id)
+	value, err := store.Metadata(id, name)
+	if _, ok := err.(PasteNotFoundError); ok && store != r.Primary {
+		healthServer.IncrementMetric("paste.replica.fallbacks")
+		value, err = r.Primary.Metadata(id, name)
+	}
+	return value, err
+}
+
+func (r *ReplicatedPasteStore) SetMetadata(id PasteID, name string, value string) error {
+	r.markWritten(id)
+	return r.Primary.SetMetadata(id, name, value)
+}
+
+func (r *ReplicatedPasteStore) CountView(id PasteID) (int, error) {
+	r.markWritten(id)
+	return r.Primary.CountView(id)
+}
+
+func (r *ReplicatedPasteStore) readStream(p *Paste) (*PasteReader, error) {
+	store := r.readStoreForID(p.ID)
+	reader, err := store.readStream(p)
+	if err != nil && store != r.Primary {
+		healthServer.IncrementMetric("paste.replica.fallbacks")
+		reader, err = r.Primary.readStream(p)
+	}
+	return reader, err
+}
+
+func (r *ReplicatedPasteStore) writeStream(p *Paste) (*PasteWriter, error) {
+	r.markWritten(p.ID)
+	return r.Primary.writeStream(p)
+}
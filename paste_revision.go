@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A paste's revision identifies its content: body, language, title,
+// license and expiration. It is sent as the ETag of the paste's JSON and of
+// API updates, and carried by the edit form, so that an update can say
+// which revision it was made against (with If-Match, or the form value
+// revision). An update against any other revision fails with 412 instead
+// of overwriting the changes made since.
+
+type PastePreconditionFailedError struct {
+	ID       PasteID
+	Revision string
+}
+
+func (e PastePreconditionFailedError) Error() string {
+	return "Paste " + e.ID.String() + " has changed since that revision; reload it and try again."
+}
+
+func (e PastePreconditionFailedError) StatusCode() int {
+	return http.StatusPreconditionFailed
+}
+
+func (e PastePreconditionFailedError) APIErrorCode() string {
+	return APIErrorPreconditionFailed
+}
+
+func (e PastePreconditionFailedError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{"revision": e.Revision}
+}
+
+// pasteRevision returns p's revision, or "" if its body can't be read.
+func pasteRevision(p *Paste) string {
+	reader, err := p.Reader()
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	language := ""
+	if p.Language != nil {
+		language = p.Language.ID
+	}
+	fmt.Fprintf(h, "%q %q %q %q\n", language, p.Title, p.License, p.Expiration)
+	if _, err := io.Copy(h, reader); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))[:20]
+}
+
+func pasteETag(revision string) string {
+	return `"` + revision + `"`
+}
+
+// A paste's update lock is held from checking an update's precondition
+// until the update has been written. Each paste has its own, so that
+// updates to different pastes don't wait on one another; locks are dropped
+// once no one holds or wants them.
+var pasteUpdateLocks = struct {
+	sync.Mutex
+	m map[PasteID]*pasteUpdateLock
+}{m: make(map[PasteID]*pasteUpdateLock)}
+
+type pasteUpdateLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockPasteUpdates takes id's update lock, and returns the function that
+// releases it.
+func lockPasteUpdates(id PasteID) (unlock func()) {
+	pasteUpdateLocks.Lock()
+	l, ok := pasteUpdateLocks.m[id]
+	if !ok {
+		l = &pasteUpdateLock{}
+		pasteUpdateLocks.m[id] = l
+	}
+	l.refs++
+	pasteUpdateLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		pasteUpdateLocks.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(pasteUpdateLocks.m, id)
+		}
+		pasteUpdateLocks.Unlock()
+	}
+}
+
+// checkPastePrecondition returns an error unless r was made against p's
+// current revision, or names none.
+func checkPastePrecondition(r *http.Request, p *Paste) error {
+	var wanted []string
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if strings.TrimSpace(ifMatch) == "*" {
+			return nil
+		}
+		for _, tag := range strings.Split(ifMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			// Weak tags never match (RFC 7232 §3.1).
+			if !strings.HasPrefix(tag, "W/") {
+				wanted = append(wanted, strings.Trim(tag, `"`))
+			}
+		}
+		if len(wanted) == 0 {
+			wanted = []string{""}
+		}
+	} else if revision := r.FormValue("revision"); revision != "" {
+		wanted = []string{revision}
+	} else {
+		return nil
+	}
+
+	current := pasteRevision(p)
+	for _, revision := range wanted {
+		if revision != "" && revision == current {
+			return nil
+		}
+	}
+	healthServer.IncrementMetric("paste.updated.conflict")
+	return PastePreconditionFailedError{ID: p.ID, Revision: current}
+}
+
+func init() {
+	RegisterTemplateFunction("pasteRevision", pasteRevision)
+}
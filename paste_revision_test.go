@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockPasteUpdates(t *testing.T) {
+	unlockA := lockPasteUpdates("aaaaa")
+
+	// Another paste's lock is free.
+	lockPasteUpdates("bbbbb")()
+
+	// The same paste's isn't, until it is released.
+	locked, released := make(chan struct{}), make(chan struct{})
+	go func() {
+		unlock := lockPasteUpdates("aaaaa")
+		close(locked)
+		unlock()
+		close(released)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("took a paste's update lock while it was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("a paste's update lock wasn't released")
+	}
+	<-released
+
+	pasteUpdateLocks.Lock()
+	n := len(pasteUpdateLocks.m)
+	pasteUpdateLocks.Unlock()
+	if n != 0 {
+		t.Errorf("%d update locks kept after they were released", n)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// A paste can be searched on the server (/paste/<id>/search), which
+// answers with the numbers of the matching lines. The find box on a
+// paste's page uses it, so that it finds lines a folded paste hasn't
+// fetched yet. Queries are literal unless regex is set, in which case
+// they are Go regular expressions (which run in linear time).
+
+const (
+	MaxSearchQueryLength = 256
+	// MaxSearchMatches is how many matching lines a search reports.
+	MaxSearchMatches = 1000
+	// searchPreviewLength is how many characters of a matching line are
+	// sent with it.
+	searchPreviewLength = 120
+)
+
+type SearchMatch struct {
+	Line    int    `json:"line"`
+	Preview string `json:"preview"`
+}
+
+// pasteSearchHandler searches a paste. Form values: q (the query), regex
+// (to treat it as a regular expression) and case (to match case).
+func pasteSearchHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	if p.direct {
+		writeAPIError(w, apiError(APIErrorValidation, "paste %v is too large to search", p.ID))
+		return
+	}
+	if p.viewLimited && !isEditAllowed(p, r) {
+		writeAPIError(w, apiError(APIErrorForbidden, "paste %v can only be viewed whole", p.ID))
+		return
+	}
+
+	query := r.FormValue("q")
+	if query == "" || len(query) > MaxSearchQueryLength || !utf8.ValidString(query) {
+		writeAPIError(w, apiError(APIErrorValidation, "q must be 1 to %d bytes of UTF-8", MaxSearchQueryLength).With("field", "q"))
+		return
+	}
+	if r.FormValue("regex") == "" {
+		query = regexp.QuoteMeta(query)
+	} else if _, err := regexp.Compile(query); err != nil {
+		writeAPIError(w, apiError(APIErrorValidation, "q is not a regular expression: %v", err).With("field", "q"))
+		return
+	}
+	if r.FormValue("case") == "" {
+		query = "(?i)" + query
+	}
+	pattern := regexp.MustCompile(query)
+
+	reader, err := p.Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	matches := []SearchMatch{}
+	truncated := false
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, int(PASTE_MAXIMUM_LENGTH)+1)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if !pattern.MatchString(text) {
+			continue
+		}
+		if len(matches) == MaxSearchMatches {
+			truncated = true
+			break
+		}
+		preview := text
+		if utf8.RuneCountInString(preview) > searchPreviewLength {
+			preview = string([]rune(preview)[:searchPreviewLength])
+		}
+		matches = append(matches, SearchMatch{line, preview})
+	}
+	if err := scanner.Err(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	healthServer.IncrementMetric("paste.searched")
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"matches":   matches,
+		"truncated": truncated,
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A paste's editors can have it scanned for personal information (email
+// addresses, phone numbers and national ID numbers), typically in logs that
+// were shared before anyone looked closely:
+//
+//	GET  /paste/{id}/scan               the findings, to choose from
+//	POST /paste/{id}/scan               redact=<finding>...
+//	GET, POST /api/v1/pastes/{id}/scan  the same, as JSON (redact=all for
+//	                                    every finding)
+//
+// Each finding comes with the text it would be replaced by. Redacting saves
+// the paste as a new revision; as findings are numbered in the order they
+// were found, the request must carry the revision that was scanned (as
+// If-Match, or the form value revision), and is refused if the paste has
+// changed since. The scan is a set of patterns, not a guarantee.
+
+const PII_MAX_FINDINGS int = 1000
+
+// PIIKind is a kind of personal information the scanner looks for.
+type PIIKind struct {
+	Name        string
+	Description string
+	pattern     *regexp.Regexp
+	// valid, if set, weeds out matches that can't be what they look like.
+	valid func(string) bool
+}
+
+// piiKinds are tried in order; a match overlapping an earlier one is
+// skipped, so that (for example) an SSN isn't found again as a phone
+// number.
+var piiKinds = []*PIIKind{
+	{"email", "Email address", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`), nil},
+	{"ssn", "US Social Security number", regexp.MustCompile(`\d{3}-\d{2}-\d{4}`), validSSN},
+	{"nino", "UK National Insurance number", regexp.MustCompile(`[A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z] ?\d{2} ?\d{2} ?\d{2} ?[A-D]`), nil},
+	{"sin", "Canadian Social Insurance number", regexp.MustCompile(`\d{3}[ -]\d{3}[ -]\d{3}`), validSIN},
+	{"phone", "Phone number", regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{1,4}\)[ .-]?)?\d{2,4}[ .-]\d{3,4}(?:[ .-]?\d{3,4})?`), validPhone},
+}
+
+func digitsOf(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func validSSN(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// validSIN checks the Luhn digit of a SIN (which never starts with 0 or 8).
+func validSIN(s string) bool {
+	digits := digitsOf(s)
+	if digits[0] == '0' || digits[0] == '8' {
+		return false
+	}
+	sum := 0
+	for i, c := range digits {
+		d := int(c - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validPhone wants enough digits to dial, and doesn't take dotted numbers
+// (versions, addresses) without a country code for phone numbers.
+func validPhone(s string) bool {
+	n := len(digitsOf(s))
+	if n < 7 || n > 15 {
+		return false
+	}
+	return strings.HasPrefix(s, "+") || !strings.Contains(s, ".")
+}
+
+// piiBoundary reports whether the match at line[start:end] stands on its
+// own, rather than being part of a longer word or number.
+func piiBoundary(line string, start, end int) bool {
+	isWord := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '_'
+	}
+	if start > 0 && (isWord(line[start-1]) || strings.IndexByte("+-.@", line[start-1]) >= 0) {
+		return false
+	}
+	if end < len(line) && (isWord(line[end]) || line[end] == '@' || (strings.IndexByte("-.", line[end]) >= 0 && end+1 < len(line) && isWord(line[end+1]))) {
+		return false
+	}
+	return true
+}
+
+// PIIFinding is a piece of personal information found in a paste.
+type PIIFinding struct {
+	ID     int    `json:"id"`
+	Kind   string `json:"kind"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Text   string `json:"text"`
+	// Redaction is what the text is replaced with, if it is redacted.
+	Redaction string `json:"redaction"`
+
+	offset int
+}
+
+func (f PIIFinding) Description() string {
+	for _, kind := range piiKinds {
+		if kind.Name == f.Kind {
+			return kind.Description
+		}
+	}
+	return f.Kind
+}
+
+// scanForPII finds the personal information in body, in order, reporting
+// whether there was more than it would list.
+func scanForPII(body string) ([]PIIFinding, bool) {
+	findings := []PIIFinding{}
+	offset := 0
+	for n, line := range strings.SplitAfter(body, "\n") {
+		var taken [][2]int
+		var found []PIIFinding
+		for _, kind := range piiKinds {
+		matches:
+			for _, m := range kind.pattern.FindAllStringIndex(line, -1) {
+				text := line[m[0]:m[1]]
+				if !piiBoundary(line, m[0], m[1]) || (kind.valid != nil && !kind.valid(text)) {
+					continue
+				}
+				for _, t := range taken {
+					if m[0] < t[1] && t[0] < m[1] {
+						continue matches
+					}
+				}
+				taken = append(taken, [2]int{m[0], m[1]})
+				found = append(found, PIIFinding{
+					Kind:      kind.Name,
+					Line:      n + 1,
+					Column:    utf8.RuneCountInString(line[:m[0]]) + 1,
+					Text:      text,
+					Redaction: "[redacted " + kind.Name + "]",
+					offset:    offset + m[0],
+				})
+			}
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].offset < found[j].offset })
+		for _, f := range found {
+			if len(findings) == PII_MAX_FINDINGS {
+				return findings, true
+			}
+			f.ID = len(findings) + 1
+			findings = append(findings, f)
+		}
+		offset += len(line)
+	}
+	return findings, false
+}
+
+// redactPII replaces the findings in body chosen by redact.
+func redactPII(body string, findings []PIIFinding, redact func(PIIFinding) bool) (string, int) {
+	var b strings.Builder
+	last, n := 0, 0
+	for _, f := range findings {
+		if !redact(f) {
+			continue
+		}
+		b.WriteString(body[last:f.offset])
+		b.WriteString(f.Redaction)
+		last = f.offset + len(f.Text)
+		n++
+	}
+	b.WriteString(body[last:])
+	return b.String(), n
+}
+
+// scanPaste scans p's body, which it returns with the findings.
+func scanPaste(p *Paste) (string, []PIIFinding, bool, error) {
+	if p.direct {
+		return "", nil, false, apiError(APIErrorValidation, "paste %v was uploaded directly, and can't be scanned", p.ID)
+	}
+	body, err := pasteBody(p)
+	if err != nil {
+		return "", nil, false, err
+	}
+	healthServer.IncrementMetric("paste.scanned")
+	findings, truncated := scanForPII(string(body))
+	return string(body), findings, truncated, nil
+}
+
+// redactPaste redacts the findings in p named by the form values redact,
+// saving p. The caller holds p's update lock.
+func redactPaste(r *http.Request, p *Paste) (int, error) {
+	if err := checkPastePrecondition(r, p); err != nil {
+		return 0, err
+	}
+	r.ParseForm()
+	chosen := make(map[int]bool)
+	all := false
+	for _, v := range r.Form["redact"] {
+		for _, field := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if field == "all" {
+				all = true
+				continue
+			}
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return 0, apiError(APIErrorValidation, "redact must list finding IDs, or all").With("field", "redact")
+			}
+			chosen[id] = true
+		}
+	}
+	if !all && len(chosen) == 0 {
+		return 0, apiError(APIErrorValidation, "choose the findings to redact").With("field", "redact")
+	}
+
+	body, findings, _, err := scanPaste(p)
+	if err != nil {
+		return 0, err
+	}
+	redacted, n := redactPII(body, findings, func(f PIIFinding) bool { return all || chosen[f.ID] })
+	if n == 0 {
+		return 0, nil
+	}
+	if err := replacePasteBody(r, p, redacted); err != nil {
+		return 0, err
+	}
+	healthServer.IncrementMetric("paste.redacted")
+	return n, nil
+}
+
+func pasteScanHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	_, findings, truncated, err := scanPaste(p)
+	if err != nil {
+		panic(err)
+	}
+	RenderPage(w, r, "paste_scan", &struct {
+		Paste     *Paste
+		Revision  string
+		Findings  []PIIFinding
+		Truncated bool
+	}{
+		Paste:     p,
+		Revision:  pasteRevision(p),
+		Findings:  findings,
+		Truncated: truncated,
+	})
+}
+
+func pasteRedact(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	defer lockPasteUpdates(p.ID)()
+	n, err := redactPaste(r, p)
+	if err != nil {
+		panic(err)
+	}
+	if n == 1 {
+		SetFlash(w, "success", fmt.Sprintf("Redacted 1 finding from paste %v.", p.ID))
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Redacted %d findings from paste %v.", n, p.ID))
+	}
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// apiPasteScanHandler scans a paste (GET) or redacts what was found (POST).
+func apiPasteScanHandler(w http.ResponseWriter, r *http.Request) {
+	o, err := lookupPasteWithRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p := o.(*Paste)
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"scan", p.ID})
+		return
+	}
+
+	if r.Method == "POST" {
+		if p.Encrypted {
+			writeAPIError(w, apiError(APIErrorValidation, "encrypted pastes can only be edited with the web form"))
+			return
+		}
+		defer lockPasteUpdates(p.ID)()
+		n, err := redactPaste(r, p)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		revision := pasteRevision(p)
+		w.Header().Set("ETag", pasteETag(revision))
+		writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+			"id":       p.ID,
+			"url":      pasteURL("show", p),
+			"revision": revision,
+			"redacted": n,
+		})
+		return
+	}
+
+	_, findings, truncated, err := scanPaste(p)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	revision := pasteRevision(p)
+	w.Header().Set("ETag", pasteETag(revision))
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"id":        p.ID,
+		"revision":  revision,
+		"findings":  findings,
+		"truncated": truncated,
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/DHowett/ghostbin/account"
+	"github.com/gorilla/mux"
+)
+
+// Owners with accounts can pin pastes they want kept at hand. A pinned
+// paste is never archived (one already archived is brought back when it is
+// pinned), and its rendering is kept in the render cache apart from the
+// LRU, so that other pastes can't push it out; it is rendered as soon as
+// it's pinned. Each account may pin pins.max_per_account pastes.
+//
+// The pinning account is kept with the paste (pinned_by), and the pastes
+// an account has pinned with the account (pins).
+
+type PinLimitError struct {
+	Limit int
+}
+
+func (e PinLimitError) Error() string {
+	if e.Limit == 0 {
+		return "Pinning is turned off."
+	}
+	return fmt.Sprintf("You can pin at most %d pastes; unpin one first.", e.Limit)
+}
+
+func (e PinLimitError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+// Pinned reports whether the paste is pinned.
+func (p *Paste) Pinned() bool {
+	return p.pinnedBy != ""
+}
+
+// userPins returns the pastes user has pinned that are still pinned by
+// user, dropping those that aren't (they were destroyed, say).
+func userPins(user *account.User) []PasteID {
+	ids, _ := user.Values["pins"].([]string)
+	var pins []PasteID
+	for _, id := range ids {
+		if pinnedBy, _ := pasteStore.Metadata(PasteID(id), "pinned_by"); pinnedBy == user.Name {
+			pins = append(pins, PasteID(id))
+		}
+	}
+	return pins
+}
+
+func saveUserPins(user *account.User, pins []PasteID) error {
+	ids := make([]string, len(pins))
+	for i, id := range pins {
+		ids[i] = id.String()
+	}
+	user.Values["pins"] = ids
+	return user.Save()
+}
+
+// pinPaste pins p for user, enforcing user's pin limit, and warms it up.
+func pinPaste(ctx context.Context, user *account.User, p *Paste) error {
+	if p.pinnedBy == user.Name {
+		return nil
+	}
+	pins := userPins(user)
+	if limit := instanceConfig.Pins.MaxPerAccount; len(pins) >= limit {
+		return PinLimitError{limit}
+	}
+
+	if err := p.store.SetMetadata(p.ID, "pinned_by", user.Name); err != nil {
+		return err
+	}
+	p.pinnedBy = user.Name
+	if err := saveUserPins(user, append(pins, p.ID)); err != nil {
+		return err
+	}
+
+	prewarmPaste(ctx, p)
+	healthServer.IncrementMetric("paste.pinned")
+	return nil
+}
+
+// unpinPaste unpins p, whoever pinned it.
+func unpinPaste(user *account.User, p *Paste) error {
+	if p.pinnedBy == "" {
+		return nil
+	}
+	if err := p.store.SetMetadata(p.ID, "pinned_by", ""); err != nil {
+		return err
+	}
+	p.pinnedBy = ""
+	forgetRenderedPaste(p.ID)
+
+	var kept []PasteID
+	for _, id := range userPins(user) {
+		if id != p.ID {
+			kept = append(kept, id)
+		}
+	}
+	return saveUserPins(user, kept)
+}
+
+// prewarmPaste brings p's body back from cold storage, if it is there, and
+// renders it into the cache.
+func prewarmPaste(ctx context.Context, p *Paste) {
+	if reader, err := p.Reader(); err == nil {
+		reader.Close()
+	}
+	if !p.Encrypted && !p.direct {
+		forgetRenderedPaste(p.ID)
+		renderedPaste(ctx, p)
+	}
+}
+
+func pinnedByFilename(filename string) bool {
+	return getMetadata(filename, "pinned_by", "") != ""
+}
+
+// setPastePin pins or unpins a paste for the requester, who must have an
+// account and be able to edit it.
+func setPastePin(r *http.Request, p *Paste, pin bool) error {
+	user := GetUser(r)
+	if user == nil {
+		return PasteAccessDeniedError{"pin", p.ID}
+	}
+	if _, err := p.store.Metadata(p.ID, "pinned_by"); err != nil {
+		return err
+	}
+	if pin {
+		return pinPaste(r.Context(), user, p)
+	}
+	return unpinPaste(user, p)
+}
+
+func pastePin(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	pin := r.FormValue("pin") != "false"
+	if err := setPastePin(r, p, pin); err != nil {
+		panic(err)
+	}
+	if pin {
+		SetFlash(w, "success", fmt.Sprintf("Paste %v pinned.", p.ID))
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Paste %v unpinned.", p.ID))
+	}
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// apiPastePinHandler pins (PUT) or unpins (DELETE) a paste.
+func apiPastePinHandler(w http.ResponseWriter, r *http.Request) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, _ := pasteStore.Get(id, nil)
+	if p == nil || p.trashed != "" {
+		writeAPIError(w, PasteNotFoundError{ID: id})
+		return
+	}
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"pin", id})
+		return
+	}
+	if err := setPastePin(r, p, r.Method == "PUT"); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	resp := map[string]interface{}{"id": id, "pinned": p.Pinned()}
+	if user := GetUser(r); user != nil {
+		resp["pins_left"] = instanceConfig.Pins.MaxPerAccount - len(userPins(user))
+	}
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+func init() {
+	RegisterTemplateFunction("pinsEnabled", func() bool { return instanceConfig.Pins.MaxPerAccount > 0 })
+}
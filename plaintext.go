@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// /paste/<id>/export answers with a paste as plain text that survives being
+// pasted into ticketing systems and chat: ANSI escape sequences and other
+// control characters are stripped, line endings made \n, trailing
+// whitespace trimmed, tabs expanded and unusual spaces made plain, and
+// lines are numbered if asked.
+
+// MaxPlainTextTabWidth is the widest a tab can be expanded to.
+const MaxPlainTextTabWidth = 16
+
+// ansiEscapePattern matches CSI sequences (colours, cursor movement), OSC
+// sequences (titles, hyperlinks) and the other two-character escapes.
+var ansiEscapePattern = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|\x1b[@-Z\\\\-_]")
+
+type PlainTextOptions struct {
+	// TabWidth is how many columns tabs are expanded to; 0 keeps them.
+	TabWidth    int
+	LineNumbers bool
+}
+
+// cleanPlainTextLine returns line without escape sequences, control
+// characters, odd spaces or trailing whitespace, with tabs expanded.
+func cleanPlainTextLine(line string, tabWidth int) string {
+	// A carriage return in terminal output starts the line over.
+	if i := strings.LastIndexByte(strings.TrimRight(line, "\r"), '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+	line = ansiEscapePattern.ReplaceAllString(line, "")
+
+	var out strings.Builder
+	column := 0
+	for _, c := range line {
+		switch {
+		case c == '\t':
+			if tabWidth == 0 {
+				out.WriteRune(c)
+				column++
+				continue
+			}
+			n := tabWidth - column%tabWidth
+			out.WriteString(strings.Repeat(" ", n))
+			column += n
+			continue
+		case c == '\u200b' || c == '\ufeff' || c == '\u00ad':
+			// Zero-width spaces, byte-order marks and soft hyphens.
+			continue
+		case unicode.IsSpace(c):
+			c = ' '
+		case unicode.IsControl(c) || c == unicode.ReplacementChar:
+			continue
+		}
+		out.WriteRune(c)
+		column++
+	}
+	return strings.TrimRightFunc(out.String(), unicode.IsSpace)
+}
+
+// writePlainText writes the paste read from r to w as opts asks.
+func writePlainText(w io.Writer, r io.Reader, opts PlainTextOptions) error {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, int(PASTE_MAXIMUM_LENGTH)+1)
+	for scanner.Scan() {
+		lines = append(lines, cleanPlainTextLine(scanner.Text(), opts.TabWidth))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	bw := bufio.NewWriter(w)
+	width := len(strconv.Itoa(len(lines)))
+	for i, line := range lines {
+		if opts.LineNumbers {
+			if line == "" {
+				fmt.Fprintf(bw, "%*d |\n", width, i+1)
+			} else {
+				fmt.Fprintf(bw, "%*d | %s\n", width, i+1, line)
+			}
+		} else {
+			bw.WriteString(line + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// plainTextOptionsForRequest reads PlainTextOptions from r's form values:
+// line_numbers, and tabs (the tab width; the language's, or 4, if unset).
+func plainTextOptionsForRequest(r *http.Request, p *Paste) (PlainTextOptions, error) {
+	opts := PlainTextOptions{LineNumbers: r.FormValue("line_numbers") != ""}
+	if v := r.FormValue("tabs"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > MaxPlainTextTabWidth {
+			return opts, PasteInputError{"tabs", fmt.Sprintf("must be a number from 0 to %d", MaxPlainTextTabWidth)}
+		}
+		opts.TabWidth = n
+		return opts, nil
+	}
+	language := p.Language
+	if language == nil {
+		language = unknownLanguage
+	}
+	settings, _ := languageSettingsStore.Settings(language.ID)
+	opts.TabWidth = settings.TabWidth
+	if opts.TabWidth == 0 {
+		opts.TabWidth = 4
+	}
+	return opts, nil
+}
+
+func pastePlainTextHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	if p.direct {
+		panic(apiError(APIErrorValidation, "paste %v is too large to export; download it instead", p.ID))
+	}
+	opts, err := plainTextOptionsForRequest(r, p)
+	if err != nil {
+		panic(err)
+	}
+
+	out, done, err := meterRawBody(w, r, p)
+	if err != nil {
+		panic(err)
+	}
+	defer done()
+
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	reader, err := p.Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	healthServer.IncrementMetric("paste.plain_text_exported")
+	writePlainText(out, reader, opts)
+}
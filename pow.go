@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/securecookie"
+)
+
+// Anonymous API clients can be made to do some work before creating a
+// paste, in place of a CAPTCHA. Challenges are signed and carry their own
+// difficulty and expiry, so issuing them takes no state; spent challenges
+// are remembered until they expire so that a solution can't be replayed.
+
+var powKey []byte
+
+// spentProofOfWorkMu is held across looking up a challenge in ephStore and
+// spending it, so that two requests can't spend the same one.
+var spentProofOfWorkMu sync.Mutex
+
+// proofOfWorkDifficulty returns the difficulty r's challenges must have:
+// harder for addresses with a poor reputation.
+func proofOfWorkDifficulty(r *http.Request) int {
+	difficulty := instanceConfig.ProofOfWork.Difficulty
+	if ipSuspect(r) {
+		difficulty += instanceConfig.Reputation.PowPenalty
+	}
+	return difficulty
+}
+
+// newProofOfWorkChallenge returns "<expiry>.<difficulty>.<random>.<mac>".
+func newProofOfWorkChallenge(r *http.Request) (challenge string, difficulty int, expires time.Time) {
+	random, err := generateRandomBase32String(10, 16)
+	if err != nil {
+		panic(err)
+	}
+	difficulty = proofOfWorkDifficulty(r)
+	expires = time.Now().Add(instanceConfig.ProofOfWork.Lifetime.Duration())
+	message := fmt.Sprintf("%d.%d.%s", expires.Unix(), difficulty, random)
+	mac := base32Encoder.EncodeToString(constructMAC([]byte(message), powKey))
+	return message + "." + mac, difficulty, expires
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b == 0 {
+			n += 8
+			continue
+		}
+		for b&0x80 == 0 {
+			n++
+			b <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// checkProofOfWork verifies that nonce solves challenge, which must be as
+// hard as r's challenges are, and spends the challenge.
+func checkProofOfWork(r *http.Request, challenge, nonce string) error {
+	if challenge == "" || nonce == "" {
+		return fmt.Errorf("this request requires proof of work (pow_challenge and pow_nonce)")
+	}
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return fmt.Errorf("malformed proof-of-work challenge")
+	}
+	mac, err := base32Encoder.DecodeString(parts[3])
+	if err != nil || !checkMAC([]byte(strings.Join(parts[:3], ".")), mac, powKey) {
+		return fmt.Errorf("invalid proof-of-work challenge")
+	}
+	expiry, _ := strconv.ParseInt(parts[0], 10, 64)
+	expires := time.Unix(expiry, 0)
+	if time.Now().After(expires) {
+		return fmt.Errorf("proof-of-work challenge has expired")
+	}
+	difficulty, _ := strconv.Atoi(parts[1])
+	if difficulty < proofOfWorkDifficulty(r) {
+		return fmt.Errorf("proof-of-work challenge is too easy; get a new one")
+	}
+
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return fmt.Errorf("pow_nonce does not solve the challenge")
+	}
+
+	spentProofOfWorkMu.Lock()
+	defer spentProofOfWorkMu.Unlock()
+	if _, spent := ephStore.Get("POW|" + challenge); spent {
+		return fmt.Errorf("proof-of-work challenge has already been used")
+	}
+	ephStore.Put("POW|"+challenge, true, expires.Sub(time.Now()))
+	return nil
+}
+
+func proofOfWorkChallengeResponse(r *http.Request) map[string]interface{} {
+	challenge, difficulty, expires := newProofOfWorkChallenge(r)
+	return map[string]interface{}{
+		"challenge":  challenge,
+		"difficulty": difficulty,
+		"algorithm":  "sha256",
+		"expires":    expires.UTC(),
+	}
+}
+
+func apiProofOfWorkHandler(w http.ResponseWriter, r *http.Request) {
+	if !instanceConfig.ProofOfWork.Enabled {
+		writeAPIError(w, apiError(APIErrorNotImplemented, "proof of work is not enabled on this instance"))
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, proofOfWorkChallengeResponse(r))
+}
+
+// proofOfWorkHandler requires anonymous requests to carry a solved
+// challenge. Refusals include a fresh challenge.
+type proofOfWorkHandler struct {
+	http.Handler
+}
+
+func (h proofOfWorkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if instanceConfig.ProofOfWork.Enabled && GetUser(r) == nil {
+		if err := checkProofOfWork(r, r.FormValue("pow_challenge"), r.FormValue("pow_nonce")); err != nil {
+			healthServer.IncrementMetric("pow.refused")
+			writeAPIError(w, apiError(APIErrorForbidden, "%v", err).With("pow", proofOfWorkChallengeResponse(r)))
+			return
+		}
+		healthServer.IncrementMetric("pow.accepted")
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+
+	keyFile := filepath.Join(arguments.root, "pow.key")
+	key, err := SlurpFile(keyFile)
+	if err != nil {
+		key = securecookie.GenerateRandomKey(32)
+		err = ioutil.WriteFile(keyFile, key, 0600)
+		if err != nil {
+			glog.Fatal("pow.key not found, and an attempt to create one failed: ", err)
+		}
+	}
+	powKey = key
+}
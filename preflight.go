@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Before the server binds its listener, it runs its preflight checks: that
+// config.yml was accepted, that its stores can be written to (and the cold
+// store reached), that its languages and TLS certificate load, and that the
+// templates and highlighters work. Running them warms the caches the first
+// requests would otherwise fill (the parsed templates; the highlighter's
+// interpreter and modules, in the page cache). A failed check that would
+// break every request stops the server, with what to fix; the others are
+// logged as warnings.
+
+// preflightTimeout bounds each check that waits on something else.
+const preflightTimeout = 30 * time.Second
+
+type PreflightCheck struct {
+	Name string
+	// Fatal checks keep the server from starting when they fail.
+	Fatal bool
+	fn    func() error
+}
+
+var preflightChecks []PreflightCheck
+
+func RegisterPreflightCheck(name string, fatal bool, fn func() error) {
+	preflightChecks = append(preflightChecks, PreflightCheck{Name: name, Fatal: fatal, fn: fn})
+}
+
+// runPreflight runs every preflight check, reporting whether the server
+// may start.
+func runPreflight() bool {
+	ok := true
+	warnings := 0
+	start := time.Now()
+	for _, check := range preflightChecks {
+		err := runPreflightCheck(check)
+		switch {
+		case err == nil:
+			glog.Info("Preflight: ", check.Name, ": ok")
+		case check.Fatal:
+			glog.Error("Preflight: ", check.Name, ": ", err)
+			ok = false
+		default:
+			glog.Warning("Preflight: ", check.Name, ": ", err)
+			warnings++
+		}
+	}
+	healthServer.SetMetric("preflight.warnings", warnings)
+	glog.Infof("Preflight checks finished in %v.", time.Since(start).Round(time.Millisecond))
+	return ok
+}
+
+func runPreflightCheck(check PreflightCheck) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	return check.fn()
+}
+
+// checkWritable makes sure files can be created in dir.
+func checkWritable(dir string) error {
+	file, err := ioutil.TempFile(dir, ".preflight-")
+	if err != nil {
+		return fmt.Errorf("can't write to %s (check that it exists and that this user owns it): %v", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func preflightStorage() error {
+	dirs := []string{
+		arguments.root,
+		filepath.Join(arguments.root, "pastes"),
+		filepath.Join(arguments.root, "accounts"),
+		filepath.Join(arguments.root, "sessions"),
+	}
+	dirs = append(dirs, instanceConfig.Store.Replicas...)
+	for _, dir := range dirs {
+		if err := checkWritable(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func preflightColdStore() error {
+	cold := filesystemPasteStore.ColdStore
+	if cold == nil {
+		return nil
+	}
+	key := instanceConfig.Archive.Prefix + "preflight"
+	done := make(chan error, 1)
+	go func() {
+		if err := cold.Put(key, strings.NewReader("preflight"), 9); err != nil {
+			done <- fmt.Errorf("can't write to the cold store (check archive.directory or archive.s3): %v", err)
+			return
+		}
+		r, err := cold.Get(key)
+		if err != nil {
+			done <- fmt.Errorf("can't read back from the cold store: %v", err)
+			return
+		}
+		r.Close()
+		done <- cold.Delete(key)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(preflightTimeout):
+		return fmt.Errorf("the cold store didn't answer in %v", preflightTimeout)
+	}
+}
+
+func preflightTLS() error {
+	hc := instanceConfig.HTTP
+	if hc.TLSCert == "" {
+		return nil
+	}
+	if _, err := tls.LoadX509KeyPair(hc.TLSCert, hc.TLSKey); err != nil {
+		return fmt.Errorf("can't load http.tls_cert and http.tls_key: %v", err)
+	}
+	return nil
+}
+
+func preflightLanguages() error {
+	if len(languageConfig.languageMap) == 0 {
+		return fmt.Errorf("languages.yml defines no languages")
+	}
+	if languageConfig.Formatters["default"] == nil {
+		return fmt.Errorf("languages.yml defines no default formatter")
+	}
+	for name, formatter := range languageConfig.Formatters {
+		if formatter.fn == nil {
+			return fmt.Errorf("formatter %s in languages.yml has an unknown func %q", name, formatter.Func)
+		}
+	}
+	return nil
+}
+
+func preflightTemplates() error {
+	// With -rebuild, the templates are parsed again for every request;
+	// parse them once here anyway, so that mistakes surface now.
+	if err := ExecuteTemplate(ioutil.Discard, "tmpl_page", &RenderContext{Request: httptest.NewRequest("GET", "/", nil), Page: "index"}); err != nil {
+		return fmt.Errorf("can't render the front page: %v", err)
+	}
+	return nil
+}
+
+// warmFormatter runs formatter once, so that its first paste isn't slow
+// (or broken).
+func warmFormatter(name string, formatter *Formatter) error {
+	if formatter.Func == "commandFormatter" && len(formatter.Args) > 0 {
+		if _, err := exec.LookPath(formatter.Args[0]); err != nil {
+			return fmt.Errorf("formatter %s: %v", name, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	if out, err := formatter.Format(ctx, strings.NewReader("preflight\n"), "text"); err != nil {
+		return fmt.Errorf("formatter %s failed: %v %s", name, err, out)
+	}
+	return nil
+}
+
+func preflightHighlighter() error {
+	return warmFormatter("default", languageConfig.Formatters["default"])
+}
+
+func preflightFormatters() error {
+	var names []string
+	for name := range languageConfig.Formatters {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var failed []string
+	for _, name := range names {
+		if err := warmFormatter(name, languageConfig.Formatters[name]); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("pastes in their languages won't be highlighted: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func init() {
+	RegisterPreflightCheck("configuration", true, func() error {
+		if configurationError != nil {
+			return fmt.Errorf("config.yml was refused: %v", configurationError)
+		}
+		return nil
+	})
+	RegisterPreflightCheck("storage", true, preflightStorage)
+	RegisterPreflightCheck("cold store", true, preflightColdStore)
+	RegisterPreflightCheck("tls", true, preflightTLS)
+	RegisterPreflightCheck("languages", true, preflightLanguages)
+	RegisterPreflightCheck("templates", true, preflightTemplates)
+	RegisterPreflightCheck("highlighter", true, preflightHighlighter)
+	RegisterPreflightCheck("formatters", false, preflightFormatters)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/securecookie"
+)
+
+// The privacy settings govern every record spectre keeps about a visitor:
+// how IP addresses are stored (whole, truncated to a network prefix, or
+// as a keyed hash), and how long anything about a visit may be kept.
+// Stores keep retention in check as they go; a periodic sweep removes
+// whatever still outlives it (after the setting is lowered, say).
+//
+// Operators with strict privacy postures can turn analytics off, leaving
+// nothing recorded about how particular pastes are viewed, or by whom:
+// access logs stop, and the sweep clears those already kept. Aggregate
+// metrics, and the per-paste state features depend on (view limits,
+// bandwidth allowances), are unaffected.
+
+const (
+	IPModeFull     = "full"
+	IPModeTruncate = "truncate"
+	IPModeHash     = "hash"
+)
+
+var privacyKey []byte
+
+// anonymizeIP returns ip in the form in which it may be stored.
+func anonymizeIP(ip string) string {
+	// X-Forwarded-For may carry a whole chain; the client is first.
+	if i := strings.IndexByte(ip, ','); i >= 0 {
+		ip = ip[:i]
+	}
+	ip = strings.TrimSpace(ip)
+
+	switch instanceConfig.Privacy.IPMode {
+	case IPModeTruncate:
+		parsed := net.ParseIP(strings.Trim(ip, "[]"))
+		if parsed == nil {
+			return hashIP(ip)
+		}
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(instanceConfig.Privacy.IPv4Prefix, 32)).String()
+		}
+		return parsed.Mask(net.CIDRMask(instanceConfig.Privacy.IPv6Prefix, 128)).String()
+	case IPModeHash:
+		return hashIP(ip)
+	}
+	return ip
+}
+
+// hashIP returns a keyed hash of ip. The key changes every
+// privacy.hash_rotation, after which hashes of the same address differ.
+func hashIP(ip string) string {
+	key := privacyKey
+	if rotation := instanceConfig.Privacy.HashRotation.Duration(); rotation > 0 {
+		period := time.Now().UnixNano() / int64(rotation)
+		key = constructMAC([]byte(strconv.FormatInt(period, 10)), privacyKey)
+	}
+	return "h:" + base32Encoder.EncodeToString(constructMAC([]byte(ip), key))[:16]
+}
+
+// StoredIPForRequest returns the request's source address in the form in
+// which it may be stored; use it for anything that outlives the request.
+func StoredIPForRequest(r *http.Request) string {
+	return anonymizeIP(SourceIPForRequest(r))
+}
+
+// privacyRetention caps d, the lifetime of a record about a visitor, at
+// privacy.retention.
+func privacyRetention(d time.Duration) time.Duration {
+	if limit := instanceConfig.Privacy.Retention.Duration(); limit > 0 && (d <= 0 || d > limit) {
+		return limit
+	}
+	return d
+}
+
+// SweepPrivacy removes the records that have outlived privacy.retention,
+// and the access logs if analytics are off, returning how many it removed.
+func SweepPrivacy() int {
+	n := 0
+	if !instanceConfig.Privacy.Analytics {
+		if cleared := accessLogStore.Clear(); cleared > 0 {
+			glog.Info("PRIVACY: Removed ", cleared, " access log events, as analytics are off")
+			n += cleared
+		}
+	}
+	if retention := instanceConfig.Privacy.Retention.Duration(); retention > 0 {
+		cutoff := time.Now().Add(-retention)
+		pruned := abuseBlockStore.PruneBefore(cutoff)
+		pruned += accessLogStore.PruneBefore(cutoff)
+		if pruned > 0 {
+			glog.Info("PRIVACY: Removed ", pruned, " records older than ", retention)
+		}
+		n += pruned
+	}
+	healthServer.SetMetric("privacy.last_sweep.removed", n)
+	return n
+}
+
+func init() {
+	RegisterJob("privacy-sweep", "Remove records that have outlived privacy.retention, and access logs while privacy.analytics is off.", func(run *JobRun) error {
+		run.SetResult("removed %d records", SweepPrivacy())
+		return nil
+	})
+
+	arguments.register()
+	arguments.parse()
+
+	keyFile := filepath.Join(arguments.root, "privacy.key")
+	key, err := SlurpFile(keyFile)
+	if err != nil {
+		key = securecookie.GenerateRandomKey(32)
+		err = ioutil.WriteFile(keyFile, key, 0600)
+		if err != nil {
+			glog.Fatal("privacy.key not found, and an attempt to create one failed: ", err)
+		}
+	}
+	privacyKey = key
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A private instance shows nothing to anyone who hasn't logged in. Logging
+// in itself, invite links, the static assets the login page needs and the
+// replication and SCIM endpoints (which carry their own credentials) are left open,
+// as is the instance's announcement, which says that it is private. So are
+// raw bodies requested with a valid signature.
+
+var privateInstanceExemptPrefixes = []string{
+	"/auth/",
+	"/invite/",
+	"/partial/login_logout",
+	"/replication/",
+	"/scim/",
+	"/.well-known/spectre",
+}
+
+func isPublicAsset(path string) bool {
+	f, err := http.Dir("public").Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	return err == nil && !fi.IsDir()
+}
+
+type privateInstanceHandler struct {
+	http.Handler
+}
+
+func (h privateInstanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !instanceConfig.Instance.Private || GetUser(r) != nil {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	for _, prefix := range privateInstanceExemptPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			h.Handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	// Signed raw URLs stand in for the login.
+	if rawSignatureValid(r) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path != "/" && isPublicAsset(r.URL.Path) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	healthServer.IncrementMetric("request.private_denied")
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, apiError(APIErrorUnauthorized, "this instance requires you to log in"))
+		return
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	RenderPage(w, r, "login_required", nil)
+}
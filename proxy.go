@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A request's source address is the address it came from, unless that is
+// one of http.trusted_proxies: only then are CF-Connecting-IP and
+// X-Forwarded-For believed, since anyone else can send them with whatever
+// they like. X-Forwarded-For is read from the right, each trusted proxy
+// having appended the address it saw; the first hop that isn't a trusted
+// proxy is the client.
+
+// parseProxyRange parses a trusted proxy, given as a CIDR or as a single
+// address.
+func parseProxyRange(s string) (*net.IPNet, error) {
+	if strings.ContainsRune(s, '/') {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an address or a CIDR", s)
+	}
+	bits := 128
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func validateProxiesConfig(c *_Configuration) error {
+	for _, p := range c.HTTP.TrustedProxies {
+		if _, err := parseProxyRange(p); err != nil {
+			return fmt.Errorf("http.trusted_proxies: %v", err)
+		}
+	}
+	return nil
+}
+
+// isTrustedProxy reports whether ip is one of http.trusted_proxies.
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, p := range instanceConfig.HTTP.TrustedProxies {
+		if ipnet, err := parseProxyRange(p); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHopIP(s string) net.IP {
+	return net.ParseIP(strings.Trim(strings.TrimSpace(s), "[]"))
+}
+
+// SourceIPForRequest returns the address r came from, as described above.
+func SourceIPForRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := parseHopIP(host)
+	if !isTrustedProxy(remote) {
+		return host
+	}
+
+	if ip := parseHopIP(r.Header.Get("CF-Connecting-IP")); ip != nil {
+		return ip.String()
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHopIP(hops[i])
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// sourceIPVerified reports whether SourceIPForRequest names the client, rather
+// than falling back to a trusted proxy in front of it.
+func sourceIPVerified(r *http.Request) bool {
+	return !isTrustedProxy(parseHopIP(SourceIPForRequest(r)))
+}
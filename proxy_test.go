@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSourceIPForRequest(t *testing.T) {
+	saved := instanceConfig.HTTP.TrustedProxies
+	defer func() { instanceConfig.HTTP.TrustedProxies = saved }()
+	instanceConfig.HTTP.TrustedProxies = []string{"10.0.0.0/8", "::1"}
+
+	for _, tc := range []struct {
+		remote, cf, xff string
+		want            string
+	}{
+		// Anyone but a trusted proxy is who they connect as.
+		{"203.0.113.9:4000", "", "", "203.0.113.9"},
+		{"203.0.113.9:4000", "198.51.100.1", "198.51.100.2", "203.0.113.9"},
+		// A trusted proxy's headers are believed.
+		{"10.0.0.1:4000", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"10.0.0.1:4000", "", "198.51.100.2", "198.51.100.2"},
+		{"[::1]:4000", "", "2001:db8::1", "2001:db8::1"},
+		// Hops the client made up are to the left of the ones it can't.
+		{"10.0.0.1:4000", "", "192.0.2.66, 198.51.100.2, 10.0.0.7", "198.51.100.2"},
+		// With nothing but trusted proxies or garbage, the proxy is all
+		// there is to go on.
+		{"10.0.0.1:4000", "", "10.0.0.2", "10.0.0.1"},
+		{"10.0.0.1:4000", "", "192.0.2.66, not-an-address", "10.0.0.1"},
+		{"10.0.0.1:4000", "", "", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.cf != "" {
+			r.Header.Set("CF-Connecting-IP", tc.cf)
+		}
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := SourceIPForRequest(r); got != tc.want {
+			t.Errorf("from %s (CF-Connecting-IP %q, X-Forwarded-For %q): got %s, want %s", tc.remote, tc.cf, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestValidateProxiesConfig(t *testing.T) {
+	c := defaultConfiguration()
+	if err := validateProxiesConfig(&c); err != nil {
+		t.Fatalf("default trusted proxies refused: %v", err)
+	}
+	c.HTTP.TrustedProxies = []string{"10.0.0.0/8", "proxy.example.com"}
+	if err := validateProxiesConfig(&c); err == nil {
+		t.Errorf("a host name was accepted as a trusted proxy")
+	}
+}
@@ -64,7 +64,7 @@
 				this.clearPreference("defaultLanguage");
 			},
 			defaultExpiration: function() {
-				return this.getPreference("defaultExpiration", "-1");
+				return this.getPreference("defaultExpiration", null);
 			},
 			setDefaultExpiration: function(value) {
 				this.setPreference("defaultExpiration", value);
@@ -181,6 +181,13 @@
 				if(flash.type) {
 					newFlash.addClass('well-' + flash.type);
 				}
+				var duration = 4000;
+				if(flash.action) {
+					var form = $('<form method="POST"><button class="btn btn-link" type="submit"></button></form>');
+					form.attr("action", flash.action).find("button").text(flash.action_label);
+					newFlash.find('p').append(" ").append(form);
+					duration = 10000;
+				}
 				container.append(newFlash);
 				container.show();
 
@@ -191,7 +198,7 @@
 							container.hide();
 							newFlash.remove();
 						});
-					}, 4000);
+					}, duration);
 				}, 500);
 			},
 		};
@@ -225,11 +232,18 @@ $(function() {
 		});
 		var lang = Spectre.languageNamed(langbox.data("selected")) ||
 				Spectre.defaultLanguage() ||
+				Spectre.languageNamed(langbox.data("default")) ||
 				Spectre.languageNamed("text");
 		langbox.select2("data", lang);
 
 		if(context === "new") {
-			pasteForm.find("input[name='expire']").val(Spectre.defaultExpiration());
+			// The saved expiration may no longer be on offer, and gives way
+			// to the referring site's.
+			var savedExpiration = Spectre.defaultExpiration();
+			if(!pasteForm.find("input[name='expire']").is("[data-referred]") &&
+					$("#expireModal button[data-value='"+savedExpiration+"']").length > 0) {
+				pasteForm.find("input[name='expire']").val(savedExpiration);
+			}
 
 			var optModal = $("#optionsModal");
 			optModal.modal({show: false});
@@ -346,6 +360,37 @@ $(function() {
 		$("#expirationButton").on("click", function() {
 			expModal.modal("show");
 		});
+
+		var sealInput = $("#sealInput");
+		var sealValue = pasteForm.find("input[name='sealed_until']");
+		var wasSealed = sealValue.val() !== "";
+		var pad = function(n) { return (n < 10 ? "0" : "") + n; };
+		if(wasSealed) {
+			// datetime-local wants the local time, without a zone.
+			var d = new Date(sealValue.val());
+			sealInput.val(d.getFullYear()+"-"+pad(d.getMonth()+1)+"-"+pad(d.getDate())+"T"+pad(d.getHours())+":"+pad(d.getMinutes()));
+		}
+		sealInput.on("change", function() {
+			var d = new Date(sealInput.val());
+			sealValue.val(isNaN(d.getTime()) ? (wasSealed ? "none" : "") : d.toISOString().replace(/\.\d+Z$/, "Z"));
+		});
+		$("#unsealButton").on("click", function() {
+			sealInput.val("");
+			sealValue.val(wasSealed ? "none" : "");
+		});
+
+		var viewsInput = $("#viewsInput");
+		var viewsValue = pasteForm.find("input[name='views']");
+		var wasLimited = viewsValue.val() !== "";
+		viewsInput.val(viewsValue.val());
+		viewsInput.on("change", function() {
+			var n = parseInt(viewsInput.val(), 10);
+			viewsValue.val(n > 0 ? String(n) : (wasLimited ? "none" : ""));
+		});
+		$("#unlimitViewsButton").on("click", function() {
+			viewsInput.val("");
+			viewsValue.val(wasLimited ? "none" : "");
+		});
 	})();
 
 	// Common for the following functions.
@@ -357,6 +402,7 @@ $(function() {
 		if(code.length > 0) {
 			var linebar = $(document.createElement('div'))
 					.addClass("line-highlight-bar")
+					.attr("aria-hidden", "true")
 					.hide()
 					.appendTo('body');
 			var permabar = linebar
@@ -372,13 +418,17 @@ $(function() {
 					.show();
 			};
 
+			// Screen readers hear which line is highlighted, as they can't see the bar.
+			var lineStatus = $("#line-status");
 			var setSelectedLineNumber = function(line) {
 				if(typeof line !== 'undefined') {
 					permabar.data("cur-line", line);
 					history.replaceState({"line":line}, "", "#L"+line);
+					lineStatus.text("Line "+line+" highlighted");
 				} else {
 					permabar.removeData("cur-line");
 					history.replaceState(null, "", "#");
+					lineStatus.text("Line highlight cleared");
 				}
 			};
 
@@ -391,7 +441,17 @@ $(function() {
 				return undefined;
 			};
 
-			lineNumberTrough.fillWithLineNumbers((code.text().match(/\n/g)||[]).length+1, function() {
+			// Lines with syntax errors are marked, with the error as their title.
+			var markDiagnostics = function() {
+				$.each(lineNumberTrough.data("diagnostics") || [], function(i, d) {
+					$("span:nth-child("+d.line+")", lineNumberTrough)
+						.addClass("line-error")
+						.attr("title", (d.column ? "Column "+d.column+": " : "")+d.message);
+				});
+			};
+
+			var bindLineNumbers = function() {
+				markDiagnostics();
 				lineNumberTrough.children().mouseenter(function() {
 					positionLinebar.call(this, linebar);
 				}).mouseleave(function() {
@@ -406,8 +466,17 @@ $(function() {
 					setSelectedLineNumber(line);
 					positionLinebar.call(this, permabar);
 				});
+			};
+
+			// Folded pastes add lines as they are fetched.
+			code.on("lines-added", function() {
+				lineNumberTrough.fillWithLineNumbers((code.text().match(/\n/g)||[]).length+1, bindLineNumbers);
+			});
+
+			lineNumberTrough.fillWithLineNumbers((code.text().match(/\n/g)||[]).length+1, function() {
+				bindLineNumbers();
 
-				$(window).on("load popstate", function() {
+				$(window).on("load popstate", function(e) {
 					var n = lineFromHash(window.location.hash);
 					if(n) {
 						var linespan = $("span:nth-child("+n+")", lineNumberTrough);
@@ -415,6 +484,10 @@ $(function() {
 							setSelectedLineNumber(n);
 							positionLinebar.call(linespan.get(0), permabar);
 							linespan.scrollMinimal();
+							// A link to a line leaves the keyboard in the paste.
+							if(e.type === "load") {
+								code.get(0).focus({preventScroll: true});
+							}
 						}
 					}
 				});
@@ -437,6 +510,102 @@ $(function() {
 			});
 		}
 	})();
+	(function(){
+		// Folded pastes fetch the rest of their lines a chunk at a time, as
+		// the reader nears the end of what has been fetched (or follows a
+		// link to a line not fetched yet).
+		if(code.length === 0 || !code.data("lines-url")) return;
+
+		var total = 0+code.data("total-lines"), chunkLines = 0+code.data("chunk-lines");
+		var loaded = chunkLines, loading = false;
+		var loadMore = function(done) {
+			if(loading || loaded >= total) return;
+			loading = true;
+			$.getJSON(code.data("lines-url"), {start: loaded+1}).done(function(data) {
+				var lines = code.children("code");
+				(lines.length > 0 ? lines : code).append("\n"+data.html);
+				loaded = data.end;
+				code.trigger("lines-added");
+				if(done) done();
+			}).always(function() {
+				loading = false;
+			});
+		};
+
+		$(window).on("scroll resize", function() {
+			if($(window).scrollTop() + 2*$(window).height() > code.offset().top + code.outerHeight()) {
+				loadMore();
+			}
+		});
+
+		// Fetches lines up to target, then shows the line in the hash.
+		var loadTo = function(target) {
+			if(loaded < target && loaded < total) {
+				loadMore(function() { loadTo(target); });
+			} else {
+				$(window).trigger("popstate");
+			}
+		};
+		code.on("need-line", function(e, line) {
+			loadTo(line);
+		});
+
+		var v = window.location.hash.match(/^#L(\d+)/);
+		if(v && parseInt(v[1], 10) > loaded) {
+			loadTo(parseInt(v[1], 10));
+		}
+	})();
+	(function(){
+		// The find box asks the server, which has the whole paste even
+		// when the page doesn't.
+		var findForm = $("#findForm");
+		if(findForm.length === 0 || code.length === 0) return;
+		findForm.removeClass("hide");
+
+		var status = findForm.find(".paste-find-status");
+		var matches = [], truncated = false, current = -1, lastQuery = null;
+		var showMatch = function(i) {
+			current = (i + matches.length) % matches.length;
+			var line = matches[current].line;
+			status.text((current+1) + " of " + matches.length + (truncated ? "+" : ""));
+			history.replaceState({"line":line}, "", "#L"+line);
+			if(code.data("lines-url")) {
+				code.trigger("need-line", [line]);
+			} else {
+				$(window).trigger("popstate");
+			}
+		};
+
+		findForm.on("submit", function(e) {
+			e.preventDefault();
+			var query = findForm.serialize();
+			if(!findForm.find("[name=q]").val()) return;
+			if(query === lastQuery && matches.length > 0) {
+				showMatch(current+1);
+				return;
+			}
+			lastQuery = query;
+			$.getJSON(findForm.attr("action"), query).done(function(data) {
+				matches = data.matches;
+				truncated = data.truncated;
+				if(matches.length === 0) {
+					status.text("No matches");
+					return;
+				}
+				showMatch(0);
+			}).fail(function(xhr) {
+				matches = [];
+				status.text((xhr.responseJSON && xhr.responseJSON.error) || "The search failed.");
+			});
+		});
+		findForm.find("[data-find]").on("click", function() {
+			if(matches.length === 0) {
+				findForm.submit();
+				return;
+			}
+			showMatch(current + ($(this).data("find") === "next" ? 1 : -1));
+		});
+	})();
 	(function(){
 		if(codeeditor.length > 0) {
 			codeeditor.keydown(function(e) {
@@ -512,6 +681,36 @@ $(function() {
 	});
 });
 
+$(function(){
+	// Pages without a content block skip to the paste or its editor.
+	if($("#content").length === 0) {
+		var target = $("#code, #code-editor").first();
+		if(target.length > 0) {
+			$("a.skip-link").attr("href", "#"+target.attr("id"));
+		} else {
+			$("a.skip-link").remove();
+		}
+	}
+
+	// With accessibility.audit, controls and images nobody could name are
+	// outlined, and listed in the console.
+	if(document.documentElement.hasAttribute("data-a11y-audit")) {
+		var problems = $("a, button, input:not([type=hidden]), select, textarea, img, [role=img]").filter(function() {
+			var el = $(this);
+			if(el.attr("aria-hidden") === "true" || el.attr("aria-label") || el.attr("aria-labelledby")) return false;
+			if(this.tagName === "IMG") return !el.attr("alt") && el.attr("alt") !== "";
+			if(el.is("input, select, textarea")) {
+				return !el.attr("title") && (!this.id || $("label[for='"+this.id+"']").length === 0) && el.closest("label").length === 0;
+			}
+			return $.trim(el.text()) === "" && !el.attr("title") && !el.val();
+		});
+		problems.addClass("a11y-audit-problem");
+		if(problems.length > 0 && window.console) {
+			console.warn("Accessibility audit: "+problems.length+" element(s) without an accessible name", problems.get());
+		}
+	}
+});
+
 $(function(){
 	if(docCookies.hasItem("flash")) {
 		var flash = JSON.parse(atob(docCookies.getItem("flash")));
@@ -519,3 +718,33 @@ $(function(){
 		Spectre.displayFlash(flash);
 	}
 });
+
+$(function(){
+	if("serviceWorker" in navigator) {
+		navigator.serviceWorker.register("/sw.js");
+	}
+
+	// Shares kept by the service worker while we were offline are opened,
+	// one at a time, in the new-paste form.
+	if(!("caches" in window) || !navigator.onLine) {
+		return;
+	}
+	caches.open("spectre-shares").then(function(cache) {
+		return cache.keys().then(function(keys) {
+			if(keys.length == 0) {
+				return;
+			}
+			return cache.match(keys[0]).then(function(resp) {
+				return resp.json();
+			}).then(function(share) {
+				return cache.delete(keys[0]).then(function() {
+					var form = $("<form>", {method: "POST", action: "/share"}).hide();
+					$.each(share, function(name, value) {
+						form.append($("<input>", {type: "hidden", name: name, value: value}));
+					});
+					form.appendTo("body").submit();
+				});
+			});
+		});
+	});
+});
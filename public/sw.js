@@ -0,0 +1,42 @@
+// spectre's service worker. It keeps shares (see share.go) that can't be
+// sent for want of a connection, and answers them with a page saying so;
+// application.js submits them again once the browser is back online.
+"use strict";
+
+var OFFLINE_CACHE = "spectre-offline";
+var OFFLINE_PAGE = "/share-offline.html";
+var SHARE_QUEUE = "spectre-shares";
+
+self.addEventListener("install", function(event) {
+	event.waitUntil(caches.open(OFFLINE_CACHE).then(function(cache) {
+		return cache.add(OFFLINE_PAGE);
+	}));
+	self.skipWaiting();
+});
+
+self.addEventListener("activate", function(event) {
+	event.waitUntil(self.clients.claim());
+});
+
+self.addEventListener("fetch", function(event) {
+	var req = event.request;
+	if(req.method !== "POST" || new URL(req.url).pathname !== "/share") {
+		return;
+	}
+
+	var queued = req.clone();
+	event.respondWith(fetch(req).catch(function() {
+		return queued.formData().then(function(form) {
+			var share = {
+				title: form.get("title") || "",
+				text: form.get("text") || "",
+				url: form.get("url") || "",
+			};
+			return caches.open(SHARE_QUEUE).then(function(cache) {
+				return cache.put("/share/queued/" + Date.now(), new Response(JSON.stringify(share)));
+			});
+		}).then(function() {
+			return caches.match(OFFLINE_PAGE);
+		});
+	}));
+});
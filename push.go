@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// A paste can be pushed to another spectre instance, one of those named in
+// push.peers, to move it from a scratch instance to one that keeps things
+// longer:
+//
+//	POST /api/v1/pastes/{id}/push
+//
+//	peer=archive[&token=...][&expire=...]
+//
+// The paste is created on the peer through its extension endpoint (see
+// extension.go), authenticated with the token configured for the peer or,
+// if one is given, the caller's own extension token there. The body, its
+// language, title and license go along, and the paste's own URL as its
+// source. Unless the caller chooses an expiration the peer offers, the copy
+// is given the shortest one that keeps it at least as long as the original
+// would have lasted (or none, if the original never expires and the peer
+// allows that). The copy's URL is recorded with the paste.
+
+// PushPeer is an instance pastes may be pushed to.
+type PushPeer struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Token is an extension token on the peer, used when the caller
+	// doesn't give one of their own.
+	Token string `yaml:"token"`
+}
+
+func validatePushConfig(c *_Configuration) error {
+	seen := make(map[string]bool)
+	for _, peer := range c.Push.Peers {
+		if peer.Name == "" || seen[peer.Name] {
+			return fmt.Errorf("push peer %q needs a name of its own", peer.Name)
+		}
+		seen[peer.Name] = true
+		if u, err := url.Parse(peer.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("push peer %q: url %q is not an http or https URL", peer.Name, peer.URL)
+		}
+	}
+	return nil
+}
+
+func pushPeerNamed(name string) *PushPeer {
+	for i, peer := range instanceConfig.Push.Peers {
+		if peer.Name == name {
+			return &instanceConfig.Push.Peers[i]
+		}
+	}
+	return nil
+}
+
+// PushError is a peer's refusal of a pushed paste.
+type PushError struct {
+	Peer    string
+	Message string
+}
+
+func (e PushError) Error() string {
+	return fmt.Sprintf("%s refused the paste: %s", e.Peer, e.Message)
+}
+
+func (e PushError) StatusCode() int {
+	return http.StatusBadGateway
+}
+
+func (e PushError) APIErrorCode() string {
+	return APIErrorUpstream
+}
+
+var pushClient = &http.Client{Timeout: 30 * time.Second}
+
+// peerRequest makes a request of peer's API, decoding its answer into v.
+func peerRequest(peer *PushPeer, req *http.Request, v interface{}) error {
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return PushError{peer.Name, err.Error()}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return PushError{peer.Name, err.Error()}
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return PushError{peer.Name, apiErr.Error}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return PushError{peer.Name, "unintelligible response: " + err.Error()}
+	}
+	return nil
+}
+
+// peerExpiration chooses the expiration, among those peer offers, that
+// keeps a copy of p around at least as long as p.
+func peerExpiration(peer *PushPeer, p *Paste) (string, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(peer.URL, "/")+"/api/v1/expirations", nil)
+	if err != nil {
+		return "", err
+	}
+	var offered struct {
+		Presets []ExpirationPreset `json:"presets"`
+		Never   bool               `json:"never"`
+	}
+	if err := peerRequest(peer, req, &offered); err != nil {
+		return "", err
+	}
+
+	var best, longest string
+	var bestDur, longestDur time.Duration
+	remaining := time.Until(p.ExpirationTime())
+	for _, preset := range offered.Presets {
+		d, err := ParseDuration(preset.Value)
+		if err != nil {
+			continue
+		}
+		if d > longestDur {
+			longest, longestDur = preset.Value, d
+		}
+		if !p.ExpirationTime().IsZero() && d >= remaining && (best == "" || d < bestDur) {
+			best, bestDur = preset.Value, d
+		}
+	}
+	switch {
+	case best != "":
+		return best, nil
+	case offered.Never:
+		return "-1", nil
+	case longest != "":
+		return longest, nil
+	}
+	return "", nil
+}
+
+// pushPaste copies p to peer, authenticating with token, and records the
+// copy's URL with p.
+func pushPaste(r *http.Request, p *Paste, peer *PushPeer, token, expire string) (map[string]interface{}, error) {
+	reader, err := p.Reader()
+	if err != nil {
+		return nil, err
+	}
+	text, err := ioutil.ReadAll(io.LimitReader(reader, int64(PASTE_MAXIMUM_LENGTH)+1))
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	if ByteSize(len(text)) > PASTE_MAXIMUM_LENGTH {
+		return nil, PasteTooLargeError(ByteSize(len(text)))
+	}
+
+	if expire == "" {
+		if expire, err = peerExpiration(peer, p); err != nil {
+			return nil, err
+		}
+	}
+	source := p.Source
+	if source == "" {
+		source = BaseURLForRequest(r).ResolveReference(&url.URL{Path: pasteURL("show", p)}).String()
+	}
+	form := url.Values{
+		"text":       {string(text)},
+		"title":      {p.Title},
+		"license":    {p.License},
+		"expire":     {expire},
+		"source_url": {source},
+	}
+	if p.Language != nil && p.Language != unknownLanguage {
+		form.Set("lang", p.Language.ID)
+	}
+	if p.immutable {
+		form.Set("immutable", "1")
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(peer.URL, "/")+"/api/v1/extension/pastes", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	var created struct {
+		ID     string `json:"id"`
+		URL    string `json:"url"`
+		RawURL string `json:"raw_url"`
+	}
+	if err := peerRequest(peer, req, &created); err != nil {
+		return nil, err
+	}
+
+	// The copy exists whatever happens here; failing to note it is only
+	// logged, so that the caller still learns where it went.
+	filename := filesystemPasteStore.filenameForID(p.ID)
+	pushed := append(p.pushedTo, created.URL)
+	if err := putMetadata(filename, "pushed_to", strings.Join(pushed, " ")); err != nil {
+		glog.Error("Failed to record ", p.ID, "'s push to ", peer.Name, ": ", err)
+	} else {
+		p.pushedTo = pushed
+	}
+	healthServer.IncrementMetric("paste.pushed")
+
+	return map[string]interface{}{
+		"id":        p.ID,
+		"peer":      peer.Name,
+		"remote_id": created.ID,
+		"url":       created.URL,
+		"raw_url":   created.RawURL,
+		"expire":    expire,
+		"pushed_to": p.pushedTo,
+	}, nil
+}
+
+func apiPastePushHandler(w http.ResponseWriter, r *http.Request) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, err := pasteStore.Get(id, nil)
+	if _, ok := err.(PasteEncryptedError); ok {
+		writeAPIError(w, apiError(APIErrorValidation, "encrypted pastes can't be pushed"))
+		return
+	}
+	if p == nil || p.trashed != "" {
+		writeAPIError(w, PasteNotFoundError{ID: id})
+		return
+	}
+	if GetUser(r) == nil || !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"push", id})
+		return
+	}
+	if p.Sealed() || p.pending || p.direct {
+		writeAPIError(w, apiError(APIErrorValidation, "sealed, held and directly uploaded pastes can't be pushed"))
+		return
+	}
+
+	peer := pushPeerNamed(r.FormValue("peer"))
+	if peer == nil {
+		writeAPIError(w, apiError(APIErrorValidation, "peer must be one of this instance's push peers").With("field", "peer"))
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		token = peer.Token
+	}
+	if token == "" {
+		writeAPIError(w, apiError(APIErrorValidation, "%s needs an extension token", peer.Name).With("field", "token"))
+		return
+	}
+
+	resp, err := pushPaste(r, p, peer, token, strings.TrimSpace(r.FormValue("expire")))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusCreated, resp)
+}
+
+// apiPushPeersHandler lists the peers pastes can be pushed to.
+func apiPushPeersHandler(w http.ResponseWriter, r *http.Request) {
+	peers := []map[string]interface{}{}
+	for _, peer := range instanceConfig.Push.Peers {
+		peers = append(peers, map[string]interface{}{
+			"name":  peer.Name,
+			"url":   peer.URL,
+			"token": peer.Token != "",
+		})
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{"peers": peers})
+}
+
+func init() {
+	RegisterTemplateFunction("pastePushedTo", func(p *Paste) []string { return p.pushedTo })
+}
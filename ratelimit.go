@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API requests are counted against api.rate_limit per api.rate_window: per
+// account for callers who are logged in, and per address for everyone
+// else. Past the limit they are refused with 429 until the window is over.
+// So that clients can pace themselves instead, every API response carries
+// the caller's standing in the RateLimit headers of the IETF draft
+// (draft-ietf-httpapi-ratelimit-headers):
+//
+//	RateLimit-Policy: 600;w=600    the limit, and its window in seconds
+//	RateLimit-Limit: 600
+//	RateLimit-Remaining: 598
+//	RateLimit-Reset: 431           seconds until the window is over
+//
+// GET /api/v1/limits describes all of the caller's quotas (API requests,
+// its address's download bandwidth, pins, request sizes, proof of work and
+// any block) without counting against them.
+
+const apiLimitsPath = "/api/v1/limits"
+
+type rateCounter struct {
+	mu    sync.Mutex
+	n     int
+	start time.Time
+}
+
+// rateCounters serializes the creation of counters.
+var rateCounters sync.Mutex
+
+// apiRateWindow is how long a caller's requests are counted for.
+func apiRateWindow() time.Duration {
+	return privacyRetention(instanceConfig.API.RateWindow.Duration())
+}
+
+// apiRateSource is who r's requests are counted against: its account, or
+// the address it came from, as resolved through the trusted proxies. The
+// address isn't anonymized, as clients sharing a truncated prefix would
+// share a counter; it is only held in memory, for the window.
+func apiRateSource(r *http.Request) string {
+	if user := GetUser(r); user != nil {
+		return "account:" + user.Name
+	}
+	return "ip:" + SourceIPForRequest(r)
+}
+
+// apiRateCounterFor returns source's counter, starting a new one if its
+// window is over.
+func apiRateCounterFor(source string) *rateCounter {
+	rateCounters.Lock()
+	defer rateCounters.Unlock()
+	if v, ok := ephStore.Get("RL|" + source); ok {
+		return v.(*rateCounter)
+	}
+	c := &rateCounter{start: time.Now()}
+	ephStore.Put("RL|"+source, c, apiRateWindow())
+	return c
+}
+
+// take counts a request against c, unless c is already at limit. It
+// returns how many requests c has counted, and whether this one was.
+func (c *rateCounter) take(limit int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n >= limit {
+		return c.n, false
+	}
+	c.n++
+	return c.n, true
+}
+
+func (c *rateCounter) used() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// secondsUntil rounds the time until t up to a whole number of seconds.
+func secondsUntil(t time.Time) int {
+	d := time.Until(t)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// apiRateLimitHandler counts API requests, and refuses those over the
+// limit.
+type apiRateLimitHandler struct {
+	http.Handler
+}
+
+func (h apiRateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := instanceConfig.API.RateLimit
+	if limit <= 0 || !strings.HasPrefix(r.URL.Path, "/api/") {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	c := apiRateCounterFor(apiRateSource(r))
+	used, allowed := c.used(), true
+	if r.URL.Path != apiLimitsPath {
+		used, allowed = c.take(limit)
+	}
+	reset := secondsUntil(c.start.Add(apiRateWindow()))
+	hdr := w.Header()
+	hdr.Set("RateLimit-Policy", strconv.Itoa(limit)+";w="+strconv.Itoa(int(apiRateWindow()/time.Second)))
+	hdr.Set("RateLimit-Limit", strconv.Itoa(limit))
+	hdr.Set("RateLimit-Remaining", strconv.Itoa(limit-used))
+	hdr.Set("RateLimit-Reset", strconv.Itoa(reset))
+	if !allowed {
+		healthServer.IncrementMetric("api.rate_limited")
+		writeAPIError(w, apiError(APIErrorRateLimited, "too many API requests; try again in %d seconds", reset).With("retry_after", reset))
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+// apiLimitsHandler describes the caller's quotas.
+func apiLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{
+		"request_size": map[string]int64{
+			RequestSizeClassForm:   instanceConfig.Limits.Form,
+			RequestSizeClassAPI:    instanceConfig.Limits.API,
+			RequestSizeClassUpload: instanceConfig.Limits.Upload,
+		},
+	}
+
+	if limit := instanceConfig.API.RateLimit; limit > 0 {
+		c := apiRateCounterFor(apiRateSource(r))
+		reset := c.start.Add(apiRateWindow())
+		resp["requests"] = map[string]interface{}{
+			"limit":     limit,
+			"remaining": limit - c.used(),
+			"window":    int(apiRateWindow() / time.Second),
+			"reset":     secondsUntil(reset),
+			"reset_at":  reset.UTC(),
+		}
+	}
+
+	if bw := &instanceConfig.Bandwidth; bw.IP > 0 {
+		used, reset := addressBandwidthUsed(r)
+		remaining := bw.IP - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		bandwidth := map[string]interface{}{
+			"limit":     bw.IP,
+			"remaining": remaining,
+			"window":    int(bw.Window.Duration() / time.Second),
+			"action":    bw.Action,
+		}
+		if !reset.IsZero() {
+			bandwidth["reset"] = secondsUntil(reset)
+			bandwidth["reset_at"] = reset.UTC()
+		}
+		resp["bandwidth"] = bandwidth
+	}
+
+	if user := GetUser(r); user != nil && instanceConfig.Pins.MaxPerAccount > 0 {
+		resp["pins"] = map[string]int{
+			"limit":     instanceConfig.Pins.MaxPerAccount,
+			"remaining": instanceConfig.Pins.MaxPerAccount - len(userPins(user)),
+		}
+	}
+
+	resp["proof_of_work"] = map[string]interface{}{
+		"required":   instanceConfig.ProofOfWork.Enabled && GetUser(r) == nil,
+		"difficulty": instanceConfig.ProofOfWork.Difficulty,
+	}
+
+	for _, source := range abuseSources(r) {
+		if block, ok := abuseBlockStore.Get(source); ok {
+			resp["blocked"] = map[string]interface{}{
+				"reason": block.Reason,
+				"until":  block.Expires.UTC(),
+			}
+			break
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+func validateAPIRateConfig(c *_Configuration) error {
+	if c.API.RateLimit > 0 && c.API.RateWindow.Duration() <= 0 {
+		return fmt.Errorf("api.rate_window must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIRateSourceResolvesProxies(t *testing.T) {
+	savedProxies, savedPrivacy := instanceConfig.HTTP.TrustedProxies, instanceConfig.Privacy
+	defer func() { instanceConfig.HTTP.TrustedProxies, instanceConfig.Privacy = savedProxies, savedPrivacy }()
+	instanceConfig.HTTP.TrustedProxies = []string{"10.0.0.1"}
+	instanceConfig.Privacy.IPMode = IPModeTruncate
+	instanceConfig.Privacy.IPv4Prefix = 24
+
+	for _, tc := range []struct {
+		remote, xff string
+		source      string
+	}{
+		{"203.0.113.9:4000", "", "ip:203.0.113.9"},
+		{"203.0.113.9:4000", "198.51.100.2", "ip:203.0.113.9"},
+		{"10.0.0.1:4000", "198.51.100.7, 198.51.100.2", "ip:198.51.100.2"},
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/limits", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if source := apiRateSource(r); source != tc.source {
+			t.Errorf("%s via %q: source %q, want %q", tc.remote, tc.xff, source, tc.source)
+		}
+	}
+}
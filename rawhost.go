@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+)
+
+// Raw paste bodies can be served from a separate host (raw_host.url),
+// typically a CDN whose origin is this instance, so that large downloads
+// are kept off the main host while pages stay on it. Raw links, and
+// requests for raw bodies on the main host, go to the raw host with a
+// signed URL; the raw host serves only those, and only when the signature
+// holds. Signatures expire on a grid of raw_host.expiry, so that a paste's
+// raw URL stays the same (and cacheable) for a while. Encrypted pastes,
+// whose keys live in the main host's cookies, are always served from the
+// main host.
+//
+// Paste owners can also mint signed raw URLs of their own, with an expiry
+// of their choosing (up to raw_host.max_signed_expiry), through the API.
+// These are checked the same way, on either host, and stand in for the
+// login on a private instance: a CI job can fetch a config paste with one
+// without an API token on the box.
+
+var rawHostKey []byte
+
+func rawHost() *url.URL {
+	if instanceConfig.RawHost.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(instanceConfig.RawHost.URL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return u
+}
+
+func rawSignatureMessage(id PasteID, kind string, expires int64) []byte {
+	return []byte(id.String() + "|" + kind + "|" + strconv.FormatInt(expires, 10))
+}
+
+// rawPasteURL returns the URL of the paste's body: kind is "raw" or
+// "download".
+func rawPasteURL(kind string, p *Paste) string {
+	host := rawHost()
+	if host == nil || p.Encrypted {
+		return pasteURL(kind, p)
+	}
+
+	grid := int64(instanceConfig.RawHost.Expiry.Duration() / time.Second)
+	if grid <= 0 {
+		grid = 3600
+	}
+	// Always at least one grid step away.
+	expires := (time.Now().Unix()/grid + 2) * grid
+	return signedRawURL(host, kind, p.ID, expires)
+}
+
+// signedRawURL returns the URL, under base, of a paste's body signed to
+// expire at expires.
+func signedRawURL(base *url.URL, kind string, id PasteID, expires int64) string {
+	mac := constructMAC(rawSignatureMessage(id, kind, expires), rawHostKey)
+	u := base.ResolveReference(&url.URL{Path: "/paste/" + id.String() + "/" + kind})
+	u.RawQuery = url.Values{
+		"e": {strconv.FormatInt(expires, 10)},
+		"s": {base32Encoder.EncodeToString(mac)},
+	}.Encode()
+	return u.String()
+}
+
+// parseRawPath splits a path of the form /paste/{id}/raw (or /download).
+func parseRawPath(path string) (PasteID, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "paste" || (parts[2] != "raw" && parts[2] != "download") {
+		return "", "", false
+	}
+	return PasteIDFromString(parts[1]), parts[2], true
+}
+
+// rawSignatureValid reports whether r carries an unexpired signature for
+// the body it asks for.
+func rawSignatureValid(r *http.Request) bool {
+	id, kind, ok := parseRawPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("e"), 10, 64)
+	mac, macErr := base32Encoder.DecodeString(q.Get("s"))
+	return err == nil && macErr == nil && time.Now().Unix() <= expires && checkMAC(rawSignatureMessage(id, kind, expires), mac, rawHostKey)
+}
+
+func onRawHost(r *http.Request) bool {
+	host := rawHost()
+	return host != nil && strings.EqualFold(r.Host, host.Host)
+}
+
+type RawURLSignatureError struct{}
+
+func (e RawURLSignatureError) Error() string {
+	return "This link has expired. Go back to the paste for a new one."
+}
+
+func (e RawURLSignatureError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+// rawHostHandler confines the raw host to signed requests for raw bodies,
+// which skip the private instance check (the signature stands in for the
+// login). Pages are never served there.
+type rawHostHandler struct {
+	http.Handler
+	router http.Handler
+}
+
+func (h rawHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !onRawHost(r) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	if _, _, ok := parseRawPath(r.URL.Path); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !rawSignatureValid(r) {
+		healthServer.IncrementMetric("raw_host.refused")
+		err := RawURLSignatureError{}
+		RenderError(err, err.StatusCode(), w)
+		return
+	}
+	healthServer.IncrementMetric("raw_host.served")
+	h.router.ServeHTTP(w, r)
+}
+
+// redirectsToRawHost sends requests for raw bodies on the main host to the
+// raw host.
+func redirectsToRawHost(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		p := o.(*Paste)
+		if rawHost() != nil && !p.Encrypted && !onRawHost(r) {
+			kind := "raw"
+			if strings.HasSuffix(r.URL.Path, "/download") {
+				kind = "download"
+			}
+			location := rawPasteURL(kind, p)
+			if wantsLicenseHeader(r, p) {
+				location += "&license_header=1"
+			}
+			for _, name := range []string{"lines", "rev"} {
+				if v := r.FormValue(name); v != "" {
+					location += "&" + name + "=" + url.QueryEscape(v)
+				}
+			}
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		fn(o, w, r)
+	}
+}
+
+// apiPasteRawURLHandler mints a signed URL for a paste's raw body. Form
+// values: expires_in (a duration; default 1h), download (to sign the
+// download URL instead).
+func apiPasteRawURLHandler(w http.ResponseWriter, r *http.Request) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, err := pasteStore.Get(id, nil)
+	if _, ok := err.(PasteEncryptedError); ok {
+		writeAPIError(w, apiError(APIErrorValidation, "encrypted pastes can't be fetched with a signed URL"))
+		return
+	}
+	if p == nil || p.trashed != "" {
+		writeAPIError(w, PasteNotFoundError{ID: id})
+		return
+	}
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"sign URLs for", id})
+		return
+	}
+
+	ttl := time.Hour
+	if v := r.FormValue("expires_in"); v != "" {
+		ttl, err = ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			writeAPIError(w, apiError(APIErrorValidation, "expires_in must be a positive duration, like 30m or 2d").With("field", "expires_in"))
+			return
+		}
+	}
+	if max := instanceConfig.RawHost.MaxSignedExpiry.Duration(); max > 0 && ttl > max {
+		writeAPIError(w, apiError(APIErrorValidation, "expires_in may be at most %v", max).With("field", "expires_in"))
+		return
+	}
+	kind := "raw"
+	if r.FormValue("download") != "" {
+		kind = "download"
+	}
+
+	base := rawHost()
+	if base == nil {
+		base = BaseURLForRequest(r)
+	}
+	expires := time.Now().Add(ttl).Unix()
+	healthServer.IncrementMetric("raw_host.signed")
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"id":      p.ID,
+		"url":     signedRawURL(base, kind, p.ID, expires),
+		"expires": time.Unix(expires, 0).UTC(),
+	})
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+
+	keyFile := filepath.Join(arguments.root, "raw.key")
+	key, err := SlurpFile(keyFile)
+	if err != nil {
+		key = securecookie.GenerateRandomKey(32)
+		err = ioutil.WriteFile(keyFile, key, 0600)
+		if err != nil {
+			glog.Fatal("raw.key not found, and an attempt to create one failed: ", err)
+		}
+	}
+	rawHostKey = key
+
+	RegisterTemplateFunction("rawPasteURL", rawPasteURL)
+}
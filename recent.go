@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// People who paste without an account can still find (and delete) what
+// they just posted: each paste they create is given an edit token, which
+// is kept, with the paste's ID, in a long-lived "recent" cookie, and whose
+// hash is kept with the paste. /recent lists the pastes in the cookie whose
+// tokens still match; entries that don't (the paste expired, or was
+// deleted) are dropped from it. Nothing ties the list to an IP address or
+// an account; clearing cookies forgets it.
+
+// MaxRecentPastes is how many pastes the recent cookie remembers.
+const MaxRecentPastes = 30
+
+type RecentPaste struct {
+	ID      PasteID
+	Token   string
+	Created time.Time
+}
+
+func hashEditToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkEditToken reports whether token is p's edit token.
+func checkEditToken(p *Paste, token string) bool {
+	if p.editToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(p.editToken), []byte(hashEditToken(token))) == 1
+}
+
+func recentPastes(r *http.Request) []RecentPaste {
+	session, _ := clientLongtermSessionStore.Get(r, "recent")
+	recent, _ := session.Values["pastes"].([]RecentPaste)
+	return recent
+}
+
+func saveRecentPastes(w http.ResponseWriter, r *http.Request, recent []RecentPaste) {
+	session, _ := clientLongtermSessionStore.Get(r, "recent")
+	if len(recent) == 0 {
+		delete(session.Values, "pastes")
+	} else {
+		session.Values["pastes"] = recent
+	}
+	if err := session.Save(r, w); err != nil {
+		glog.Errorln(err)
+	}
+}
+
+// rememberRecentPaste gives p, about to be saved for the first time, an
+// edit token, and adds it to the requester's recent cookie. The cookie is
+// written with the rest of the request's sessions.
+func rememberRecentPaste(r *http.Request, p *Paste) {
+	token, err := generateRandomBase32String(20, 32)
+	if err != nil {
+		glog.Errorln(err)
+		return
+	}
+	p.editToken = hashEditToken(token)
+
+	session, _ := clientLongtermSessionStore.Get(r, "recent")
+	recent, _ := session.Values["pastes"].([]RecentPaste)
+	recent = append([]RecentPaste{{ID: p.ID, Token: token, Created: time.Now()}}, recent...)
+	if len(recent) > MaxRecentPastes {
+		recent = recent[:MaxRecentPastes]
+	}
+	session.Values["pastes"] = recent
+}
+
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	recent := recentPastes(r)
+	valid := recent[:0:0]
+	var pastes []*Paste
+	for _, entry := range recent {
+		p, err := getPaste(r.Context(), entry.ID, nil)
+		if e, ok := err.(DeadlineExceededError); ok {
+			// Don't forget pastes just because the store is slow.
+			RenderError(e, e.StatusCode(), w)
+			return
+		}
+		if p == nil || !checkEditToken(p, entry.Token) {
+			continue
+		}
+		valid = append(valid, entry)
+		pastes = append(pastes, p)
+	}
+	if len(valid) != len(recent) {
+		saveRecentPastes(w, r, valid)
+	}
+	RenderPage(w, r, "recent", pastes)
+}
+
+func recentDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	recent := recentPastes(r)
+	i := -1
+	for j, entry := range recent {
+		if entry.ID == id {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		RenderError(PasteNotFoundError{ID: id}, http.StatusNotFound, w)
+		return
+	}
+
+	p, err := getPaste(r.Context(), id, nil)
+	if e, ok := err.(DeadlineExceededError); ok {
+		RenderError(e, e.StatusCode(), w)
+		return
+	}
+	if p != nil && p.trashed == "" {
+		if !checkEditToken(p, recent[i].Token) {
+			RenderError(PasteAccessDeniedError{"delete", id}, http.StatusForbidden, w)
+			return
+		}
+		p.deletionReason = "deleted by its owner"
+		if grace := instanceConfig.Trash.Deleted.Duration(); grace > 0 && trashPaste(p, p.deletionReason, grace) {
+			// As in pasteDelete, the owner keeps their permissions (and
+			// the paste stays listed), so that they can undo this.
+			SetFlashWithAction(w, "success", fmt.Sprintf("Paste %v deleted.", id), "Undo", pasteURL("restore", p))
+			w.Header().Set("Location", "/recent")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		if err := destroyPaste(r.Context(), p); err != nil {
+			RenderError(err, http.StatusInternalServerError, w)
+			return
+		}
+	}
+
+	saveRecentPastes(w, r, append(recent[:i:i], recent[i+1:]...))
+	perms := GetPastePermissions(r)
+	perms.Delete(id)
+	perms.Save(w, r)
+
+	SetFlash(w, "success", fmt.Sprintf("Paste %v deleted.", id))
+	w.Header().Set("Location", "/recent")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func init() {
+	gob.Register([]RecentPaste(nil))
+	RegisterTemplateFunction("maxRecentPastes", func() int { return MaxRecentPastes })
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Handlers panic with HTTPErrors to bail out of a request; anything else a
+// handler panics with is a bug. Bugs are answered with a 500 carrying an
+// error ID, logged with their stack trace under that ID, and handed to the
+// configured error reporters so that someone finds out about them.
+
+// InternalError is what a visitor sees in place of a bug.
+type InternalError struct {
+	ID  string
+	Err error
+}
+
+func (e InternalError) Error() string {
+	if _, ok := e.Err.(runtime.Error); ok || e.Err == nil {
+		return "Something went wrong on our end."
+	}
+	return e.Err.Error()
+}
+
+func (e InternalError) StatusCode() int {
+	return http.StatusInternalServerError
+}
+
+func (e InternalError) ErrorTemplateName() string {
+	return "internal_error"
+}
+
+func (e InternalError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{"error_id": e.ID}
+}
+
+// ErrorEvent describes one recovered panic.
+type ErrorEvent struct {
+	ID        string
+	Time      time.Time
+	Message   string
+	Type      string
+	Stack     string
+	Method    string
+	URL       string
+	UserAgent string
+	RequestID string
+}
+
+// An ErrorReporter is told about every recovered panic. Report is called
+// on its own goroutine.
+type ErrorReporter interface {
+	Report(ev *ErrorEvent) error
+}
+
+var errorReporters struct {
+	sync.Mutex
+	list []ErrorReporter
+}
+
+func RegisterErrorReporter(reporter ErrorReporter) {
+	errorReporters.Lock()
+	errorReporters.list = append(errorReporters.list, reporter)
+	errorReporters.Unlock()
+}
+
+func newErrorID() string {
+	// Sentry wants event IDs to be 32 hex digits.
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// recordPanic logs and reports a panic recovered while serving r (which may
+// be nil) and returns the error to show in its place.
+func recordPanic(rec interface{}, r *http.Request) InternalError {
+	err, _ := rec.(error)
+	ev := &ErrorEvent{
+		ID:      newErrorID(),
+		Time:    time.Now().UTC(),
+		Message: fmt.Sprint(rec),
+		Type:    fmt.Sprintf("%T", rec),
+		Stack:   string(debug.Stack()),
+	}
+	if r != nil {
+		ev.Method, ev.URL, ev.UserAgent, ev.RequestID = r.Method, r.URL.String(), r.UserAgent(), RequestID(r)
+	}
+
+	glog.Errorf("Recovered panic (error %s, request %s) serving %s %s: %s\n%s", ev.ID, ev.RequestID, ev.Method, ev.URL, ev.Message, ev.Stack)
+	healthServer.IncrementMetric("panic.recovered")
+
+	errorReporters.Lock()
+	reporters := errorReporters.list
+	errorReporters.Unlock()
+	for _, reporter := range reporters {
+		go func(reporter ErrorReporter) {
+			if err := reporter.Report(ev); err != nil {
+				glog.Warningf("Failed to report error %s: %v", ev.ID, err)
+				healthServer.IncrementMetric("panic.report_failed")
+			}
+		}(reporter)
+	}
+	return InternalError{ID: ev.ID, Err: err}
+}
+
+// recoveryHandler catches whatever the handlers under it don't: panics in
+// middleware, in handlers that don't recover for themselves, and panics
+// with values that aren't errors.
+type recoveryHandler struct {
+	http.Handler
+}
+
+func (h recoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		rec := recover()
+		if rec == nil {
+			return
+		}
+		if rec == http.ErrAbortHandler {
+			panic(rec)
+		}
+
+		err := recordPanic(rec, r)
+		if requestSizeClass(r) == RequestSizeClassForm {
+			RenderError(err, err.StatusCode(), w)
+		} else {
+			writeAPIError(w, err)
+		}
+	}()
+	h.Handler.ServeHTTP(w, r)
+}
+
+// webhookErrorReporter posts each ErrorEvent as JSON to a URL.
+type webhookErrorReporter struct {
+	url    string
+	client *http.Client
+}
+
+func (wr *webhookErrorReporter) Report(ev *ErrorEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return wr.post(wr.url, body, nil)
+}
+
+func (wr *webhookErrorReporter) post(url string, body []byte, header http.Header) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// sentryErrorReporter sends events to Sentry, or anything that speaks its
+// store API, given a DSN (https://<key>@<host>/<project>).
+type sentryErrorReporter struct {
+	webhookErrorReporter
+	key string
+}
+
+func newSentryErrorReporter(dsn string) (*sentryErrorReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN %q", dsn)
+	}
+	project := strings.Trim(u.Path, "/")
+	if project == "" {
+		return nil, fmt.Errorf("Sentry DSN %q names no project", dsn)
+	}
+	store := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/api/" + project + "/store/"}
+	return &sentryErrorReporter{
+		webhookErrorReporter: webhookErrorReporter{url: store.String(), client: &http.Client{Timeout: 10 * time.Second}},
+		key:                  u.User.Username(),
+	}, nil
+}
+
+func (sr *sentryErrorReporter) Report(ev *ErrorEvent) error {
+	hostname, _ := os.Hostname()
+	event := map[string]interface{}{
+		"event_id":    ev.ID,
+		"timestamp":   ev.Time.Format("2006-01-02T15:04:05"),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "spectre",
+		"server_name": hostname,
+		"environment": Env(),
+		"message":     ev.Message,
+		"exception": map[string]interface{}{
+			"values": []map[string]interface{}{{"type": ev.Type, "value": ev.Message}},
+		},
+		"extra": map[string]string{"stack": ev.Stack},
+	}
+	if ev.RequestID != "" {
+		event["tags"] = map[string]string{"request_id": ev.RequestID}
+	}
+	if ev.URL != "" {
+		event["request"] = map[string]interface{}{
+			"method":  ev.Method,
+			"url":     ev.URL,
+			"headers": map[string]string{"User-Agent": ev.UserAgent},
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return sr.post(sr.url, body, http.Header{
+		"X-Sentry-Auth": {"Sentry sentry_version=7, sentry_client=spectre/1.0, sentry_key=" + sr.key},
+	})
+}
+
+// startErrorReporters registers the reporters named in the configuration.
+func startErrorReporters() {
+	if dsn := instanceConfig.Errors.SentryDSN; dsn != "" {
+		sr, err := newSentryErrorReporter(dsn)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		RegisterErrorReporter(sr)
+	}
+	if hook := instanceConfig.Errors.Webhook; hook != "" {
+		RegisterErrorReporter(&webhookErrorReporter{url: hook, client: &http.Client{Timeout: 10 * time.Second}})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// The redirect map sends requests for pastes that don't exist (any longer)
+// elsewhere: to another paste, keeping the rest of the path (so that
+// /paste/old/raw goes to /paste/new/raw), or to a URL. It is consulted only
+// once a paste can't be found, and is managed by admins through the API;
+// the redirects.txt written by `spectre import` can be posted to it as is.
+
+type Redirect struct {
+	From      PasteID   `json:"from"`
+	To        string    `json:"to"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"-"`
+}
+
+// toURL reports whether the redirect leads to a URL rather than a paste.
+func (rd *Redirect) toURL() bool {
+	return strings.Contains(rd.To, "/")
+}
+
+type RedirectStore struct {
+	Redirects map[PasteID]*Redirect
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *RedirectStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save redirects: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+func validRedirectTarget(to string) bool {
+	if !strings.Contains(to, "/") {
+		return to != "" && !strings.ContainsAny(to, " ?#")
+	}
+	if strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "//") {
+		return true
+	}
+	u, err := url.Parse(to)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Put adds redirects, replacing any from the same pastes.
+func (s *RedirectStore) Put(redirects []*Redirect) error {
+	for _, rd := range redirects {
+		if rd.From == "" || strings.Contains(string(rd.From), "/") {
+			return fmt.Errorf("%q is not a paste ID", rd.From)
+		}
+		if !validRedirectTarget(rd.To) {
+			return fmt.Errorf("%q is neither a paste ID nor a URL", rd.To)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rd := range redirects {
+		s.Redirects[rd.From] = rd
+	}
+	return s.save()
+}
+
+func (s *RedirectStore) Get(from PasteID) (*Redirect, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rd, ok := s.Redirects[from]
+	return rd, ok
+}
+
+func (s *RedirectStore) Delete(from PasteID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Redirects[from]; !ok {
+		return false
+	}
+	delete(s.Redirects, from)
+	s.save()
+	return true
+}
+
+// List returns every redirect, ordered by the paste redirected from.
+func (s *RedirectStore) List() []*Redirect {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	redirects := make([]*Redirect, 0, len(s.Redirects))
+	for _, rd := range s.Redirects {
+		redirects = append(redirects, rd)
+	}
+	sort.Slice(redirects, func(i, j int) bool { return redirects[i].From < redirects[j].From })
+	return redirects
+}
+
+// LocationForRequest returns where r, a request for the missing paste id,
+// should be redirected.
+func (s *RedirectStore) LocationForRequest(r *http.Request, id PasteID) (string, bool) {
+	rd, ok := s.Get(id)
+	if !ok {
+		return "", false
+	}
+	healthServer.IncrementMetric("paste.redirected")
+	if rd.toURL() {
+		return rd.To, true
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if u, err := route.URL("id", rd.To); err == nil {
+			u.RawQuery = r.URL.RawQuery
+			return u.String(), true
+		}
+	}
+	u, _ := pasteRouter.Get("show").URL("id", rd.To)
+	return u.String(), true
+}
+
+func LoadRedirectStore(filename string) *RedirectStore {
+	var s *RedirectStore
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode redirects: ", err)
+		}
+	}
+	if s == nil {
+		s = &RedirectStore{}
+	}
+	if s.Redirects == nil {
+		s.Redirects = make(map[PasteID]*Redirect)
+	}
+	s.filename = filename
+	return s
+}
+
+func apiRedirectsHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"redirects": redirectStore.List(),
+	})
+}
+
+// apiRedirectsCreateHandler adds redirects: one, from the form values from
+// and to, or, for a text/plain body, one "from to" pair per line.
+func apiRedirectsCreateHandler(w http.ResponseWriter, r *http.Request) {
+	createdBy := GetUser(r).Name
+	var redirects []*Redirect
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if len(fields) != 2 {
+				writeAPIError(w, apiError(APIErrorValidation, "expected \"from to\", got %q", scanner.Text()))
+				return
+			}
+			redirects = append(redirects, &Redirect{From: PasteIDFromString(fields[0]), To: fields[1], Created: time.Now(), CreatedBy: createdBy})
+		}
+		if err := scanner.Err(); err != nil {
+			writeAPIError(w, apiError(APIErrorValidation, "%v", err))
+			return
+		}
+	} else {
+		redirects = append(redirects, &Redirect{From: PasteIDFromString(r.FormValue("from")), To: r.FormValue("to"), Created: time.Now(), CreatedBy: createdBy})
+	}
+
+	if err := redirectStore.Put(redirects); err != nil {
+		writeAPIError(w, apiError(APIErrorValidation, "%v", err))
+		return
+	}
+	writeAPIResponse(w, http.StatusCreated, map[string]interface{}{
+		"redirects": redirects,
+	})
+}
+
+func apiRedirectDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	from := PasteIDFromString(mux.Vars(r)["id"])
+	if !redirectStore.Delete(from) {
+		writeAPIError(w, apiError(APIErrorNotFound, "no redirect from %s", from))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var redirectStore *RedirectStore
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	redirectStore = LoadRedirectStore(filepath.Join(arguments.root, "redirects.gob"))
+}
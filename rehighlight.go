@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sort"
+)
+
+// After a highlighter or formatter upgrade, cached renderings are stale.
+// The rehighlight job marks every one of them stale at once (so that
+// nothing renders with the old highlighter again), then renders afresh the
+// pastes that were cached, so that popular pastes don't all miss the cache
+// together. It works through pastes in ID order, checkpointing as it goes,
+// so a retried run picks up where the last attempt stopped.
+
+// rerenderIfCached renders a paste again if it has a cached rendering,
+// reporting whether it did.
+func rerenderIfCached(id PasteID) bool {
+	renderCache.mu.RLock()
+	_, cached := renderCache.pinned[id]
+	if !cached && renderCache.c != nil {
+		_, cached = renderCache.c.Get(id)
+	}
+	renderCache.mu.RUnlock()
+	if !cached {
+		return false
+	}
+
+	p, err := pasteStore.Get(id, nil)
+	if err != nil {
+		forgetRenderedPaste(id)
+		return false
+	}
+	renderPaste(context.Background(), p)
+	return true
+}
+
+func init() {
+	RegisterJob("rehighlight", "Render cached pastes again, after the highlighter or formatters change.", func(run *JobRun) error {
+		if run.Checkpoint == "" {
+			renderCache.mu.Lock()
+			renderCache.generation++
+			renderCache.mu.Unlock()
+		}
+
+		var ids []string
+		if err := filesystemPasteStore.Walk(func(id PasteID) error {
+			ids = append(ids, id.String())
+			return nil
+		}); err != nil {
+			return err
+		}
+		sort.Strings(ids)
+
+		rendered := 0
+		for i, id := range ids {
+			if id <= run.Checkpoint {
+				continue
+			}
+			if rerenderIfCached(PasteIDFromString(id)) {
+				rendered++
+			}
+			run.Progress(int64(i+1), int64(len(ids)))
+			if i%100 == 99 {
+				run.SetCheckpoint(id)
+			}
+		}
+		run.SetResult("rendered %d cached pastes again", rendered)
+		return nil
+	})
+}
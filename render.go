@@ -29,6 +29,16 @@ func (d DeferLookupError) Error() string {
 	return ""
 }
 
+// MovedLookupError is returned by a lookup for an object that now lives at
+// Location.
+type MovedLookupError struct {
+	Location string
+}
+
+func (m MovedLookupError) Error() string {
+	return "moved to " + m.Location
+}
+
 type ModelRenderFunc func(Model, http.ResponseWriter, *http.Request)
 type ModelLookupFunc func(*http.Request) (Model, error)
 
@@ -38,17 +48,28 @@ func RenderError(e error, statusCode int, w http.ResponseWriter) {
 	if cte, ok := e.(CustomTemplateError); ok {
 		page = cte.ErrorTemplateName()
 	}
-	RenderPage(w, nil, page, e)
+	ExecuteTemplate(w, "tmpl_page", &RenderContext{Page: page, Obj: e, RequestID: responseRequestID(w)})
 }
 
-func errorRecoveryHandler(w http.ResponseWriter) {
-	if err := recover(); err != nil {
-		status := http.StatusInternalServerError
-		if weberr, ok := err.(HTTPError); ok {
-			status = weberr.StatusCode()
+// recoveredError turns a value recovered from a panic into the error to
+// render: an HTTPError is passed along, and anything else is a bug, to be
+// recorded and answered with an InternalError.
+func recoveredError(rec interface{}, r *http.Request) (error, int) {
+	if err, ok := rec.(error); ok {
+		if weberr, ok := err.(HTTPError); ok && weberr.StatusCode() != http.StatusInternalServerError {
+			return err, weberr.StatusCode()
 		}
+	}
+	return recordPanic(rec, r), http.StatusInternalServerError
+}
 
-		RenderError(err.(error), status, w)
+func errorRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if rec := recover(); rec != nil {
+		if rec == http.ErrAbortHandler {
+			panic(rec)
+		}
+		err, status := recoveredError(rec, r)
+		RenderError(err, status, w)
 	}
 }
 
@@ -64,20 +85,21 @@ func RenderPageForModel(page string) ModelRenderFunc {
 
 func RenderPageHandler(page string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer errorRecoveryHandler(w)
+		defer errorRecoveryHandler(w, r)
 		RenderPage(w, r, page, nil)
 	})
 }
 
 func RenderPage(w io.Writer, r *http.Request, page string, obj interface{}) {
-	ExecuteTemplate(w, "tmpl_page", &RenderContext{Request: r, Page: page, Obj: obj})
+	ExecuteTemplate(w, "tmpl_page", &RenderContext{Request: r, Page: page, Obj: obj, RequestID: RequestID(r)})
 }
 
 func RenderPartialHandler(page string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			if err := recover(); err != nil {
-				RenderPartial(w, r, "error", err.(error))
+			if rec := recover(); rec != nil {
+				err, _ := recoveredError(rec, r)
+				RenderPartial(w, r, "error", err)
 			}
 		}()
 		RenderPartial(w, r, page, nil)
@@ -85,12 +107,12 @@ func RenderPartialHandler(page string) http.HandlerFunc {
 }
 
 func RenderPartial(w io.Writer, r *http.Request, name string, obj interface{}) {
-	ExecuteTemplate(w, "partial_"+name, &RenderContext{Request: r, Page: name, Obj: obj})
+	ExecuteTemplate(w, "partial_"+name, &RenderContext{Request: r, Page: name, Obj: obj, RequestID: RequestID(r)})
 }
 
 func RequiredModelObjectHandler(lookup ModelLookupFunc, fn ModelRenderFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer errorRecoveryHandler(w)
+		defer errorRecoveryHandler(w, r)
 
 		if obj, err := lookup(r); err != nil {
 			if dle, ok := err.(DeferLookupError); ok {
@@ -101,6 +123,9 @@ func RequiredModelObjectHandler(lookup ModelLookupFunc, fn ModelRenderFunc) http
 				})
 				w.Header().Set("Location", dle.Interstitial.String())
 				w.WriteHeader(http.StatusFound)
+			} else if moved, ok := err.(MovedLookupError); ok {
+				w.Header().Set("Location", moved.Location)
+				w.WriteHeader(http.StatusMovedPermanently)
 			} else {
 				panic(err)
 			}
@@ -111,10 +136,24 @@ func RequiredModelObjectHandler(lookup ModelLookupFunc, fn ModelRenderFunc) http
 }
 
 func SetFlash(w http.ResponseWriter, kind, body string) {
-	flashBody, err := json.Marshal(map[string]string{
+	setFlash(w, map[string]string{
 		"type": kind,
 		"body": body,
 	})
+}
+
+// SetFlashWithAction sets a flash carrying a button that POSTs to action.
+func SetFlashWithAction(w http.ResponseWriter, kind, body, label, action string) {
+	setFlash(w, map[string]string{
+		"type":         kind,
+		"body":         body,
+		"action":       action,
+		"action_label": label,
+	})
+}
+
+func setFlash(w http.ResponseWriter, flash map[string]string) {
+	flashBody, err := json.Marshal(flash)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+)
+
+// Rendering is held to a budget so that a pathological paste (one enormous
+// line, markup nested thousands deep, a highlighter that produces
+// megabytes) degrades to plain text instead of exhausting the process.
+
+var errRenderOutputTooLarge = errors.New("rendered output exceeds the render budget")
+
+// renderFallbackReason returns why a paste's body should not be handed to
+// its formatter, or "" if it may be.
+func renderFallbackReason(body []byte, language *Language, truncated bool) string {
+	if truncated {
+		return "size"
+	}
+
+	longest, current := 0, 0
+	for _, c := range body {
+		if c == '\n' {
+			current = 0
+			continue
+		}
+		current++
+		if current > longest {
+			longest = current
+		}
+	}
+	if longest > instanceConfig.Render.MaxLineLength {
+		return "line_length"
+	}
+
+	if language.Formatter == "markdown" && markupNestingDepth(body) > instanceConfig.Render.MaxNesting {
+		return "nesting"
+	}
+	return ""
+}
+
+// markupNestingDepth estimates how deeply Markdown in body nests: the
+// deepest run of blockquote markers at the start of a line, or of open
+// brackets and parentheses anywhere.
+func markupNestingDepth(body []byte) int {
+	deepest, brackets, quotes, lineStart := 0, 0, 0, true
+	for _, c := range body {
+		switch {
+		case c == '\n':
+			lineStart, quotes = true, 0
+			continue
+		case lineStart && c == '>':
+			quotes++
+			if quotes > deepest {
+				deepest = quotes
+			}
+			continue
+		case lineStart && (c == ' ' || c == '\t'):
+			continue
+		}
+		lineStart = false
+
+		switch c {
+		case '[', '(':
+			brackets++
+			if brackets > deepest {
+				deepest = brackets
+			}
+		case ']', ')':
+			if brackets > 0 {
+				brackets--
+			}
+		}
+	}
+	return deepest
+}
+
+// cappedBuffer collects a formatter's output, giving up (and cancelling the
+// formatter) once it grows past its limit.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit      int
+	cancel     context.CancelFunc
+	overflowed bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		b.overflowed = true
+		b.cancel()
+		return 0, errRenderOutputTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// validateRenderConfig refuses a render budget that no paste could fit:
+// a limit of 0 would show every paste as plain text (or, for max_input,
+// as nothing at all).
+func validateRenderConfig(c *_Configuration) error {
+	rc := c.Render
+	for name, v := range map[string]int64{
+		"max_input":       rc.MaxInput,
+		"max_line_length": int64(rc.MaxLineLength),
+		"max_nesting":     int64(rc.MaxNesting),
+		"max_output":      int64(rc.MaxOutput),
+		"timeout":         int64(rc.Timeout),
+	} {
+		if v <= 0 {
+			return fmt.Errorf("render.%s must be positive", name)
+		}
+	}
+	return nil
+}
+
+func renderPlainText(body []byte, truncated bool) string {
+	out := template.HTMLEscapeString(string(body))
+	if truncated {
+		out += "\n\n[This paste is too large to display in full. View it raw to see the rest.]"
+	}
+	return out
+}
+
+// FormatBudgeted formats the contents of r within the render budget,
+// falling back to plain text when the budget would be exceeded.
+func FormatBudgeted(ctx context.Context, r io.Reader, language *Language) (string, error) {
+	maxInput := instanceConfig.Render.MaxInput
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxInput+1))
+	if err != nil {
+		return "", err
+	}
+	truncated := int64(len(body)) > maxInput
+	if truncated {
+		body = body[:maxInput]
+	}
+
+	if reason := renderFallbackReason(body, language, truncated); reason != "" {
+		healthServer.IncrementMetric("render.fallback." + reason)
+		return renderPlainText(body, truncated), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, instanceConfig.Render.Timeout.Duration())
+	defer cancel()
+	out, err := FormatStreamContext(ctx, bytes.NewReader(body), language)
+	if err != nil || len(out) > instanceConfig.Render.MaxOutput {
+		reason := "output"
+		if ctx.Err() == context.DeadlineExceeded {
+			reason = "timeout"
+		} else if err != nil && err != errRenderOutputTooLarge {
+			reason = "error"
+		}
+		healthServer.IncrementMetric("render.fallback." + reason)
+		return renderPlainText(body, false), nil
+	}
+	return out, nil
+}
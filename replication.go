@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Replication keeps a secondary instance's paste store in step with a
+// primary's, for disaster recovery. The primary journals every change to
+// its pastes; secondaries either poll the journal (pull) or have changes
+// posted to them as they happen (push). Either way, a secondary that has
+// fallen too far behind can catch up with the replication-sync command.
+
+type ReplicationEventType string
+
+const (
+	ReplicationEventCreate ReplicationEventType = "create"
+	ReplicationEventUpdate ReplicationEventType = "update"
+	ReplicationEventDelete ReplicationEventType = "delete"
+	ReplicationEventExpire ReplicationEventType = "expire"
+)
+
+// Conflict rules decide whether a change from the primary may overwrite a
+// paste that was modified on the secondary.
+const (
+	// ReplicationConflictNewest keeps whichever copy was modified last.
+	ReplicationConflictNewest = "newest"
+	// ReplicationConflictPrimary always takes the primary's copy.
+	ReplicationConflictPrimary = "primary"
+)
+
+type ReplicationEvent struct {
+	Seq  uint64               `json:"seq"`
+	Type ReplicationEventType `json:"type"`
+	ID   PasteID              `json:"id"`
+	Time time.Time            `json:"time"`
+}
+
+// PasteSnapshot is a paste exactly as stored: its body is still encrypted,
+// if the paste is.
+type PasteSnapshot struct {
+	ID       PasteID           `json:"id"`
+	Modified time.Time         `json:"modified"`
+	Metadata map[string]string `json:"metadata"`
+	Body     []byte            `json:"body"`
+}
+
+// ReplicationChange is what a primary pushes to its secondaries. Snapshot is
+// nil for deletions.
+type ReplicationChange struct {
+	Event    ReplicationEvent `json:"event"`
+	Snapshot *PasteSnapshot   `json:"snapshot,omitempty"`
+}
+
+func (store *FilesystemPasteStore) Snapshot(id PasteID) (*PasteSnapshot, error) {
+	filename := store.filenameForID(id)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, PasteNotFoundError{ID: id}
+	}
+
+	file, err := store.openBody(id)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	body, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	for _, name := range pasteMetadataNames {
+		if hasMetadata(filename, name) {
+			metadata[name] = getMetadata(filename, name, "")
+		}
+	}
+	return &PasteSnapshot{
+		ID:       id,
+		Modified: fi.ModTime(),
+		Metadata: metadata,
+		Body:     body,
+	}, nil
+}
+
+// Restore writes a snapshot into the store, replacing any paste of the same
+// ID. It does not call the store's callbacks.
+func (store *FilesystemPasteStore) Restore(s *PasteSnapshot) error {
+	filename := store.filenameForID(s.ID)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	store.archiveMu.Lock()
+	defer store.archiveMu.Unlock()
+
+	asideFilename := filename + ".atomic"
+	if err := ioutil.WriteFile(asideFilename, s.Body, 0600); err != nil {
+		os.Remove(asideFilename)
+		return err
+	}
+	for _, name := range pasteMetadataNames {
+		if value, ok := s.Metadata[name]; ok {
+			putMetadata(asideFilename, name, value)
+		}
+	}
+	os.Chtimes(asideFilename, s.Modified, s.Modified)
+
+	store.forgetArchivedBody(filename)
+	return os.Rename(asideFilename, filename)
+}
+
+// ReplicationJournal is the primary's bounded, persistent log of paste
+// changes. Sequence numbers keep increasing across restarts.
+type ReplicationJournal struct {
+	Events  []ReplicationEvent
+	NextSeq uint64
+
+	size     int
+	filename string
+	mu       sync.Mutex
+	notify   []chan ReplicationEvent
+	// metrics prefixes the names of the journal's metrics.
+	metrics string
+}
+
+func LoadReplicationJournal(filename string, size int) *ReplicationJournal {
+	j := &ReplicationJournal{NextSeq: 1}
+	if file, err := os.Open(filename); err == nil {
+		if err := gob.NewDecoder(file).Decode(j); err != nil {
+			glog.Error("Failed to decode replication journal: ", err)
+		}
+		file.Close()
+	}
+	j.size = size
+	j.filename = filename
+	j.metrics = "replication"
+	return j
+}
+
+func (j *ReplicationJournal) save() error {
+	asideFilename := j.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := gob.NewEncoder(file).Encode(j); err != nil {
+		glog.Error("Failed to save replication journal: ", err)
+		return err
+	}
+	return os.Rename(asideFilename, j.filename)
+}
+
+func (j *ReplicationJournal) Record(t ReplicationEventType, id PasteID) {
+	j.mu.Lock()
+	ev := ReplicationEvent{Seq: j.NextSeq, Type: t, ID: id, Time: time.Now()}
+	j.NextSeq++
+	j.Events = append(j.Events, ev)
+	if len(j.Events) > j.size {
+		j.Events = append([]ReplicationEvent(nil), j.Events[len(j.Events)-j.size:]...)
+	}
+	j.save()
+	notify := j.notify
+	j.mu.Unlock()
+
+	healthServer.IncrementMetric(j.metrics + ".events")
+	for _, c := range notify {
+		select {
+		case c <- ev:
+		default:
+			healthServer.IncrementMetric(j.metrics + ".push.dropped")
+		}
+	}
+}
+
+// Since returns the events after seq. complete is false if some of them
+// have already been dropped from the journal.
+func (j *ReplicationJournal) Since(seq uint64, limit int) (events []ReplicationEvent, complete bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	complete = seq+1 >= j.NextSeq || (len(j.Events) > 0 && j.Events[0].Seq <= seq+1)
+	for _, ev := range j.Events {
+		if ev.Seq > seq {
+			events = append(events, ev)
+			if len(events) == limit {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (j *ReplicationJournal) Head() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.NextSeq - 1
+}
+
+// Subscribe returns a channel that receives every event recorded from now
+// on. Events are dropped if the channel's buffer is full.
+func (j *ReplicationJournal) Subscribe() <-chan ReplicationEvent {
+	c := make(chan ReplicationEvent, 1024)
+	j.mu.Lock()
+	j.notify = append(j.notify, c)
+	j.mu.Unlock()
+	return c
+}
+
+// Unsubscribe stops sending events to c, a channel returned by Subscribe.
+func (j *ReplicationJournal) Unsubscribe(c <-chan ReplicationEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i, n := range j.notify {
+		if n == c {
+			j.notify = append(j.notify[:i:i], j.notify[i+1:]...)
+			return
+		}
+	}
+}
+
+// watch records the changes published on the event bus. A paste going into
+// the trash is gone as far as anyone following the journal is concerned,
+// and comes back (as an update) if it is restored.
+func (j *ReplicationJournal) watch() {
+	SubscribeEvent(func(ev *Event) {
+		switch {
+		case ev.Kind == EventPasteCreated:
+			j.Record(ReplicationEventCreate, ev.PasteID)
+		case ev.Kind == EventPasteModified && ev.Paste.trashed == TrashReasonExpired:
+			j.Record(ReplicationEventExpire, ev.PasteID)
+		case ev.Kind == EventPasteModified && ev.Paste.trashed != "":
+			j.Record(ReplicationEventDelete, ev.PasteID)
+		case ev.Kind == EventPasteModified:
+			j.Record(ReplicationEventUpdate, ev.PasteID)
+		case ev.Paste.trashed != "":
+			// Recorded when it was trashed.
+		case ev.Paste.expired:
+			j.Record(ReplicationEventExpire, ev.PasteID)
+		default:
+			j.Record(ReplicationEventDelete, ev.PasteID)
+		}
+	}, EventPasteCreated, EventPasteModified, EventPasteDestroyed)
+}
+
+type ReplicationPasteInfo struct {
+	ID       PasteID   `json:"id"`
+	Modified time.Time `json:"modified"`
+}
+
+type replicationEventsResponse struct {
+	Events []ReplicationEvent `json:"events"`
+	Head   uint64             `json:"head"`
+}
+
+const REPLICATION_EVENT_PAGE_SIZE int = 500
+
+// Replicator implements both sides of replication; Journal is set only on
+// the primary.
+type Replicator struct {
+	Store    *FilesystemPasteStore
+	Journal  *ReplicationJournal
+	Token    string
+	Primary  string
+	Conflict string
+	// StateFilename records the last event a pulling secondary applied.
+	StateFilename string
+
+	client *http.Client
+}
+
+func (rep *Replicator) httpClient() *http.Client {
+	if rep.client == nil {
+		rep.client = &http.Client{Timeout: 1 * time.Minute}
+	}
+	return rep.client
+}
+
+func (rep *Replicator) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return rep.Token != "" && hmac.Equal([]byte(token), []byte(rep.Token))
+}
+
+func (rep *Replicator) requiresToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rep.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func writeReplicationJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (rep *Replicator) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseUint(r.FormValue("since"), 10, 64)
+	events, complete := rep.Journal.Since(since, REPLICATION_EVENT_PAGE_SIZE)
+	if !complete {
+		http.Error(w, "The journal no longer reaches back that far; run replication-sync.", http.StatusGone)
+		return
+	}
+	writeReplicationJSON(w, &replicationEventsResponse{Events: events, Head: rep.Journal.Head()})
+}
+
+func (rep *Replicator) pastesHandler(w http.ResponseWriter, r *http.Request) {
+	pastes := []ReplicationPasteInfo{}
+	err := rep.Store.Walk(func(id PasteID) error {
+		if fi, err := os.Stat(rep.Store.filenameForID(id)); err == nil {
+			pastes = append(pastes, ReplicationPasteInfo{ID: id, Modified: fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Replication-Head", strconv.FormatUint(rep.Journal.Head(), 10))
+	writeReplicationJSON(w, pastes)
+}
+
+func (rep *Replicator) pasteHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := rep.Store.Snapshot(PasteIDFromString(mux.Vars(r)["id"]))
+	if err != nil {
+		if _, ok := err.(PasteNotFoundError); ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeReplicationJSON(w, s)
+}
+
+func (rep *Replicator) applyHandler(w http.ResponseWriter, r *http.Request) {
+	var change ReplicationChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rep.Apply(change.Event, change.Snapshot); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// localIsNewer reports whether the conflict rule says to keep the local copy
+// of a paste over a change made on the primary at t.
+func (rep *Replicator) localIsNewer(id PasteID, t time.Time) bool {
+	if rep.Conflict == ReplicationConflictPrimary {
+		return false
+	}
+	fi, err := os.Stat(rep.Store.filenameForID(id))
+	return err == nil && fi.ModTime().After(t)
+}
+
+// Apply brings a change from the primary into the local store. snapshot is
+// required for creations and updates.
+func (rep *Replicator) Apply(ev ReplicationEvent, snapshot *PasteSnapshot) error {
+	switch ev.Type {
+	case ReplicationEventCreate, ReplicationEventUpdate:
+		if snapshot == nil {
+			return fmt.Errorf("%s event for %v has no snapshot", ev.Type, ev.ID)
+		}
+		if rep.localIsNewer(snapshot.ID, snapshot.Modified) {
+			glog.Info("REPLICATION: Keeping newer local copy of ", snapshot.ID)
+			healthServer.IncrementMetric("replication.conflicts")
+			return nil
+		}
+		if err := rep.Store.Restore(snapshot); err != nil {
+			return err
+		}
+		forgetRenderedPaste(snapshot.ID)
+		scheduleRestoredExpiration(rep.Store, snapshot.ID)
+
+	case ReplicationEventDelete, ReplicationEventExpire:
+		if rep.localIsNewer(ev.ID, ev.Time) {
+			glog.Info("REPLICATION: Keeping newer local copy of deleted paste ", ev.ID)
+			healthServer.IncrementMetric("replication.conflicts")
+			return nil
+		}
+		err := rep.Store.Destroy(&Paste{ID: ev.ID, store: rep.Store, deletionReason: "replicated from primary (" + string(ev.Type) + ")"})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown replication event type %q", ev.Type)
+	}
+
+	healthServer.IncrementMetric("replication.applied")
+	return nil
+}
+
+// scheduleRestoredExpiration registers a restored paste with the local
+// expirator; expiration times follow from the paste's modification time,
+// which restoring preserves. It reports whether the schedule changed.
+func scheduleRestoredExpiration(store *FilesystemPasteStore, id PasteID) bool {
+	p, err := store.Get(id, nil)
+	if p == nil {
+		if err != nil {
+			glog.Error("Failed to load restored paste ", id, ": ", err)
+		}
+		return false
+	}
+	if p.trashed != "" {
+		pasteExpirator.ExpireObject(p, p.trashedUntil.Sub(time.Now()))
+	} else if p.Expiration != "" && p.Expiration != "-1" {
+		// An expiration in the past fires immediately.
+		pasteExpirator.ExpireObject(p, p.ExpirationTime().Sub(time.Now()))
+	} else if pasteExpirator.ObjectHasExpiration(p) {
+		pasteExpirator.CancelObjectExpiration(p)
+	} else {
+		return false
+	}
+	return true
+}
+
+func (rep *Replicator) fetch(path string, v interface{}) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(rep.Primary, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+rep.Token)
+	resp, err := rep.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp, ReplicationResponseError{StatusCode: resp.StatusCode}
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(v)
+}
+
+type ReplicationResponseError struct {
+	StatusCode int
+}
+
+func (e ReplicationResponseError) Error() string {
+	return fmt.Sprintf("primary returned %d", e.StatusCode)
+}
+
+func (rep *Replicator) fetchSnapshot(id PasteID) (*PasteSnapshot, error) {
+	var s PasteSnapshot
+	if _, err := rep.fetch("/replication/pastes/"+url.PathEscape(id.String()), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (rep *Replicator) lastAppliedSeq() uint64 {
+	b, err := ioutil.ReadFile(rep.StateFilename)
+	if err != nil {
+		return 0
+	}
+	seq, _ := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return seq
+}
+
+func (rep *Replicator) setLastAppliedSeq(seq uint64) error {
+	return ioutil.WriteFile(rep.StateFilename, []byte(strconv.FormatUint(seq, 10)+"\n"), 0600)
+}
+
+// Pull applies every event the primary has journaled since the last pull.
+func (rep *Replicator) Pull() (int, error) {
+	n := 0
+	seq := rep.lastAppliedSeq()
+	for {
+		var page replicationEventsResponse
+		if _, err := rep.fetch("/replication/events?since="+strconv.FormatUint(seq, 10), &page); err != nil {
+			return n, err
+		}
+		if len(page.Events) == 0 {
+			if page.Head < seq {
+				// The primary's journal has been reset.
+				return n, ReplicationResponseError{StatusCode: http.StatusGone}
+			}
+			return n, nil
+		}
+
+		for _, ev := range page.Events {
+			var snapshot *PasteSnapshot
+			if ev.Type == ReplicationEventCreate || ev.Type == ReplicationEventUpdate {
+				var err error
+				snapshot, err = rep.fetchSnapshot(ev.ID)
+				if rerr, ok := err.(ReplicationResponseError); ok && rerr.StatusCode == http.StatusNotFound {
+					// It has since been deleted; a later event says so.
+					seq = ev.Seq
+					continue
+				} else if err != nil {
+					return n, err
+				}
+			}
+			if err := rep.Apply(ev, snapshot); err != nil {
+				return n, err
+			}
+			seq = ev.Seq
+			n++
+		}
+		if err := rep.setLastAppliedSeq(seq); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Sync makes the local store match the primary's, pulling every paste that
+// is missing or out of date. Local pastes the primary does not have are
+// removed only under the "primary" conflict rule.
+func (rep *Replicator) Sync(progress func(PasteID)) (int, error) {
+	var pastes []ReplicationPasteInfo
+	resp, err := rep.fetch("/replication/pastes", &pastes)
+	if err != nil {
+		return 0, err
+	}
+	head, _ := strconv.ParseUint(resp.Header.Get("X-Replication-Head"), 10, 64)
+
+	n := 0
+	remote := make(map[PasteID]bool, len(pastes))
+	for _, info := range pastes {
+		remote[info.ID] = true
+		if fi, err := os.Stat(rep.Store.filenameForID(info.ID)); err == nil && fi.ModTime().Equal(info.Modified) {
+			continue
+		}
+
+		snapshot, err := rep.fetchSnapshot(info.ID)
+		if rerr, ok := err.(ReplicationResponseError); ok && rerr.StatusCode == http.StatusNotFound {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		ev := ReplicationEvent{Type: ReplicationEventUpdate, ID: info.ID, Time: info.Modified}
+		if err := rep.Apply(ev, snapshot); err != nil {
+			return n, err
+		}
+		if progress != nil {
+			progress(info.ID)
+		}
+		n++
+	}
+
+	if rep.Conflict == ReplicationConflictPrimary {
+		var extra []PasteID
+		rep.Store.Walk(func(id PasteID) error {
+			if !remote[id] {
+				extra = append(extra, id)
+			}
+			return nil
+		})
+		for _, id := range extra {
+			if err := rep.Store.Destroy(&Paste{ID: id, store: rep.Store, deletionReason: "not on primary"}); err != nil {
+				return n, err
+			}
+			if progress != nil {
+				progress(id)
+			}
+			n++
+		}
+	}
+
+	// Anything that changed while we were listing will be pulled again;
+	// applying a change twice is harmless.
+	return n, rep.setLastAppliedSeq(head)
+}
+
+func (rep *Replicator) RunPull(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for _ = range ticker.C {
+		n, err := rep.Pull()
+		if rerr, ok := err.(ReplicationResponseError); ok && rerr.StatusCode == http.StatusGone {
+			glog.Warning("REPLICATION: Fell behind the primary's journal; resynchronizing.")
+			n, err = rep.Sync(nil)
+		}
+		if err != nil {
+			glog.Error("REPLICATION: Pull failed: ", err)
+			healthServer.IncrementMetric("replication.errors")
+		}
+		if n > 0 {
+			glog.Infof("REPLICATION: Applied %d changes from the primary.", n)
+		}
+	}
+}
+
+// RunPush posts every journaled change to a secondary as it happens. A
+// secondary that misses a push (because it was down, say) should be brought
+// back up to date with replication-sync.
+func (rep *Replicator) RunPush(target string) {
+	events := rep.Journal.Subscribe()
+	for ev := range events {
+		change := &ReplicationChange{Event: ev}
+		if ev.Type == ReplicationEventCreate || ev.Type == ReplicationEventUpdate {
+			snapshot, err := rep.Store.Snapshot(ev.ID)
+			if err != nil {
+				// Deleted before we got to it; its delete event is coming.
+				continue
+			}
+			change.Snapshot = snapshot
+		}
+
+		if err := rep.push(target, change); err != nil {
+			glog.Error("REPLICATION: Failed to push ", ev.ID, " to ", target, ": ", err)
+			healthServer.IncrementMetric("replication.errors")
+		}
+	}
+}
+
+func (rep *Replicator) push(target string, change *ReplicationChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(target, "/")+"/replication/apply", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+rep.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rep.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return ReplicationResponseError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// RegisterRoutes adds the endpoints for this instance's replication role.
+func (rep *Replicator) RegisterRoutes(router *mux.Router) {
+	if rep.Journal != nil {
+		router.Methods("GET").Path("/replication/events").Handler(rep.requiresToken(http.HandlerFunc(rep.eventsHandler)))
+		router.Methods("GET").Path("/replication/pastes").Handler(rep.requiresToken(http.HandlerFunc(rep.pastesHandler)))
+		router.Methods("GET").Path("/replication/pastes/{id}").Handler(rep.requiresToken(http.HandlerFunc(rep.pasteHandler)))
+	} else {
+		router.Methods("POST").Path("/replication/apply").Handler(rep.requiresToken(http.HandlerFunc(rep.applyHandler)))
+	}
+}
+
+var replicator *Replicator
+
+func init() {
+	RegisterCommand("replication-sync", "bring this secondary up to date with its primary", func(args []string) error {
+		if replicator == nil || replicator.Journal != nil || replicator.Primary == "" {
+			return fmt.Errorf("this instance is not a secondary with a primary configured")
+		}
+		n, err := replicator.Sync(func(id PasteID) {
+			fmt.Println(id)
+		})
+		fmt.Printf("Synchronized %d pastes.\n", n)
+		return err
+	})
+}
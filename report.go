@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
@@ -14,10 +15,18 @@ import (
 type ReportInfo map[string]int
 type ReportStore struct {
 	Reports  map[PasteID]ReportInfo
+	mu       sync.Mutex
 	filename string
 }
 
 func (r *ReportStore) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.save()
+}
+
+// save must be called with mu held.
+func (r *ReportStore) save() error {
 	asideFilename := r.filename + ".atomic"
 	file, err := os.Create(asideFilename)
 	if err != nil {
@@ -37,6 +46,8 @@ func (r *ReportStore) Save() error {
 }
 
 func (r *ReportStore) Add(id PasteID, kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	currentReportsForPaste, ok := r.Reports[id]
 
 	if !ok {
@@ -45,13 +56,31 @@ func (r *ReportStore) Add(id PasteID, kind string) {
 	}
 
 	currentReportsForPaste[kind] = currentReportsForPaste[kind] + 1
-	r.Save()
+	r.save()
 }
 
 func (r *ReportStore) Delete(p PasteID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.Reports, p)
 	glog.Info(p, " deleted from report history.")
-	r.Save()
+	r.save()
+}
+
+// All returns a copy of every paste's reports, safe to range over (or hand to
+// a template) while new reports are being filed.
+func (r *ReportStore) All() map[PasteID]ReportInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reports := make(map[PasteID]ReportInfo, len(r.Reports))
+	for id, info := range r.Reports {
+		infoCopy := make(ReportInfo, len(info))
+		for kind, n := range info {
+			infoCopy[kind] = n
+		}
+		reports[id] = infoCopy
+	}
+	return reports
 }
 
 func LoadReportStore(filename string) *ReportStore {
@@ -90,7 +119,7 @@ func reportPaste(o Model, w http.ResponseWriter, r *http.Request) {
 }
 
 func reportClear(w http.ResponseWriter, r *http.Request) {
-	defer errorRecoveryHandler(w)
+	defer errorRecoveryHandler(w, r)
 
 	id := PasteIDFromString(mux.Vars(r)["id"])
 	reportStore.Delete(id)
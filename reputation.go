@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Writers' IP addresses can be scored by reputation providers: DNS
+// blocklists, or an HTTP service. A score runs from 0 (nothing known
+// against the address) to 1 (known bad); a request's score is the worst
+// any provider gives it, cached for a while so that providers aren't asked
+// about every request.
+//
+// Scores feed the abuse checks and the limits on anonymous clients:
+// addresses scoring at least reputation.block_score are blocked like any
+// other abusive source, and those scoring at least suspect_score get half
+// the burst allowance, fewer password attempts and harder proof-of-work
+// challenges. Providers that fail or time out are taken to know nothing.
+
+// A ReputationProvider scores IP addresses.
+type ReputationProvider interface {
+	Name() string
+	Score(ctx context.Context, ip net.IP) (float64, error)
+}
+
+var reputationProviders struct {
+	sync.Mutex
+	list []ReputationProvider
+}
+
+func RegisterReputationProvider(provider ReputationProvider) {
+	reputationProviders.Lock()
+	reputationProviders.list = append(reputationProviders.list, provider)
+	reputationProviders.Unlock()
+}
+
+// dnsblReputationProvider looks addresses up in a DNS blocklist zone;
+// listed addresses score 1.
+type dnsblReputationProvider struct {
+	zone     string
+	resolver *net.Resolver
+}
+
+func (p *dnsblReputationProvider) Name() string {
+	return "dnsbl:" + p.zone
+}
+
+// dnsblName returns the name under which zone lists ip: its octets (or, for
+// IPv6, its nibbles) reversed.
+func dnsblName(ip net.IP, zone string) string {
+	var labels []string
+	if v4 := ip.To4(); v4 != nil {
+		for i := len(v4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(v4[i]))
+		}
+	} else {
+		const hex = "0123456789abcdef"
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, string(hex[ip[i]&0xf]), string(hex[ip[i]>>4]))
+		}
+	}
+	return strings.Join(labels, ".") + "." + zone
+}
+
+func (p *dnsblReputationProvider) Score(ctx context.Context, ip net.IP) (float64, error) {
+	addrs, err := p.resolver.LookupHost(ctx, dnsblName(ip, p.zone))
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	// Blocklists answer within 127.0.0.0/8; anything else is a resolver
+	// that answers everything.
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "127.") {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// httpReputationProvider asks an HTTP service: it GETs a URL template with
+// {ip} replaced by the address, and expects {"score": <0 to 1>}.
+type httpReputationProvider struct {
+	url    string
+	client *http.Client
+}
+
+func (p *httpReputationProvider) Name() string {
+	return "http"
+}
+
+func (p *httpReputationProvider) Score(ctx context.Context, ip net.IP) (float64, error) {
+	req, err := http.NewRequest("GET", strings.Replace(p.url, "{ip}", url.QueryEscape(ip.String()), -1), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("reputation service answered %s", resp.Status)
+	}
+	var body struct {
+		Score float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	if body.Score < 0 || body.Score > 1 {
+		return 0, fmt.Errorf("reputation service gave a score of %v", body.Score)
+	}
+	return body.Score, nil
+}
+
+// ipReputation returns the score of r's source address.
+func ipReputation(r *http.Request) float64 {
+	reputationProviders.Lock()
+	providers := reputationProviders.list
+	reputationProviders.Unlock()
+	if len(providers) == 0 {
+		return 0
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(strings.Split(SourceIPForRequest(r), ",")[0]))
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return 0
+	}
+	key := "REP|" + StoredIPForRequest(r)
+	if v, ok := ephStore.Get(key); ok {
+		return v.(float64)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), instanceConfig.Reputation.Timeout.Duration())
+	defer cancel()
+	scores := make(chan float64, len(providers))
+	for _, provider := range providers {
+		go func(provider ReputationProvider) {
+			score, err := provider.Score(ctx, ip)
+			if err != nil {
+				glog.Warningf("Reputation provider %s failed: %v", provider.Name(), err)
+				healthServer.IncrementMetric("reputation.failed")
+			}
+			scores <- score
+		}(provider)
+	}
+	var worst float64
+	for range providers {
+		if score := <-scores; score > worst {
+			worst = score
+		}
+	}
+
+	ephStore.Put(key, worst, privacyRetention(instanceConfig.Reputation.Cache.Duration()))
+	healthServer.IncrementMetric("reputation.checked")
+	if worst > 0 && worst >= instanceConfig.Reputation.SuspectScore {
+		healthServer.IncrementMetric("reputation.suspect")
+	}
+	return worst
+}
+
+// ipSuspect reports whether r's source address scores at least
+// reputation.suspect_score.
+func ipSuspect(r *http.Request) bool {
+	score := ipReputation(r)
+	return score > 0 && score >= instanceConfig.Reputation.SuspectScore
+}
+
+// startReputationProviders registers the providers named in the
+// configuration.
+func startReputationProviders() {
+	timeout := instanceConfig.Reputation.Timeout.Duration()
+	for _, zone := range instanceConfig.Reputation.DNSBL {
+		RegisterReputationProvider(&dnsblReputationProvider{zone: strings.Trim(zone, "."), resolver: net.DefaultResolver})
+	}
+	if u := instanceConfig.Reputation.HTTP; u != "" {
+		if !strings.Contains(u, "{ip}") {
+			glog.Fatalf("reputation.http (%q) must contain {ip}", u)
+		}
+		RegisterReputationProvider(&httpReputationProvider{url: u, client: &http.Client{Timeout: timeout}})
+	}
+}
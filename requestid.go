@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Every request has an ID, sent back as X-Request-ID: the one it came
+// with, if http.trust_request_id is set and it looks like one (so that a
+// proxy in front can hand down its own), or a new one. It is shown on error
+// pages and in API error bodies, logged with the panics it comes to, and
+// sent along to the error reporters, so that someone reporting a failed
+// request can say which it was, and an operator can find it. With
+// http.log_requests set, every request is logged along with its ID.
+
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+func newRequestID() string {
+	id, err := generateRandomBase32String(10, 16)
+	if err != nil {
+		return newErrorID()
+	}
+	return id
+}
+
+// RequestID returns r's ID, or "" for a nil request.
+func RequestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// responseRequestID returns the ID of the request w is answering.
+func responseRequestID(w http.ResponseWriter) string {
+	return w.Header().Get(requestIDHeader)
+}
+
+type requestLogWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+}
+
+func (w *requestLogWriter) WriteHeader(status int) {
+	if w.statusCode == 0 {
+		w.statusCode = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestLogWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *requestLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type requestIDHandler struct {
+	http.Handler
+}
+
+func (h requestIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(requestIDHeader)
+	if !instanceConfig.HTTP.TrustRequestID || !requestIDPattern.MatchString(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+
+	if !instanceConfig.HTTP.LogRequests {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	lw := &requestLogWriter{ResponseWriter: w}
+	defer func() {
+		status := lw.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		glog.Infof("Request %s: %s %s %d %dB %v", id, r.Method, r.URL.RequestURI(), status, lw.written, time.Since(start))
+	}()
+	h.Handler.ServeHTTP(lw, r)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Operators can offer retention classes (retention.classes), which bound
+// how long the pastes in them may live: an "ephemeral" class might allow an
+// hour at most, and an "archive" class have no bound at all. A paste is put
+// in a class when it is created or edited (retention), or in
+// retention.default if it is created without one. Classes may be kept for
+// accounts, or for those with a permission.
+//
+// setPasteExpiration holds a paste's expiration to its class: one that is
+// longer than the class allows (or never) is cut to the class's maximum.
+// Changing a class's maximum applies to pastes as their expirations are
+// next set, not to those already scheduled. Pastes an admin has exempted
+// (see exemption.go) aren't held to their class.
+
+// RetentionClass is a named bound on how long pastes may live.
+type RetentionClass struct {
+	Name  string `yaml:"name" json:"name"`
+	Label string `yaml:"label" json:"label"`
+	// Max is the longest pastes in the class may live, as a duration;
+	// "" for no bound.
+	Max string `yaml:"max" json:"max,omitempty"`
+	// Requires is who may put pastes in the class: "" for anyone,
+	// "account" for anyone logged in, or the name of a permission.
+	Requires string `yaml:"requires" json:"requires,omitempty"`
+}
+
+// MaxDuration returns the longest pastes in c may live, or 0 if there is
+// no bound.
+func (c *RetentionClass) MaxDuration() time.Duration {
+	d, _ := ParseDuration(c.Max)
+	return d
+}
+
+// availableTo reports whether r may put pastes in c.
+func (c *RetentionClass) availableTo(r *http.Request) bool {
+	switch c.Requires {
+	case "":
+		return true
+	case "account":
+		return GetUser(r) != nil
+	}
+	return userHasPermission(r, c.Requires) || userHasPermission(r, "admin")
+}
+
+func validateRetentionConfig(c *_Configuration) error {
+	seen := make(map[string]bool)
+	for _, class := range c.Retention.Classes {
+		if class.Name == "" || seen[class.Name] {
+			return fmt.Errorf("retention class %q needs a name of its own", class.Name)
+		}
+		seen[class.Name] = true
+		if class.Max != "" {
+			if d, err := ParseDuration(class.Max); err != nil || d <= 0 {
+				return fmt.Errorf("retention class %q: max %q is not a duration", class.Name, class.Max)
+			}
+		}
+	}
+	if c.Retention.Default != "" && !seen[c.Retention.Default] {
+		return fmt.Errorf("retention.default: no class is named %q", c.Retention.Default)
+	}
+	return nil
+}
+
+// RetentionClassNamed returns the configured class with the given name, or
+// nil.
+func RetentionClassNamed(name string) *RetentionClass {
+	if name == "" {
+		return nil
+	}
+	for i := range instanceConfig.Retention.Classes {
+		if instanceConfig.Retention.Classes[i].Name == name {
+			return &instanceConfig.Retention.Classes[i]
+		}
+	}
+	return nil
+}
+
+// parseRetention validates a retention class as submitted: "" (none given)
+// or the name of a configured class. Whether the submitter may use it is
+// up to checkRetentionClass.
+func parseRetention(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return s, nil
+	}
+	if RetentionClassNamed(s) == nil {
+		names := make([]string, 0, len(instanceConfig.Retention.Classes))
+		for _, class := range instanceConfig.Retention.Classes {
+			names = append(names, class.Name)
+		}
+		if len(names) == 0 {
+			return "", PasteInputError{"retention", "can't be chosen on this instance"}
+		}
+		return "", PasteInputError{"retention", "must be one of " + strings.Join(names, ", ")}
+	}
+	return s, nil
+}
+
+// checkRetentionClass refuses in if it puts a paste in a class r may not
+// use.
+func checkRetentionClass(r *http.Request, in *PasteInput) error {
+	if class := RetentionClassNamed(in.Retention); class != nil && !class.availableTo(r) {
+		healthServer.IncrementMetric("retention." + class.Name + ".refused")
+		return PasteInputError{"retention", "is not available to you"}
+	}
+	return nil
+}
+
+// defaultRetention returns s, or the default retention class if s is "".
+func defaultRetention(s string) string {
+	if s == "" {
+		return instanceConfig.Retention.Default
+	}
+	return s
+}
+
+// retainedExpiration returns expireIn ("-1" for never), held to the
+// maximum of p's retention class.
+func retainedExpiration(p *Paste, expireIn string) string {
+	class := RetentionClassNamed(p.Retention)
+	if class == nil || class.Max == "" || retentionExempt(p) {
+		return expireIn
+	}
+	if expireIn != "" && expireIn != "-1" {
+		if d, err := ParseDuration(expireIn); err == nil && d <= class.MaxDuration() {
+			return expireIn
+		}
+	}
+	healthServer.IncrementMetric("retention." + class.Name + ".capped")
+	return class.Max
+}
+
+// pasteRetention describes p's retention class for its JSON, or returns
+// nil if it has none.
+func pasteRetention(p *Paste) map[string]interface{} {
+	class := RetentionClassNamed(p.Retention)
+	if class == nil {
+		return nil
+	}
+	retention := map[string]interface{}{"class": class.Name, "label": class.Label}
+	if class.Max != "" {
+		retention["max"] = class.Max
+	}
+	return retention
+}
+
+// retentionClassesFor returns the classes r may put pastes in.
+func retentionClassesFor(r *http.Request) []RetentionClass {
+	var classes []RetentionClass
+	for _, class := range instanceConfig.Retention.Classes {
+		if class.availableTo(r) {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+func init() {
+	RegisterTemplateFunction("retentionClasses", func(ri *RenderContext) []RetentionClass { return retentionClassesFor(ri.Request) })
+	RegisterTemplateFunction("retentionDefault", func() string { return instanceConfig.Retention.Default })
+}
@@ -0,0 +1,965 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DHowett/ghostbin/account"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Identity providers can manage accounts through SCIM 2.0 (RFC 7643 and
+// 7644) at /scim/v2, authenticating with scim.token. Provisioned users are
+// ordinary accounts, created with the password the provider sends, if any;
+// deactivating or deleting one disables the account, which keeps its
+// pastes but can no longer log in. Groups confer the permissions that
+// scim.group_permissions lists for their display names.
+//
+// Accounts are stored under a hash of their names, which can't be listed,
+// so scim.gob keeps the provisioned users' names and IDs, and the groups.
+
+const (
+	scimUserSchema     = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema    = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema     = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema    = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema    = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimMaxResultsPage = 200
+)
+
+type SCIMUser struct {
+	ID         string
+	UserName   string
+	ExternalID string
+	Active     bool
+	Created    time.Time
+	Modified   time.Time
+}
+
+type SCIMGroup struct {
+	ID          string
+	DisplayName string
+	ExternalID  string
+	// Members holds the IDs of member users.
+	Members  []string
+	Created  time.Time
+	Modified time.Time
+}
+
+type SCIMStore struct {
+	Users  map[string]*SCIMUser
+	Groups map[string]*SCIMGroup
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *SCIMStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = gob.NewEncoder(file).Encode(s)
+	if err != nil {
+		glog.Error("Failed to save SCIM state: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+func LoadSCIMStore(filename string) *SCIMStore {
+	var s *SCIMStore
+	file, err := os.Open(filename)
+	if err == nil {
+		err := gob.NewDecoder(file).Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode SCIM state: ", err)
+		}
+	}
+	if s == nil {
+		s = &SCIMStore{}
+	}
+	if s.Users == nil {
+		s.Users = make(map[string]*SCIMUser)
+	}
+	if s.Groups == nil {
+		s.Groups = make(map[string]*SCIMGroup)
+	}
+	s.filename = filename
+	return s
+}
+
+// userNamed returns the provisioned user with the given name. It must be
+// called with s.mu held.
+func (s *SCIMStore) userNamed(name string) *SCIMUser {
+	for _, u := range s.Users {
+		if strings.EqualFold(u.UserName, name) {
+			return u
+		}
+	}
+	return nil
+}
+
+// groupsOf returns the groups u is a member of. It must be called with
+// s.mu held.
+func (s *SCIMStore) groupsOf(id string) []*SCIMGroup {
+	var groups []*SCIMGroup
+	for _, g := range s.Groups {
+		for _, member := range g.Members {
+			if member == id {
+				groups = append(groups, g)
+				break
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].DisplayName < groups[j].DisplayName })
+	return groups
+}
+
+// syncAccount brings the account of the provisioned user with the given
+// ID into line: disabled unless active, and holding its groups'
+// permissions. It must be called with s.mu held.
+func (s *SCIMStore) syncAccount(id string) {
+	u, ok := s.Users[id]
+	if !ok {
+		return
+	}
+	user := userStore.Get(u.UserName)
+	if user == nil {
+		return
+	}
+	perms := PastePermission{}
+	for _, g := range s.groupsOf(id) {
+		for _, perm := range instanceConfig.SCIM.GroupPermissions[g.DisplayName] {
+			perms[perm] = true
+		}
+	}
+	user.Values["scim.permissions"] = perms
+	if u.Active {
+		delete(user.Values, "disabled")
+	} else {
+		user.Values["disabled"] = true
+	}
+	if err := user.Save(); err != nil {
+		glog.Errorf("SCIM: Failed to save %s: %v", u.UserName, err)
+	}
+}
+
+// syncAll brings every provisioned account into line, after the group
+// permissions have changed.
+func (s *SCIMStore) syncAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.Users {
+		s.syncAccount(id)
+	}
+}
+
+func accountDisabled(user *account.User) bool {
+	disabled, _ := user.Values["disabled"].(bool)
+	return disabled
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type scimRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimUserResource struct {
+	Schemas    []string  `json:"schemas"`
+	ID         string    `json:"id,omitempty"`
+	UserName   string    `json:"userName"`
+	ExternalID string    `json:"externalId,omitempty"`
+	Active     *bool     `json:"active,omitempty"`
+	Password   string    `json:"password,omitempty"`
+	Groups     []scimRef `json:"groups,omitempty"`
+	Meta       *scimMeta `json:"meta,omitempty"`
+}
+
+type scimGroupResource struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id,omitempty"`
+	DisplayName string    `json:"displayName"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	Members     []scimRef `json:"members"`
+	Meta        *scimMeta `json:"meta,omitempty"`
+}
+
+// userResource must be called with s.mu held.
+func (s *SCIMStore) userResource(u *SCIMUser) *scimUserResource {
+	active := u.Active
+	res := &scimUserResource{
+		Schemas:    []string{scimUserSchema},
+		ID:         u.ID,
+		UserName:   u.UserName,
+		ExternalID: u.ExternalID,
+		Active:     &active,
+		Meta:       &scimMeta{"User", u.Created.UTC(), u.Modified.UTC(), "/scim/v2/Users/" + u.ID},
+	}
+	for _, g := range s.groupsOf(u.ID) {
+		res.Groups = append(res.Groups, scimRef{Value: g.ID, Display: g.DisplayName, Ref: "/scim/v2/Groups/" + g.ID})
+	}
+	return res
+}
+
+// groupResource must be called with s.mu held.
+func (s *SCIMStore) groupResource(g *SCIMGroup) *scimGroupResource {
+	res := &scimGroupResource{
+		Schemas:     []string{scimGroupSchema},
+		ID:          g.ID,
+		DisplayName: g.DisplayName,
+		ExternalID:  g.ExternalID,
+		Members:     []scimRef{},
+		Meta:        &scimMeta{"Group", g.Created.UTC(), g.Modified.UTC(), "/scim/v2/Groups/" + g.ID},
+	}
+	for _, id := range g.Members {
+		ref := scimRef{Value: id, Ref: "/scim/v2/Users/" + id}
+		if u, ok := s.Users[id]; ok {
+			ref.Display = u.UserName
+		}
+		res.Members = append(res.Members, ref)
+	}
+	return res
+}
+
+type SCIMError struct {
+	Status   int
+	SCIMType string
+	Detail   string
+}
+
+func (e SCIMError) Error() string {
+	return e.Detail
+}
+
+func scimError(status int, scimType, format string, args ...interface{}) SCIMError {
+	return SCIMError{status, scimType, fmt.Sprintf(format, args...)}
+}
+
+func writeSCIMResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	if v != nil {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			glog.Error("Failed to encode SCIM response: ", err)
+		}
+	}
+}
+
+func writeSCIMError(w http.ResponseWriter, err SCIMError) {
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(err.Status),
+		"detail":  err.Detail,
+	}
+	if err.SCIMType != "" {
+		body["scimType"] = err.SCIMType
+	}
+	writeSCIMResponse(w, err.Status, body)
+}
+
+// scimHandler answers SCIM requests that carry scim.token.
+type scimHandler func(w http.ResponseWriter, r *http.Request) error
+
+func (h scimHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := instanceConfig.SCIM.Token
+	if token == "" {
+		writeSCIMError(w, scimError(http.StatusNotFound, "", "SCIM is not enabled on this instance"))
+		return
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hmac.Equal([]byte(given), []byte(token)) {
+		healthServer.IncrementMetric("scim.unauthorized")
+		writeSCIMError(w, scimError(http.StatusUnauthorized, "", "a valid bearer token is required"))
+		return
+	}
+	if err := h(w, r); err != nil {
+		scimErr, ok := err.(SCIMError)
+		if !ok {
+			glog.Error("SCIM: ", err)
+			scimErr = scimError(http.StatusInternalServerError, "", "%v", err)
+		}
+		writeSCIMError(w, scimErr)
+	}
+}
+
+func decodeSCIMBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return scimError(http.StatusBadRequest, "invalidSyntax", "the request body could not be understood: %v", err)
+	}
+	return nil
+}
+
+var scimFilterPattern = regexp.MustCompile(`^\s*(\w+)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// parseSCIMFilter understands the one filter providers use to look
+// resources up: <attribute> eq "<value>".
+func parseSCIMFilter(filter string) (string, string, error) {
+	if filter == "" {
+		return "", "", nil
+	}
+	m := scimFilterPattern.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", scimError(http.StatusBadRequest, "invalidFilter", "only filters of the form <attribute> eq \"<value>\" are supported")
+	}
+	value, err := strconv.Unquote(`"` + m[2] + `"`)
+	if err != nil {
+		return "", "", scimError(http.StatusBadRequest, "invalidFilter", "malformed filter value")
+	}
+	return m[1], value, nil
+}
+
+// scimPage applies startIndex and count to n results, returning the slice
+// bounds.
+func scimPage(r *http.Request, n int) (int, int, int) {
+	start, _ := strconv.Atoi(r.FormValue("startIndex"))
+	if start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count > scimMaxResultsPage {
+		count = scimMaxResultsPage
+	} else if count < 0 {
+		count = 0
+	}
+	lo := start - 1
+	if lo > n {
+		lo = n
+	}
+	hi := lo + count
+	if hi > n {
+		hi = n
+	}
+	return start, lo, hi
+}
+
+func writeSCIMList(w http.ResponseWriter, r *http.Request, resources []interface{}) {
+	start, lo, hi := scimPage(r, len(resources))
+	writeSCIMResponse(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(resources),
+		"startIndex":   start,
+		"itemsPerPage": hi - lo,
+		"Resources":    resources[lo:hi],
+	})
+}
+
+func newSCIMID() (string, error) {
+	return generateRandomBase32String(16, 26)
+}
+
+func scimListUsersHandler(w http.ResponseWriter, r *http.Request) error {
+	attr, value, err := parseSCIMFilter(r.FormValue("filter"))
+	if err != nil {
+		return err
+	}
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	var users []*SCIMUser
+	for _, u := range scimStore.Users {
+		switch strings.ToLower(attr) {
+		case "":
+		case "username":
+			if !strings.EqualFold(u.UserName, value) {
+				continue
+			}
+		case "externalid":
+			if u.ExternalID != value {
+				continue
+			}
+		case "id":
+			if u.ID != value {
+				continue
+			}
+		default:
+			return scimError(http.StatusBadRequest, "invalidFilter", "users can't be filtered by %s", attr)
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Created.Before(users[j].Created) })
+	resources := make([]interface{}, len(users))
+	for i, u := range users {
+		resources[i] = scimStore.userResource(u)
+	}
+	writeSCIMList(w, r, resources)
+	return nil
+}
+
+func scimCreateUserHandler(w http.ResponseWriter, r *http.Request) error {
+	var res scimUserResource
+	if err := decodeSCIMBody(r, &res); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(res.UserName)
+	if name == "" {
+		return scimError(http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	if scimStore.userNamed(name) != nil {
+		return scimError(http.StatusConflict, "uniqueness", "%s has already been provisioned", name)
+	}
+	// An account someone registered for themselves isn't the provider's to
+	// take over (or to set the password of).
+	if userStore.Get(name) != nil {
+		return scimError(http.StatusConflict, "uniqueness", "an account named %s already exists", name)
+	}
+	user := userStore.Create(name)
+	if user == nil {
+		return scimError(http.StatusConflict, "uniqueness", "%s could not be created", name)
+	}
+	if res.Password != "" {
+		if err := user.UpdateChallenge(res.Password); err != nil {
+			return err
+		}
+	} else if err := user.Save(); err != nil {
+		return err
+	}
+	healthServer.IncrementMetric("user.created")
+	PublishEvent(&Event{Kind: EventAccountCreated, Account: name, Details: map[string]interface{}{"via": "scim"}})
+
+	id, err := newSCIMID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u := &SCIMUser{ID: id, UserName: name, ExternalID: res.ExternalID, Active: res.Active == nil || *res.Active, Created: now, Modified: now}
+	scimStore.Users[id] = u
+	scimStore.syncAccount(id)
+	if err := scimStore.save(); err != nil {
+		return err
+	}
+	glog.Infof("SCIM: Provisioned %s (%s)", name, id)
+	healthServer.IncrementMetric("scim.user.created")
+	w.Header().Set("Location", "/scim/v2/Users/"+id)
+	writeSCIMResponse(w, http.StatusCreated, scimStore.userResource(u))
+	return nil
+}
+
+// scimUser returns the user the request names. It must be called with
+// scimStore.mu held.
+func scimUser(r *http.Request) (*SCIMUser, error) {
+	id := mux.Vars(r)["id"]
+	u, ok := scimStore.Users[id]
+	if !ok {
+		return nil, scimError(http.StatusNotFound, "", "there is no user %s", id)
+	}
+	return u, nil
+}
+
+func scimGetUserHandler(w http.ResponseWriter, r *http.Request) error {
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	u, err := scimUser(r)
+	if err != nil {
+		return err
+	}
+	writeSCIMResponse(w, http.StatusOK, scimStore.userResource(u))
+	return nil
+}
+
+// updateSCIMUser applies a change to u and its account, and answers with
+// the result. It must be called with scimStore.mu held.
+func updateSCIMUser(w http.ResponseWriter, u *SCIMUser, active *bool, externalID *string, password string) error {
+	if active != nil {
+		u.Active = *active
+	}
+	if externalID != nil {
+		u.ExternalID = *externalID
+	}
+	if password != "" {
+		if user := userStore.Get(u.UserName); user != nil {
+			if err := user.UpdateChallenge(password); err != nil {
+				return err
+			}
+		}
+	}
+	u.Modified = time.Now()
+	scimStore.syncAccount(u.ID)
+	if err := scimStore.save(); err != nil {
+		return err
+	}
+	healthServer.IncrementMetric("scim.user.updated")
+	writeSCIMResponse(w, http.StatusOK, scimStore.userResource(u))
+	return nil
+}
+
+func scimReplaceUserHandler(w http.ResponseWriter, r *http.Request) error {
+	var res scimUserResource
+	if err := decodeSCIMBody(r, &res); err != nil {
+		return err
+	}
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	u, err := scimUser(r)
+	if err != nil {
+		return err
+	}
+	if res.UserName != "" && !strings.EqualFold(res.UserName, u.UserName) {
+		return scimError(http.StatusBadRequest, "mutability", "accounts can't be renamed")
+	}
+	active := res.Active == nil || *res.Active
+	return updateSCIMUser(w, u, &active, &res.ExternalID, res.Password)
+}
+
+type scimPatch struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// decodeSCIMPatchValue decodes an operation's value, which some providers
+// send as a string ("False") where a boolean belongs.
+func decodeSCIMPatchValue(raw json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			if b, ok := v.(*bool); ok {
+				if *b, err = strconv.ParseBool(s); err == nil {
+					return nil
+				}
+			}
+		}
+		return scimError(http.StatusBadRequest, "invalidValue", "invalid value: %s", raw)
+	}
+	return nil
+}
+
+func scimPatchUserHandler(w http.ResponseWriter, r *http.Request) error {
+	var patch scimPatch
+	if err := decodeSCIMBody(r, &patch); err != nil {
+		return err
+	}
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	u, err := scimUser(r)
+	if err != nil {
+		return err
+	}
+
+	var active *bool
+	var externalID *string
+	var password string
+	for _, op := range patch.Operations {
+		if kind := strings.ToLower(op.Op); kind != "replace" && kind != "add" {
+			return scimError(http.StatusBadRequest, "invalidValue", "users only support replace and add operations")
+		}
+		values := map[string]json.RawMessage{}
+		if op.Path == "" {
+			if err := decodeSCIMPatchValue(op.Value, &values); err != nil {
+				return err
+			}
+		} else {
+			values[op.Path] = op.Value
+		}
+		for path, value := range values {
+			switch strings.ToLower(path) {
+			case "active":
+				active = new(bool)
+				if err := decodeSCIMPatchValue(value, active); err != nil {
+					return err
+				}
+			case "externalid":
+				externalID = new(string)
+				if err := decodeSCIMPatchValue(value, externalID); err != nil {
+					return err
+				}
+			case "password":
+				if err := decodeSCIMPatchValue(value, &password); err != nil {
+					return err
+				}
+			case "username":
+				var name string
+				if err := decodeSCIMPatchValue(value, &name); err != nil {
+					return err
+				}
+				if !strings.EqualFold(name, u.UserName) {
+					return scimError(http.StatusBadRequest, "mutability", "accounts can't be renamed")
+				}
+			default:
+				// Attributes spectre has no use for (names, emails) are
+				// ignored rather than refused, as providers send them
+				// regardless.
+			}
+		}
+	}
+	return updateSCIMUser(w, u, active, externalID, password)
+}
+
+// scimDeleteUserHandler deprovisions a user: its account is disabled, not
+// destroyed, so that its pastes live on.
+func scimDeleteUserHandler(w http.ResponseWriter, r *http.Request) error {
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	u, err := scimUser(r)
+	if err != nil {
+		return err
+	}
+	u.Active = false
+	scimStore.syncAccount(u.ID)
+	for _, g := range scimStore.groupsOf(u.ID) {
+		g.Members = removeSCIMMember(g.Members, u.ID)
+	}
+	delete(scimStore.Users, u.ID)
+	if err := scimStore.save(); err != nil {
+		return err
+	}
+	glog.Infof("SCIM: Deprovisioned %s (%s)", u.UserName, u.ID)
+	PublishEvent(&Event{Kind: EventAccountDeprovisioned, Account: u.UserName, Details: map[string]interface{}{"scim_id": u.ID}})
+	healthServer.IncrementMetric("scim.user.deleted")
+	writeSCIMResponse(w, http.StatusNoContent, nil)
+	return nil
+}
+
+func removeSCIMMember(members []string, id string) []string {
+	kept := members[:0]
+	for _, member := range members {
+		if member != id {
+			kept = append(kept, member)
+		}
+	}
+	return kept
+}
+
+func scimListGroupsHandler(w http.ResponseWriter, r *http.Request) error {
+	attr, value, err := parseSCIMFilter(r.FormValue("filter"))
+	if err != nil {
+		return err
+	}
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	var groups []*SCIMGroup
+	for _, g := range scimStore.Groups {
+		switch strings.ToLower(attr) {
+		case "":
+		case "displayname":
+			if g.DisplayName != value {
+				continue
+			}
+		case "externalid":
+			if g.ExternalID != value {
+				continue
+			}
+		case "id":
+			if g.ID != value {
+				continue
+			}
+		default:
+			return scimError(http.StatusBadRequest, "invalidFilter", "groups can't be filtered by %s", attr)
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Created.Before(groups[j].Created) })
+	resources := make([]interface{}, len(groups))
+	for i, g := range groups {
+		resources[i] = scimStore.groupResource(g)
+	}
+	writeSCIMList(w, r, resources)
+	return nil
+}
+
+// scimMemberIDs checks that refs name provisioned users. It must be called
+// with scimStore.mu held.
+func scimMemberIDs(refs []scimRef) ([]string, error) {
+	var ids []string
+	for _, ref := range refs {
+		if _, ok := scimStore.Users[ref.Value]; !ok {
+			return nil, scimError(http.StatusBadRequest, "invalidValue", "there is no user %s", ref.Value)
+		}
+		ids = append(ids, ref.Value)
+	}
+	return ids, nil
+}
+
+// setSCIMGroupMembers replaces g's members, bringing both the old and the
+// new members' accounts into line. It must be called with scimStore.mu
+// held.
+func setSCIMGroupMembers(g *SCIMGroup, members []string) {
+	affected := append(append([]string{}, g.Members...), members...)
+	seen := make(map[string]bool)
+	g.Members = g.Members[:0]
+	for _, id := range members {
+		if !seen[id] {
+			seen[id] = true
+			g.Members = append(g.Members, id)
+		}
+	}
+	for _, id := range affected {
+		scimStore.syncAccount(id)
+	}
+}
+
+func scimCreateGroupHandler(w http.ResponseWriter, r *http.Request) error {
+	var res scimGroupResource
+	if err := decodeSCIMBody(r, &res); err != nil {
+		return err
+	}
+	if strings.TrimSpace(res.DisplayName) == "" {
+		return scimError(http.StatusBadRequest, "invalidValue", "displayName is required")
+	}
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	for _, g := range scimStore.Groups {
+		if g.DisplayName == res.DisplayName {
+			return scimError(http.StatusConflict, "uniqueness", "there is already a group called %s", res.DisplayName)
+		}
+	}
+	members, err := scimMemberIDs(res.Members)
+	if err != nil {
+		return err
+	}
+	id, err := newSCIMID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	g := &SCIMGroup{ID: id, DisplayName: res.DisplayName, ExternalID: res.ExternalID, Created: now, Modified: now}
+	scimStore.Groups[id] = g
+	setSCIMGroupMembers(g, members)
+	if err := scimStore.save(); err != nil {
+		return err
+	}
+	healthServer.IncrementMetric("scim.group.created")
+	w.Header().Set("Location", "/scim/v2/Groups/"+id)
+	writeSCIMResponse(w, http.StatusCreated, scimStore.groupResource(g))
+	return nil
+}
+
+// scimGroup returns the group the request names. It must be called with
+// scimStore.mu held.
+func scimGroup(r *http.Request) (*SCIMGroup, error) {
+	id := mux.Vars(r)["id"]
+	g, ok := scimStore.Groups[id]
+	if !ok {
+		return nil, scimError(http.StatusNotFound, "", "there is no group %s", id)
+	}
+	return g, nil
+}
+
+func scimGetGroupHandler(w http.ResponseWriter, r *http.Request) error {
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	g, err := scimGroup(r)
+	if err != nil {
+		return err
+	}
+	writeSCIMResponse(w, http.StatusOK, scimStore.groupResource(g))
+	return nil
+}
+
+func scimReplaceGroupHandler(w http.ResponseWriter, r *http.Request) error {
+	var res scimGroupResource
+	if err := decodeSCIMBody(r, &res); err != nil {
+		return err
+	}
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	g, err := scimGroup(r)
+	if err != nil {
+		return err
+	}
+	members, err := scimMemberIDs(res.Members)
+	if err != nil {
+		return err
+	}
+	if res.DisplayName != "" {
+		g.DisplayName = res.DisplayName
+	}
+	g.ExternalID = res.ExternalID
+	g.Modified = time.Now()
+	setSCIMGroupMembers(g, members)
+	if err := scimStore.save(); err != nil {
+		return err
+	}
+	writeSCIMResponse(w, http.StatusOK, scimStore.groupResource(g))
+	return nil
+}
+
+var scimMemberPathPattern = regexp.MustCompile(`^members\[value eq "([^"]*)"\]$`)
+
+func scimPatchGroupHandler(w http.ResponseWriter, r *http.Request) error {
+	var patch scimPatch
+	if err := decodeSCIMBody(r, &patch); err != nil {
+		return err
+	}
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	g, err := scimGroup(r)
+	if err != nil {
+		return err
+	}
+
+	members := append([]string{}, g.Members...)
+	for _, op := range patch.Operations {
+		kind, path := strings.ToLower(op.Op), op.Path
+		if path == "" && (kind == "add" || kind == "replace") {
+			// Without a path, the value holds the attributes to change.
+			var value struct {
+				DisplayName *string    `json:"displayName"`
+				Members     *[]scimRef `json:"members"`
+			}
+			if err := decodeSCIMPatchValue(op.Value, &value); err != nil {
+				return err
+			}
+			if value.Members != nil {
+				ids, err := scimMemberIDs(*value.Members)
+				if err != nil {
+					return err
+				}
+				if kind == "add" {
+					members = append(members, ids...)
+				} else {
+					members = ids
+				}
+			}
+			if value.DisplayName != nil && *value.DisplayName != "" {
+				g.DisplayName = *value.DisplayName
+			}
+			continue
+		}
+		switch {
+		case strings.EqualFold(path, "members"):
+			var refs []scimRef
+			if kind != "remove" || len(op.Value) > 0 {
+				if err := decodeSCIMPatchValue(op.Value, &refs); err != nil {
+					return err
+				}
+			}
+			ids, err := scimMemberIDs(refs)
+			if kind != "remove" && err != nil {
+				return err
+			}
+			switch kind {
+			case "add":
+				members = append(members, ids...)
+			case "replace":
+				members = ids
+			case "remove":
+				if len(op.Value) == 0 {
+					members = nil
+				}
+				for _, ref := range refs {
+					members = removeSCIMMember(members, ref.Value)
+				}
+			}
+		case kind == "remove" && scimMemberPathPattern.MatchString(path):
+			members = removeSCIMMember(members, scimMemberPathPattern.FindStringSubmatch(path)[1])
+		case kind == "replace" && strings.EqualFold(path, "displayName"):
+			var displayName string
+			if err := decodeSCIMPatchValue(op.Value, &displayName); err != nil {
+				return err
+			}
+			if displayName != "" {
+				g.DisplayName = displayName
+			}
+		default:
+			return scimError(http.StatusBadRequest, "invalidPath", "unsupported operation %s on %q", op.Op, path)
+		}
+	}
+	g.Modified = time.Now()
+	setSCIMGroupMembers(g, members)
+	if err := scimStore.save(); err != nil {
+		return err
+	}
+	healthServer.IncrementMetric("scim.group.updated")
+	writeSCIMResponse(w, http.StatusOK, scimStore.groupResource(g))
+	return nil
+}
+
+func scimDeleteGroupHandler(w http.ResponseWriter, r *http.Request) error {
+	scimStore.mu.Lock()
+	defer scimStore.mu.Unlock()
+	g, err := scimGroup(r)
+	if err != nil {
+		return err
+	}
+	members := g.Members
+	delete(scimStore.Groups, g.ID)
+	for _, id := range members {
+		scimStore.syncAccount(id)
+	}
+	if err := scimStore.save(); err != nil {
+		return err
+	}
+	healthServer.IncrementMetric("scim.group.deleted")
+	writeSCIMResponse(w, http.StatusNoContent, nil)
+	return nil
+}
+
+func scimServiceProviderConfigHandler(w http.ResponseWriter, r *http.Request) error {
+	supported := func(b bool) map[string]bool { return map[string]bool{"supported": b} }
+	writeSCIMResponse(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResultsPage},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "scim.token from the instance's configuration",
+		}},
+	})
+	return nil
+}
+
+func registerSCIMRoutes(router *mux.Router) {
+	scim := router.PathPrefix("/scim/v2").Subrouter()
+	scim.Methods("GET").Path("/ServiceProviderConfig").Handler(scimHandler(scimServiceProviderConfigHandler))
+	scim.Methods("GET").Path("/Users").Handler(scimHandler(scimListUsersHandler))
+	scim.Methods("POST").Path("/Users").Handler(scimHandler(scimCreateUserHandler))
+	scim.Methods("GET").Path("/Users/{id}").Handler(scimHandler(scimGetUserHandler))
+	scim.Methods("PUT").Path("/Users/{id}").Handler(scimHandler(scimReplaceUserHandler))
+	scim.Methods("PATCH").Path("/Users/{id}").Handler(scimHandler(scimPatchUserHandler))
+	scim.Methods("DELETE").Path("/Users/{id}").Handler(scimHandler(scimDeleteUserHandler))
+	scim.Methods("GET").Path("/Groups").Handler(scimHandler(scimListGroupsHandler))
+	scim.Methods("POST").Path("/Groups").Handler(scimHandler(scimCreateGroupHandler))
+	scim.Methods("GET").Path("/Groups/{id}").Handler(scimHandler(scimGetGroupHandler))
+	scim.Methods("PUT").Path("/Groups/{id}").Handler(scimHandler(scimReplaceGroupHandler))
+	scim.Methods("PATCH").Path("/Groups/{id}").Handler(scimHandler(scimPatchGroupHandler))
+	scim.Methods("DELETE").Path("/Groups/{id}").Handler(scimHandler(scimDeleteGroupHandler))
+}
+
+var scimStore *SCIMStore
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	scimStore = LoadSCIMStore(filepath.Join(arguments.root, "scim.gob"))
+
+	// Group permissions may have changed.
+	RegisterReloadFunction(scimStore.syncAll)
+}
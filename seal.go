@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DHowett/gotimeout"
+)
+
+// A paste can be sealed until a given time (sealed_until, RFC 3339 or Unix
+// seconds; "none" unseals it early), for coordinated disclosures and puzzle
+// hunts. Until then its title, language and the time it unseals are shown
+// to anyone, but its body only to those who can edit it; titles aren't
+// inferred for sealed pastes, as they would give the body away. Each seal
+// has a handle in pasteUnsealer, which clears it when it runs out and then
+// publishes the paste over ActivityPub, if its author would have had it
+// published when it was made. The seal's time is what counts, though, so a
+// lost handle delays only the publishing.
+
+// MaxSealDuration is how far ahead a paste can be sealed.
+const MaxSealDuration = 366 * 24 * time.Hour
+
+var pasteUnsealer *gotimeout.Expirator
+
+// PasteSealedError is returned for requests for a sealed paste's body.
+type PasteSealedError struct {
+	ID    PasteID
+	Until time.Time
+}
+
+func (e PasteSealedError) Error() string {
+	return fmt.Sprintf("Paste %v is sealed until %s.", e.ID, e.Until.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+func (e PasteSealedError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+func (e PasteSealedError) APIErrorDetails() map[string]interface{} {
+	return map[string]interface{}{
+		"sealed_until": e.Until.UTC(),
+		"retry_after":  int(time.Until(e.Until)/time.Second) + 1,
+	}
+}
+
+func (p *Paste) SealedUntil() time.Time {
+	return p.sealedUntil
+}
+
+// Sealed reports whether p's body is still sealed.
+func (p *Paste) Sealed() bool {
+	return !p.sealedUntil.IsZero() && time.Now().Before(p.sealedUntil)
+}
+
+// parseSeal validates a seal as submitted: "" (none given), "none", or a
+// time no more than MaxSealDuration ahead.
+func parseSeal(s string) (time.Time, bool, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return time.Time{}, false, nil
+	case "none":
+		return time.Time{}, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		secs, serr := strconv.ParseInt(s, 10, 64)
+		if serr != nil {
+			return time.Time{}, false, PasteInputError{"sealed_until", "must be a time (RFC 3339 or Unix seconds) or none"}
+		}
+		t = time.Unix(secs, 0)
+	}
+	if d := time.Until(t); d <= 0 || d > MaxSealDuration {
+		return time.Time{}, false, PasteInputError{"sealed_until", "must be in the future, and within a year"}
+	}
+	return t, false, nil
+}
+
+// sealPaste applies in's seal to p, which is then to be saved.
+func sealPaste(p *Paste, in *PasteInput) {
+	switch {
+	case in.Unseal:
+		p.sealedUntil, p.sealedBy = time.Time{}, ""
+		pasteUnsealer.CancelObjectExpiration(p)
+	case !in.SealedUntil.IsZero():
+		p.sealedUntil = in.SealedUntil
+		pasteUnsealer.ExpireObject(p, time.Until(p.sealedUntil))
+		healthServer.IncrementMetric("paste.sealed")
+	}
+}
+
+// publishPaste publishes a new paste over ActivityPub as r's account or,
+// if it is sealed, has it published when it unseals.
+func publishPaste(r *http.Request, p *Paste) {
+	if activityPub == nil {
+		return
+	}
+	user := GetUser(r)
+	if p.pending {
+		// Approving it publishes it.
+		if activityPub.HandleForUser(user) != "" && !p.Encrypted {
+			moderationQueue.SetPublisher(p.ID, user.Name)
+		}
+		return
+	}
+	if !p.Sealed() {
+		activityPub.Publish(user, p)
+		return
+	}
+	if activityPub.HandleForUser(user) != "" && !p.Encrypted {
+		p.sealedBy = user.Name
+		p.store.SetMetadata(p.ID, "sealed_by", user.Name)
+	}
+}
+
+// pasteSealValue returns p's seal as a form value, or "" if it has none.
+func pasteSealValue(p *Paste) string {
+	if !p.Sealed() {
+		return ""
+	}
+	return p.sealedUntil.UTC().Format(time.RFC3339)
+}
+
+// checkSeal returns a PasteSealedError if r may not see p's body yet.
+func checkSeal(p *Paste, r *http.Request) error {
+	if p.Sealed() && !isEditAllowed(p, r) {
+		return PasteSealedError{p.ID, p.sealedUntil}
+	}
+	return nil
+}
+
+// checksSeal refuses requests for sealed bodies.
+func checksSeal(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		if err := checkSeal(o.(*Paste), r); err != nil {
+			w.Header().Set("Cache-Control", "no-store")
+			panic(err)
+		}
+		fn(o, w, r)
+	}
+}
+
+// UnsealingPasteStore is the store behind pasteUnsealer.
+type UnsealingPasteStore struct {
+	PasteStore
+}
+
+func (u *UnsealingPasteStore) GetExpirable(id gotimeout.ExpirableID) gotimeout.Expirable {
+	v, _ := u.PasteStore.Get(PasteID(id), nil)
+	if v == nil {
+		return nil
+	}
+	return v
+}
+
+func (u *UnsealingPasteStore) DestroyExpirable(ex gotimeout.Expirable) {
+	p, ok := ex.(*Paste)
+	if !ok || p.sealedUntil.IsZero() {
+		return
+	}
+	if p.Sealed() {
+		// Sealed again, for longer, since the handle was made.
+		pasteUnsealer.ExpireObject(p, time.Until(p.sealedUntil))
+		return
+	}
+
+	publisher := p.sealedBy
+	u.PasteStore.SetMetadata(p.ID, "sealed_until", "")
+	u.PasteStore.SetMetadata(p.ID, "sealed_by", "")
+	p.sealedUntil, p.sealedBy = time.Time{}, ""
+	publishesPasteEvent(EventPasteModified)(p)
+	healthServer.IncrementMetric("paste.unsealed")
+
+	if activityPub != nil && publisher != "" && p.trashed == "" && !p.pending {
+		if user := userStore.Get(publisher); user != nil {
+			activityPub.Publish(user, p)
+		}
+	}
+}
+
+func init() {
+	RegisterTemplateFunction("pasteSealValue", pasteSealValue)
+	RegisterTemplateFunction("pasteSealedFor", func(ri *RenderContext) bool {
+		return checkSeal(ri.Obj.(*Paste), ri.Request) != nil
+	})
+}
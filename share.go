@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Installed as a web app (from /manifest.webmanifest), spectre is offered
+// as a target when text or a link is shared on a phone. Shares are POSTed
+// to /share, which opens the new-paste form with them filled in: the text
+// as the body (or the link, if there's no text), the link otherwise as the
+// paste's source, and the title as its title. Nothing is saved until the
+// sharer saves it.
+//
+// Shares made while offline are kept by the service worker (public/sw.js)
+// and submitted to /share again when the browser is back online (see
+// public/js/application.js).
+
+// SharedText is what was shared to /share.
+type SharedText struct {
+	Title  string
+	Text   string
+	Source string
+}
+
+type sharedTextContextKey struct{}
+
+func parseSharedText(r *http.Request) *SharedText {
+	share := &SharedText{
+		Title: sanitizeTitle(r.FormValue("title")),
+		Text:  r.FormValue("text"),
+	}
+	link := strings.TrimSpace(r.FormValue("url"))
+	if strings.TrimSpace(share.Text) == "" {
+		share.Text = link
+	} else if source, err := parseSourceURL(link); err == nil {
+		share.Source = source
+	}
+	if title := []rune(share.Title); len(title) > MaxTitleLength {
+		share.Title = string(title[:MaxTitleLength])
+	}
+	return share
+}
+
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	defer errorRecoveryHandler(w, r)
+	healthServer.IncrementMetric("share.received")
+	ctx := context.WithValue(r.Context(), sharedTextContextKey{}, parseSharedText(r))
+	RenderPage(w, r.WithContext(ctx), "index", nil)
+}
+
+// sharedText returns what was shared to the page being rendered, if it is
+// /share.
+func sharedText(ri *RenderContext) *SharedText {
+	share, _ := ri.Request.Context().Value(sharedTextContextKey{}).(*SharedText)
+	return share
+}
+
+func webManifestHandler(w http.ResponseWriter, r *http.Request) {
+	b := brandingFor(r)
+	manifest := map[string]interface{}{
+		"name":             b.Name,
+		"short_name":       b.Name,
+		"start_url":        "/",
+		"scope":            "/",
+		"display":          "standalone",
+		"background_color": b.BackgroundColor,
+		"theme_color":      b.PrimaryColor,
+		"icons": []map[string]string{
+			{"src": "/site-icon60.png", "sizes": "60x60", "type": "image/png"},
+			{"src": "/site-icon76.png", "sizes": "76x76", "type": "image/png"},
+			{"src": "/site-icon120.png", "sizes": "120x120", "type": "image/png"},
+			{"src": "/site-icon152.png", "sizes": "152x152", "type": "image/png"},
+		},
+		"share_target": map[string]interface{}{
+			"action":  "/share",
+			"method":  "POST",
+			"enctype": "application/x-www-form-urlencoded",
+			"params": map[string]string{
+				"title": "title",
+				"text":  "text",
+				"url":   "url",
+			},
+		},
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+func init() {
+	RegisterTemplateFunction("sharedText", sharedText)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// With shortener.enabled, owners can give a paste a short link: a code of
+// shortener.code_length characters that redirects to it, from /s/{code}
+// and, if shortener.host is set, from the root of that host. A paste has
+// at most one, made (or looked up) on its page or through the API. Short
+// links count their clicks, and last exactly as long as their paste: they
+// stop working when it expires or is deleted, and are dropped then, so that
+// a code never outlives what it led to.
+//
+// The code and its clicks are kept with the paste (short_code,
+// short_clicks); shortLinkIndex maps codes back to pastes.
+
+const shortLinkPrefix = "/s/"
+
+var shortLinkIndex *ShortLinkIndex
+
+type ShortLinkIndex struct {
+	Codes map[string]PasteID
+
+	filename string
+	mu       sync.Mutex
+	// clicksMu serializes click counts.
+	clicksMu sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *ShortLinkIndex) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save short links: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+// Put maps code to id, unless code is taken.
+func (s *ShortLinkIndex) Put(code string, id PasteID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Codes[code]; ok {
+		return false, nil
+	}
+	s.Codes[code] = id
+	return true, s.save()
+}
+
+func (s *ShortLinkIndex) Get(code string) (PasteID, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.Codes[code]
+	return id, ok
+}
+
+// Delete drops code, if it still leads to id.
+func (s *ShortLinkIndex) Delete(code string, id PasteID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Codes[code] != id {
+		return
+	}
+	delete(s.Codes, code)
+	s.save()
+}
+
+func LoadShortLinkIndex(filename string) *ShortLinkIndex {
+	var s *ShortLinkIndex
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode short links: ", err)
+		}
+	}
+	if s == nil {
+		s = &ShortLinkIndex{}
+	}
+	if s.Codes == nil {
+		s.Codes = make(map[string]PasteID)
+	}
+	s.filename = filename
+	return s
+}
+
+type ShortLink struct {
+	Code   string
+	URL    string
+	Clicks int
+}
+
+func shortenerEnabled() bool {
+	return instanceConfig.Shortener.Enabled
+}
+
+func shortHost() *url.URL {
+	if instanceConfig.Shortener.Host == "" {
+		return nil
+	}
+	u, err := url.Parse(instanceConfig.Shortener.Host)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return u
+}
+
+func onShortHost(r *http.Request) bool {
+	host := shortHost()
+	return host != nil && strings.EqualFold(r.Host, host.Host)
+}
+
+// shortLinkURL returns code's URL: on the short host, if there is one, or
+// else relative to this one.
+func shortLinkURL(code string) string {
+	if host := shortHost(); host != nil {
+		return host.ResolveReference(&url.URL{Path: "/" + code}).String()
+	}
+	return shortLinkPrefix + code
+}
+
+// pasteShortCode returns the code of the paste's short link, if it has one.
+func pasteShortCode(id PasteID) string {
+	code, _ := pasteStore.Metadata(id, "short_code")
+	if code == "" {
+		return ""
+	}
+	// A paste restored from the trash keeps a code that was dropped.
+	if to, ok := shortLinkIndex.Get(code); !ok || to != id {
+		return ""
+	}
+	return code
+}
+
+// pasteShortLink returns the paste's short link, or nil.
+func pasteShortLink(p *Paste) *ShortLink {
+	code := pasteShortCode(p.ID)
+	if code == "" {
+		return nil
+	}
+	value, _ := p.store.Metadata(p.ID, "short_clicks")
+	clicks, _ := strconv.Atoi(value)
+	return &ShortLink{Code: code, URL: shortLinkURL(code), Clicks: clicks}
+}
+
+// shortenPaste gives p a short link, unless it has one already, and
+// returns it, and whether it is new.
+func shortenPaste(p *Paste) (*ShortLink, bool, error) {
+	if link := pasteShortLink(p); link != nil {
+		return link, false, nil
+	}
+	for tries := 0; tries < 10; tries++ {
+		code, err := generateRandomBase32String(instanceConfig.Shortener.CodeLength, instanceConfig.Shortener.CodeLength)
+		if err != nil {
+			return nil, false, err
+		}
+		ok, err := shortLinkIndex.Put(code, p.ID)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		if err := p.store.SetMetadata(p.ID, "short_code", code); err != nil {
+			shortLinkIndex.Delete(code, p.ID)
+			return nil, false, err
+		}
+		p.store.SetMetadata(p.ID, "short_clicks", "0")
+		healthServer.IncrementMetric("short.created")
+		return &ShortLink{Code: code, URL: shortLinkURL(code)}, true, nil
+	}
+	return nil, false, fmt.Errorf("no short code was free for paste %s", p.ID)
+}
+
+// unshortenPaste drops p's short link, if it has one.
+func unshortenPaste(p *Paste) {
+	if code, _ := p.store.Metadata(p.ID, "short_code"); code != "" {
+		shortLinkIndex.Delete(code, p.ID)
+		p.store.SetMetadata(p.ID, "short_code", "")
+		healthServer.IncrementMetric("short.dropped")
+	}
+}
+
+// countShortClick counts a click on the short link of the paste with the
+// given ID.
+func countShortClick(id PasteID) {
+	shortLinkIndex.clicksMu.Lock()
+	defer shortLinkIndex.clicksMu.Unlock()
+	value, _ := pasteStore.Metadata(id, "short_clicks")
+	clicks, _ := strconv.Atoi(value)
+	pasteStore.SetMetadata(id, "short_clicks", strconv.Itoa(clicks+1))
+}
+
+// shortLinkTarget returns the paste code leads to, if it leads anywhere.
+func shortLinkTarget(code string) (*Paste, bool) {
+	id, ok := shortLinkIndex.Get(strings.ToLower(code))
+	if !ok {
+		return nil, false
+	}
+	p, err := pasteStore.Get(id, nil)
+	if _, ok := err.(PasteNotFoundError); ok {
+		// Its paste was destroyed without a word (by gc, say).
+		shortLinkIndex.Delete(strings.ToLower(code), id)
+		return nil, false
+	}
+	if p == nil {
+		// The store is failing; the link may yet lead somewhere.
+		glog.Error("Failed to look up short link ", code, ": ", err)
+		return nil, false
+	}
+	if expires := p.ExpirationTime(); p.trashed != "" || (!expires.IsZero() && !expires.After(time.Now())) {
+		return nil, false
+	}
+	return p, true
+}
+
+// followShortLink redirects to the paste code leads to, under base.
+func followShortLink(w http.ResponseWriter, r *http.Request, base *url.URL, code string) {
+	p, ok := shortLinkTarget(code)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "HEAD" {
+		countShortClick(p.ID)
+		healthServer.IncrementMetric("short.clicked")
+	}
+	location := pasteURL("show", p)
+	if base != nil {
+		location = base.ResolveReference(&url.URL{Path: location}).String()
+	}
+	// Every click is to reach the instance, to be counted, and none may
+	// outlive the paste.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusFound)
+}
+
+func shortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if !shortenerEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	followShortLink(w, r, nil, mux.Vars(r)["code"])
+}
+
+// shortHostHandler confines the short host to short links. On a private
+// instance it leaves them to the main host, which asks for the login.
+type shortHostHandler struct {
+	http.Handler
+}
+
+func (h shortHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !shortenerEnabled() || !onShortHost(r) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	base, _ := url.Parse(instanceConfig.Shortener.BaseURL)
+	code := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method != "GET" && r.Method != "HEAD":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case code == "":
+		http.Redirect(w, r, base.String(), http.StatusFound)
+	case strings.Contains(code, "/"):
+		http.NotFound(w, r)
+	case instanceConfig.Instance.Private:
+		http.Redirect(w, r, base.ResolveReference(&url.URL{Path: shortLinkPrefix + code}).String(), http.StatusFound)
+	default:
+		followShortLink(w, r, base, code)
+	}
+}
+
+// pasteShorten gives a paste a short link from its page.
+func pasteShorten(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	if !shortenerEnabled() {
+		panic(PasteAccessDeniedError{"shorten", p.ID})
+	}
+	if _, _, err := shortenPaste(p); err != nil {
+		panic(err)
+	}
+	SetFlash(w, "success", fmt.Sprintf("Paste %v has a short link.", p.ID))
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// apiPasteShortLinkHandler returns (GET), makes (POST) or drops (DELETE) a
+// paste's short link.
+func apiPasteShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if !shortenerEnabled() {
+		writeAPIError(w, apiError(APIErrorNotFound, "short links are turned off"))
+		return
+	}
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, _ := pasteStore.Get(id, nil)
+	if p == nil || p.trashed != "" {
+		writeAPIError(w, PasteNotFoundError{ID: id})
+		return
+	}
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"shorten", id})
+		return
+	}
+
+	status := http.StatusOK
+	var link *ShortLink
+	switch r.Method {
+	case "DELETE":
+		unshortenPaste(p)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "POST":
+		var created bool
+		var err error
+		if link, created, err = shortenPaste(p); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if created {
+			status = http.StatusCreated
+		}
+	default:
+		if link = pasteShortLink(p); link == nil {
+			writeAPIError(w, apiError(APIErrorNotFound, "paste %s has no short link", id))
+			return
+		}
+	}
+
+	u, _ := url.Parse(link.URL)
+	resp := map[string]interface{}{
+		"id":     id,
+		"code":   link.Code,
+		"url":    BaseURLForRequest(r).ResolveReference(u).String(),
+		"clicks": link.Clicks,
+	}
+	if expires := p.ExpirationTime(); !expires.IsZero() {
+		resp["expires"] = expires.UTC()
+	}
+	writeAPIResponse(w, status, resp)
+}
+
+func validateShortenerConfig(c *_Configuration) error {
+	sc := &c.Shortener
+	if sc.CodeLength < 4 || sc.CodeLength > 16 {
+		return fmt.Errorf("shortener.code_length must be from 4 to 16")
+	}
+	if sc.Host == "" {
+		return nil
+	}
+	if u, err := url.Parse(sc.Host); err != nil || u.Host == "" {
+		return fmt.Errorf("shortener.host must be a URL, like https://sho.rt/")
+	}
+	if u, err := url.Parse(sc.BaseURL); err != nil || u.Host == "" {
+		return fmt.Errorf("shortener.base_url must be set to the instance's URL when shortener.host is")
+	}
+	return nil
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	shortLinkIndex = LoadShortLinkIndex(filepath.Join(arguments.root, "shortlinks.gob"))
+
+	RegisterTemplateFunction("shortenerEnabled", shortenerEnabled)
+	RegisterTemplateFunction("pasteShortLink", pasteShortLink)
+	SubscribeEvent(onPasteEvent(unshortenPaste), EventPasteExpired, EventPasteDestroying)
+}
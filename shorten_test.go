@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+type failingPasteStore struct {
+	PasteStore
+}
+
+func (failingPasteStore) Get(id PasteID, key []byte) (*Paste, error) {
+	return nil, errors.New("the store is down")
+}
+
+func TestShortLinkKeptWhileStoreFails(t *testing.T) {
+	saved := pasteStore
+	defer func() { pasteStore = saved }()
+
+	pasteStore = failingPasteStore{}
+	shortLinkIndex.Put("kept", "abcde")
+	defer shortLinkIndex.Delete("kept", "abcde")
+	if _, ok := shortLinkTarget("kept"); ok {
+		t.Error("a failing store's link leads somewhere")
+	}
+	if _, ok := shortLinkIndex.Get("kept"); !ok {
+		t.Error("a failing store's link was deleted")
+	}
+
+	pasteStore = NewMemoryPasteStore()
+	shortLinkIndex.Put("gone", "fghij")
+	if _, ok := shortLinkTarget("gone"); ok {
+		t.Error("a missing paste's link leads somewhere")
+	}
+	if _, ok := shortLinkIndex.Get("gone"); ok {
+		t.Error("a missing paste's link was kept")
+	}
+}
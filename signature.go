@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/DHowett/ghostbin/account"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Accounts can register public keys (OpenSSH, minisign or OpenPGP) and
+// attach detached signatures made with them to their pastes, so that
+// readers can tell that a script or a config really came from the
+// account. A signature is checked when it is attached, and again whenever
+// it is shown, against the keys the account has then: removing a key
+// withdraws what it signed. Rewriting a paste's body drops its signature.
+//
+// Signatures are over the paste's body exactly as served raw:
+//
+//   ssh-keygen -Y sign -n file -f ~/.ssh/id_ed25519 paste.txt
+//   minisign -S -m paste.txt
+//   gpg --armor --detach-sign paste.txt
+
+const (
+	SigningKeySSH      = "ssh"
+	SigningKeyMinisign = "minisign"
+	SigningKeyPGP      = "pgp"
+
+	// MaxSigningKeys is how many keys an account can register.
+	MaxSigningKeys = 10
+	// MaxSignatureLength is the longest signature (or key) accepted.
+	MaxSignatureLength = 8192
+
+	// sshSignatureNamespace is the namespace (ssh-keygen -n) SSH
+	// signatures must be made in.
+	sshSignatureNamespace = "file"
+)
+
+// SigningKey is a public key registered on an account.
+type SigningKey struct {
+	Type        string
+	Fingerprint string
+	Comment     string
+	// Text is the key as it was registered.
+	Text string
+
+	ssh      ssh.PublicKey
+	minisign []byte
+	pgp      openpgp.EntityList
+}
+
+// parseSigningKey parses an OpenSSH authorized_keys line, a minisign public
+// key (with or without its comment line) or an armored OpenPGP public key.
+func parseSigningKey(text string) (*SigningKey, error) {
+	text = strings.TrimSpace(text)
+	key := &SigningKey{Text: text}
+	switch {
+	case strings.Contains(text, "-----BEGIN PGP PUBLIC KEY BLOCK-----"):
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(text))
+		if err != nil || len(entities) != 1 {
+			return nil, fmt.Errorf("That isn't an OpenPGP public key.")
+		}
+		key.Type, key.pgp = SigningKeyPGP, entities
+		key.Fingerprint = fmt.Sprintf("%X", entities[0].PrimaryKey.Fingerprint)
+		for name := range entities[0].Identities {
+			key.Comment = name
+			break
+		}
+	case strings.HasPrefix(text, "ssh-") || strings.HasPrefix(text, "ecdsa-"):
+		pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("That isn't an SSH public key.")
+		}
+		key.Type, key.ssh, key.Comment = SigningKeySSH, pub, comment
+		key.Fingerprint = ssh.FingerprintSHA256(pub)
+	default:
+		lines := strings.Split(text, "\n")
+		if len(lines) == 2 && strings.HasPrefix(lines[0], "untrusted comment:") {
+			key.Comment = strings.TrimSpace(strings.TrimPrefix(lines[0], "untrusted comment:"))
+			lines = lines[1:]
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[0]))
+		if len(lines) != 1 || err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+			return nil, fmt.Errorf("That isn't an SSH, minisign or OpenPGP public key.")
+		}
+		key.Type, key.minisign = SigningKeyMinisign, raw
+		key.Fingerprint = fmt.Sprintf("%016X", binary.LittleEndian.Uint64(raw[2:10]))
+	}
+	return key, nil
+}
+
+// Verify checks signature, detached and armored, over message.
+func (k *SigningKey) Verify(message []byte, signature string) error {
+	switch k.Type {
+	case SigningKeySSH:
+		return verifySSHSignature(k.ssh, message, signature)
+	case SigningKeyMinisign:
+		return verifyMinisignSignature(k.minisign, message, signature)
+	case SigningKeyPGP:
+		_, err := openpgp.CheckArmoredDetachedSignature(k.pgp, bytes.NewReader(message), strings.NewReader(signature))
+		return err
+	}
+	return fmt.Errorf("unknown key type %q", k.Type)
+}
+
+// verifySSHSignature checks an SSHSIG signature (ssh-keygen -Y sign).
+func verifySSHSignature(pub ssh.PublicKey, message []byte, signature string) error {
+	body := strings.TrimSpace(signature)
+	if !strings.HasPrefix(body, "-----BEGIN SSH SIGNATURE-----") || !strings.HasSuffix(body, "-----END SSH SIGNATURE-----") {
+		return fmt.Errorf("not an SSH signature")
+	}
+	body = strings.TrimSuffix(strings.TrimPrefix(body, "-----BEGIN SSH SIGNATURE-----"), "-----END SSH SIGNATURE-----")
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil || len(blob) < 10 || string(blob[:6]) != "SSHSIG" {
+		return fmt.Errorf("not an SSH signature")
+	}
+
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(blob[6:], &sig); err != nil || sig.Version != 1 {
+		return fmt.Errorf("not a version 1 SSH signature")
+	}
+	if !bytes.Equal(sig.PublicKey, pub.Marshal()) {
+		return fmt.Errorf("signed with another key")
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return fmt.Errorf("signed for %q rather than %q", sig.Namespace, sshSignatureNamespace)
+	}
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unknown hash algorithm %q", sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	signed := struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)}
+	var inner ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &inner); err != nil {
+		return fmt.Errorf("bad SSH signature: %v", err)
+	}
+	return pub.Verify(append([]byte("SSHSIG"), ssh.Marshal(signed)...), &inner)
+}
+
+// verifyMinisignSignature checks a minisign signature, and its trusted
+// comment, with a minisign public key (as decoded).
+func verifyMinisignSignature(pub []byte, message []byte, signature string) error {
+	lines := strings.Split(strings.TrimSpace(strings.Replace(signature, "\r", "", -1)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("not a minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("not a minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], pub[2:10]) {
+		return fmt.Errorf("signed with another key")
+	}
+	key := ed25519.PublicKey(pub[10:])
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b512(message)
+		message = sum[:]
+	default:
+		return fmt.Errorf("unknown minisign algorithm")
+	}
+	if !ed25519.Verify(key, message, sig[10:]) {
+		return fmt.Errorf("signature doesn't match")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || !ed25519.Verify(key, append(append([]byte{}, sig[10:]...), strings.TrimPrefix(lines[2], "trusted comment: ")...), global) {
+		return fmt.Errorf("trusted comment doesn't match")
+	}
+	return nil
+}
+
+// userSigningKeys returns the keys registered on user.
+func userSigningKeys(user *account.User) []*SigningKey {
+	if user == nil {
+		return nil
+	}
+	texts, _ := user.Values["signing.keys"].([]string)
+	keys := make([]*SigningKey, 0, len(texts))
+	for _, text := range texts {
+		if key, err := parseSigningKey(text); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func addSigningKey(user *account.User, text string) (*SigningKey, error) {
+	if len(text) > MaxSignatureLength {
+		return nil, fmt.Errorf("That key is too long.")
+	}
+	key, err := parseSigningKey(text)
+	if err != nil {
+		return nil, err
+	}
+	texts, _ := user.Values["signing.keys"].([]string)
+	if len(texts) >= MaxSigningKeys {
+		return nil, fmt.Errorf("You can register at most %d keys.", MaxSigningKeys)
+	}
+	for _, existing := range userSigningKeys(user) {
+		if existing.Fingerprint == key.Fingerprint {
+			return nil, fmt.Errorf("That key is already registered.")
+		}
+	}
+	user.Values["signing.keys"] = append(texts, key.Text)
+	return key, user.Save()
+}
+
+func removeSigningKey(user *account.User, fingerprint string) error {
+	var kept []string
+	for _, key := range userSigningKeys(user) {
+		if key.Fingerprint != fingerprint {
+			kept = append(kept, key.Text)
+		}
+	}
+	user.Values["signing.keys"] = kept
+	return user.Save()
+}
+
+// PasteSignature is a signature attached to a paste. The signing account's
+// (stored) name is kept with the paste, as signed_by, to check the signature
+// against that account's keys, but it is never shown: readers know the
+// signer by the key's fingerprint, and by their ActivityPub address if they
+// publish.
+type PasteSignature struct {
+	Signature string
+	// Signer is the signing account's ActivityPub address, if it has one.
+	Signer string
+	// Key is the account's key that made it, if it verifies.
+	Key *SigningKey
+	// Problem says why it doesn't verify, if it doesn't.
+	Problem string
+}
+
+func pasteBody(p *Paste) ([]byte, error) {
+	reader, err := p.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(io.LimitReader(reader, int64(PASTE_MAXIMUM_LENGTH)))
+}
+
+// verifyPasteSignature checks signature over p's body against signer's
+// keys, returning the key that made it.
+func verifyPasteSignature(p *Paste, signer *account.User, signature string) (*SigningKey, error) {
+	keys := userSigningKeys(signer)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the account has no signing keys")
+	}
+	body, err := pasteBody(p)
+	if err != nil {
+		return nil, err
+	}
+	var last error
+	for _, key := range keys {
+		if last = key.Verify(body, signature); last == nil {
+			return key, nil
+		}
+	}
+	if len(keys) > 1 {
+		return nil, fmt.Errorf("it wasn't made by any of the account's keys (%v)", last)
+	}
+	return nil, last
+}
+
+// pasteSignature returns p's signature, checked, or nil if it has none.
+func pasteSignature(p *Paste) *PasteSignature {
+	if p.direct {
+		return nil
+	}
+	signer, _ := p.store.Metadata(p.ID, "signed_by")
+	signature, _ := p.store.Metadata(p.ID, "signature")
+	if signer == "" || signature == "" {
+		return nil
+	}
+	s := &PasteSignature{Signature: signature}
+	user := userStore.Get(signer)
+	if user == nil {
+		s.Problem = "the account that signed it is gone"
+		return s
+	}
+	if activityPub != nil {
+		if handle := activityPub.HandleForUser(user); handle != "" {
+			s.Signer = "@" + handle + "@" + activityPub.domain()
+		}
+	}
+	key, err := verifyPasteSignature(p, user, signature)
+	if err != nil {
+		s.Problem = err.Error()
+	}
+	s.Key = key
+	return s
+}
+
+// signPaste attaches user's signature to p, if it verifies.
+func signPaste(p *Paste, user *account.User, signature string) (*SigningKey, error) {
+	if p.direct {
+		return nil, apiError(APIErrorValidation, "paste %v is too large to sign", p.ID)
+	}
+	if len(signature) > MaxSignatureLength {
+		return nil, apiError(APIErrorValidation, "signature is too long").With("field", "signature")
+	}
+	key, err := verifyPasteSignature(p, user, signature)
+	if err != nil {
+		return nil, apiError(APIErrorValidation, "signature doesn't verify: %v", err).With("field", "signature")
+	}
+	if err := p.store.SetMetadata(p.ID, "signature", strings.TrimSpace(signature)); err != nil {
+		return nil, err
+	}
+	if err := p.store.SetMetadata(p.ID, "signed_by", user.Name); err != nil {
+		return nil, err
+	}
+	healthServer.IncrementMetric("paste.signed")
+	return key, nil
+}
+
+func unsignPaste(p *Paste) error {
+	p.store.SetMetadata(p.ID, "signed_by", "")
+	return p.store.SetMetadata(p.ID, "signature", "")
+}
+
+func signatureResponse(s *PasteSignature) map[string]interface{} {
+	response := map[string]interface{}{
+		"signature": s.Signature,
+		"verified":  s.Key != nil,
+	}
+	if s.Signer != "" {
+		response["signer"] = s.Signer
+	}
+	if s.Key != nil {
+		response["key_type"] = s.Key.Type
+		response["fingerprint"] = s.Key.Fingerprint
+		response["public_key"] = s.Key.Text
+	} else {
+		response["problem"] = s.Problem
+	}
+	return response
+}
+
+// apiPasteSignatureHandler shows (GET), attaches (PUT, with the form value
+// signature) or removes (DELETE) a paste's signature. Attaching and
+// removing take a logged-in account that can edit the paste.
+func apiPasteSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	o, err := lookupPasteWithRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p := o.(*Paste)
+
+	if r.Method == "GET" {
+		s := pasteSignature(p)
+		if s == nil {
+			writeAPIError(w, apiError(APIErrorNotFound, "paste %v isn't signed", p.ID))
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, signatureResponse(s))
+		return
+	}
+
+	user := GetUser(r)
+	if user == nil {
+		writeAPIError(w, apiError(APIErrorUnauthorized, "log in to sign pastes"))
+		return
+	}
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"sign", p.ID})
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if err := unsignPaste(p); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, map[string]interface{}{"id": p.ID})
+		return
+	}
+
+	if _, err := signPaste(p, user, r.FormValue("signature")); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, signatureResponse(pasteSignature(p)))
+}
+
+// signingKeysHandler adds (the form value key) or removes (remove, a
+// fingerprint) a key on the session's account.
+func signingKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUser(r)
+	if user == nil {
+		RenderError(fmt.Errorf("You need to log in to register signing keys."), http.StatusForbidden, w)
+		return
+	}
+
+	if fingerprint := r.FormValue("remove"); fingerprint != "" {
+		if err := removeSigningKey(user, fingerprint); err != nil {
+			SetFlash(w, "error", err.Error())
+		} else {
+			SetFlash(w, "success", "Key removed. Pastes it signed no longer show as signed.")
+		}
+	} else if key, err := addSigningKey(user, r.FormValue("key")); err != nil {
+		SetFlash(w, "error", err.Error())
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Added %s key %s.", key.Type, key.Fingerprint))
+	}
+
+	w.Header().Set("Location", "/session")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func init() {
+	RegisterTemplateFunction("signingKeys", userSigningKeys)
+	RegisterTemplateFunction("pasteSignature", pasteSignature)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Each time the server starts, it writes a recovery report: whether it was
+// stopped cleanly the last time (a marker file, running, is left in the
+// root while it runs and removed once SIGINT or SIGTERM has stopped it
+// and everything has been saved), how many expirations it loaded and how many of those had come
+// due while it was down (and were expired at once), how many jobs it
+// resumed, and, once a sweep of the store has finished in the background,
+// how many pastes it holds and what orphaned data it found. The latest
+// report is shown on /admin; the last few are kept in recovery.gob and
+// served at /api/v1/admin/recovery.
+
+// MaxRecoveryReports is how many reports are kept.
+const MaxRecoveryReports = 20
+
+type RecoveryReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// Unclean is set when the last run wasn't stopped cleanly.
+	Unclean       bool      `json:"unclean"`
+	PreviousPID   int       `json:"previous_pid,omitempty"`
+	PreviousStart time.Time `json:"previous_start,omitempty"`
+
+	Expirations  int `json:"expirations"`
+	ForceExpired int `json:"force_expired"`
+	JobsResumed  int `json:"jobs_resumed"`
+
+	Pastes   int                `json:"pastes"`
+	Bytes    int64              `json:"bytes"`
+	Archived int                `json:"archived"`
+	Trashed  int                `json:"trashed"`
+	Orphans  map[OrphanKind]int `json:"orphans"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Size returns the bytes of paste bodies on the filesystem, for display.
+func (r *RecoveryReport) Size() ByteSize {
+	return ByteSize(r.Bytes)
+}
+
+type RecoveryStore struct {
+	// Reports are newest first.
+	Reports []*RecoveryReport
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *RecoveryStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save recovery reports: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+// Add records a new report, forgetting the oldest beyond
+// MaxRecoveryReports.
+func (s *RecoveryStore) Add(report *RecoveryReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Reports = append([]*RecoveryReport{report}, s.Reports...)
+	if len(s.Reports) > MaxRecoveryReports {
+		s.Reports = s.Reports[:MaxRecoveryReports]
+	}
+	return s.save()
+}
+
+// Update saves changes made to the reports with fn.
+func (s *RecoveryStore) Update(fn func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+	return s.save()
+}
+
+// Latest returns a copy of the newest report, or nil.
+func (s *RecoveryStore) Latest() *RecoveryReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Reports) == 0 {
+		return nil
+	}
+	report := *s.Reports[0]
+	return &report
+}
+
+func (s *RecoveryStore) All() []RecoveryReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := make([]RecoveryReport, len(s.Reports))
+	for i, report := range s.Reports {
+		reports[i] = *report
+	}
+	return reports
+}
+
+func LoadRecoveryStore(filename string) *RecoveryStore {
+	var s *RecoveryStore
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode recovery reports: ", err)
+		}
+	}
+	if s == nil {
+		s = &RecoveryStore{}
+	}
+	s.filename = filename
+	return s
+}
+
+var recoveryStore *RecoveryStore
+
+// recoveryReport is this run's report.
+var recoveryReport = &RecoveryReport{Started: time.Now()}
+
+// noteExpirationsAtBoot counts the expirations the expirator is about to
+// load from filename, and those it will expire at once.
+func noteExpirationsAtBoot(filename string) {
+	schedule, err := ReadExpirationSchedule(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			recoveryReport.Errors = append(recoveryReport.Errors, fmt.Sprintf("reading the expiration schedule: %v", err))
+		}
+		return
+	}
+	now := time.Now()
+	for _, t := range schedule {
+		recoveryReport.Expirations++
+		if !t.After(now) {
+			recoveryReport.ForceExpired++
+		}
+	}
+}
+
+func runningMarkerFilename() string {
+	return filepath.Join(arguments.root, "running")
+}
+
+// beginRecovery checks whether the last run stopped cleanly, marks this
+// one as running, and records the report so far.
+func beginRecovery(jobsResumed int) {
+	report := recoveryReport
+	report.JobsResumed = jobsResumed
+
+	marker := runningMarkerFilename()
+	if file, err := os.Open(marker); err == nil {
+		var unix int64
+		fmt.Fscan(file, &report.PreviousPID, &unix)
+		file.Close()
+		report.Unclean = true
+		report.PreviousStart = time.Unix(unix, 0)
+	}
+	if file, err := os.Create(marker); err == nil {
+		fmt.Fprintln(file, os.Getpid(), report.Started.Unix())
+		file.Close()
+	} else {
+		report.Errors = append(report.Errors, fmt.Sprintf("marking the server as running: %v", err))
+	}
+
+	if report.Unclean {
+		glog.Warningf("RECOVERY: The last run (pid %d, started %v) didn't stop cleanly.", report.PreviousPID, report.PreviousStart)
+	}
+	glog.Infof("RECOVERY: Loaded %d expirations, %d of them overdue; resumed %d jobs.", report.Expirations, report.ForceExpired, report.JobsResumed)
+	healthServer.SetMetric("recovery.unclean", report.Unclean)
+	healthServer.SetMetric("recovery.force_expired", report.ForceExpired)
+	if err := recoveryStore.Add(report); err != nil {
+		glog.Error("Failed to save the recovery report: ", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		glog.Info("Received ", sig, "; stopping.")
+		shutdown(marker)
+	}()
+
+	go finishRecovery(report)
+}
+
+// shutdownTimeout bounds how long stopping waits for the requests in
+// flight, and then for the expiration schedule to be saved.
+const shutdownTimeout = 30 * time.Second
+
+// shutdown stops serving, lets the requests in flight finish and saves
+// what is still waiting to be saved, then exits. The marker is removed
+// only once all of that has succeeded; otherwise the next run reports an
+// unclean shutdown.
+func shutdown(marker string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	clean := true
+	if err := stopServing(ctx); err != nil {
+		glog.Error("Failed to finish the requests in flight: ", err)
+		clean = false
+	}
+	if err := FlushPasteExpirations(shutdownTimeout); err != nil {
+		glog.Error("Failed to save the expiration schedule: ", err)
+		clean = false
+	}
+	if err := accessLogStore.Flush(); err != nil {
+		glog.Error("Failed to save access logs: ", err)
+		clean = false
+	}
+
+	code := 1
+	if clean {
+		os.Remove(marker)
+		code = 0
+	}
+	glog.Flush()
+	os.Exit(code)
+}
+
+// finishRecovery sweeps the store, completing report.
+func finishRecovery(report *RecoveryReport) {
+	var pastes, archived, trashed int
+	var bytes int64
+	err := filesystemPasteStore.Walk(func(id PasteID) error {
+		filename := filesystemPasteStore.filenameForID(id)
+		fi, err := os.Stat(filename)
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		pastes++
+		bytes += fi.Size()
+		if filesystemPasteStore.archivedKey(filename) != "" {
+			archived++
+		}
+		if getMetadata(filename, "trashed", "") != "" {
+			trashed++
+		}
+		return nil
+	})
+	gc := garbageCollector.Sweep(false)
+
+	recoveryStore.Update(func() {
+		report.Pastes, report.Bytes, report.Archived, report.Trashed = pastes, bytes, archived, trashed
+		report.Orphans = gc.Counts()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("sweeping the store: %v", err))
+		}
+		report.Errors = append(report.Errors, gc.Errors...)
+		report.Finished = time.Now()
+	})
+	glog.Infof("RECOVERY: %d pastes (%v), %d archived, %d in the trash; %d orphans.", pastes, ByteSize(bytes), archived, trashed, len(gc.Orphans))
+}
+
+func apiRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"reports": recoveryStore.All(),
+	})
+}
+
+func init() {
+	RegisterTemplateFunction("recoveryReport", func() *RecoveryReport { return recoveryStore.Latest() })
+
+	arguments.register()
+	arguments.parse()
+	recoveryStore = LoadRecoveryStore(filepath.Join(arguments.root, "recovery.gob"))
+}
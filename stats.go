@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// With stats.enabled set, /api/v1/stats tells anyone who asks how many
+// pastes the instance holds, how many were written today (UTC), which
+// version it runs and how long it has been up, for status and about pages
+// and for directories of instances to show. The numbers are coarse by
+// design: pastes are counted as they are created and destroyed, and
+// counted again from the store every stats.interval by the stats job, so
+// that those created or destroyed by other means (replication, for one)
+// show up eventually.
+
+type InstanceStats struct {
+	Pastes int
+	// Today is the number of pastes created on Day, a UTC date.
+	Day     string
+	Today   int
+	Counted time.Time
+
+	filename string
+	mu       sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *InstanceStats) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save instance stats: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+func statsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// rollOver starts a new day's count, if it is one. It must be called with
+// s.mu held.
+func (s *InstanceStats) rollOver(now time.Time) {
+	if day := statsDay(now); day != s.Day {
+		s.Day, s.Today = day, 0
+	}
+}
+
+func (s *InstanceStats) pasteCreated() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollOver(time.Now())
+	s.Pastes++
+	s.Today++
+	s.save()
+}
+
+func (s *InstanceStats) pasteDestroyed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Pastes > 0 {
+		s.Pastes--
+	}
+	s.save()
+}
+
+// Recount counts the pastes in store again.
+func (s *InstanceStats) Recount(store *FilesystemPasteStore) (int, error) {
+	n := 0
+	err := store.Walk(func(id PasteID) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Pastes, s.Counted = n, time.Now()
+	return n, s.save()
+}
+
+func LoadInstanceStats(filename string) *InstanceStats {
+	var s *InstanceStats
+	file, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(file)
+		err := dec.Decode(&s)
+		file.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode instance stats: ", err)
+		}
+	}
+	if s == nil {
+		s = &InstanceStats{}
+	}
+	s.filename = filename
+	return s
+}
+
+var instanceStats *InstanceStats
+
+type instanceStatsResponse struct {
+	Name    string    `json:"name"`
+	Version string    `json:"version"`
+	Started time.Time `json:"started"`
+	// Uptime is in seconds.
+	Uptime int64 `json:"uptime"`
+	Pastes struct {
+		Total int `json:"total"`
+		Today int `json:"today"`
+	} `json:"pastes"`
+	Counted time.Time `json:"counted"`
+}
+
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !instanceConfig.Stats.Enabled {
+		writeAPIError(w, apiError(APIErrorNotFound, "this instance doesn't publish its stats"))
+		return
+	}
+
+	now := time.Now()
+	resp := &instanceStatsResponse{
+		Name:    brandingFor(r).Name,
+		Version: VERSION,
+		Started: launchTime,
+		Uptime:  int64(now.Sub(launchTime) / time.Second),
+	}
+	instanceStats.mu.Lock()
+	instanceStats.rollOver(now)
+	resp.Pastes.Total, resp.Pastes.Today, resp.Counted = instanceStats.Pastes, instanceStats.Today, instanceStats.Counted
+	instanceStats.mu.Unlock()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if maxAge := instanceConfig.Stats.MaxAge.Duration(); maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+	}
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+// startInstanceStats schedules the stats job, running it now if the
+// pastes have never been counted.
+func startInstanceStats() {
+	if !instanceConfig.Stats.Enabled {
+		return
+	}
+	jobRunner.Schedule("stats", instanceConfig.Stats.Interval.Duration())
+	if instanceStats.Counted.IsZero() {
+		jobRunner.Enqueue("stats", nil)
+	}
+}
+
+func init() {
+	arguments.register()
+	arguments.parse()
+	instanceStats = LoadInstanceStats(filepath.Join(arguments.root, "stats.gob"))
+
+	SubscribeEvent(func(ev *Event) {
+		instanceStats.pasteCreated()
+	}, EventPasteCreated)
+	SubscribeEvent(func(ev *Event) {
+		instanceStats.pasteDestroyed()
+	}, EventPasteDestroyed)
+
+	RegisterJob("stats", "Count the pastes in the store again, for /api/v1/stats.", func(run *JobRun) error {
+		n, err := instanceStats.Recount(filesystemPasteStore)
+		run.SetResult("counted %d pastes", n)
+		return err
+	})
+}
@@ -11,10 +11,12 @@ import (
 )
 
 type RenderContext struct {
-	Obj      interface{}
-	Request  *http.Request
-	Page     string
-	template *template.Template
+	Obj     interface{}
+	Request *http.Request
+	Page    string
+	// RequestID is the ID of the request being answered, if known.
+	RequestID string
+	template  *template.Template
 }
 
 var templateFunctions template.FuncMap = template.FuncMap{}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Pastes saved without a title are given one inferred from their body, for
+// listings and link previews: the first Markdown heading, a file name the
+// body gives for itself (in a "file:" comment or a diff header), what its
+// shebang runs, or failing those its first non-empty line. Encrypted and
+// sealed pastes are left untitled, as a title would give their content
+// away, and so are direct uploads, whose bodies the server doesn't read.
+
+const (
+	// inferredTitleLines is how many lines are looked at for hints.
+	inferredTitleLines = 20
+	// inferredTitleLength is how many characters of a line a title keeps.
+	inferredTitleLength = 60
+)
+
+var (
+	markdownHeadingPattern = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+	setextUnderlinePattern = regexp.MustCompile(`^(=+|-+)\s*$`)
+	filenameHintPattern    = regexp.MustCompile(`(?i)^\W{0,4}\s*(?:file(?:name)?|path)\s*[:=]\s*([\w./\\-]+\.\w+)`)
+	diffHeaderPattern      = regexp.MustCompile(`^(?:diff --git a/\S+ b/|\+\+\+ b/|\+\+\+ )(\S+)`)
+	commentMarkerPattern   = regexp.MustCompile(`^(?://+|#+|--|;+|/\*+|\*+|<!--)\s*`)
+)
+
+// pasteTitle returns the title to give p, which is being saved from in;
+// p's language must already be set.
+func pasteTitle(p *Paste, in *PasteInput) string {
+	if in.Title != "" || p.Encrypted || p.Sealed() {
+		return in.Title
+	}
+	language := ""
+	if p.Language != nil {
+		language = p.Language.ID
+	}
+	title := inferTitle(in.Body, language)
+	if title != "" {
+		healthServer.IncrementMetric("paste.title_inferred")
+	}
+	return title
+}
+
+// inferTitle returns a title for a paste in language (an ID, or "") with
+// the given body, or "" if it has nothing to go on.
+func inferTitle(body string, language string) string {
+	lines := strings.SplitN(body, "\n", inferredTitleLines+1)
+	if len(lines) > inferredTitleLines {
+		lines = lines[:inferredTitleLines]
+	}
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+
+	if language == "markdown" {
+		for i, line := range lines {
+			if m := markdownHeadingPattern.FindStringSubmatch(line); m != nil && m[1] != "" {
+				return truncateTitle(m[1])
+			}
+			if i > 0 && strings.TrimSpace(lines[i-1]) != "" && setextUnderlinePattern.MatchString(line) {
+				return truncateTitle(strings.TrimSpace(lines[i-1]))
+			}
+		}
+	}
+
+	for _, line := range lines {
+		if m := diffHeaderPattern.FindStringSubmatch(line); m != nil && m[1] != "/dev/null" {
+			return truncateTitle("Changes to " + m[1])
+		}
+		if m := filenameHintPattern.FindStringSubmatch(line); m != nil {
+			return truncateTitle(path.Base(strings.Replace(m[1], `\`, "/", -1)))
+		}
+	}
+
+	if strings.HasPrefix(lines[0], "#!") {
+		fields := strings.Fields(lines[0][2:])
+		if len(fields) > 0 {
+			interpreter := path.Base(fields[0])
+			if interpreter == "env" && len(fields) > 1 {
+				interpreter = fields[1]
+				for _, f := range fields[1:] {
+					if !strings.HasPrefix(f, "-") {
+						interpreter = path.Base(f)
+						break
+					}
+				}
+			}
+			return truncateTitle(interpreter + " script")
+		}
+	}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(commentMarkerPattern.ReplaceAllString(strings.TrimSpace(line), ""))
+		if line != "" {
+			return truncateTitle(line)
+		}
+	}
+	return ""
+}
+
+// truncateTitle cuts s down to inferredTitleLength characters, marking the
+// cut with an ellipsis.
+func truncateTitle(s string) string {
+	s = sanitizeTitle(s)
+	if utf8.RuneCountInString(s) <= inferredTitleLength {
+		return s
+	}
+	runes := []rune(s)[:inferredTitleLength-1]
+	return strings.TrimSpace(string(runes)) + "…"
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
+)
+
+// When tombstones.retention is set, every destroyed paste leaves behind a
+// tombstone recording its ID, a digest of its body, why it went and when,
+// so that abuse reports about pastes that no longer exist can still be
+// answered. Tombstones expire after the retention period. Expired pastes
+// leave a tombstone for at least tombstones.expired, so that visitors can
+// be told that the paste they're after expired (with a 410) rather than
+// that it never existed.
+
+type Tombstone struct {
+	ID      PasteID
+	SHA256  string
+	Reason  string
+	Deleted time.Time
+}
+
+func (t *Tombstone) ExpirationID() gotimeout.ExpirableID {
+	return gotimeout.ExpirableID(t.ID)
+}
+
+type TombstoneStore struct {
+	Tombstones map[PasteID]*Tombstone
+	ExpiryJunk *gotimeout.HandleMap
+
+	filename  string
+	expirator *gotimeout.Expirator
+	mu        sync.Mutex
+}
+
+// save must be called with s.mu held.
+func (s *TombstoneStore) save() error {
+	asideFilename := s.filename + ".atomic"
+	file, err := os.Create(asideFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := gob.NewEncoder(file)
+
+	err = enc.Encode(s)
+	if err != nil {
+		glog.Error("Failed to save tombstones: ", err)
+		return err
+	}
+
+	return os.Rename(asideFilename, s.filename)
+}
+
+func (s *TombstoneStore) Add(t *Tombstone, retention time.Duration) {
+	s.mu.Lock()
+	s.Tombstones[t.ID] = t
+	s.save()
+	s.mu.Unlock()
+
+	s.expirator.ExpireObject(t, retention)
+	healthServer.IncrementMetric("tombstone.created")
+}
+
+func (s *TombstoneStore) Get(id PasteID) (*Tombstone, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.Tombstones[id]
+	return t, ok
+}
+
+// Find returns the tombstones whose ID or digest starts with query (all of
+// them if query is empty), newest first.
+func (s *TombstoneStore) Find(query string) []*Tombstone {
+	query = strings.ToLower(strings.TrimSpace(query))
+	s.mu.Lock()
+	var found []*Tombstone
+	for _, t := range s.Tombstones {
+		if query == "" || strings.HasPrefix(strings.ToLower(t.ID.String()), query) || strings.HasPrefix(t.SHA256, query) {
+			found = append(found, t)
+		}
+	}
+	s.mu.Unlock()
+	sort.Sort(tombstonesByDeletion(found))
+	return found
+}
+
+type tombstonesByDeletion []*Tombstone
+
+func (l tombstonesByDeletion) Len() int           { return len(l) }
+func (l tombstonesByDeletion) Less(i, j int) bool { return l[i].Deleted.After(l[j].Deleted) }
+func (l tombstonesByDeletion) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func LoadTombstoneStore(filename string) *TombstoneStore {
+	var s *TombstoneStore
+	tombstoneFile, err := os.Open(filename)
+	if err == nil {
+		dec := gob.NewDecoder(tombstoneFile)
+		err := dec.Decode(&s)
+		tombstoneFile.Close()
+
+		if err != nil {
+			glog.Error("Failed to decode tombstones: ", err)
+		}
+	}
+	if s == nil {
+		s = &TombstoneStore{}
+	}
+	if s.Tombstones == nil {
+		s.Tombstones = make(map[PasteID]*Tombstone)
+	}
+	s.filename = filename
+	s.expirator = gotimeout.NewExpiratorWithStorage(s, s)
+	return s
+}
+
+func (s *TombstoneStore) GetExpirable(id gotimeout.ExpirableID) gotimeout.Expirable {
+	t, ok := s.Get(PasteID(id))
+	if !ok {
+		return nil
+	}
+	return t
+}
+
+func (s *TombstoneStore) DestroyExpirable(ex gotimeout.Expirable) {
+	if t, ok := ex.(*Tombstone); ok {
+		s.mu.Lock()
+		delete(s.Tombstones, t.ID)
+		s.save()
+		s.mu.Unlock()
+	}
+}
+
+func (s *TombstoneStore) RequiresFlush() bool {
+	return true
+}
+
+func (s *TombstoneStore) SaveExpirationHandles(hm *gotimeout.HandleMap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ExpiryJunk = hm
+	return s.save()
+}
+
+func (s *TombstoneStore) LoadExpirationHandles() (*gotimeout.HandleMap, error) {
+	return s.ExpiryJunk, nil
+}
+
+// recordTombstone is called as a paste is destroyed, while its body can
+// still be read.
+func recordTombstone(p *Paste) {
+	reason := p.deletionReason
+	if reason == "" {
+		reason = "deleted"
+		if p.expired {
+			reason = TrashReasonExpired
+		}
+	}
+
+	retention := instanceConfig.Tombstones.Retention.Duration()
+	if expired := instanceConfig.Tombstones.Expired.Duration(); reason == TrashReasonExpired && expired > retention {
+		retention = expired
+	}
+	if retention <= 0 {
+		return
+	}
+
+	digest, err := filesystemPasteStore.bodyDigest(p.ID)
+	if err != nil {
+		glog.Error("Failed to digest ", p.ID, " for its tombstone: ", err)
+	}
+	tombstoneStore.Add(&Tombstone{
+		ID:      p.ID,
+		SHA256:  digest,
+		Reason:  reason,
+		Deleted: time.Now(),
+	}, retention)
+}
+
+// PasteGoneError is returned when looking up a paste that has left a
+// tombstone.
+type PasteGoneError struct {
+	Tombstone *Tombstone
+}
+
+func (e PasteGoneError) Expired() bool {
+	return e.Tombstone.Reason == TrashReasonExpired
+}
+
+func (e PasteGoneError) Error() string {
+	when := e.Tombstone.Deleted.UTC().Format("2006-01-02 15:04 MST")
+	if e.Expired() {
+		return "Paste " + e.Tombstone.ID.String() + " expired on " + when + "."
+	}
+	return "Paste " + e.Tombstone.ID.String() + " was removed on " + when + "."
+}
+
+func (e PasteGoneError) StatusCode() int {
+	return http.StatusGone
+}
+
+func (e PasteGoneError) ErrorTemplateName() string {
+	return "paste_gone"
+}
+
+func adminTombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("q")
+	RenderPage(w, r, "admin_tombstones", &struct {
+		Query      string
+		Tombstones []*Tombstone
+	}{query, tombstoneStore.Find(query)})
+}
+
+var tombstoneStore *TombstoneStore
+
+func init() {
+	SubscribeEvent(onPasteEvent(recordTombstone), EventPasteDestroying)
+}
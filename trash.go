@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Pastes can be trashed rather than destroyed outright. A trashed paste is
+// hidden from everyone, but its owner (or an admin) can restore it until
+// the expirator comes back for it and destroys it for good. When
+// trash.expired is set, expiring pastes are trashed for that long first;
+// when trash.deleted is set, so are pastes their owners delete, which they
+// can then undo.
+
+const TrashReasonExpired = "expired"
+
+// A TrashingPasteStore can set pastes aside before destroying them.
+type TrashingPasteStore interface {
+	Trash(p *Paste, reason string, until time.Time) error
+	Untrash(p *Paste) error
+}
+
+func (p *Paste) Trashed() string {
+	return p.trashed
+}
+
+func (p *Paste) TrashedUntil() time.Time {
+	return p.trashedUntil
+}
+
+func (store *FilesystemPasteStore) Trash(p *Paste, reason string, until time.Time) error {
+	filename := store.filenameForID(p.ID)
+	if err := putMetadata(filename, "trashed", reason); err != nil {
+		return err
+	}
+	if err := putMetadata(filename, "trashed_until", strconv.FormatInt(until.Unix(), 10)); err != nil {
+		return err
+	}
+	p.trashed, p.trashedUntil = reason, until
+	store.PasteModifyCallback(p)
+	return nil
+}
+
+// Untrash restores p. A paste trashed because it expired no longer
+// expires.
+func (store *FilesystemPasteStore) Untrash(p *Paste) error {
+	filename := store.filenameForID(p.ID)
+	if p.trashed == TrashReasonExpired {
+		if err := putMetadata(filename, "expiration", ""); err != nil {
+			return err
+		}
+		p.Expiration = ""
+	}
+	if err := putMetadata(filename, "trashed", ""); err != nil {
+		return err
+	}
+	putMetadata(filename, "trashed_until", "")
+	p.trashed, p.trashedUntil = "", time.Time{}
+	store.PasteModifyCallback(p)
+	return nil
+}
+
+func (r *ReplicatedPasteStore) Trash(p *Paste, reason string, until time.Time) error {
+	ts, ok := r.Primary.(TrashingPasteStore)
+	if !ok {
+		return fmt.Errorf("paste store cannot trash pastes")
+	}
+	r.markWritten(p.ID)
+	return ts.Trash(p, reason, until)
+}
+
+func (r *ReplicatedPasteStore) Untrash(p *Paste) error {
+	ts, ok := r.Primary.(TrashingPasteStore)
+	if !ok {
+		return fmt.Errorf("paste store cannot trash pastes")
+	}
+	r.markWritten(p.ID)
+	return ts.Untrash(p)
+}
+
+// trashPaste trashes p for grace, after which the expirator destroys it.
+// It returns false if p could not be trashed.
+func trashPaste(p *Paste, reason string, grace time.Duration) bool {
+	ts, ok := p.store.(TrashingPasteStore)
+	if !ok {
+		return false
+	}
+	if err := ts.Trash(p, reason, time.Now().Add(grace)); err != nil {
+		glog.Error("Failed to trash ", p.ID, ": ", err)
+		return false
+	}
+	pasteExpirator.ExpireObject(p, grace)
+	forgetPasteHash(p.ID)
+	forgetRenderedPaste(p.ID)
+	healthServer.IncrementMetric("paste.trashed")
+	return true
+}
+
+// restorePaste brings p back out of the trash, and reinstates whatever
+// expiration it still has.
+func restorePaste(p *Paste) error {
+	ts, ok := p.store.(TrashingPasteStore)
+	if !ok {
+		return fmt.Errorf("paste store cannot trash pastes")
+	}
+	if err := ts.Untrash(p); err != nil {
+		return err
+	}
+	if p.Expiration != "" && p.Expiration != "-1" {
+		pasteExpirator.ExpireObject(p, p.ExpirationTime().Sub(time.Now()))
+	} else {
+		pasteExpirator.CancelObjectExpiration(p)
+	}
+	healthServer.IncrementMetric("paste.restored")
+	return nil
+}
+
+// lookupTrashedPasteWithRequest finds a trashed paste; encrypted ones are
+// found without their keys, since restoring one needs no key.
+func lookupTrashedPasteWithRequest(r *http.Request) (Model, error) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, _ := pasteStore.Get(id, nil)
+	if p == nil || p.trashed == "" {
+		return nil, PasteNotFoundError{ID: id}
+	}
+	return p, nil
+}
+
+func pasteRestore(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	if err := restorePaste(p); err != nil {
+		panic(err)
+	}
+
+	SetFlash(w, "success", fmt.Sprintf("Paste %v restored.", p.ID))
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func adminTrashHandler(w http.ResponseWriter, r *http.Request) {
+	var pastes []*Paste
+	filesystemPasteStore.Walk(func(id PasteID) error {
+		if getMetadata(filesystemPasteStore.filenameForID(id), "trashed", "") == "" {
+			return nil
+		}
+		if p, _ := pasteStore.Get(id, nil); p != nil {
+			pastes = append(pastes, p)
+		}
+		return nil
+	})
+	RenderPage(w, r, "admin_trash", pastes)
+}
+
+// apiPasteDeleteHandler deletes a paste the caller may edit. If deletions
+// can be undone, the response says until when, and where to POST to undo.
+func apiPasteDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, _ := pasteStore.Get(id, nil)
+	if p == nil || p.trashed != "" {
+		writeAPIError(w, PasteNotFoundError{ID: id})
+		return
+	}
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"delete", id})
+		return
+	}
+
+	p.deletionReason = "deleted by its owner"
+	if grace := instanceConfig.Trash.Deleted.Duration(); grace > 0 && trashPaste(p, p.deletionReason, grace) {
+		restoreURL, _ := apiRouter.Get("paste_restore").URL("id", id.String())
+		writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+			"id":               id,
+			"restorable_until": p.trashedUntil.UTC(),
+			"restore_url":      restoreURL.String(),
+		})
+		return
+	}
+
+	if err := p.Destroy(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	perms := GetPastePermissions(r)
+	perms.Delete(id)
+	perms.Save(w, r)
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{"id": id})
+}
+
+func apiPasteRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	o, err := lookupTrashedPasteWithRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p := o.(*Paste)
+	if !isEditAllowed(p, r) {
+		writeAPIError(w, PasteAccessDeniedError{"restore", p.ID})
+		return
+	}
+	if err := restorePaste(p); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{
+		"id":  p.ID,
+		"url": pasteURL("show", p),
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// Pastes too large to send through the application servers can be uploaded
+// straight to the cold store's bucket: the client asks the API for an
+// upload, PUTs the body to the pre-signed URL it gets back, and finalizes
+// the upload to create the paste. The body then stays in the bucket for
+// the paste's lifetime; it is never rehydrated, and raw views redirect to
+// the bucket. Directly uploaded pastes cannot be encrypted.
+
+// PresigningColdStore is a cold store that can hand clients URLs with which
+// to read and write bodies themselves. objectstore.Client is one.
+type PresigningColdStore interface {
+	ColdStore
+	Presign(method, key string, expiry time.Duration) (string, error)
+	Stat(key string) (int64, error)
+}
+
+func (store *FilesystemPasteStore) isDirect(filename string) bool {
+	return getMetadata(filename, "direct", "") != ""
+}
+
+// AdoptDirectBody saves p as a paste whose body is the cold store object
+// named key.
+func (store *FilesystemPasteStore) AdoptDirectBody(p *Paste, key string) error {
+	filename := store.filenameForID(p.ID)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	putMetadata(filename, "archived", key)
+	putMetadata(filename, "direct", "true")
+	p.direct = true
+	return store.Save(p)
+}
+
+// directBodyURL returns a pre-signed URL for a directly uploaded paste's
+// body, or "" if the paste was not uploaded directly.
+func directBodyURL(p *Paste) string {
+	if !p.direct {
+		return ""
+	}
+	cold, ok := filesystemPasteStore.ColdStore.(PresigningColdStore)
+	if !ok {
+		return ""
+	}
+	key := filesystemPasteStore.archivedKey(filesystemPasteStore.filenameForID(p.ID))
+	if key == "" {
+		return ""
+	}
+	url, err := cold.Presign("GET", key, instanceConfig.Upload.URLExpiry.Duration())
+	if err != nil {
+		return ""
+	}
+	return url
+}
+
+type pendingUpload struct {
+	Key        string
+	Size       int64
+	Language   string
+	Title      string
+	License    string
+	Expiration string
+	Retention  string
+	Networks   []string
+	Views      int
+}
+
+func directUploadStore(w http.ResponseWriter) PresigningColdStore {
+	cold, ok := filesystemPasteStore.ColdStore.(PresigningColdStore)
+	if !instanceConfig.Upload.Direct || !ok {
+		writeAPIError(w, apiError(APIErrorNotImplemented, "direct uploads are not enabled on this instance"))
+		return nil
+	}
+	return cold
+}
+
+// apiUploadCreateHandler reserves an upload. Form values: size (required,
+// in bytes), lang, title, expire.
+func apiUploadCreateHandler(w http.ResponseWriter, r *http.Request) {
+	cold := directUploadStore(w)
+	if cold == nil {
+		return
+	}
+
+	if err := abuseBlocked(r); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		writeAPIError(w, apiError(APIErrorValidation, "size must be a positive number of bytes").With("field", "size"))
+		return
+	}
+	if size > instanceConfig.Upload.MaxSize {
+		writeAPIError(w, apiError(APIErrorTooLarge, "uploads may be at most %v", ByteSize(instanceConfig.Upload.MaxSize)))
+		return
+	}
+
+	// The body isn't here to check; the rest of the submission is.
+	in, err := parsePasteInput(func(name string) string {
+		if name == "text" {
+			return ""
+		}
+		return r.FormValue(name)
+	})
+	if err == nil {
+		err = checkRetentionClass(r, in)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	token, err := generateRandomBase32String(20, 32)
+	if err != nil {
+		panic(err)
+	}
+	upload := &pendingUpload{
+		Key:        instanceConfig.Archive.Prefix + "uploads/" + token,
+		Size:       size,
+		Language:   in.Language,
+		Title:      in.Title,
+		License:    in.License,
+		Expiration: defaultExpiration(in.Expiration),
+		Retention:  defaultRetention(in.Retention),
+		Networks:   in.Networks,
+		Views:      in.ViewLimit,
+	}
+
+	expiry := instanceConfig.Upload.URLExpiry.Duration()
+	uploadURL, err := cold.Presign("PUT", upload.Key, expiry)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	ephStore.Put("U|"+token, upload, expiry)
+
+	finalizeURL, _ := apiRouter.Get("upload_finalize").URL("token", token)
+	healthServer.IncrementMetric("paste.upload.started")
+	writeAPIResponse(w, http.StatusCreated, map[string]interface{}{
+		"upload_url":   uploadURL,
+		"method":       "PUT",
+		"expires":      time.Now().Add(expiry).UTC(),
+		"finalize_url": finalizeURL.String(),
+	})
+}
+
+// apiUploadFinalizeHandler turns a completed upload into a paste.
+func apiUploadFinalizeHandler(w http.ResponseWriter, r *http.Request) {
+	cold := directUploadStore(w)
+	if cold == nil {
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	v, ok := ephStore.Get("U|" + token)
+	upload, _ := v.(*pendingUpload)
+	if !ok || upload == nil {
+		writeAPIError(w, apiError(APIErrorNotFound, "no such upload (they expire after %v)", instanceConfig.Upload.URLExpiry.Duration()))
+		return
+	}
+
+	size, err := cold.Stat(upload.Key)
+	if err != nil {
+		writeAPIError(w, apiError(APIErrorConflict, "the body has not been uploaded: %v", err))
+		return
+	}
+	if size != upload.Size {
+		cold.Delete(upload.Key)
+		ephStore.Delete("U|" + token)
+		writeAPIError(w, apiError(APIErrorValidation, "uploaded %d bytes; expected %d", size, upload.Size))
+		return
+	}
+	ephStore.Delete("U|" + token)
+
+	id, err := pasteStore.GenerateNewPasteID(false)
+	if err != nil {
+		panic(err)
+	}
+	p := &Paste{ID: id, store: filesystemPasteStore}
+	p.Language = LanguageNamed(upload.Language)
+	if p.Language == nil {
+		p.Language = unknownLanguage
+	}
+	p.Title = upload.Title
+	p.License = upload.License
+	p.Networks = upload.Networks
+	limitPasteViews(p, &PasteInput{ViewLimit: upload.Views})
+	p.Retention = upload.Retention
+	p.Expiration = retainedExpiration(p, upload.Expiration)
+	attributeChange(r, p)
+	holdForApproval(r, p)
+	if err := filesystemPasteStore.AdoptDirectBody(p, upload.Key); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p.store = pasteStore
+
+	setPasteExpiration(p, p.Expiration)
+
+	perms := GetPastePermissions(r)
+	perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
+	perms.Save(w, r)
+	sessions.Save(r, w)
+
+	publishPaste(r, p)
+
+	healthServer.IncrementMetric("paste.created")
+	healthServer.IncrementMetric("paste.upload.finalized")
+	writeAPIResponse(w, http.StatusCreated, map[string]interface{}{
+		"id":     p.ID,
+		"url":    pasteURL("show", p),
+		"status": pasteStatus(p),
+	})
+}
@@ -120,6 +120,9 @@ func BaseURLForRequest(r *http.Request) *url.URL {
 }
 
 func RequestIsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
 	proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
 	if proto == "" {
 		proto = strings.ToLower(r.URL.Scheme)
@@ -127,17 +130,6 @@ func RequestIsHTTPS(r *http.Request) bool {
 	return proto == "https"
 }
 
-func SourceIPForRequest(r *http.Request) string {
-	ip := r.Header.Get("CF-Connecting-IP")
-	if ip == "" {
-		ip := r.Header.Get("X-Forwarded-For")
-		if ip == "" {
-			ip = r.RemoteAddr[:strings.LastIndex(r.RemoteAddr, ":")]
-		}
-	}
-	return ip
-}
-
 func HTTPSMuxMatcher(r *http.Request, rm *mux.RouteMatch) bool {
 	return Env() == EnvironmentDevelopment || RequestIsHTTPS(r)
 }
@@ -202,23 +194,25 @@ func Env() string {
 	return environment
 }
 
+var brand string = SPECTRE_DEFAULT_BRAND
+
+// Brand returns the instance's name, as its default branding has it.
+func Brand() string {
+	return brandingForHost("").Name
+}
+
 func init() {
 	environment = os.Getenv("SPECTRE_ENV")
 	if environment != EnvironmentProduction {
 		environment = EnvironmentDevelopment
 	}
 
-	brand := os.Getenv("SPECTRE_BRAND")
-	if brand == "" {
-		brand = SPECTRE_DEFAULT_BRAND
+	if b := os.Getenv("SPECTRE_BRAND"); b != "" {
+		brand = b
 	}
 
 	RegisterTemplateFunction("env", func() string { return environment })
 
-	RegisterTemplateFunction("brand", func() string {
-		return brand
-	})
-
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
 	go func() {
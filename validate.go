@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Pastes in the languages named in validation.languages are checked for
+// syntax errors when they are saved. What is found is kept with the paste
+// (as its "diagnostics" metadata), shown against the offending lines when
+// it is viewed, and given to API clients as the paste's diagnostics: a list
+// that is empty for a paste that checked out, and missing for one that
+// wasn't checked. Encrypted pastes are never checked, as the diagnostics
+// would be kept in the clear. Pastes larger than validation.max_size, or
+// that take longer than validation.timeout to check, go unchecked.
+
+// PasteDiagnostic is a problem found in a paste's body.
+type PasteDiagnostic struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+var pasteValidators = map[string]func([]byte) []PasteDiagnostic{
+	"json": validateJSON,
+	"yaml": validateYAML,
+	"xml":  validateXML,
+}
+
+// lineAndColumn finds the (1-based) line and column of offset in body.
+func lineAndColumn(body []byte, offset int64) (int, int) {
+	if offset > int64(len(body)) {
+		offset = int64(len(body))
+	}
+	before := body[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, len(before) - bytes.LastIndexByte(before, '\n')
+}
+
+func validateJSON(body []byte) []PasteDiagnostic {
+	var v interface{}
+	err := json.Unmarshal(body, &v)
+	if err == nil {
+		return []PasteDiagnostic{}
+	}
+	offset := int64(len(body))
+	if serr, ok := err.(*json.SyntaxError); ok {
+		offset = serr.Offset
+	}
+	line, column := lineAndColumn(body, offset)
+	return []PasteDiagnostic{{Line: line, Column: column, Message: strings.TrimPrefix(err.Error(), "json: ")}}
+}
+
+// yaml.v2 only says which line a problem is on, in its message.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+func validateYAML(body []byte) []PasteDiagnostic {
+	d := yaml.NewDecoder(bytes.NewReader(body))
+	for {
+		var v interface{}
+		err := d.Decode(&v)
+		if err == io.EOF {
+			return []PasteDiagnostic{}
+		}
+		if err != nil {
+			diag := PasteDiagnostic{Line: 1, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+			if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+				diag.Line, _ = strconv.Atoi(m[1])
+				diag.Message = strings.TrimPrefix(err.Error(), m[0])
+			}
+			return []PasteDiagnostic{diag}
+		}
+	}
+}
+
+func validateXML(body []byte) []PasteDiagnostic {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	// Only the syntax matters, not what the characters are.
+	d.CharsetReader = func(charset string, r io.Reader) (io.Reader, error) { return r, nil }
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return []PasteDiagnostic{}
+		}
+		if err != nil {
+			line, column := lineAndColumn(body, d.InputOffset())
+			if serr, ok := err.(*xml.SyntaxError); ok && serr.Line != line {
+				line, column = serr.Line, 0
+			}
+			return []PasteDiagnostic{{Line: line, Column: column, Message: strings.TrimPrefix(err.Error(), "XML syntax error on line "+strconv.Itoa(line)+": ")}}
+		}
+	}
+}
+
+// validatePasteBody checks body, p's new body, if p's language is to be
+// checked, and keeps what it finds with p. It must be called before p is
+// saved.
+func validatePasteBody(p *Paste, body []byte) {
+	p.diagnostics = nil
+	if p.Encrypted || p.Language == nil || !validatedLanguage(p.Language.ID) {
+		return
+	}
+	vc := instanceConfig.Validation
+	if int64(len(body)) > vc.MaxSize {
+		healthServer.IncrementMetric("paste.validation.skipped")
+		return
+	}
+
+	validate := pasteValidators[p.Language.ID]
+	done := make(chan []PasteDiagnostic, 1)
+	go func() { done <- validate(body) }()
+	select {
+	case p.diagnostics = <-done:
+	case <-time.After(vc.Timeout.Duration()):
+		// The check runs on to no purpose, but it is bounded by MaxSize.
+		healthServer.IncrementMetric("paste.validation.timeout")
+		return
+	}
+	if len(p.diagnostics) > 0 {
+		healthServer.IncrementMetric("paste.diagnosed")
+	}
+}
+
+func validateValidationConfig(c *_Configuration) error {
+	if c.Validation.MaxSize <= 0 {
+		return fmt.Errorf("validation.max_size must be positive")
+	}
+	if c.Validation.Timeout <= 0 {
+		return fmt.Errorf("validation.timeout must be positive")
+	}
+	for _, id := range c.Validation.Languages {
+		if pasteValidators[id] == nil {
+			return fmt.Errorf("validation: pastes in %q can't be checked", id)
+		}
+	}
+	return nil
+}
+
+func validatedLanguage(id string) bool {
+	if pasteValidators[id] == nil {
+		return false
+	}
+	for _, l := range instanceConfig.Validation.Languages {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
+
+func encodePasteDiagnostics(diagnostics []PasteDiagnostic) string {
+	if diagnostics == nil {
+		return ""
+	}
+	b, _ := json.Marshal(diagnostics)
+	return string(b)
+}
+
+func parsePasteDiagnostics(s string) []PasteDiagnostic {
+	if s == "" {
+		return nil
+	}
+	var diagnostics []PasteDiagnostic
+	if json.Unmarshal([]byte(s), &diagnostics) != nil {
+		return nil
+	}
+	return diagnostics
+}
+
+func init() {
+	RegisterTemplateFunction("pasteDiagnostics", func(p *Paste) []PasteDiagnostic { return p.diagnostics })
+	RegisterTemplateFunction("pasteDiagnosticsJSON", func(p *Paste) string { return encodePasteDiagnostics(p.diagnostics) })
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateYAMLRejectsAliasBombs(t *testing.T) {
+	body := `a: &a ["lol","lol","lol","lol","lol","lol","lol","lol","lol"]
+b: &b [*a,*a,*a,*a,*a,*a,*a,*a,*a]
+c: &c [*b,*b,*b,*b,*b,*b,*b,*b,*b]
+d: &d [*c,*c,*c,*c,*c,*c,*c,*c,*c]
+e: &e [*d,*d,*d,*d,*d,*d,*d,*d,*d]
+f: &f [*e,*e,*e,*e,*e,*e,*e,*e,*e]
+g: &g [*f,*f,*f,*f,*f,*f,*f,*f,*f]
+h: &h [*g,*g,*g,*g,*g,*g,*g,*g,*g]
+i: &i [*h,*h,*h,*h,*h,*h,*h,*h,*h]
+`
+	start := time.Now()
+	diagnostics := validateYAML([]byte(body))
+	if len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Message, "aliasing") {
+		t.Errorf("diagnostics %+v, want one about aliasing", diagnostics)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %v", d)
+	}
+}
+
+func TestValidatePasteBodySkipsLargePastes(t *testing.T) {
+	saved := instanceConfig.Validation
+	defer func() { instanceConfig.Validation = saved }()
+	instanceConfig.Validation.Languages = []string{"json"}
+	instanceConfig.Validation.MaxSize = 8
+	instanceConfig.Validation.Timeout = ConfigDuration(time.Second)
+
+	p := &Paste{Language: &Language{ID: "json"}}
+	validatePasteBody(p, []byte("{"))
+	if len(p.diagnostics) != 1 {
+		t.Errorf("small paste: diagnostics %+v, want one", p.diagnostics)
+	}
+	validatePasteBody(p, []byte("{{{{{{{{{"))
+	if p.diagnostics != nil {
+		t.Errorf("large paste: diagnostics %+v, want it unchecked", p.diagnostics)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A paste can be limited to a number of views (views; "none" lifts the
+// limit), after which it expires: burn-after-reading is a limit of one. Its
+// page, JSON, raw body, download, plain text export and log view each count
+// as a view, unless they are requested by someone who can edit it, who is
+// shown how many views it has left instead. HEAD requests don't count, so
+// that link checkers don't use views up. When the last view has been
+// served, the paste is handed to pasteExpirator, which destroys it (by way
+// of the trash) as if it had expired. Views of pastes exempt from
+// retention (see exemption.go) aren't counted.
+//
+// View-limited pastes are only ever served whole: they don't fold, can't be
+// searched, aren't cached publicly and aren't published over ActivityPub.
+
+// MaxPasteViews is the greatest view limit a paste can be given.
+const MaxPasteViews = 1000000
+
+// parseViewLimit validates a view limit as submitted: "" (none given),
+// "none", or a number of views. It returns the limit, 0 if none was given,
+// and whether the limit is to be lifted.
+func parseViewLimit(s string) (int, bool, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return 0, false, nil
+	case "none":
+		return 0, true, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > MaxPasteViews {
+		return 0, false, PasteInputError{"views", fmt.Sprintf("must be a number of views from 1 to %d, or none", MaxPasteViews)}
+	}
+	return n, false, nil
+}
+
+// limitPasteViews applies in's view limit to p, which is then to be saved.
+func limitPasteViews(p *Paste, in *PasteInput) {
+	switch {
+	case in.NoViewLimit:
+		p.viewLimited, p.viewsLeft, p.viewsChanged = false, 0, true
+	case in.ViewLimit > 0:
+		p.viewLimited, p.viewsLeft, p.viewsChanged = true, in.ViewLimit, true
+	}
+}
+
+func (p *Paste) ViewLimited() bool {
+	return p.viewLimited
+}
+
+// ViewsLeft returns how many more times p can be viewed, if it is view
+// limited.
+func (p *Paste) ViewsLeft() int {
+	return p.viewsLeft
+}
+
+// pasteViewsValue returns p's view limit as a form value, or "" if it has
+// none.
+func pasteViewsValue(p *Paste) string {
+	if !p.viewLimited {
+		return ""
+	}
+	return strconv.Itoa(p.viewsLeft)
+}
+
+// CountView counts a view of the paste with the given ID against its limit,
+// returning how many views it has left. It returns a PasteNotFoundError if
+// it had none left.
+func (store *FilesystemPasteStore) CountView(id PasteID) (int, error) {
+	store.viewsMu.Lock()
+	defer store.viewsMu.Unlock()
+
+	filename := store.filenameForID(id)
+	left, err := strconv.Atoi(getMetadata(filename, "views_left", ""))
+	if err != nil || left <= 0 {
+		return 0, PasteNotFoundError{ID: id}
+	}
+	left--
+	if err := putMetadata(filename, "views_left", strconv.Itoa(left)); err != nil {
+		return 0, err
+	}
+	return left, nil
+}
+
+// checkViewsLeft returns a PasteNotFoundError if p has used its views up
+// and r may not see it regardless.
+func checkViewsLeft(p *Paste, r *http.Request) error {
+	if p.viewLimited && p.viewsLeft <= 0 && !isEditAllowed(p, r) {
+		return PasteNotFoundError{ID: p.ID}
+	}
+	return nil
+}
+
+// countView counts r against p's view limit, if it has one and r counts.
+// The function it returns must be called once p has been served; after its
+// last view, it sends p to be destroyed.
+func countView(p *Paste, r *http.Request) (func(), error) {
+	if !p.viewLimited || r.Method == "HEAD" || isEditAllowed(p, r) || retentionExempt(p) {
+		return func() {}, nil
+	}
+
+	left, err := p.store.CountView(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	p.viewsLeft = left
+	healthServer.IncrementMetric("paste.view_counted")
+	return func() {
+		if left == 0 {
+			healthServer.IncrementMetric("paste.views_exhausted")
+			pasteExpirator.ExpireObject(p, 0)
+		}
+	}, nil
+}
+
+// countsView counts requests for a view-limited paste against its limit.
+func countsView(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		served, err := countView(o.(*Paste), r)
+		if err != nil {
+			panic(err)
+		}
+		defer served()
+		fn(o, w, r)
+	}
+}
+
+func init() {
+	RegisterTemplateFunction("pasteViewsValue", pasteViewsValue)
+}